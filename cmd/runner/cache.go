@@ -20,8 +20,9 @@ import (
 )
 
 var (
-	objCacheOpt    = flag.String("cache-dir", "", "An optional directory to be used as a cache for downloaded artifacts")
-	objCacheMaxOpt = flag.String("cache-size", "", "The maximum target size of the disk based download cache, for example (10Gb), must be larger than 1Gb")
+	objCacheOpt     = flag.String("cache-dir", "", "An optional directory to be used as a cache for downloaded artifacts")
+	objCacheMaxOpt  = flag.String("cache-size", "", "The maximum target size of the disk based download cache, for example (10Gb), must be larger than 1Gb")
+	objCacheTreeOpt = flag.String("cache-unpacked", "", "An optional method (auto, reflink, hardlink, or copy) used to place the unpacked contents of immutable archives, which are retained in the cache, into experiments")
 
 	// CacheActive is set to true if or when the caching system has been configured and is activated
 	CacheActive = false
@@ -39,6 +40,15 @@ func getCacheOptions() (dir string, size int64, err kv.Error) {
 		}
 	}
 
+	if len(*objCacheTreeOpt) != 0 {
+		if len(*objCacheOpt) == 0 {
+			return dir, size, kv.NewError("if the option cache-unpacked is specified the cache-dir must also be specified").With("stack", stack.Trace().TrimRuntime())
+		}
+		if err = runner.CheckTreeMethod(*objCacheTreeOpt); err != nil {
+			return dir, size, err
+		}
+	}
+
 	if len(*objCacheMaxOpt) != 0 {
 		size, errGo := humanize.ParseBytes(*objCacheMaxOpt)
 		if errGo != nil {
@@ -68,9 +78,17 @@ func startObjStore(ctx context.Context, removedC chan os.FileInfo, errorC chan k
 	// Create the cache directory if it doesn't exist yet
 	_ = os.MkdirAll(dir, 0700)
 
-	err = runner.InitObjStore(ctx, dir, size, removedC, errorC)
+	if err = runner.InitObjStore(ctx, dir, size, removedC, errorC); err != nil {
+		return true, err
+	}
 
-	return true, err
+	if len(*objCacheTreeOpt) != 0 {
+		if err = runner.EnableTreeCache(*objCacheTreeOpt); err != nil {
+			return true, err
+		}
+		logger.Info("unpacked artifact cache enabled", "method", *objCacheTreeOpt)
+	}
+	return true, nil
 }
 
 func RunObjCache(ctx context.Context) (err kv.Error) {
@@ -87,7 +105,6 @@ func RunObjCache(ctx context.Context) (err kv.Error) {
 
 			close(errorC)
 			close(removedC)
-			_ = os.RemoveAll(*objCacheOpt)
 		}()
 		for {
 			select {
@@ -42,7 +42,6 @@ func serviceFileQueue(ctx context.Context, checkInterval time.Duration) {
 		return
 	}
 
-	matcher, mismatcher := initFileQueueParams()
 	fqProject := runner.NewLocalQueue(*localQueueRootOpt, nil, logger)
 
 	// Tracks all known queues and their cancel functions so they can have any
@@ -123,6 +122,8 @@ func serviceFileQueue(ctx context.Context, checkInterval time.Duration) {
 
 			// Found returns a map that contains the queues that were found
 			// on the file queues root specified by the FileQueue data structure
+			// The patterns are refreshed on every check as they can be changed while running
+			matcher, mismatcher := initFileQueueParams()
 			found, err := fqProject.GetKnown(ctx, matcher, mismatcher)
 
 			if err != nil {
@@ -57,33 +57,7 @@ func HandleMsg(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, c
 		return rsc, hardError, err.With("hardErr", hardError)
 	}
 
-	// Check for the presence of artifact credentials and if we see none, then for backward
-	// compatibility, see if there are AWS credentials in the env variables and if so load these
-	// into the artifacts
-	for key, art := range proc.Request.Experiment.Artifacts {
-		if art.Credentials.Plain != nil {
-			continue
-		}
-		if art.Credentials.JWT != nil {
-			continue
-		}
-		if art.Credentials.AWS != nil {
-			continue
-		}
-		if *allowEnvSecrets {
-			if accessKey, isPresent := proc.Request.Config.Env["AWS_ACCESS_KEY_ID"]; isPresent {
-				secretKey := proc.Request.Config.Env["AWS_SECRET_ACCESS_KEY"]
-				newArt := art.Clone()
-				newArt.Credentials = request.Credentials{
-					AWS: &request.AWSCredential{
-						AccessKey: accessKey,
-						SecretKey: secretKey,
-					},
-				}
-				proc.Request.Experiment.Artifacts[key] = *newArt
-			}
-		}
-	}
+	applyEnvSecrets(proc.Request)
 
 	// Modify the prometheus metrics that track running jobs
 	atomic.AddInt32(&queueRunning, 1)
@@ -131,3 +105,34 @@ func HandleMsg(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, c
 
 	return rsc, ack, nil
 }
+
+// applyEnvSecrets checks for the presence of artifact credentials and if there are none, then for backward
+// compatibility, see if there are AWS credentials in the env variables and if so loads these
+// into the artifacts
+//
+func applyEnvSecrets(rqst *request.Request) {
+	for key, art := range rqst.Experiment.Artifacts {
+		if art.Credentials.Plain != nil {
+			continue
+		}
+		if art.Credentials.JWT != nil {
+			continue
+		}
+		if art.Credentials.AWS != nil {
+			continue
+		}
+		if *allowEnvSecrets {
+			if accessKey, isPresent := rqst.Config.Env["AWS_ACCESS_KEY_ID"]; isPresent {
+				secretKey := rqst.Config.Env["AWS_SECRET_ACCESS_KEY"]
+				newArt := art.Clone()
+				newArt.Credentials = request.Credentials{
+					AWS: &request.AWSCredential{
+						AccessKey: accessKey,
+						SecretKey: secretKey,
+					},
+				}
+				rqst.Experiment.Artifacts[key] = *newArt
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the HTTPS intake service that accepts signed requests from
+// clients and places them on local file queues
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	intakeAddrOpt = flag.String("intake-address", "", "the address for an optional https server that accepts signed requests for local file queues (default disabled)")
+	intakeCertOpt = flag.String("intake-cert", "", "the PEM encoded certificate file for the intake https server")
+	intakeKeyOpt  = flag.String("intake-key", "", "the PEM encoded private key file for the intake https server")
+	intakeURLOpt  = flag.String("intake-url", "", "the external base URL, for example https://intake.example.com, used in the status URLs returned by the intake when it is reached through a proxy")
+
+	intakeWindowOpt = flag.Duration("intake-replay-window", time.Duration(7*24*time.Hour), "the period either side of the present within which the time_added of requests accepted by the intake must fall, records used to reject replayed requests are kept for this period")
+)
+
+func validateIntakeOpts() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if len(*intakeAddrOpt) == 0 {
+		return errs
+	}
+	if len(*localQueueRootOpt) == 0 {
+		errs = append(errs, kv.NewError("the intake-address option requires the queue-root option").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*intakeCertOpt) == 0 || len(*intakeKeyOpt) == 0 {
+		errs = append(errs, kv.NewError("the intake-address option requires the intake-cert and intake-key options").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*intakeURLOpt) != 0 {
+		if u, errGo := url.Parse(*intakeURLOpt); errGo != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			errs = append(errs, kv.NewError("the intake-url option must be an http or https URL").With("intake-url", *intakeURLOpt).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	if *intakeWindowOpt <= 0 {
+		errs = append(errs, kv.NewError("the intake-replay-window option must be a positive duration").With("intake-replay-window", *intakeWindowOpt).With("stack", stack.Trace().TrimRuntime()))
+	}
+	return errs
+}
+
+// serviceIntake runs an https server accepting signed requests for local file queues
+// until the ctx is cancelled
+//
+func serviceIntake(ctx context.Context) {
+
+	if len(*intakeAddrOpt) == 0 {
+		logger.Info("intake service disabled", stack.Trace().TrimRuntime())
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(runner.IntakePrefix, runner.NewIntake(runner.NewLocalQueue(*localQueueRootOpt, nil, logger), GetRqstSigs(), *intakeURLOpt, *intakeWindowOpt, logger))
+
+	srv := &http.Server{
+		Addr:              *intakeAddrOpt,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutCtx)
+	}()
+
+	logger.Info("starting the intake service", "address", *intakeAddrOpt)
+
+	if errGo := srv.ListenAndServeTLS(*intakeCertOpt, *intakeKeyOpt); errGo != nil && errGo != http.ErrServerClosed {
+		logger.Warn("intake service failed", "address", *intakeAddrOpt, "error", errGo.Error(), "stack", stack.Trace().TrimRuntime())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-stack/stack"
@@ -22,6 +23,14 @@ var (
 
 	noNewTasks = uberatomic.NewBool(false)
 
+	// limits holds the limits supplied using the runtime configuration file, when
+	// they have not been supplied the command line options are used
+	limits = struct {
+		tasks *uint
+		idle  *time.Duration
+		sync.Mutex
+	}{}
+
 	LimitCheck = time.Duration(0)
 )
 
@@ -29,6 +38,33 @@ const (
 	minimumLimitInterval = time.Duration(5 * time.Minute)
 )
 
+// getLimits returns the limits on the number of tasks and the idle time currently in use
+//
+func getLimits() (maxTasks uint, maxIdle time.Duration) {
+	limits.Lock()
+	defer limits.Unlock()
+
+	maxTasks, maxIdle = *maxTasksOpt, *maxIdleOpt
+	if limits.tasks != nil {
+		maxTasks = *limits.tasks
+	}
+	if limits.idle != nil {
+		maxIdle = *limits.idle
+	}
+	return maxTasks, maxIdle
+}
+
+// setLimits replaces the limits on the number of tasks and the idle time, nil values
+// restore the command line options
+//
+func setLimits(maxTasks *uint, maxIdle *time.Duration) {
+	limits.Lock()
+	defer limits.Unlock()
+
+	limits.tasks = maxTasks
+	limits.idle = maxIdle
+}
+
 type activity struct {
 	idle time.Time // Time when the last running count of zero was observed
 }
@@ -38,13 +74,15 @@ func limitCheck(acts *activity) (limit bool, msg string) {
 		return true, ""
 	}
 
-	if *maxTasksOpt == 0 && *maxIdleOpt == time.Duration(0) {
+	maxTasks, maxIdle := getLimits()
+
+	if maxTasks == 0 && maxIdle == time.Duration(0) {
 		msg = fmt.Sprint("task limits not in use", "stack", stack.Trace().TrimRuntime())
 		return false, msg
 	}
 	running := queueRunning
 	if running != 0 {
-		acts.idle = time.Now().Add(*maxIdleOpt)
+		acts.idle = time.Now().Add(maxIdle)
 		logger.Debug("idle time reset", "stack", stack.Trace().TrimRuntime())
 	}
 	// Now see how many tasks have run in the system
@@ -55,7 +93,7 @@ func limitCheck(acts *activity) (limit bool, msg string) {
 	// See if the total of running tasks and ran tasks equals or exceed the maximum number
 	// this runner has been configured to handle
 	//if *maxTasksOpt != 0 && math.Round(running+ran) > math.Round(float64(*maxTasksOpt)) {
-	if *maxTasksOpt != 0 && ran >= (int32)(*maxTasksOpt) {
+	if maxTasks != 0 && ran >= (int32)(maxTasks) {
 		// See if we are drained and the max run count has been reached
 		if running != 0 {
 			msg = fmt.Sprint("stack", stack.Trace().TrimRuntime())
@@ -67,11 +105,11 @@ func limitCheck(acts *activity) (limit bool, msg string) {
 		return true, msg
 	}
 
-	logger.Debug("ready to check idle limit", "running", running, "idle", acts.idle, "max idle time", *maxIdleOpt, "stack", stack.Trace().TrimRuntime())
+	logger.Debug("ready to check idle limit", "running", running, "idle", acts.idle, "max idle time", maxIdle, "stack", stack.Trace().TrimRuntime())
 
 	// If nothing is running and the last time we saw anything running was more than the idle timer
 	// then we can stop, as long as the user specified a maximum idle time that was not zero
-	if running == 0 && acts.idle.Before(time.Now()) && *maxIdleOpt != time.Duration(0) {
+	if running == 0 && acts.idle.Before(time.Now()) && maxIdle != time.Duration(0) {
 		msg = fmt.Sprint("stack", stack.Trace().TrimRuntime())
 		return true, msg
 	}
@@ -97,8 +135,9 @@ func serviceLimiter(ctx context.Context, cancel context.CancelFunc) {
 	check := time.NewTicker(*limitIntervalOpt)
 	defer check.Stop()
 
+	_, maxIdle := getLimits()
 	acts := activity{
-		idle: time.Now().Add(*maxIdleOpt),
+		idle: time.Now().Add(maxIdle),
 	}
 
 	// Suppress duplicate logs
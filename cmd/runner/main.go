@@ -25,7 +25,9 @@ import (
 	"github.com/leaf-ai/studio-go-runner/internal/cuda"
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
 	"github.com/leaf-ai/studio-go-runner/internal/disk_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
 	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	aws_ext "github.com/leaf-ai/studio-go-runner/pkg/aws"
 
 	"github.com/davecgh/go-spew/spew"
 
@@ -63,7 +65,9 @@ var (
 	maxDiskOpt  = flag.String("max-disk", "0gb", "maximum amount of local disk storage to be allocated to tasks using SI, ICE units, for example 512gb, 16gib, 1024mb, 64mib etc' (default 0, is 85% of available Disk)")
 
 	msgEncryptDirOpt   = flag.String("encrypt-dir", "./certs/message", "directory where secrets have been mounted into pod containers")
+	msgKeyOverlapOpt   = flag.Duration("encrypt-key-overlap", time.Duration(24*time.Hour), "the period during which message decryption keys removed from the encrypt-dir continue to be accepted")
 	acceptClearTextOpt = flag.Bool("clear-text-messages", false, "enables clear-text messages across queues support (Associated Risk)")
+	strictRequestsOpt  = flag.Bool("strict-requests", false, "reject requests containing fields that are not part of the request schema, rather than reporting them as warnings")
 
 	cpuProfileOpt = flag.String("cpu-profile", "", "write a cpu profile to file")
 
@@ -77,7 +81,7 @@ var (
 	// rqstSigs contains a map with the index being the prefix of queue names and their public keys for inbound request queues
 	rspnsEncrypt = &defense.PubkeyStore{}
 
-	promAddrOpt = flag.String("prom-address", ":9090", "the address for the prometheus http server within the runner")
+	promAddrOpt = flag.String("prom-address", "", "the address for the prometheus http server within the runner, for example :9090, the exporter is disabled when empty")
 
 	captureOutputMD = flag.Bool("schema-logs", true, "automatically add experiment logs to metadata json")
 
@@ -184,8 +188,6 @@ func main() {
 //
 func Main() {
 
-	fmt.Printf("%s built from branch %s, against commit id %s\n", os.Args[0], gitBranch, gitCommit)
-
 	flag.Usage = usage
 
 	// Use the go options parser to load command line options that have been set, and look
@@ -193,6 +195,13 @@ func Main() {
 	//
 	envflag.Parse()
 
+	// Validating a request prints only the report, and does not start the server
+	if len(*validateOpt) != 0 {
+		os.Exit(runValidate(context.Background()))
+	}
+
+	fmt.Printf("%s built from branch %s, against commit id %s\n", os.Args[0], gitBranch, gitCommit)
+
 	doneC := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -332,22 +341,26 @@ func validateCredsOpts() (errs []kv.Error) {
 	if TestMode {
 		logger.Warn("running in test mode, queue validation not performed")
 	} else {
-		if len(*sqsCertsDirOpt) == 0 && len(*amqpURL) == 0 &&
-			len(*localQueueRootOpt) == 0 {
-			errs = append(errs, kv.NewError("One of the amqp-url, sqs-certs or queue-root options must be set for the runner to work"))
-		} else {
-			stat, err := os.Stat(*sqsCertsDirOpt)
-			if err != nil || !stat.Mode().IsDir() {
-				if len(*amqpURL) == 0 {
-					*localQueueRootOpt = os.ExpandEnv(*localQueueRootOpt)
-					stat, err = os.Stat(*localQueueRootOpt)
-					if err != nil || !stat.Mode().IsDir() {
-						msg := fmt.Sprintf(
-							"sqs-certs must be set to an existing directory, or amqp-url is specified, or queue-root must be set to an existing directory for the runner to perform any useful work (%s)",
-							*sqsCertsDirOpt)
-						errs = append(errs, kv.NewError(msg))
-					}
-				}
+		if len(*sqsCertsDirOpt) == 0 && len(*sqsIdentitiesOpt) == 0 && len(*amqpURL) == 0 &&
+			len(*localQueueRootOpt) == 0 && len(*pubsubProjectsOpt) == 0 {
+			errs = append(errs, kv.NewError("One of the amqp-url, sqs-certs, sqs-identities, pubsub-projects or queue-root options must be set for the runner to work"))
+		}
+		// Each queue option that has been supplied is checked on its own merits
+		// irrespective of any others being present
+		if len(*sqsCertsDirOpt) != 0 {
+			if stat, err := os.Stat(*sqsCertsDirOpt); err != nil || !stat.Mode().IsDir() {
+				errs = append(errs, kv.NewError("sqs-certs must be set to an existing directory").With("sqs-certs", *sqsCertsDirOpt))
+			}
+		}
+		if len(*localQueueRootOpt) != 0 {
+			*localQueueRootOpt = os.ExpandEnv(*localQueueRootOpt)
+			if stat, err := os.Stat(*localQueueRootOpt); err != nil || !stat.Mode().IsDir() {
+				errs = append(errs, kv.NewError("queue-root must be set to an existing directory").With("queue-root", *localQueueRootOpt))
+			}
+		}
+		if len(*sqsIdentitiesOpt) != 0 {
+			if _, err := aws_ext.LoadSQSIdentities(*sqsIdentitiesOpt); err != nil {
+				errs = append(errs, err)
 			}
 		}
 	}
@@ -401,6 +414,14 @@ func validateServerOpts() (errs []kv.Error) {
 
 	errs = append(errs, validateCredsOpts()...)
 
+	errs = append(errs, validateIntakeOpts()...)
+
+	errs = append(errs, validateRuntimeConfigOpts()...)
+
+	errs = append(errs, validatePrefetchOpts()...)
+
+	errs = append(errs, validateTransferOpts()...)
+
 	return errs
 }
 
@@ -482,6 +503,28 @@ func EntryPoint(ctx context.Context, cancel context.CancelFunc, doneC chan struc
 		errs = append(errs, qerrs...)
 	}
 
+	if err := runner.InitScriptTemplates(ctx, *cfgNamespace, *cfgConfigMap, logger); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Transfer limits from the command line, these are replaced by any present in the
+	// runtime configuration
+	if err := applyTransferLimits(&runner.RuntimeConfig{}); err != nil {
+		errs = append(errs, err)
+	}
+
+	// The runtime configuration is applied after the queue matcher has been initialized as
+	// the file can replace the queue patterns
+	if err := startRuntimeConfig(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Discover the python interpreters available for experiments, failures are not fatal
+	// as pyenv is scanned again when experiments arrive
+	if _, err := runner.InitPythonVersions(ctx, logger); err != nil {
+		logger.Warn("python versions not discovered", "error", err.Error())
+	}
+
 	// Now check for any fatal kv.before allowing the system to continue.  This allows
 	// all kv.that could have ocuured as a result of incorrect options to be flushed
 	// out rather than having a frustrating single failure at a time loop for users
@@ -502,8 +545,10 @@ func startServices(ctx context.Context, cancel context.CancelFunc, statusC chan
 	go cuda.MonitorGPUs(ctx, statusC, errorC)
 
 	// loops doing prometheus exports for resource consumption statistics etc
-	// on a regular basis
-	//server.StartPrometheusExporter(ctx, *promAddrOpt, &resources.Resources{}, time.Duration(10*time.Second), logger)
+	// on a regular basis, only when an address for the exporter has been supplied
+	if len(*promAddrOpt) != 0 {
+		server.StartPrometheusExporter(ctx, *promAddrOpt, &resources.Resources{}, time.Duration(10*time.Second), logger)
+	}
 
 	// The timing for queues being refreshed should me much more frequent when testing
 	// is being done to allow short lived resources such as queues etc to be refreshed
@@ -514,6 +559,10 @@ func startServices(ctx context.Context, cancel context.CancelFunc, statusC chan
 		serviceIntervals = time.Duration(5 * time.Second)
 	}
 
+	// Load the message decryption keys and start watching for keys being rotated, this
+	// is done before the queue services start so that the watcher uses our context
+	initWrapperOnce.Do(func() { initWrapper(ctx, errorC) })
+
 	// Setup a watcher that will scan a signatures directory loading in
 	// new queue related message signing keys, non blocking function that
 	// spins off a servicing function
@@ -544,8 +593,23 @@ func startServices(ctx context.Context, cancel context.CancelFunc, statusC chan
 	//
 	go serviceSQS(ctx, serviceIntervals)
 
+	// Create a component that listens to Google Cloud Pub/Sub projects for
+	// subscriptions to process work from
+	//
+	go servicePubSub(ctx, serviceIntervals)
+
 	// Create a component that listens to local file queues root for work
 	// queues
 	//
 	go serviceFileQueue(ctx, 3*time.Second)
+
+	// Start the optional https intake that accepts signed requests and places
+	// them on the local file queues
+	//
+	go serviceIntake(ctx)
+
+	// Start the optional prefetching of artifacts for requests waiting on the
+	// local file queues
+	//
+	go servicePrefetch(ctx, serviceIntervals)
 }
@@ -2,7 +2,31 @@
 
 package main
 
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 var (
 	queueRunning int32 = 0
 	queueRan     int32 = 0
+
+	experimentMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_experiment_metric",
+			Help: "The latest value of metrics reported by running experiments.",
+		},
+		[]string{"project", "queue", "experiment", "metric"},
+	)
+	experimentMetricStep = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_experiment_metric_step",
+			Help: "The step of the latest value of metrics reported by running experiments.",
+		},
+		[]string{"project", "queue", "experiment", "metric"},
+	)
 )
+
+func init() {
+	prometheus.MustRegister(experimentMetric)
+	prometheus.MustRegister(experimentMetricStep)
+}
@@ -0,0 +1,54 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the handling of the storage mirror sets from the runtime configuration,
+// see the mirrors.go file within the internal/s3 package
+
+import (
+	"os"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// storageMirrors returns the mirror sets from the runtime configuration with any environment
+// variables within the credentials expanded
+//
+func storageMirrors(cfg *runner.RuntimeConfig) (sets []s3.MirrorSet, err kv.Error) {
+	sets = make([]s3.MirrorSet, 0, len(cfg.Mirrors))
+	for _, entry := range cfg.Mirrors {
+		set := s3.MirrorSet{
+			Name:      entry.Name,
+			Buckets:   entry.Buckets,
+			Mirrors:   make([]s3.Mirror, 0, len(entry.Fallbacks)+1),
+			Replicate: entry.Replicate,
+		}
+		for _, m := range append([]runner.StorageMirror{entry.Primary}, entry.Fallbacks...) {
+			mirror := s3.Mirror{
+				Endpoint: m.Endpoint,
+				UseSSL:   m.SSL,
+			}
+			if len(m.AccessKey) != 0 {
+				mirror.Creds = &request.AWSCredential{
+					AccessKey: os.ExpandEnv(m.AccessKey),
+					SecretKey: os.ExpandEnv(m.SecretKey),
+					Session:   os.ExpandEnv(m.SessionToken),
+					Region:    m.Region,
+				}
+				if len(mirror.Creds.AccessKey) == 0 || len(mirror.Creds.SecretKey) == 0 {
+					return nil, kv.NewError("mirror credentials are empty once expanded").With("mirror_set", entry.Name, "endpoint", m.Endpoint).With("stack", stack.Trace().TrimRuntime())
+				}
+			} else if len(m.Region) != 0 {
+				return nil, kv.NewError("mirror region given without credentials").With("mirror_set", entry.Name, "endpoint", m.Endpoint).With("stack", stack.Trace().TrimRuntime())
+			}
+			set.Mirrors = append(set.Mirrors, mirror)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of the prefetcher which examines the requests waiting
+// on local file queues and places their immutable artifacts into the cache before the requests
+// are claimed by this, or another, runner sharing the cache.
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/disk_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	prefetchDepthOpt     = flag.Int("prefetch-depth", 0, "the number of requests at the head of each local file queue whose immutable artifacts are placed into the cache before the requests are claimed (default 0, disabled)")
+	prefetchBudgetOpt    = flag.String("prefetch-budget", "10Gb", "the maximum size of the prefetched artifacts of requests that are still waiting on queues, for example 10Gb")
+	prefetchBandwidthOpt = flag.String("prefetch-bandwidth", "", "an optional limit on the bandwidth, in bytes per second, used for prefetching artifacts, for example 20Mb")
+)
+
+func getPrefetchOptions() (budget int64, bandwidth int64, err kv.Error) {
+	size, errGo := humanize.ParseBytes(*prefetchBudgetOpt)
+	if errGo != nil {
+		return 0, 0, kv.Wrap(errGo, "option prefetch-budget was not formatted correctly").With("stack", stack.Trace().TrimRuntime())
+	}
+	budget = int64(size)
+
+	if len(*prefetchBandwidthOpt) != 0 {
+		limit, errGo := humanize.ParseBytes(*prefetchBandwidthOpt)
+		if errGo != nil {
+			return 0, 0, kv.Wrap(errGo, "option prefetch-bandwidth was not formatted correctly").With("stack", stack.Trace().TrimRuntime())
+		}
+		bandwidth = int64(limit)
+	}
+	return budget, bandwidth, nil
+}
+
+func validatePrefetchOpts() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if *prefetchDepthOpt <= 0 {
+		return errs
+	}
+	if len(*localQueueRootOpt) == 0 {
+		errs = append(errs, kv.NewError("the prefetch-depth option requires the queue-root option").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*objCacheOpt) == 0 {
+		errs = append(errs, kv.NewError("the prefetch-depth option requires the cache-dir option").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, _, err := getPrefetchOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// prefetchItem records the prefetching done for a single request waiting on a queue
+type prefetchItem struct {
+	subscription string
+	id           string
+	size         int64 // The size of the artifacts prefetched for the request
+	done         bool  // Set once all of the artifacts for the request have been examined
+}
+
+type prefetcher struct {
+	queue      *runner.LocalQueue
+	budget     int64
+	limiter    *rate.Limiter
+	items      map[string]*prefetchItem
+	cacheDir   string
+	sharedDisk bool // Set when the cache is on the device used for experiments
+}
+
+// servicePrefetch runs for the lifetime of the daemon and uses the ctx to perform orderly shutdowns.
+// It periodically examines the requests at the head of the local file queues and places their
+// immutable artifacts into the cache.
+//
+func servicePrefetch(ctx context.Context, checkInterval time.Duration) {
+
+	if *prefetchDepthOpt <= 0 {
+		logger.Info("artifact prefetching disabled", stack.Trace().TrimRuntime())
+		return
+	}
+	if !CacheActive {
+		logger.Warn("artifact prefetching disabled, the cache is not active", stack.Trace().TrimRuntime())
+		return
+	}
+
+	budget, bandwidth, err := getPrefetchOptions()
+	if err != nil {
+		logger.Warn("artifact prefetching disabled", "error", err.Error())
+		return
+	}
+
+	// Downloads are written into the cache directory, the space allocated to experiments is only
+	// affected when the cache shares their device
+	sharedDisk, err := disk_resource.SameDevice(*objCacheOpt, *tempOpt)
+	if err != nil {
+		logger.Warn("artifact prefetching disabled", "error", err.Error())
+		return
+	}
+
+	pf := &prefetcher{
+		queue:      runner.NewLocalQueue(*localQueueRootOpt, nil, logger),
+		budget:     budget,
+		items:      map[string]*prefetchItem{},
+		cacheDir:   *objCacheOpt,
+		sharedDisk: sharedDisk,
+	}
+	if bandwidth > 0 {
+		// The burst is the largest write the limiter will admit in one go
+		burst := bandwidth
+		if burst > 1024*1024 {
+			burst = 1024 * 1024
+		}
+		pf.limiter = rate.NewLimiter(rate.Limit(bandwidth), int(burst))
+	}
+
+	logger.Info("artifact prefetching enabled", "depth", *prefetchDepthOpt, "budget", humanize.Bytes(uint64(budget)), "bandwidth", *prefetchBandwidthOpt)
+
+	check := time.NewTicker(checkInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+			pf.check(ctx)
+		}
+	}
+}
+
+// outstanding returns the size of the prefetched artifacts of requests that are still queued
+//
+func (pf *prefetcher) outstanding() (size int64) {
+	for _, item := range pf.items {
+		size += item.size
+	}
+	return size
+}
+
+// check drops the records of requests that have left the queues and then prefetches the artifacts
+// of the requests at the head of each queue
+//
+func (pf *prefetcher) check(ctx context.Context) {
+	for key, item := range pf.items {
+		if queued, err := pf.queue.IsQueued(filepath.Base(item.subscription), item.id); err == nil && !queued {
+			delete(pf.items, key)
+		}
+	}
+
+	w, err := getWrapper()
+	if err != nil {
+		logger.Debug("prefetching skipped", "error", err.Error())
+		return
+	}
+
+	matcher, mismatcher := runner.GetQueuePatterns()
+	queues, err := pf.queue.Refresh(ctx, matcher, mismatcher)
+	if err != nil {
+		logger.Debug("prefetching skipped", "error", err.Error())
+		return
+	}
+
+	for subscription := range queues {
+		// The subscription is the path of the queue directory, options and signatures are
+		// selected using the same short queue name the processor uses
+		shortQName, err := pf.queue.GetShortQName(&task.QueueTask{Subscription: subscription})
+		if err != nil {
+			logger.Debug("prefetching skipped", "subscription", subscription, "error", err.Error())
+			continue
+		}
+		// Work on paused queues is not going to be claimed soon
+		if runner.GetQueueOptions(shortQName).Paused {
+			continue
+		}
+		ids, msgs, err := pf.queue.Peek(subscription, *prefetchDepthOpt)
+		if err != nil {
+			logger.Debug("prefetching skipped", "subscription", subscription, "error", err.Error())
+			continue
+		}
+		for i, id := range ids {
+			if ctx.Err() != nil {
+				return
+			}
+			pf.prefetch(ctx, subscription, shortQName, id, msgs[i], w)
+		}
+	}
+}
+
+// prefetch places the immutable artifacts of a single queued request into the cache
+//
+func (pf *prefetcher) prefetch(ctx context.Context, subscription string, shortQName string, id string, msg []byte, w *defense.Wrapper) {
+	key := filepath.Join(subscription, id)
+	item, isPresent := pf.items[key]
+	if !isPresent {
+		item = &prefetchItem{
+			subscription: subscription,
+			id:           id,
+		}
+		pf.items[key] = item
+	}
+	if item.done {
+		return
+	}
+
+	qt := &task.QueueTask{
+		Subscription: subscription,
+		ShortQName:   shortQName,
+		Msg:          msg,
+		Wrapper:      w,
+	}
+	rqst, _, _, err := decodeMsg(qt, false)
+	if err != nil {
+		// The request will be rejected, or retried, by the runner that claims it
+		logger.Debug("request not prefetched", "subscription", subscription, "id", id, "error", err.Error())
+		item.done = true
+		return
+	}
+
+	env := requestEnv(rqst)
+
+	exhausted := false
+	admit := func(size int64) (release func(), err kv.Error) {
+		if pf.outstanding()+size > pf.budget {
+			exhausted = true
+			return nil, kv.NewError("prefetch budget exhausted").With("size", humanize.Bytes(uint64(size))).With("stack", stack.Trace().TrimRuntime())
+		}
+		// When the cache is on its own device the free space of that device is checked
+		if !pf.sharedDisk {
+			free, err := disk_resource.GetPathFree(pf.cacheDir)
+			if err != nil {
+				exhausted = true
+				return nil, err
+			}
+			if free < uint64(size) {
+				exhausted = true
+				return nil, kv.NewError("cache disk space exhausted").With("available", humanize.Bytes(free), "size", humanize.Bytes(uint64(size)), "dir", pf.cacheDir).With("stack", stack.Trace().TrimRuntime())
+			}
+			return func() {}, nil
+		}
+		// Space is reserved while downloading so that prefetching cannot use space
+		// that has been allocated to experiments
+		alloc, err := disk_resource.AllocDisk(uint64(size), true)
+		if err != nil {
+			exhausted = true
+			return nil, err
+		}
+		return func() { _ = alloc.Release() }, nil
+	}
+
+	for group, art := range rqst.Experiment.Artifacts {
+		if group == "_metadata" || len(art.Qualified) == 0 || art.Mutable {
+			continue
+		}
+		// Artifacts on the local file system gain nothing from prefetching
+		if strings.HasPrefix(art.Qualified, "file:") {
+			continue
+		}
+
+		size, warns, err := artifactCache.Prefetch(ctx, art.Clone(), rqst.Config.Database.ProjectId, group, env, admit, pf.limiter)
+		for _, warn := range warns {
+			logger.Debug("artifact prefetch warning", "experiment_id", rqst.Experiment.Key, "group", group, "warning", warn.Error())
+		}
+		if err != nil {
+			if exhausted {
+				// Try again once artifacts for earlier requests have been claimed
+				logger.Debug("artifact prefetch deferred", "experiment_id", rqst.Experiment.Key, "group", group, "error", err.Error())
+				return
+			}
+			logger.Debug("artifact prefetch failed", "experiment_id", rqst.Experiment.Key, "group", group, "error", err.Error())
+			continue
+		}
+		if size != 0 {
+			item.size += size
+			logger.Debug("artifact prefetched", "experiment_id", rqst.Experiment.Key, "group", group, "size", humanize.Bytes(uint64(size)))
+		}
+	}
+	item.done = true
+}
+
+// requestEnv returns the environment used to access the storage of the artifacts within a request
+//
+func requestEnv(rqst *request.Request) (env map[string]string) {
+	env = extractValidEnv()
+	for k, v := range rqst.Config.Env {
+		env[k] = expandEnv(v)
+	}
+	env["AWS_SDK_LOAD_CONFIG"] = "1"
+	return env
+}
@@ -9,7 +9,7 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -25,7 +25,6 @@ import (
 	"unicode"
 
 	"github.com/valyala/fastjson"
-	"golang.org/x/crypto/ssh"
 
 	farm "github.com/dgryski/go-farm"
 	humanize "github.com/dustin/go-humanize"
@@ -48,6 +47,7 @@ type processor struct {
 	ExprEnvs   map[string]string `json:"expr_envs"`
 	Request    *request.Request  `json:"request"` // merge these two fields, to avoid split data in a DB and some in JSON
 	QueueCreds string            `json:"credentials_file"`
+	ShortQName string            `json:"queue"` // The name of the queue the work was received from
 	Artifacts  *runner.ArtifactCache
 	Executor   Executor
 	status     chan string // Used by the processor to get notifications about external status changes
@@ -55,6 +55,8 @@ type processor struct {
 	AccessionID string      // A unique identifier for this task
 	ResponseQ   chan string // A response queue the runner can employ to send progress updates on
 	evalDone    bool        // true, if evaluation should be processed as completed
+	metrics     *runner.MetricsRecorder
+	warnings    []string // Problems found when the request was compared with the request schema
 }
 
 type tempSafe struct {
@@ -83,6 +85,9 @@ var (
 
 	statusArtifactName = "_results"
 	statusFileName     = "status.json"
+
+	// metricsReportInterval is the interval between the latest values of experiment metrics being reported
+	metricsReportInterval = 15 * time.Second
 )
 
 const (
@@ -178,9 +183,11 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 		RootDir:     temp,
 		Group:       qt.Subscription,
 		QueueCreds:  qt.Credentials[:],
+		ShortQName:  qt.ShortQName,
 		AccessionID: accessionID,
 		ResponseQ:   qt.ResponseQ,
 		evalDone:    false,
+		metrics:     runner.NewMetricsRecorder(),
 	}
 
 	// Extract processor information from the message received on the wire, includes decryption etc
@@ -215,9 +222,12 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 
 	switch mode {
 	case ExecPythonVEnv:
-		if proc.Executor, err = runner.NewVirtualEnv(proc.Request, proc.ExprDir, proc.AccessionID, logger); err != nil {
+		venv, err := runner.NewVirtualEnv(proc.Request, proc.ExprDir, proc.AccessionID, qt.ShortQName, logger)
+		if err != nil {
 			return nil, true, err
 		}
+		venv.OutputTap = proc.metrics.Observe
+		proc.Executor = venv
 	default:
 		return nil, true, kv.NewError("unable to determine execution class from artifacts").With("stack", stack.Trace().TrimRuntime()).
 			With("mode", mode, "project", proc.Request.Config.Database.ProjectId).With("experiment", proc.Request.Experiment.Key)
@@ -230,93 +240,89 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 //
 func (proc *processor) unpackMsg(qt *task.QueueTask) (hardError bool, err kv.Error) {
 
+	rqst, warnings, hardError, err := decodeMsg(qt, true)
+	proc.warnings = append(proc.warnings, warnings...)
+	if err != nil {
+		return hardError, err
+	}
+	proc.Request = rqst
+
+	if len(proc.warnings) != 0 {
+		logger.Warn("request does not match the schema", "experiment_id", proc.Request.Experiment.Key, "warnings", strings.Join(proc.warnings, ", "))
+	}
+	return hardError, nil
+}
+
+// decodeMsg will validate and, if needed, decrypt the message payload inside the queueTask (qt)
+// to obtain the request.  When checkResources is true the resources in the clear text portion of
+// encrypted messages are checked against the available resources before decryption.
+//
+func decodeMsg(qt *task.QueueTask, checkResources bool) (rqst *request.Request, warnings []string, hardError bool, err kv.Error) {
+
+	strict := strictRequests(qt.ShortQName)
+
 	// Check to see if we have an encrypted or signed request
 	if isEnvelope, _ := defense.IsEnvelope(qt.Msg); isEnvelope {
 
 		if qt.Wrapper == nil {
-			return false, kv.NewError("encrypted msg support not enabled").With("stack", stack.Trace().TrimRuntime())
+			return nil, warnings, false, kv.NewError("encrypted msg support not enabled").With("stack", stack.Trace().TrimRuntime())
 		}
 
 		// First load in the clear text portion of the message and test its resource request
 		// against available resources before decryption
-		envelope, err := defense.UnmarshalEnvelope(qt.Msg)
+		envelope, w, err := defense.DecodeEnvelope(qt.Msg, strict)
 		if err != nil {
-			return true, err
-		}
-		if _, err = allocResource(&envelope.Message.Resource, "", false); err != nil {
-			return false, err
+			return nil, warnings, true, err
 		}
-
-		if len(envelope.Message.Signature) == 0 {
-			return false, kv.NewError("encrypted payload has no signature").With("stack", stack.Trace().TrimRuntime())
-		}
-
-		if len(envelope.Message.Fingerprint) == 0 {
-			return false, kv.NewError("payload signature has no fingerprint").With("stack", stack.Trace().TrimRuntime())
+		warnings = append(warnings, w...)
+		if checkResources {
+			if _, err = allocResource(&envelope.Message.Resource, "", false); err != nil {
+				return nil, warnings, false, err
+			}
 		}
 
 		// Now check the signature by getting the queue name and then looking for the applicable
 		// public key inside the signature store
-		pubKey, fp, err := GetRqstSigs().SelectSSH(qt.ShortQName)
-		if err != nil {
-			return false, err
-		}
-		if fp != envelope.Message.Fingerprint {
+		fp, err := GetRqstSigs().VerifyEnvelope(qt.ShortQName, envelope)
+		if len(fp) != 0 && fp != envelope.Message.Fingerprint {
 			logger.Info("payload signature has an unmatched fingerprint", "fingerprint", fp, "message.Fingerprint", envelope.Message.Fingerprint)
 		}
-
-		sigBin, errGo := base64.StdEncoding.DecodeString(envelope.Message.Signature)
-		if errGo != nil {
-			return false, kv.Wrap(errGo).With("signature", envelope.Message.Signature).With("stack", stack.Trace().TrimRuntime())
+		if err != nil {
+			return nil, warnings, false, err
 		}
 
-		err = nil
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = kv.Wrap(r.(error)).With("stack", stack.Trace().TrimRuntime())
-				}
-			}()
-
-			// First try for the RFC format using the parser
-			sig, errSig := defense.ParseSSHSignature(sigBin)
-			if errSig != nil {
-				// We could have 64 byte blob so just try to use that
-				if len(sigBin) == 64 {
-					sig = &ssh.Signature{
-						Format: "ssh-ed25519",
-						Blob:   sigBin,
-					}
-				} else {
-					err = errSig
-					return
-				}
-			}
-			if err == nil {
-				if errGo := pubKey.Verify([]byte(envelope.Message.Payload), sig); errGo != nil {
-					err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-				}
-			}
-		}()
-		if err != nil {
-			return false, err
+		// If the key used to encrypt the payload has been retired for longer than the overlap
+		// period the message can never be decrypted and so is not left on the queue to be
+		// redelivered.  Keys that are not yet known to this runner might be yet to be loaded
+		// from the key directory, so the message is left for a later attempt, or another runner.
+		if !qt.Wrapper.HasKey(envelope.Message.KeyID) {
+			err = kv.NewError("decryption key not available").With("key_id", envelope.Message.KeyID).With("stack", stack.Trace().TrimRuntime())
+			return nil, warnings, qt.Wrapper.KeyRevoked(envelope.Message.KeyID), err
 		}
 
 		// Decrypt, using the wrapper, the master request structure and assign it to our task
-		if proc.Request, err = qt.Wrapper.Request(envelope); err != nil {
-			return true, err
+		payload, err := qt.Wrapper.Payload(envelope)
+		if err != nil {
+			return nil, warnings, true, err
+		}
+		if rqst, w, err = request.DecodeRequest(payload, strict); err != nil {
+			return nil, warnings, true, err
 		}
+		warnings = append(warnings, w...)
 
 	} else {
 		if !*acceptClearTextOpt {
-			return true, kv.NewError("unencrypted messages not enabled").With("stack", stack.Trace().TrimRuntime())
+			return nil, warnings, true, kv.NewError("unencrypted messages not enabled").With("stack", stack.Trace().TrimRuntime())
 		}
 		// restore the msg into the processing data structure from the JSON queue payload
-		if proc.Request, err = request.UnmarshalRequest(qt.Msg); err != nil {
-			return true, err
+		w := []string{}
+		if rqst, w, err = request.DecodeRequest(qt.Msg, strict); err != nil {
+			return nil, warnings, true, err
 		}
+		warnings = append(warnings, w...)
 	}
-	return hardError, nil
+
+	return rqst, warnings, false, nil
 }
 
 // Close will release all resources and clean up the work directory that
@@ -553,6 +559,9 @@ func (p *processor) updateMetaData(group string, artifact request.Artifact, acce
 	case "output":
 		src := filepath.Join(p.ExprDir, "output", "output")
 		jsonDest := filepath.Join(metaDir, "scrape-host-"+accessionID+".json")
+		if err = p.metrics.Save(filepath.Join(metaDir, "metrics-"+accessionID+".json"), p.Request.Experiment.Key); err != nil {
+			logger.Warn("metrics could not be saved", "experiment_id", p.Request.Experiment.Key, "error", err.Error())
+		}
 		return p.copyToMetaData(src, jsonDest)
 	default:
 		return kv.NewError("group unrecognized").With("group", group, "stack", stack.Trace().TrimRuntime())
@@ -587,9 +596,61 @@ func (p *processor) returnOne(ctx context.Context, group string, artifact reques
 		return false, warns, nil
 	}
 
+	seal, err := p.resultSealKey(artifact)
+	if err != nil {
+		return false, warns, err.With("group", group)
+	}
+	p.addObjectMetadata(&artifact)
+
 	//logger.Debug("uploading artifact", "experiment_id", p.Request.Experiment.Key, "file", filepath.Join(p.ExprDir, group))
 	defer logger.Debug("upload artifact done", "group", group, "experiment_id", p.Request.Experiment.Key, "file", filepath.Join(p.ExprDir, group))
-	return artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.ExprEnvs, p.ExprDir)
+	return artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.ExprEnvs, p.ExprDir, seal)
+}
+
+// addObjectMetadata adds user metadata identifying the experiment, and the runner, to the
+// options of an artifact being uploaded so that objects can be traced back to the work that
+// produced them.  Metadata supplied by the experimenter is not replaced.
+//
+func (p *processor) addObjectMetadata(artifact *request.Artifact) {
+	opts := &request.ObjectOptions{}
+	if artifact.Object != nil {
+		opts = artifact.Object.Clone()
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = map[string]string{}
+	}
+
+	host, _ := os.Hostname()
+	for k, v := range map[string]string{
+		"Studioml-Experiment-Key": p.Request.Experiment.Key,
+		"Studioml-Accession-Id":   p.AccessionID,
+		"Studioml-Host":           host,
+	} {
+		if _, isPresent := opts.Metadata[k]; !isPresent && len(v) != 0 {
+			opts.Metadata[k] = v
+		}
+	}
+	artifact.Object = opts
+}
+
+// resultSealKey returns the public key that an uploaded artifact is to be encrypted with, if
+// the artifact, or the queue it came from, asks for encrypted results.  The key is the one used
+// to encrypt responses for the queue.  When encryption is required and no key is available an
+// error is returned rather than uploading the artifact in clear text.
+//
+func (p *processor) resultSealKey(artifact request.Artifact) (pub *rsa.PublicKey, err kv.Error) {
+	if !artifact.Encrypt && !runner.GetQueueOptions(p.ShortQName).EncryptResults {
+		return nil, nil
+	}
+
+	store := GetRspnsEncrypt()
+	if store == nil {
+		return nil, kv.NewError("encrypted results requested without response encryption keys").With("queue", p.ShortQName).With("stack", stack.Trace().TrimRuntime())
+	}
+	if pub, err = store.Select(responseQueue(p.ShortQName)); err != nil {
+		return nil, err.With("queue", p.ShortQName)
+	}
+	return pub, nil
 }
 
 func (p *processor) artifactIsEmpty(group string) (result bool, err error) {
@@ -619,6 +680,7 @@ type resultArtifacts struct {
 	ExperimentID string                    `json:"experiment_id"`
 	Host         string                    `json:"host"`
 	Artifacts    map[string]resultArtifact `json:"artifacts"`
+	Warnings     []string                  `json:"warnings,omitempty"`
 }
 
 func (p *processor) uploadResultArtifact(ctx context.Context, results *resultArtifacts, accessionID string) (err kv.Error) {
@@ -683,6 +745,7 @@ func (p *processor) returnAll(ctx context.Context, accessionID string, err kv.Er
 	finalArtStatus.ExitMsg = exitMsg
 	finalArtStatus.ExperimentID = p.Request.Experiment.Key
 	finalArtStatus.Host, _ = os.Hostname()
+	finalArtStatus.Warnings = p.warnings
 	finalArtStatus.Artifacts = make(map[string]resultArtifact)
 
 	for _, group := range keys {
@@ -778,6 +841,9 @@ func (p *processor) Process(ctx context.Context) (ack bool, err kv.Error) {
 		}
 	}
 
+	// Let the listener know of any problems with the request that did not prevent it being run
+	p.sendWarnings()
+
 	// The allocation details are passed in to the runner to allow the
 	// resource reservations to become known to the running applications.
 	// This call will block until the task stops processing.
@@ -905,6 +971,21 @@ func extractValidEnv() (envs map[string]string) {
 	return envs
 }
 
+// envExpansion matches %...% pairs within the values of the env block specified by the studioml client
+var envExpansion = regexp.MustCompile(`(?U)(?:\%(.*)*\%)+`)
+
+// expandEnv replaces %...% pairs within the value with the value of the named environment
+// variable of the runner process, pairs naming variables that are not set are left untouched
+//
+func expandEnv(v string) (expanded string) {
+	for _, match := range envExpansion.FindAllString(v, -1) {
+		if envV := os.Getenv(match[1 : len(match)-1]); len(envV) != 0 {
+			v = strings.Replace(v, match, envV, -1)
+		}
+	}
+	return v
+}
+
 // applyEnv is used to apply the contents of the env block specified by the studioml client into the
 // runners environment table.
 //
@@ -919,9 +1000,6 @@ func (p *processor) applyEnv(alloc *pkgResources.Allocated) {
 
 	p.ExprEnvs = extractValidEnv()
 
-	// Expand %...% pairs by iterating the env table for the process and explicitly replacing on each line
-	re := regexp.MustCompile(`(?U)(?:\%(.*)*\%)+`)
-
 	// Checkmarx code checking note. Checkmarx is for Web applications and is not a good fit general purpose server code.
 	// It is also worth mentioning that if you are reading this message that Checkmarx does not understand Go package structure
 	// and does not appear to use the Go AST  to validate code so is not able to perform path and escape analysis which
@@ -933,11 +1011,8 @@ func (p *processor) applyEnv(alloc *pkgResources.Allocated) {
 	// Environment variables need to be applied here to assist in unpacking S3 files etc
 	for k, v := range p.Request.Config.Env {
 
-		for _, match := range re.FindAllString(v, -1) {
-			if envV := os.Getenv(match[1 : len(match)-1]); len(envV) != 0 {
-				v = strings.Replace(v, match, envV, -1)
-			}
-		}
+		v = expandEnv(v)
+
 		// Update the processor env table with the resolved value
 		p.Request.Config.Env[k] = v
 
@@ -1118,6 +1193,10 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	//
 	doneC := p.checkpointStart(runCtx, accessionID, refresh, refreshTimeout)
 
+	// Start reporting the metrics the experiment emits while it is running
+	metricsDoneC := make(chan struct{})
+	go p.reportMetrics(runCtx, metricsDoneC)
+
 	cancelReason := ""
 
 	// Now wait on the context supplied by the caller to be done,
@@ -1187,10 +1266,102 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	case <-time.After(5 * time.Minute):
 		logger.Debug("runScript artifact checkpointer unresponsive", " experiment_id", p.Request.Experiment.Key)
 	}
+	<-metricsDoneC
 
 	return err
 }
 
+// sendWarnings sends any problems found when the request was compared with the request
+// schema to the response queue, if one is present
+//
+func (p *processor) sendWarnings() {
+	if p.ResponseQ == nil || len(p.warnings) == 0 {
+		return
+	}
+
+	msg, errGo := json.Marshal(struct {
+		ExperimentID string   `json:"experiment_id"`
+		Warnings     []string `json:"warnings"`
+	}{
+		ExperimentID: p.Request.Experiment.Key,
+		Warnings:     p.warnings,
+	})
+	if errGo != nil {
+		logger.Warn("warnings could not be encoded", "experiment_id", p.Request.Experiment.Key, "error", errGo.Error())
+		return
+	}
+
+	select {
+	case p.ResponseQ <- string(msg):
+	default:
+		logger.Warn("unresponsive response queue channel")
+	}
+}
+
+// sendMetrics pushes the most recent values of any metrics seen since the last call to
+// prometheus and to the response queue if one is present
+//
+func (p *processor) sendMetrics() {
+	latest, updated := p.metrics.Latest()
+	if !updated {
+		return
+	}
+
+	for _, point := range latest {
+		experimentMetric.WithLabelValues(p.Request.Config.Database.ProjectId, p.ShortQName, p.Request.Experiment.Key, point.Name).Set(point.Value)
+		experimentMetricStep.WithLabelValues(p.Request.Config.Database.ProjectId, p.ShortQName, p.Request.Experiment.Key, point.Name).Set(float64(point.Step))
+	}
+
+	if p.ResponseQ == nil {
+		return
+	}
+
+	msg, errGo := json.Marshal(struct {
+		ExperimentID string               `json:"experiment_id"`
+		Metrics      []runner.MetricPoint `json:"metrics"`
+	}{
+		ExperimentID: p.Request.Experiment.Key,
+		Metrics:      latest,
+	})
+	if errGo != nil {
+		logger.Warn("metrics could not be encoded", "experiment_id", p.Request.Experiment.Key, "error", errGo.Error())
+		return
+	}
+
+	select {
+	case p.ResponseQ <- string(msg):
+	default:
+		logger.Warn("unresponsive response queue channel")
+	}
+}
+
+// reportMetrics will on a regular basis send the latest values of metrics emitted by the experiment
+// until the context is done.  Once the experiment is done its metrics are removed from prometheus,
+// the experiment key is one of the labels so the metrics of other experiments are left in place.
+//
+func (p *processor) reportMetrics(ctx context.Context, doneC chan struct{}) {
+	defer close(doneC)
+
+	report := time.NewTicker(metricsReportInterval)
+	defer report.Stop()
+
+	for {
+		select {
+		case <-report.C:
+			p.sendMetrics()
+		case <-ctx.Done():
+			p.sendMetrics()
+
+			latest, _ := p.metrics.Latest()
+			for _, point := range latest {
+				experimentMetric.DeleteLabelValues(p.Request.Config.Database.ProjectId, p.ShortQName, p.Request.Experiment.Key, point.Name)
+				experimentMetricStep.DeleteLabelValues(p.Request.Config.Database.ProjectId, p.ShortQName, p.Request.Experiment.Key, point.Name)
+			}
+			return
+		}
+	}
+}
+
 type StatusInfo struct {
 	Key    string `json:"key"`
 	Status string `json:"status"`
@@ -16,6 +16,7 @@ import (
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv"
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
 	"github.com/leaf-ai/studio-go-runner/internal/task"
 	uberatomic "go.uber.org/atomic"
 	"sync"
@@ -33,7 +34,7 @@ var (
 	initWrapperOnce sync.Once
 )
 
-func initWrapper() {
+func initWrapper(ctx context.Context, errorC chan<- kv.Error) {
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -41,8 +42,9 @@ func initWrapper() {
 		}
 	}()
 	// Get the secrets that Kubernetes has stored for the runners to use
-	// for their decryption of messages on the queues
-	w, err := defense.KubernetesWrapper(*msgEncryptDirOpt)
+	// for their decryption of messages on the queues, along with any keys
+	// placed into the directory that can be rotated while we are running
+	w, err := defense.KubernetesKeyringWrapper(ctx, *msgEncryptDirOpt, *msgKeyOverlapOpt, errorC)
 	if err != nil {
 		if server.IsAliveK8s() != nil {
 			logger.Warn("kubernetes missing", "error", err.Error())
@@ -57,11 +59,15 @@ func initWrapper() {
 
 	encryptWrapErr = nil
 	encryptWrap = w
+
+	// Archives are sealed using the response queue public keys, they can only be decrypted when
+	// fetched if the matching private key has been added to these keys
+	s3.SetUnsealKeys(w)
 }
 
 func getWrapper() (w *defense.Wrapper, err kv.Error) {
 
-	initWrapperOnce.Do(initWrapper)
+	initWrapperOnce.Do(func() { initWrapper(context.Background(), nil) })
 
 	// Make sure that clear text is permitted before continuing
 	// after an error
@@ -198,6 +204,8 @@ func (live *Projects) run(ctx context.Context, proj string, mgt string, cred str
 		logger.Warn("failed project initialization", "project", proj, "error", err.Error())
 		return
 	}
+	defer qr.close()
+
 	if err := qr.run(ctx); err != nil {
 		logger.Warn("failed project runner", "project", proj, "error", err.Error())
 		return
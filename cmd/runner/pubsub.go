@@ -0,0 +1,97 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// The file contains code for locating Google Cloud Pub/Sub projects and
+// using these to process work sent to the subscriptions within them
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+	gcp_ext "github.com/leaf-ai/studio-go-runner/pkg/gcp"
+
+	"github.com/go-stack/stack"
+)
+
+var (
+	pubsubProjectsOpt = flag.String("pubsub-projects", "", "a comma separated list of Google Cloud project IDs containing Pub/Sub subscriptions the runner will take work from")
+	pubsubCredsOpt    = flag.String("pubsub-credentials", "", "an optional Google Cloud service account file used to access Pub/Sub, application default credentials are used if not specified")
+)
+
+// pubsubProjects validates access to the Pub/Sub projects that have been configured,
+// projects that cannot be accessed are skipped
+func pubsubProjects(ctx context.Context, timeout time.Duration) (serverFound map[string]task.QueueDesc) {
+	serverFound = map[string]task.QueueDesc{}
+
+	for _, gcpProject := range strings.Split(*pubsubProjectsOpt, ",") {
+		gcpProject = strings.TrimSpace(gcpProject)
+		if len(gcpProject) == 0 {
+			continue
+		}
+
+		projCtx, cancel := context.WithTimeout(ctx, timeout)
+		project, err := gcp_ext.GetPubSubProject(projCtx, gcpProject, *pubsubCredsOpt)
+		cancel()
+
+		if err != nil {
+			logger.Warn("unable to use Pub/Sub project", "project", gcpProject, "error", err.Error())
+			continue
+		}
+		serverFound[project] = task.QueueDesc{
+			Cred: *pubsubCredsOpt,
+			Proj: project,
+		}
+	}
+	return serverFound
+}
+
+func servicePubSub(ctx context.Context, connTimeout time.Duration) {
+
+	if len(*pubsubProjectsOpt) == 0 {
+		logger.Info("user disabled the Pub/Sub service")
+		return
+	}
+
+	logger.Info("starting the Pub/Sub service")
+
+	live := &Projects{
+		queueType: "pubsub",
+		projects:  map[string]context.CancelFunc{},
+	}
+
+	// first time through make sure the projects are checked immediately
+	projCheck := time.Duration(time.Second)
+
+	for {
+		select {
+		case <-ctx.Done():
+
+			live.Lock()
+			defer live.Unlock()
+
+			// When shutting down stop all projects
+			for _, quiter := range live.projects {
+				if quiter != nil {
+					quiter()
+				}
+			}
+			return
+
+		case <-time.After(projCheck):
+			projCheck = time.Duration(30 * time.Second)
+
+			serverFound := pubsubProjects(ctx, connTimeout)
+
+			logger.Info("Starting Pub/Sub lifecycle", "found", serverFound)
+
+			if err := live.Cycle(ctx, serverFound); err != nil {
+				logger.Warn("unable to process new projects", "type", live.queueType, "error", err.Error(), "stack", stack.Trace().TrimRuntime())
+				continue
+			}
+		}
+	}
+}
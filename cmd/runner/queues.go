@@ -22,6 +22,7 @@ import (
 	"github.com/andreidenissov-cog/go-service/pkg/server"
 	"github.com/davecgh/go-spew/spew"
 	aws_ext "github.com/leaf-ai/studio-go-runner/pkg/aws"
+	gcp_ext "github.com/leaf-ai/studio-go-runner/pkg/gcp"
 	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
 
 	"github.com/leaf-ai/studio-go-runner/internal/resources"
@@ -35,8 +36,27 @@ import (
 
 const (
 	responseSuffix = "_response"
+
+	// fifoSuffix is the suffix SQS requires for the names of FIFO queues
+	fifoSuffix = ".fifo"
 )
 
+// responseQueue returns the name of the queue used for responses to work from the named queue,
+// the response queue for an SQS FIFO queue is also a FIFO queue
+//
+func responseQueue(name string) (response string) {
+	if strings.HasSuffix(name, fifoSuffix) {
+		return strings.TrimSuffix(name, fifoSuffix) + responseSuffix + fifoSuffix
+	}
+	return name + responseSuffix
+}
+
+// isResponseQueue tests a queue name to see if it is used for responses
+//
+func isResponseQueue(name string) (isResponse bool) {
+	return strings.HasSuffix(strings.TrimSuffix(name, fifoSuffix), responseSuffix)
+}
+
 var (
 	// backoffs are a set of subscriptions to queues that when they are still alive
 	// in the cache the server will not attempt to retrieve work from.  When the
@@ -111,6 +131,15 @@ func NewQueuer(projectID string, mgt string, creds string, w wrapper.Wrapper) (q
 	return qr, nil
 }
 
+// close releases any connections held by the task queue, it is used once the
+// project the queuer is servicing has been dropped
+//
+func (qr *Queuer) close() {
+	if closer, ok := qr.tasker.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
 // refresh is used to update the queuer with a list of the available queues
 // accessible to the project
 //
@@ -134,7 +163,7 @@ func (qr *Queuer) refresh() (err kv.Error) {
 
 	// Ignore queues used for response messages
 	for k := range known {
-		if strings.HasSuffix(k, responseSuffix) {
+		if isResponseQueue(k) {
 			delete(known, k)
 		}
 	}
@@ -558,6 +587,13 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 //
 func (qr *Queuer) fetchWork(ctx context.Context, qt *task.QueueTask) {
 
+	// Queues can be paused using the runtime configuration, in which case work is left
+	// on the queue for other runners
+	if shortQueueName, err := qr.tasker.GetShortQName(qt); err == nil && runner.GetQueueOptions(shortQueueName).Paused {
+		logger.Trace("queue paused", "project_id", qt.Project, "subscription_id", qt.Subscription)
+		return
+	}
+
 	// If we are able to determine the required capacity for the queue and
 	// the node does not have sufficient available dont both going to get any
 	// work
@@ -571,12 +607,12 @@ func (qr *Queuer) fetchWork(ctx context.Context, qt *task.QueueTask) {
 
 	if hasWork && err == nil {
 
-		if exists, _ := qr.tasker.Exists(ctx, qt.Subscription+responseSuffix); exists {
+		if exists, _ := qr.tasker.Exists(ctx, responseQueue(qt.Subscription)); exists {
 			shortQueueName, err := qr.tasker.GetShortQName(qt)
 			if err != nil {
 				logger.Info("no short queue", "error", err.Error)
 			} else {
-				responseQName := shortQueueName + responseSuffix
+				responseQName := responseQueue(shortQueueName)
 
 				// Check before starting if there is a response queue available for
 				// reporting.  If so start a channel for reporting with a listener
@@ -587,7 +623,7 @@ func (qr *Queuer) fetchWork(ctx context.Context, qt *task.QueueTask) {
 
 					if key, err := rspEncryptStore.Select(responseQName); err == nil {
 
-						if responseQ, err := qr.tasker.Responder(ctx, responseQName, key); err != nil {
+						if responseQ, err := qr.tasker.Responder(ctx, qt, responseQName, key); err != nil {
 							logger.Warn("responder unavailable", "queue_name", responseQName, "error", err.Error())
 						} else {
 							qt.ResponseQ = responseQ
@@ -719,6 +755,11 @@ func NewTaskQueue(project string, mgt string, creds string, w wrapper.Wrapper) (
 	//	tq, err = runner.NewRabbitMQ(project, mgt, creds, w, logger)
 	case strings.HasPrefix(project, "/"):
 		tq = runner.NewLocalQueue(project, w, logger)
+	case strings.HasPrefix(project, gcp_ext.ProjectPrefix):
+		tq, err = gcp_ext.NewPubSub(context.Background(), project, creds, w, logger)
+	case aws_ext.IsIdentityCreds(creds):
+		// SQS using credentials from the runners environment
+		tq, err = aws_ext.NewSQS(project, creds, w, logger)
 	default:
 		// SQS uses a number of credential and config file names
 		files := strings.Split(creds, ",")
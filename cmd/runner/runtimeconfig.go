@@ -0,0 +1,196 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the handling of the runtime configuration file for the settings that are
+// managed by the runner itself, resource limits, the limiter, transfer limits, storage mirrors, and per queue options.  Settings
+// managed by the runner package are applied using RuntimeConfig.Apply.
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/leaf-ai/studio-go-runner/internal/cpu_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/disk_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	runtimeConfigOpt = flag.String("runtime-config", "", "optional YAML, or JSON, file of settings that can be changed while the runner is running, the file is watched and changes are validated before being applied")
+)
+
+func validateRuntimeConfigOpts() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if len(*runtimeConfigOpt) == 0 {
+		return errs
+	}
+	cfg, err := runner.LoadRuntimeConfig(*runtimeConfigOpt)
+	if err != nil {
+		return append(errs, err)
+	}
+	if _, err = checkRuntimeConfig(nil, cfg); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// runtimeResourceLimits returns the resource limits from the runtime configuration, using the
+// command line options for those that are not present
+//
+func runtimeResourceLimits(cfg *runner.RuntimeConfig) (cores uint, mem uint64, disk uint64, err kv.Error) {
+	cores = *maxCoresOpt
+	if cfg.Resources.MaxCores != nil {
+		cores = *cfg.Resources.MaxCores
+	}
+
+	memText := *maxMemOpt
+	if len(cfg.Resources.MaxMem) != 0 {
+		memText = cfg.Resources.MaxMem
+	}
+	mem, errGo := humanize.ParseBytes(memText)
+	if errGo != nil {
+		return 0, 0, 0, kv.Wrap(errGo).With("max_mem", memText).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	diskText := *maxDiskOpt
+	if len(cfg.Resources.MaxDisk) != 0 {
+		diskText = cfg.Resources.MaxDisk
+	}
+	if disk, errGo = humanize.ParseBytes(diskText); errGo != nil {
+		return 0, 0, 0, kv.Wrap(errGo).With("max_disk", diskText).With("stack", stack.Trace().TrimRuntime())
+	}
+	return cores, mem, disk, nil
+}
+
+// runtimeSettings holds a version of the runtime configuration once all of its settings have
+// been checked and prepared, so that applying it does not stop part way through
+//
+type runtimeSettings struct {
+	cores     uint
+	mem       uint64
+	disk      uint64
+	limits    transfer.Limits
+	endpoints map[string]transfer.Limits
+	mirrors   []s3.MirrorSet
+	runner    *runner.RuntimeSettings
+}
+
+// checkRuntimeConfig applies the checks for the runner managed settings that can only be made
+// using the state of the runner, such as the physical resources of the host, and prepares all
+// of the settings for being applied.  prev is the version of the configuration in effect, if any.
+//
+func checkRuntimeConfig(prev *runner.RuntimeConfig, cfg *runner.RuntimeConfig) (settings *runtimeSettings, err kv.Error) {
+	settings = &runtimeSettings{}
+	if settings.cores, settings.mem, settings.disk, err = runtimeResourceLimits(cfg); err != nil {
+		return nil, err
+	}
+	if err = cpu_resource.CheckCPULimits(settings.cores, settings.mem); err != nil {
+		return nil, err
+	}
+	if err = disk_resource.CheckDiskLimits(*tempOpt); err != nil {
+		return nil, err
+	}
+	if settings.limits, settings.endpoints, err = transferLimits(cfg); err != nil {
+		return nil, err
+	}
+	if settings.mirrors, err = storageMirrors(cfg); err != nil {
+		return nil, err
+	}
+	if settings.runner, err = cfg.Prepare(prev); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// applyRuntimeConfig puts a new version of the runtime configuration into effect, once all of
+// its settings have been checked, and logs each setting that was changed.  When an error is
+// returned none of the settings have been changed.
+//
+func applyRuntimeConfig(prev *runner.RuntimeConfig, cfg *runner.RuntimeConfig) (err kv.Error) {
+	settings, err := checkRuntimeConfig(prev, cfg)
+	if err != nil {
+		return err
+	}
+
+	// The disk limits are applied first as they depend upon the device still being present, the
+	// remaining settings were checked above and cannot then fail
+	if _, err = disk_resource.SetDiskLimits(*tempOpt, settings.disk); err != nil {
+		return err
+	}
+	if err = cpu_resource.SetCPULimits(settings.cores, settings.mem); err != nil {
+		logger.Warn("runtime configuration cpu limits not applied", "file", *runtimeConfigOpt, "error", err.Error())
+	}
+	settings.runner.Apply()
+	transfer.SetLimits(settings.limits, settings.endpoints)
+	s3.SetMirrors(settings.mirrors, logger)
+
+	var maxIdle *time.Duration
+	if len(cfg.Limiter.IdleDuration) != 0 {
+		// The duration was checked when the configuration was validated
+		idle, _ := time.ParseDuration(cfg.Limiter.IdleDuration)
+		maxIdle = &idle
+	}
+	setLimits(cfg.Limiter.Tasks, maxIdle)
+
+	for _, change := range cfg.Changes(prev) {
+		logger.Info("runtime configuration changed", "file", *runtimeConfigOpt, "setting", change.Setting, "previous", change.Previous, "value", change.Value)
+	}
+	return nil
+}
+
+// startRuntimeConfig applies the runtime configuration file, if one was specified, and then
+// watches it for changes until the ctx is Done
+//
+func startRuntimeConfig(ctx context.Context) (err kv.Error) {
+	if len(*runtimeConfigOpt) == 0 {
+		return nil
+	}
+
+	cfg, err := runner.LoadRuntimeConfig(*runtimeConfigOpt)
+	if err != nil {
+		return err
+	}
+	if err = applyRuntimeConfig(nil, cfg); err != nil {
+		return err
+	}
+
+	updates := make(chan *runner.RuntimeConfig, 1)
+	if err = runner.WatchRuntimeConfig(ctx, *runtimeConfigOpt, logger, updates); err != nil {
+		return err
+	}
+
+	go func() {
+		current := cfg
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case cfg := <-updates:
+				if err := applyRuntimeConfig(current, cfg); err != nil {
+					logger.Warn("runtime configuration rejected, current settings retained", "file", *runtimeConfigOpt, "error", err.Error())
+					continue
+				}
+				current = cfg
+			}
+		}
+	}()
+	return nil
+}
+
+// strictRequests tests whether requests from a queue must match the request schema
+//
+func strictRequests(queue string) (strict bool) {
+	if opts := runner.GetQueueOptions(queue); opts.StrictRequests != nil {
+		return *opts.StrictRequests
+	}
+	return *strictRequestsOpt
+}
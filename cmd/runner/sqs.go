@@ -5,7 +5,10 @@ package main
 // The file contains code for handling aws certificates and
 // refreshing a directory containing these certificates and using
 // these to process work sent to SQS queues that get forwarded
-// to subscriptions made by the runner
+// to subscriptions made by the runner.  Queues can also be located
+// using AWS identities obtained from the environment the runner is
+// deployed within, such as instance profiles, IRSA web identities
+// and assumed roles, that are declared in a file
 
 import (
 	"context"
@@ -32,7 +35,8 @@ import (
 )
 
 var (
-	sqsCertsDirOpt = flag.String("sqs-certs", "", "a directory used to store certificate containing sub directories")
+	sqsCertsDirOpt   = flag.String("sqs-certs", "", "a directory used to store certificate containing sub directories")
+	sqsIdentitiesOpt = flag.String("sqs-identities", "", "a YAML or JSON file containing a list of AWS regions with optional role ARNs and web identity token files, the default AWS credential chain is used to obtain credentials for SQS")
 )
 
 type awsCred struct {
@@ -45,12 +49,17 @@ func (*awsCred) validate(ctx context.Context, filenames []string) (cred *aws_gsc
 		return cred, err
 	}
 
+	cfg := aws.Config{
+		Region:                        aws.String(cred.Region),
+		Credentials:                   cred.Creds,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+	if endpoint := aws_ext.SQSEndpoint(filenames); len(endpoint) != 0 {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+
 	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(cred.Region),
-			Credentials:                   cred.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
+		Config:  cfg,
 		Profile: "default",
 	})
 
@@ -129,9 +138,68 @@ func (awsC *awsCred) refreshAWSCerts(dir string, timeout time.Duration) (found m
 	return found, nil
 }
 
+// sqsCertProjects uses the credentials files within the certificates directory to
+// locate SQS servers
+func (awsC *awsCred) sqsCertProjects(dir string, timeout time.Duration) (serverFound map[string]task.QueueDesc, err kv.Error) {
+	found, err := awsC.refreshAWSCerts(dir, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	serverFound = make(map[string]task.QueueDesc, len(found))
+
+	// Iterate the region for the main URLs to be used and use that as our main project key
+	for _, credFiles := range found {
+		urls, err := aws_ext.GetSQSProjects(strings.Split(credFiles, ","))
+		if err != nil {
+			logger.Warn("unable to refresh AWS certs", "error", err.Error())
+			continue
+		}
+		for k := range urls {
+			serverFound[k] = task.QueueDesc{
+				Cred: credFiles,
+				Proj: k,
+			}
+		}
+	}
+	return serverFound, nil
+}
+
+// sqsIdentityProjects uses the AWS identities declared within the named file to
+// locate SQS servers.  Identities that cannot obtain credentials, or access SQS, are
+// skipped
+func sqsIdentityProjects(ctx context.Context, fn string, timeout time.Duration) (serverFound map[string]task.QueueDesc, err kv.Error) {
+	identities, err := aws_ext.LoadSQSIdentities(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	serverFound = make(map[string]task.QueueDesc, len(identities))
+
+	for i := range identities {
+		identity := &identities[i]
+
+		idCtx, cancel := context.WithTimeout(ctx, timeout)
+		urls, err := aws_ext.GetSQSIdentityProjects(idCtx, identity)
+		cancel()
+
+		if err != nil {
+			logger.Warn("unable to use AWS identity", "identity", identity.Name, "region", identity.Region, "error", err.Error())
+			continue
+		}
+		for k := range urls {
+			serverFound[k] = task.QueueDesc{
+				Cred: identity.IdentityCreds(),
+				Proj: k,
+			}
+		}
+	}
+	return serverFound, nil
+}
+
 func serviceSQS(ctx context.Context, connTimeout time.Duration) {
 
-	if len(*sqsCertsDirOpt) == 0 {
+	if len(*sqsCertsDirOpt) == 0 && len(*sqsIdentitiesOpt) == 0 {
 		logger.Info("user disabled the SQS service")
 		return
 	}
@@ -172,32 +240,35 @@ func serviceSQS(ctx context.Context, connTimeout time.Duration) {
 		case <-time.After(credCheck):
 			credCheck = time.Duration(30 * time.Second)
 
-			found, err := awsC.refreshAWSCerts(*sqsCertsDirOpt, connTimeout)
-			if err != nil {
-				logger.Warn(fmt.Sprintf("unable to refresh AWS certs due to %v", err))
-				continue
-			}
+			serverFound := map[string]task.QueueDesc{}
 
-			serverFound := make(map[string]task.QueueDesc, len(found))
+			if len(*sqsCertsDirOpt) != 0 {
+				found, err := awsC.sqsCertProjects(*sqsCertsDirOpt, connTimeout)
+				if err != nil {
+					logger.Warn(fmt.Sprintf("unable to refresh AWS certs due to %v", err))
+					continue
+				}
+				for k, v := range found {
+					serverFound[k] = v
+				}
+			}
 
-			// Iterate the region for the main URLs to be used and use that as our main project key
-			for _, credFiles := range found {
-				urls, err := aws_ext.GetSQSProjects(strings.Split(credFiles, ","))
+			// Identities are loaded each time through so that the list can be
+			// changed without restarting the runner
+			if len(*sqsIdentitiesOpt) != 0 {
+				found, err := sqsIdentityProjects(ctx, *sqsIdentitiesOpt, connTimeout)
 				if err != nil {
-					logger.Warn("unable to refresh AWS certs", "error", err.Error())
+					logger.Warn("unable to load AWS identities", "error", err.Error())
 					continue
 				}
-				for k := range urls {
-					serverFound[k] = task.QueueDesc{
-						Cred: credFiles,
-						Proj: k,
-					}
+				for k, v := range found {
+					serverFound[k] = v
 				}
 			}
 
 			logger.Info("Starting SQS lifecycle", "found", serverFound)
 
-			if err = live.Cycle(ctx, serverFound); err != nil {
+			if err := live.Cycle(ctx, serverFound); err != nil {
 				logger.Warn("unable to process new projects", "type", live.queueType, "error", err.Error(), "stack", stack.Trace().TrimRuntime())
 				continue
 			}
@@ -0,0 +1,97 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the handling of the limits on the bandwidth and concurrency used when
+// transferring artifacts with storage endpoints, see the internal/transfer package
+
+import (
+	"flag"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	transferDownloadOpt    = flag.String("transfer-download-limit", "", "an optional limit, in bytes per second, for example 100Mb, on the bandwidth used to download artifacts from all remote storage endpoints combined")
+	transferUploadOpt      = flag.String("transfer-upload-limit", "", "an optional limit, in bytes per second, for example 50Mb, on the bandwidth used to upload artifacts to all remote storage endpoints combined")
+	transferConcurrencyOpt = flag.Uint("transfer-concurrency", 0, "an optional limit on the number of artifact transfers with all remote storage endpoints combined that can run at the same time (default 0, unlimited)")
+)
+
+func validateTransferOpts() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if _, _, err := transferLimits(&runner.RuntimeConfig{}); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func parseBandwidth(setting string, text string) (bytesPerSec int64, err kv.Error) {
+	if len(text) == 0 {
+		return 0, nil
+	}
+	limit, errGo := humanize.ParseBytes(text)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("setting", setting, "value", text).With("stack", stack.Trace().TrimRuntime())
+	}
+	return int64(limit), nil
+}
+
+// transferLimits returns the transfer limits from the runtime configuration, using the command
+// line options for the runner wide limits that are not present
+//
+func transferLimits(cfg *runner.RuntimeConfig) (limits transfer.Limits, endpoints map[string]transfer.Limits, err kv.Error) {
+	download := *transferDownloadOpt
+	if len(cfg.Transfers.DownloadLimit) != 0 {
+		download = cfg.Transfers.DownloadLimit
+	}
+	if limits.Download, err = parseBandwidth("download_limit", download); err != nil {
+		return limits, nil, err
+	}
+
+	upload := *transferUploadOpt
+	if len(cfg.Transfers.UploadLimit) != 0 {
+		upload = cfg.Transfers.UploadLimit
+	}
+	if limits.Upload, err = parseBandwidth("upload_limit", upload); err != nil {
+		return limits, nil, err
+	}
+
+	limits.Concurrency = int(*transferConcurrencyOpt)
+	if cfg.Transfers.Concurrency != nil {
+		limits.Concurrency = int(*cfg.Transfers.Concurrency)
+	}
+
+	endpoints = make(map[string]transfer.Limits, len(cfg.Transfers.Endpoints))
+	for _, entry := range cfg.Transfers.Endpoints {
+		endpoint := transfer.Limits{
+			Concurrency: int(entry.Concurrency),
+		}
+		if endpoint.Download, err = parseBandwidth("download_limit", entry.DownloadLimit); err != nil {
+			return limits, nil, err.With("endpoint", entry.Endpoint)
+		}
+		if endpoint.Upload, err = parseBandwidth("upload_limit", entry.UploadLimit); err != nil {
+			return limits, nil, err.With("endpoint", entry.Endpoint)
+		}
+		endpoints[entry.Endpoint] = endpoint
+	}
+	return limits, endpoints, nil
+}
+
+// applyTransferLimits puts the transfer limits from the runtime configuration, and the command
+// line, into effect
+//
+func applyTransferLimits(cfg *runner.RuntimeConfig) (err kv.Error) {
+	limits, endpoints, err := transferLimits(cfg)
+	if err != nil {
+		return err
+	}
+	transfer.SetLimits(limits, endpoints)
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the validate mode of the runner.  A request, or an envelope, is read from
+// a file and the checks the runner would apply to it after taking it from a queue are run, without
+// resources being allocated or the experiment being run.  A JSON report of the outcome, including
+// the run script that would be generated for the experiment, is printed.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/network"
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	pkgResources "github.com/leaf-ai/studio-go-runner/internal/resources"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+	"github.com/karlmutch/base62"
+)
+
+var (
+	validateOpt        = flag.String("validate", "", "validate the request, or envelope, in the named file, '-' for stdin, printing a report and exiting without running it")
+	validateQueueOpt   = flag.String("validate-queue", "", "the name of the queue the request being validated is intended for, used to select signing keys and script templates")
+	validateProbeOpt   = flag.Bool("validate-probe", true, "check that the artifacts of the request being validated can be reached")
+	validateTimeoutOpt = flag.Duration("validate-timeout", time.Duration(30*time.Second), "the maximum time spent probing each artifact of the request being validated")
+)
+
+// runValidate validates the request named by the validate option and returns the exit
+// code for the process
+//
+func runValidate(ctx context.Context) (exitCode int) {
+	if errs := validateResourceOpts(); len(errs) != 0 {
+		for _, err := range errs {
+			logger.Error(err.Error())
+		}
+		return -1
+	}
+
+	// Settings from the runtime configuration, such as per queue options, are used just as
+	// they would be by a running runner
+	if len(*runtimeConfigOpt) != 0 {
+		cfg, err := runner.LoadRuntimeConfig(*runtimeConfigOpt)
+		if err == nil {
+			err = applyRuntimeConfig(nil, cfg)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return -1
+		}
+	}
+
+	valid, err := validateRequest(ctx, *validateOpt, *validateQueueOpt, os.Stdout)
+	if err != nil {
+		logger.Error(err.Error())
+		return -1
+	}
+	if !valid {
+		return 1
+	}
+	return 0
+}
+
+// validateRequest runs the checks applied to a message received from a queue against the request,
+// or envelope, in the file and writes the report to the writer
+//
+func validateRequest(ctx context.Context, fn string, queue string, w io.Writer) (valid bool, err kv.Error) {
+	var (
+		data  []byte
+		errGo error
+	)
+	if fn == "-" {
+		data, errGo = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, errGo = ioutil.ReadFile(filepath.Clean(fn))
+	}
+	if errGo != nil {
+		return false, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	report := runner.NewValidationReport(fn)
+
+	if rqst := validateMsg(data, queue, report); rqst != nil {
+		validateExperiment(ctx, rqst, queue, report)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if errGo = enc.Encode(report); errGo != nil {
+		return false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return report.Valid, nil
+}
+
+// validateMsg applies the checks made by unpackMsg to the message and returns the request it
+// contains, if it could be extracted
+//
+func validateMsg(data []byte, queue string, report *runner.ValidationReport) (rqst *request.Request) {
+	if isEnvelope, _ := defense.IsEnvelope(data); !isEnvelope {
+		if !*acceptClearTextOpt {
+			report.Add("clear text", "", kv.NewError("unencrypted messages not enabled").With("stack", stack.Trace().TrimRuntime()))
+		}
+		rqst, warnings, err := request.DecodeRequest(data, strictRequests(queue))
+		report.Warnings = append(report.Warnings, warnings...)
+		if !report.Add("request", "", err) {
+			return nil
+		}
+		return rqst
+	}
+
+	report.Envelope = true
+
+	envelope, warnings, err := defense.DecodeEnvelope(data, strictRequests(queue))
+	report.Warnings = append(report.Warnings, warnings...)
+	if !report.Add("envelope", "", err) {
+		return nil
+	}
+
+	// The clear text resources are checked before the payload is decrypted
+	_, err = allocResource(&envelope.Message.Resource, "", false)
+	report.Add("envelope resources", resourceDetail(&envelope.Message.Resource), err)
+
+	sigs, err := defense.ReadRqstSigs(*sigsRqstDirOpt)
+	if err == nil {
+		fp := ""
+		if fp, err = sigs.VerifyEnvelope(queue, envelope); err == nil {
+			report.Add("signature", "fingerprint "+fp, nil)
+		}
+	}
+	if err != nil {
+		report.Add("signature", "", err.With("queue", queue))
+	}
+
+	w, err := getWrapper()
+	if err == nil && w == nil {
+		err = kv.NewError("encrypted msg support not enabled").With("stack", stack.Trace().TrimRuntime())
+	}
+	if err == nil && !w.HasKey(envelope.Message.KeyID) {
+		err = kv.NewError("decryption key not available").With("key_id", envelope.Message.KeyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	payload := []byte{}
+	if err == nil {
+		payload, err = w.Payload(envelope)
+	}
+	if !report.Add("decryption", "key id "+envelope.Message.KeyID, err) {
+		return nil
+	}
+
+	rqst, warnings, err = request.DecodeRequest(payload, strictRequests(queue))
+	report.Warnings = append(report.Warnings, warnings...)
+	if !report.Add("request", "", err) {
+		return nil
+	}
+	return rqst
+}
+
+// validateExperiment applies the checks made while the processor is created, and the experiment
+// run, to the request and renders the run script
+//
+func validateExperiment(ctx context.Context, rqst *request.Request, queue string, report *runner.ValidationReport) {
+	report.ExperimentID = rqst.Experiment.Key
+
+	alloc, err := allocResource(&rqst.Experiment.Resource, rqst.Experiment.Key, false)
+	report.Add("resources", resourceDetail(&rqst.Experiment.Resource), err)
+	if err != nil {
+		alloc = &pkgResources.Allocated{}
+	}
+
+	applyEnvSecrets(rqst)
+	runner.ValidateArtifacts(ctx, rqst, *validateProbeOpt, *validateTimeoutOpt, report)
+
+	// The processor fields used by the script templates are filled in as they would be for
+	// the first instance of the experiment on this runner
+	proc := &processor{
+		RootDir:     *tempOpt,
+		ExprSubDir:  getHash(rqst.Experiment.Key) + ".0",
+		Request:     rqst,
+		AccessionID: network.GetHostName() + "-" + base62.EncodeInt64(time.Now().Unix()),
+	}
+	proc.ExprDir = filepath.Join(proc.RootDir, "experiments", proc.ExprSubDir)
+
+	script, venvScript, err := runner.DryRunScript(ctx, rqst, queue, alloc, proc)
+	if report.Add("script", "python "+rqst.Experiment.PythonVer, err) {
+		report.Script = string(script)
+		report.VenvScript = string(venvScript)
+	}
+}
+
+func resourceDetail(rsc *server.Resource) (detail string) {
+	return fmt.Sprintf("cpus %d, ram %s, hdd %s, gpus %d, gpuMem %s", rsc.Cpus, rsc.Ram, rsc.Hdd, rsc.Gpus, rsc.GpuMem)
+}
@@ -0,0 +1,198 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the entry point for a command line tool that builds StudioML
+// requests, uploads their artifacts, encrypts and signs them, and then publishes
+// the requests to the queues that runners take work from
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+
+	"github.com/karlmutch/envflag"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// artifactsOpt collects the repeated artifact options, each is a group=directory pair
+type artifactsOpt map[string]string
+
+func (a artifactsOpt) String() string {
+	items := []string{}
+	for group, dir := range a {
+		items = append(items, group+"="+dir)
+	}
+	return strings.Join(items, ",")
+}
+
+func (a artifactsOpt) Set(value string) error {
+	items := strings.SplitN(value, "=", 2)
+	if len(items) != 2 || len(items[0]) == 0 || len(items[1]) == 0 {
+		return fmt.Errorf("%s is not a group=directory pair", value)
+	}
+	a[items[0]] = items[1]
+	return nil
+}
+
+var (
+	logger = log.NewLogger("submit")
+
+	specOpt  = flag.String("spec", "", "an optional JSON file containing a StudioML request that is used as the template for the experiment")
+	queueOpt = flag.String("queue", "", "the name of the queue the request is sent to, the local_, sqs_ or rmq_ prefix selects the type of queue")
+
+	queueRootOpt  = flag.String("queue-root", "", "local file path to the directory serving as a root for local file queues, used with local_ queues")
+	sqsProjectOpt = flag.String("sqs-project", "", "the URL prefix for sqs_ queues, for example https://sqs.us-west-2.amazonaws.com/123456789012, discovered using the credentials if not specified")
+	sqsCertsOpt   = flag.String("sqs-certs", "", "a comma separated list of AWS credentials and config files used to access SQS")
+	msgGroupOpt   = flag.String("msg-group", "", "the message group used for FIFO queues (default the experiment key)")
+
+	storageOpt          = flag.String("storage", "", "the s3 URL of the bucket and key prefix artifacts are uploaded to, for example s3://minio:9000/bucket/experiments")
+	storageAccessKeyOpt = flag.String("storage-access-key", "", "the access key for the artifact storage (default the AWS_ACCESS_KEY_ID environment variable)")
+	storageSecretKeyOpt = flag.String("storage-secret-key", "", "the secret key for the artifact storage (default the AWS_SECRET_ACCESS_KEY environment variable)")
+	storageRegionOpt    = flag.String("storage-region", "", "the region of the artifact storage (default the AWS_DEFAULT_REGION environment variable)")
+
+	encryptKeyOpt  = flag.String("encrypt-key", "", "the PEM file containing the RSA public key of the runners used to encrypt the request")
+	signingKeyOpt  = flag.String("signing-key", "", "the OpenSSH private key file containing the ed25519 key used to sign the request")
+	signingPassOpt = flag.String("signing-passphrase", "", "the passphrase for the signing-key file, if it is protected")
+
+	checkpointOpt = flag.Duration("checkpoint-interval", time.Duration(30*time.Second), "the interval at which the runner uploads the output of the experiment while it runs")
+
+	waitOpt        = flag.Bool("wait", false, "wait for the experiment to complete while streaming its output")
+	waitTimeoutOpt = flag.Duration("wait-timeout", time.Duration(24*time.Hour), "the maximum period of time to wait for the experiment to complete")
+	pollOpt        = flag.Duration("poll-interval", time.Duration(15*time.Second), "the interval between checks for output and results when waiting")
+
+	artifacts = artifactsOpt{}
+)
+
+func init() {
+	flag.Var(artifacts, "artifact", "a group=directory pair naming a local directory uploaded as an experiment artifact, for example workspace=./src, can be repeated")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[arguments]      studioml request submission")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Arguments:")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Environment Variables:")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "options can be read for environment variables by changing dashes '-' to underscores")
+	fmt.Fprintln(os.Stderr, "and using upper case letters.")
+}
+
+func validateOpts() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if len(*queueOpt) == 0 {
+		errs = append(errs, kv.NewError("the queue option must be set").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*encryptKeyOpt) == 0 {
+		errs = append(errs, kv.NewError("the encrypt-key option must be set").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*signingKeyOpt) == 0 {
+		errs = append(errs, kv.NewError("the signing-key option must be set").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(*storageOpt) == 0 && (len(artifacts) != 0 || *waitOpt) {
+		errs = append(errs, kv.NewError("the storage option must be set when artifacts are uploaded, or wait is used").With("stack", stack.Trace().TrimRuntime()))
+	}
+	return errs
+}
+
+func main() {
+	// Allow the enclave for secrets to wipe things
+	defer defense.StopSecret()
+
+	flag.Usage = usage
+
+	// Use the go options parser to load command line options that have been set, and look
+	// for these options inside the env variable table
+	//
+	envflag.Parse()
+
+	if errs := validateOpts(); len(errs) != 0 {
+		for _, err := range errs {
+			logger.Error(err.Error())
+		}
+		os.Exit(-1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopC := make(chan os.Signal, 1)
+	signal.Notify(stopC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-stopC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := submit(ctx); err != nil {
+		logger.Error(err.Error())
+		os.Exit(-1)
+	}
+}
+
+// submit builds and publishes the request, and optionally waits for its results
+//
+func submit(ctx context.Context) (err kv.Error) {
+	r, err := loadSpec(*specOpt)
+	if err != nil {
+		return err
+	}
+
+	store, err := newArtifactStore(*storageOpt, r.Experiment.Key)
+	if err != nil {
+		return err
+	}
+	if err = store.upload(ctx, r, artifacts); err != nil {
+		return err
+	}
+
+	msg, err := envelope(r, *encryptKeyOpt, *signingKeyOpt, *signingPassOpt)
+	if err != nil {
+		return err
+	}
+
+	group := *msgGroupOpt
+	if len(group) == 0 {
+		group = r.Experiment.Key
+	}
+	if err = publish(ctx, *queueOpt, msg, group); err != nil {
+		return err
+	}
+
+	fmt.Println(r.Experiment.Key)
+
+	if !*waitOpt {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, *waitTimeoutOpt)
+	defer cancel()
+
+	exitMsg, err := store.wait(waitCtx, r, *pollOpt, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if exitMsg != "ok" {
+		return kv.NewError("experiment failed").With("experiment_id", r.Experiment.Key, "exit_msg", exitMsg)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the functions used to publish requests to the queues that
+// runners take work from
+
+import (
+	"context"
+	"strings"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	aws_ext "github.com/leaf-ai/studio-go-runner/pkg/aws"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// publish sends the message to the queue, the type of the queue is selected using the
+// same queue name prefixes that runners use
+//
+func publish(ctx context.Context, queue string, msg []byte, group string) (err kv.Error) {
+	switch {
+	case strings.HasPrefix(queue, "local_"):
+		if len(*queueRootOpt) == 0 {
+			return kv.NewError("the queue-root option must be set for local_ queues").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+		}
+		return runner.NewLocalQueue(*queueRootOpt, nil, logger).Publish(queue, "application/json", msg, true)
+
+	case strings.HasPrefix(queue, "sqs_"):
+		return publishSQS(ctx, queue, msg, group)
+
+	case strings.HasPrefix(queue, "rmq_"):
+		return kv.NewError("amqp queues are not supported").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+
+	default:
+		return kv.NewError("queue name must have a local_, sqs_ or rmq_ prefix").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+func publishSQS(ctx context.Context, queue string, msg []byte, group string) (err kv.Error) {
+	if len(*sqsCertsOpt) == 0 {
+		return kv.NewError("the sqs-certs option must be set for sqs_ queues").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	project := *sqsProjectOpt
+	if len(project) == 0 {
+		urls, err := aws_ext.GetSQSProjects(strings.Split(*sqsCertsOpt, ","))
+		if err != nil {
+			return err
+		}
+		if len(urls) != 1 {
+			return kv.NewError("the sqs-project option must be set when the credentials do not select a single project").With("projects", urls).With("stack", stack.Trace().TrimRuntime())
+		}
+		for url := range urls {
+			project = url
+		}
+	}
+
+	sq, err := aws_ext.NewSQS(project, *sqsCertsOpt, nil, logger)
+	if err != nil {
+		return err
+	}
+	return sq.Publish(ctx, queue, msg, group)
+}
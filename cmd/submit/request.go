@@ -0,0 +1,231 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the functions used to build a StudioML request, upload the
+// artifacts it uses, and wrap it inside an encrypted and signed envelope
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+	"github.com/rs/xid"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// resultsGroup is the artifact the runner writes the final status of the experiment to
+	resultsGroup = "_results"
+	// outputGroup is the artifact the runner writes the console output of the experiment to
+	outputGroup = "output"
+)
+
+// loadSpec reads the experiment template, when one is supplied, and fills in the
+// fields that identify this submission
+//
+func loadSpec(fn string) (r *request.Request, err kv.Error) {
+	r = &request.Request{}
+	if len(fn) != 0 {
+		data, errGo := ioutil.ReadFile(filepath.Clean(fn))
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("spec", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		warnings := []string{}
+		if r, warnings, err = request.DecodeRequest(data, false); err != nil {
+			return nil, err.With("spec", fn)
+		}
+		for _, warning := range warnings {
+			logger.Warn(warning, "spec", fn)
+		}
+	}
+
+	r.SchemaVersion = request.SchemaVersion
+
+	if len(r.Experiment.Key) == 0 {
+		r.Experiment.Key = "submit-" + xid.New().String()
+	}
+	if len(r.Experiment.Status) == 0 {
+		r.Experiment.Status = "waiting"
+	}
+	if r.Experiment.Artifacts == nil {
+		r.Experiment.Artifacts = map[string]request.Artifact{}
+	}
+	r.Experiment.TimeAdded = float64(time.Now().UnixNano()) / float64(time.Second)
+	return r, nil
+}
+
+// artifactStore is the S3 location under which the artifacts for an experiment are kept
+//
+type artifactStore struct {
+	host   string
+	bucket string
+	prefix string
+	creds  *request.AWSCredential
+}
+
+// newArtifactStore parses the storage URL and prepares the credentials used for
+// the artifacts of the experiment, an empty URL results in no store
+//
+func newArtifactStore(storage string, experimentKey string) (store *artifactStore, err kv.Error) {
+	if len(storage) == 0 {
+		return nil, nil
+	}
+	uri, errGo := url.Parse(storage)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("storage", storage).With("stack", stack.Trace().TrimRuntime())
+	}
+	items := strings.SplitN(strings.Trim(uri.Path, "/"), "/", 2)
+	if uri.Scheme != "s3" || len(uri.Host) == 0 || len(items[0]) == 0 {
+		return nil, kv.NewError("storage must be an s3://host/bucket URL").With("storage", storage).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	store = &artifactStore{
+		host:   uri.Host,
+		bucket: items[0],
+		prefix: experimentKey,
+		creds: &request.AWSCredential{
+			AccessKey: *storageAccessKeyOpt,
+			SecretKey: *storageSecretKeyOpt,
+			Region:    *storageRegionOpt,
+		},
+	}
+	if len(items) > 1 && len(items[1]) != 0 {
+		store.prefix = items[1] + "/" + experimentKey
+	}
+	if len(store.creds.AccessKey) == 0 {
+		store.creds.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(store.creds.SecretKey) == 0 {
+		store.creds.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(store.creds.Region) == 0 {
+		store.creds.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return store, nil
+}
+
+// artifact returns the description of an artifact group stored by the experiment
+//
+func (store *artifactStore) artifact(group string, mutable bool) (art request.Artifact) {
+	key := store.prefix + "/" + group + ".tar"
+	return request.Artifact{
+		Bucket:    store.bucket,
+		Key:       key,
+		Mutable:   mutable,
+		Unpack:    true,
+		Qualified: "s3://" + store.host + "/" + store.bucket + "/" + key,
+		Credentials: request.Credentials{
+			AWS: store.creds,
+		},
+	}
+}
+
+// upload archives and uploads the local directories named by the artifacts and adds
+// them, along with the artifacts the runner returns results in, to the request
+//
+func (store *artifactStore) upload(ctx context.Context, r *request.Request, artifacts map[string]string) (err kv.Error) {
+	if store != nil {
+		for group, dir := range artifacts {
+			art := store.artifact(group, false)
+
+			storage, err := runner.NewStorage(ctx, &runner.StoreOpts{
+				Art:      &art,
+				Validate: true,
+			})
+			if err != nil {
+				return err.With("group", group)
+			}
+			warns, err := storage.Deposit(ctx, dir, art.Key)
+			storage.Close()
+			for _, warn := range warns {
+				logger.Warn(warn.Error())
+			}
+			if err != nil {
+				return err.With("group", group, "dir", dir)
+			}
+			r.Experiment.Artifacts[group] = art
+		}
+
+		for _, group := range []string{outputGroup, "_metadata", resultsGroup} {
+			if _, isPresent := r.Experiment.Artifacts[group]; isPresent {
+				continue
+			}
+			art := store.artifact(group, true)
+			if group == outputGroup {
+				art.SaveFreq = int(checkpointOpt.Seconds())
+			}
+			r.Experiment.Artifacts[group] = art
+		}
+	}
+
+	// The runner selects how the experiment is run using the workspace
+	if _, isPresent := r.Experiment.Artifacts["workspace"]; !isPresent {
+		return kv.NewError("workspace artifact missing").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// loadSigner reads an OpenSSH private key file for signing requests
+//
+func loadSigner(fn string, passphrase string) (signer ssh.Signer, err kv.Error) {
+	data, errGo := ioutil.ReadFile(filepath.Clean(fn))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(passphrase) != 0 {
+		signer, errGo = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, errGo = ssh.ParsePrivateKey(data)
+	}
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		return nil, kv.NewError("not ssh-ed25519").With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return signer, nil
+}
+
+// envelope encrypts the request using the public key of the runners, signs the
+// encrypted payload and returns the JSON encoded envelope
+//
+func envelope(r *request.Request, encryptKeyFn string, signingKeyFn string, passphrase string) (msg []byte, err kv.Error) {
+	publicPEM, errGo := ioutil.ReadFile(filepath.Clean(encryptKeyFn))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", encryptKeyFn).With("stack", stack.Trace().TrimRuntime())
+	}
+	w, err := defense.NewPublicWrapper(publicPEM)
+	if err != nil {
+		return nil, err.With("file", encryptKeyFn)
+	}
+
+	signer, err := loadSigner(signingKeyFn, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := w.Envelope(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.Sign(signer); err != nil {
+		return nil, err
+	}
+
+	if msg, errGo = e.Marshal(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return msg, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// Unit tests for building, encrypting, signing and publishing requests
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+type testKeys struct {
+	encryptFn string
+	signingFn string
+	rsaKey    *rsa.PrivateKey
+	edKey     ed25519.PublicKey
+}
+
+func writeKeys(t *testing.T) (keys *testKeys) {
+	dir := t.TempDir()
+	keys = &testKeys{
+		encryptFn: filepath.Join(dir, "public.pem"),
+		signingFn: filepath.Join(dir, "signing"),
+	}
+
+	rsaKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	keys.rsaKey = rsaKey
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)})
+	if errGo = os.WriteFile(keys.encryptFn, publicPEM, 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	edPublic, edKey, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	keys.edKey = edPublic
+	der, errGo := x509.MarshalPKCS8PrivateKey(edKey)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if errGo = os.WriteFile(keys.signingFn, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	return keys
+}
+
+// TestSubmitLocal builds a request from a spec, publishes it to a local queue and
+// checks that the queued envelope is signed and can be decrypted by the runner
+//
+func TestSubmitLocal(t *testing.T) {
+	keys := writeKeys(t)
+
+	specFn := filepath.Join(t.TempDir(), "spec.json")
+	spec := `{"experiment": {"key": "submit-test", "filename": "main.py", "resources_needed": {"cpus": 1},
+		"artifacts": {"workspace": {"qualified": "s3://minio:9000/bucket/workspace.tar", "unpack": true}}}}`
+	if errGo := os.WriteFile(specFn, []byte(spec), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	r, err := loadSpec(specFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Experiment.Key != "submit-test" || r.Experiment.Status != "waiting" || r.Experiment.TimeAdded == 0 {
+		t.Fatal(kv.NewError("spec not loaded").With("experiment", r.Experiment).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Without storage only the artifacts within the spec are used
+	store, err := newArtifactStore("", r.Experiment.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.upload(context.Background(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := envelope(r, keys.encryptFn, keys.signingFn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*queueRootOpt = t.TempDir()
+	queue := "local_submit"
+	if err = publish(context.Background(), queue, msg, r.Experiment.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, errGo := os.ReadDir(filepath.Join(*queueRootOpt, queue))
+	if errGo != nil || len(entries) != 1 {
+		t.Fatal(kv.NewError("request not queued").With("error", errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	queued, errGo := os.ReadFile(filepath.Join(*queueRootOpt, queue, entries[0].Name()))
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	e, err := defense.UnmarshalEnvelope(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Message.Resource.Cpus != 1 {
+		t.Fatal(kv.NewError("clear text resources missing").With("resource", e.Message.Resource).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Check the signature using the public signing key
+	sigBin, errGo := base64.StdEncoding.DecodeString(e.Message.Signature)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	sig, err := defense.ParseSSHSignature(sigBin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(keys.edKey, []byte(e.Message.Payload), sig.Blob) {
+		t.Fatal(kv.NewError("signature not verified").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Decrypt the payload as the runner would
+	if e.Message.KeyID != defense.KeyFingerprint(&keys.rsaKey.PublicKey) {
+		t.Fatal(kv.NewError("key id mismatch").With("key_id", e.Message.KeyID).With("stack", stack.Trace().TrimRuntime()))
+	}
+	decrypted, err := defense.Unseal(e.Message.Payload, keys.rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := request.UnmarshalRequest(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Experiment.Key != r.Experiment.Key || received.Experiment.Filename != "main.py" {
+		t.Fatal(kv.NewError("request mismatch").With("experiment", received.Experiment).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, isPresent := received.Experiment.Artifacts["workspace"]; !isPresent {
+		t.Fatal(kv.NewError("workspace artifact missing").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSubmitArtifacts checks the artifacts that are added for a storage location
+//
+func TestSubmitArtifacts(t *testing.T) {
+	*storageAccessKeyOpt = "access"
+	*storageSecretKeyOpt = "secret"
+	defer func() {
+		*storageAccessKeyOpt = ""
+		*storageSecretKeyOpt = ""
+	}()
+
+	for _, bad := range []string{"http://minio:9000/bucket", "s3:///bucket", "s3://minio:9000/"} {
+		if _, err := newArtifactStore(bad, "key"); err == nil {
+			t.Fatal(kv.NewError("invalid storage accepted").With("storage", bad).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	store, err := newArtifactStore("s3://minio:9000/bucket/experiments", "submit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &request.Request{
+		Experiment: request.Experiment{
+			Key:       "submit-test",
+			Artifacts: map[string]request.Artifact{},
+		},
+	}
+
+	// A workspace is needed by the runner
+	if err = store.upload(context.Background(), r, nil); err == nil {
+		t.Fatal(kv.NewError("missing workspace accepted").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	expected := map[string]bool{outputGroup: true, "_metadata": true, resultsGroup: true}
+	for group, art := range r.Experiment.Artifacts {
+		if !expected[group] {
+			t.Fatal(kv.NewError("unexpected artifact").With("group", group).With("stack", stack.Trace().TrimRuntime()))
+		}
+		key := "experiments/submit-test/" + group + ".tar"
+		if art.Key != key || art.Bucket != "bucket" || art.Qualified != "s3://minio:9000/bucket/"+key || !art.Mutable {
+			t.Fatal(kv.NewError("artifact mismatch").With("group", group, "artifact", art).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if art.Credentials.AWS == nil || art.Credentials.AWS.AccessKey != "access" || art.Credentials.AWS.SecretKey != "secret" {
+			t.Fatal(kv.NewError("artifact credentials missing").With("group", group).With("stack", stack.Trace().TrimRuntime()))
+		}
+		delete(expected, group)
+	}
+	if len(expected) != 0 {
+		t.Fatal(kv.NewError("artifacts missing").With("missing", expected).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if r.Experiment.Artifacts[outputGroup].SaveFreq == 0 {
+		t.Fatal(kv.NewError("output checkpoints not requested").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Queues without a supported type are rejected
+	for _, queue := range []string{"rmq_submit", "submit"} {
+		if err = publish(context.Background(), queue, []byte("{}"), ""); err == nil {
+			t.Fatal(kv.NewError("unsupported queue accepted").With("queue", queue).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the functions used to follow an experiment by polling the
+// artifacts the runner uploads while the experiment runs and once it completes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// fetchLimit is the largest artifact that will be downloaded while waiting
+	fetchLimit = int64(256 * 1024 * 1024)
+)
+
+// results is the document written by the runner to the _results artifact
+type results struct {
+	ExitMsg      string `json:"exit_msg"`
+	ExperimentID string `json:"experiment_id"`
+	Host         string `json:"host"`
+}
+
+// fetch downloads and unpacks an artifact into a new directory, the directory is
+// returned only if the artifact could be retrieved
+//
+func fetch(ctx context.Context, art request.Artifact) (dir string, err kv.Error) {
+	storage, err := runner.NewStorage(ctx, &runner.StoreOpts{
+		Art: &art,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer storage.Close()
+
+	dir, errGo := ioutil.TempDir("", "submit")
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, _, err = storage.Fetch(ctx, art.Key, true, dir, fetchLimit, nil); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// streamOutput writes any output of the experiment beyond the offset already
+// written to the writer and returns the new offset
+//
+func streamOutput(ctx context.Context, art request.Artifact, offset int64, w io.Writer) (next int64) {
+	dir, err := fetch(ctx, art)
+	if err != nil {
+		return offset
+	}
+	defer os.RemoveAll(dir)
+
+	f, errGo := os.Open(filepath.Join(dir, outputGroup))
+	if errGo != nil {
+		return offset
+	}
+	defer f.Close()
+
+	if _, errGo = f.Seek(offset, io.SeekStart); errGo != nil {
+		return offset
+	}
+	written, _ := io.Copy(w, f)
+	return offset + written
+}
+
+// wait polls the output and results artifacts of the experiment until the results
+// appear, streaming the output to the writer as it is uploaded by the runner.  The
+// exit message recorded by the runner is returned.
+//
+func (store *artifactStore) wait(ctx context.Context, r *request.Request, interval time.Duration, w io.Writer) (exitMsg string, err kv.Error) {
+	resultsArt, isPresent := r.Experiment.Artifacts[resultsGroup]
+	if !isPresent {
+		return "", kv.NewError("results artifact missing").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	outputArt, hasOutput := r.Experiment.Artifacts[outputGroup]
+
+	offset := int64(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", kv.NewError("wait cancelled").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		case <-time.After(interval):
+		}
+
+		if hasOutput {
+			offset = streamOutput(ctx, outputArt, offset, w)
+		}
+
+		dir, err := fetch(ctx, resultsArt)
+		if err != nil {
+			continue
+		}
+		data, errGo := ioutil.ReadFile(filepath.Join(dir, resultsGroup+".json"))
+		os.RemoveAll(dir)
+		if errGo != nil {
+			return "", kv.Wrap(errGo).With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// The final output is uploaded before the results
+		if hasOutput {
+			streamOutput(ctx, outputArt, offset, w)
+		}
+
+		result := &results{}
+		if errGo = json.Unmarshal(data, result); errGo != nil {
+			return "", kv.Wrap(errGo).With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+		return result.ExitMsg, nil
+	}
+}
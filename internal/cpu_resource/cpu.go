@@ -72,14 +72,16 @@ func CPUFree() (cores uint, mem uint64) {
 		cpuTrack.SoftMaxMem - cpuTrack.AllocMem
 }
 
-// SetCPULimits is used to set the soft limits for the CPU that is premitted to be allocated to
-// callers
+// CheckCPULimits tests whether soft limits for the CPU could be set without setting them
 //
-func SetCPULimits(maxCores uint, maxMem uint64) (err kv.Error) {
-
+func CheckCPULimits(maxCores uint, maxMem uint64) (err kv.Error) {
 	cpuTrack.Lock()
 	defer cpuTrack.Unlock()
 
+	return checkCPULimits(maxCores, maxMem)
+}
+
+func checkCPULimits(maxCores uint, maxMem uint64) (err kv.Error) {
 	if cpuTrack.InitErr != nil {
 		return cpuTrack.InitErr
 	}
@@ -92,6 +94,20 @@ func SetCPULimits(maxCores uint, maxMem uint64) (err kv.Error) {
 		msg := fmt.Sprintf("new soft memory limit %d, violated hard limit %d", maxMem, cpuTrack.HardMaxMem)
 		return kv.NewError(msg).With("stack", stack.Trace().TrimRuntime())
 	}
+	return nil
+}
+
+// SetCPULimits is used to set the soft limits for the CPU that is premitted to be allocated to
+// callers
+//
+func SetCPULimits(maxCores uint, maxMem uint64) (err kv.Error) {
+
+	cpuTrack.Lock()
+	defer cpuTrack.Unlock()
+
+	if err = checkCPULimits(maxCores, maxMem); err != nil {
+		return err
+	}
 
 	if maxCores == 0 {
 		cpuTrack.SoftMaxCores = cpuTrack.HardMaxCores
@@ -41,9 +41,14 @@ func EncryptBlock(data []byte) (key [32]byte, enc []byte, err kv.Error) {
 		return key, nil, kv.Wrap(errGo, "nonce could not be generated").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	encrypted := secretbox.Seal(nonce[:], data, &nonce, &key)
+	return key, sealBlock(&key, &nonce, data), nil
+}
 
-	return key, encrypted, nil
+// sealBlock encrypts the data using the supplied key and nonce, returning the encrypted
+// data with the nonce prepended to it in the form expected by DecryptBlock
+//
+func sealBlock(key *[32]byte, nonce *[24]byte, data []byte) (enc []byte) {
+	return secretbox.Seal(nonce[:], data, nonce, key)
 }
 
 func DecryptBlock(key [32]byte, in []byte) (clear []byte, err kv.Error) {
@@ -107,7 +107,7 @@ func TestCryptoPython(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	decrypted, err := w.unwrapRaw(encrypted)
+	decrypted, err := w.unwrapRaw(encrypted, "")
 	if err != nil {
 		for _, aLine := range output {
 			fmt.Println(aLine)
@@ -81,6 +81,41 @@ func NewDynamicStore(ctx context.Context, configuredDir string, extractFN DSExtr
 	return store, nil
 }
 
+// ReadDynamicStore is used to load a store from the files within a directory once, the directory
+// is not watched for changes.  This is intended for tools that examine individual messages.
+//
+func ReadDynamicStore(configuredDir string, extractFN DSExtract) (store *DynamicStore, err kv.Error) {
+	dir, errGo := filepath.Abs(configuredDir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", configuredDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	entries, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	store = &DynamicStore{
+		contents: map[string]interface{}{},
+		dir:      dir,
+		extract:  extractFN,
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name()[0] == '.' {
+			continue
+		}
+		if err = store.update(filepath.Join(dir, entry.Name())); err != nil {
+			// info is a special file that is used to prevent the secret from not
+			// being created by Kubernetes when there are no secrets to be mounted
+			if entry.Name() != "info" {
+				return nil, err
+			}
+		}
+	}
+	return store, nil
+}
+
 // Init is used to initialize a directory watcher backed store
 func (s *DynamicStore) Init(ctx context.Context, configuredDir string, refresh time.Duration, errorC chan<- kv.Error) (err kv.Error) {
 
@@ -332,3 +367,17 @@ func (s *DynamicStore) selection(q string) (item interface{}, err kv.Error) {
 	item = s.contents[bestMatch]
 	return item, nil
 }
+
+// items returns a copy of the collection of items keyed by the name of the
+// file they were loaded from
+//
+func (s *DynamicStore) items() (items map[string]interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	items = make(map[string]interface{}, len(s.contents))
+	for k, v := range s.contents {
+		items[k] = v
+	}
+	return items
+}
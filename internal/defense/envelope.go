@@ -3,11 +3,17 @@
 package defense
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 
 	"github.com/andreidenissov-cog/go-service/pkg/server"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // This file contains the implementation of an envelop message that will be used to
@@ -16,7 +22,12 @@ import (
 
 type OpenExperiment struct {
 	Status    string `json:"status"`
-	PythonVer string `json:"pthonver"`
+	PythonVer string `json:"pythonver"`
+
+	// LegacyPythonVer holds the python version from envelopes written by clients that used
+	// the misspelt pthonver name, it is copied to PythonVer when envelopes are decoded and
+	// is written alongside pythonver by Marshal for runners that only read pthonver
+	LegacyPythonVer string `json:"pthonver,omitempty"`
 }
 
 // Message contains any clear text fields and either an an encrypted payload or clear text
@@ -27,6 +38,7 @@ type Message struct {
 	ExperimentLifetime string          `json:"experiment_lifetime"`
 	Resource           server.Resource `json:"resources_needed"`
 	Payload            string          `json:"payload"`
+	KeyID              string          `json:"key_id,omitempty"`
 	Fingerprint        string          `json:"fingerprint"`
 	Signature          string          `json:"signature"`
 }
@@ -34,7 +46,8 @@ type Message struct {
 // Request marshals the requests made by studioML under which all of the other
 // meta data can be found
 type Envelope struct {
-	Message Message `json:"message"`
+	SchemaVersion string  `json:"schema_version,omitempty"`
+	Message       Message `json:"message"`
 }
 
 // IsEnvelop is used to test if a JSON payload is indeed present
@@ -66,12 +79,48 @@ func UnmarshalEnvelope(data []byte) (e *Envelope, err kv.Error) {
 	if errGo := json.Unmarshal(data, e); errGo != nil {
 		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
+	if len(e.Message.Experiment.PythonVer) == 0 {
+		e.Message.Experiment.PythonVer = e.Message.Experiment.LegacyPythonVer
+	}
 	return e, nil
 }
 
+// DecodeEnvelope takes an encoded StudioML envelope and extracts it in the same way
+// as UnmarshalEnvelope.  Fields that are not part of the schema, and so would be ignored,
+// are returned as warnings or, when strict is set, cause the envelope to be rejected.
+//
+func DecodeEnvelope(data []byte, strict bool) (e *Envelope, warnings []string, err kv.Error) {
+	if e, err = UnmarshalEnvelope(data); err != nil {
+		return nil, nil, err
+	}
+	if warnings, err = request.SchemaWarnings(data, e, e.SchemaVersion, strict); err != nil {
+		return nil, warnings, err
+	}
+	return e, warnings, nil
+}
+
 // Marshal takes the go data structure used to define a StudioML experiment envelope
-// and serializes it as json to the byte array
+// and serializes it as json to the byte array.  Runners that predate the pythonver
+// field read the python version from the misspelt pthonver field, so both are written
+// until those runners have been retired.
 //
 func (e *Envelope) Marshal() ([]byte, error) {
-	return json.Marshal(e)
+	out := *e
+	if len(out.Message.Experiment.LegacyPythonVer) == 0 {
+		out.Message.Experiment.LegacyPythonVer = out.Message.Experiment.PythonVer
+	}
+	return json.Marshal(&out)
+}
+
+// Sign adds a signature of the payload, along with the fingerprint of the key used,
+// to the envelope.  The signature is that verified by PubkeyStore.VerifyEnvelope.
+//
+func (e *Envelope) Sign(signer ssh.Signer) (err kv.Error) {
+	sig, errGo := signer.Sign(rand.Reader, []byte(e.Message.Payload))
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	e.Message.Fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	e.Message.Signature = base64.StdEncoding.EncodeToString(ssh.Marshal(sig))
+	return nil
 }
@@ -0,0 +1,243 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+// This file contains the implementation of a ring of message decryption keys that
+// can be rotated while the runner is running.  Passphrase protected RSA private key
+// PEM files placed within the encryption directory are loaded into the ring, the
+// public key being derived from the private key.  The key within the file with the
+// lexically greatest name is the current key.  Keys are retired by placing a file
+// alongside the key file, named using the key file name with a .retired suffix, that
+// contains the RFC3339 time of the retirement.  Retired keys continue to be accepted
+// for the configured overlap period so that messages already queued can still be
+// processed.  Keys whose files are removed are also retired, however as the key is
+// no longer on disk it will be forgotten if the runner restarts.
+
+import (
+	"context"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+type ringKey struct {
+	id         string
+	privateKey *rsa.PrivateKey
+}
+
+type retiredKey struct {
+	key   *ringKey
+	since time.Time
+}
+
+// retiredMarker is loaded from the files that record when the key within the file of
+// the same name, less the retiredSuffix, was retired
+type retiredMarker struct {
+	since time.Time
+}
+
+const retiredSuffix = ".retired"
+
+type keyRing struct {
+	store   *DynamicStore
+	overlap time.Duration
+	active  map[string]*ringKey
+	latest  *ringKey
+	retired map[string]*retiredKey
+	revoked map[string]time.Time // Keys retired for longer than the overlap, and the time they were retired
+	sync.Mutex
+}
+
+// extractRingKey returns a function to load private key files, and retirement markers, from
+// the backing store, the passphrase is read on every load to allow it to be changed alongside
+// the keys
+//
+func extractRingKey(passphraseFN string) (extract DSExtract) {
+	return func(data []byte) (item interface{}, err kv.Error) {
+		if since, errGo := time.Parse(time.RFC3339, strings.TrimSpace(string(data))); errGo == nil {
+			return retiredMarker{since: since}, nil
+		}
+		passphrase, errGo := os.ReadFile(passphraseFN)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("filename", passphraseFN).With("stack", stack.Trace().TrimRuntime())
+		}
+		privateKey, err := decodePrivatePEM(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &ringKey{
+			id:         KeyFingerprint(&privateKey.PublicKey),
+			privateKey: privateKey,
+		}, nil
+	}
+}
+
+func newKeyRing(overlap time.Duration) (ring *keyRing) {
+	return &keyRing{
+		overlap: overlap,
+		active:  map[string]*ringKey{},
+		retired: map[string]*retiredKey{},
+		revoked: map[string]time.Time{},
+	}
+}
+
+// update reconciles the keys within the ring against those most recently loaded
+// from the backing store retiring keys that have been marked as retired, or that
+// have disappeared
+//
+func (ring *keyRing) update(items map[string]interface{}, now time.Time) {
+	names := make([]string, 0, len(items))
+	markers := map[string]time.Time{}
+	for name, item := range items {
+		names = append(names, name)
+		if marker, isOK := item.(retiredMarker); isOK {
+			markers[strings.TrimSuffix(name, retiredSuffix)] = marker.since
+		}
+	}
+	sort.Strings(names)
+
+	active := make(map[string]*ringKey, len(names))
+	marked := map[string]*retiredKey{}
+	var latest *ringKey
+	for _, name := range names {
+		key, isOK := items[name].(*ringKey)
+		if !isOK {
+			continue
+		}
+		if since, isRetired := markers[name]; isRetired {
+			marked[key.id] = &retiredKey{key: key, since: since}
+			continue
+		}
+		active[key.id] = key
+		latest = key
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	for id, key := range ring.active {
+		_, isActive := active[id]
+		_, isMarked := marked[id]
+		if !isActive && !isMarked {
+			ring.retired[id] = &retiredKey{key: key, since: now}
+		}
+	}
+	for id, retired := range marked {
+		ring.retired[id] = retired
+	}
+	for id, retired := range ring.retired {
+		if _, isPresent := active[id]; isPresent {
+			delete(ring.retired, id)
+			continue
+		}
+		if now.Sub(retired.since) > ring.overlap {
+			delete(ring.retired, id)
+			ring.revoked[id] = retired.since
+		}
+	}
+	for id := range active {
+		delete(ring.revoked, id)
+	}
+	ring.active = active
+	ring.latest = latest
+}
+
+func (ring *keyRing) sync() {
+	if ring.store == nil {
+		return
+	}
+	ring.update(ring.store.items(), time.Now())
+}
+
+// current returns the key that should be used for encrypting new payloads
+//
+func (ring *keyRing) current() (key *ringKey) {
+	ring.sync()
+
+	ring.Lock()
+	defer ring.Unlock()
+	return ring.latest
+}
+
+// isRevoked returns true when the key has been retired for longer than the overlap period
+//
+func (ring *keyRing) isRevoked(keyID string) (revoked bool) {
+	ring.sync()
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	_, revoked = ring.revoked[keyID]
+	return revoked
+}
+
+// privateKeys returns the private keys that might be used to decrypt a payload, when the key
+// identifier is empty all active keys followed by any keys still within their overlap period are
+// returned
+//
+func (ring *keyRing) privateKeys(keyID string) (privateKeys []*rsa.PrivateKey) {
+	ring.sync()
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	privateKeys = []*rsa.PrivateKey{}
+
+	if len(keyID) != 0 {
+		if key, isPresent := ring.active[keyID]; isPresent {
+			privateKeys = append(privateKeys, key.privateKey)
+		} else if retired, isPresent := ring.retired[keyID]; isPresent {
+			privateKeys = append(privateKeys, retired.key.privateKey)
+		}
+		return privateKeys
+	}
+
+	if ring.latest != nil {
+		privateKeys = append(privateKeys, ring.latest.privateKey)
+	}
+	for _, key := range ring.active {
+		if key != ring.latest {
+			privateKeys = append(privateKeys, key.privateKey)
+		}
+	}
+	for _, retired := range ring.retired {
+		privateKeys = append(privateKeys, retired.key.privateKey)
+	}
+	return privateKeys
+}
+
+// KubernetesKeyringWrapper is used to obtain a wrapper that has the Kubernetes stored encryption
+// parameters for the server along with a ring of keys that are loaded from files placed into the
+// mount directory.  Keys are added by placing passphrase protected private key PEM files into the
+// directory, and retired by removing them.  Retired keys will continue to be accepted for the overlap
+// duration.
+//
+func KubernetesKeyringWrapper(ctx context.Context, mountDir string, overlap time.Duration, errorC chan<- kv.Error) (w *Wrapper, err kv.Error) {
+
+	if _, errGo := os.Stat(mountDir); errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", mountDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The statically mounted keypair is optional when a ring is being used, however if
+	// it is present it must be valid
+	w = &Wrapper{}
+	if _, errGo := os.Stat(filepath.Join(mountDir, "encryption")); errGo == nil {
+		if w, err = KubernetesWrapper(mountDir); err != nil {
+			return nil, err
+		}
+	}
+
+	w.ring = newKeyRing(overlap)
+	w.ring.store, err = NewDynamicStore(ctx, mountDir, extractRingKey(filepath.Join(mountDir, "passphrase", "ssh-passphrase")), time.Duration(10*time.Second), errorC)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	random "github.com/leaf-ai/studio-go-runner/pkg/rand"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+// TestKeyRingRotation exercises the selection of keys within a ring as keys are added
+// and retired
+func TestKeyRingRotation(t *testing.T) {
+	passphrase := random.RandomString(64)
+	passphraseFN := filepath.Join(t.TempDir(), "ssh-passphrase")
+	if errGo := os.WriteFile(passphraseFN, []byte(passphrase), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	extract := extractRingKey(passphraseFN)
+
+	keys := []*ringKey{}
+	for i := 0; i != 2; i++ {
+		privatePEM, _, err := GenerateKeyPair(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, err := extract(privatePEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, item.(*ringKey))
+	}
+	if keys[0].id == keys[1].id {
+		t.Fatal(kv.NewError("key identifiers not unique").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	overlap := time.Hour
+	w := &Wrapper{ring: newKeyRing(overlap)}
+	start := time.Now()
+
+	r := &request.Request{Experiment: request.Experiment{Key: random.RandomString(16)}}
+
+	w.ring.update(map[string]interface{}{"key-1": keys[0]}, start)
+	old, err := w.Envelope(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Message.KeyID != keys[0].id {
+		t.Fatal(kv.NewError("unexpected key used").With("key_id", old.Message.KeyID).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Rotate to the second key, retiring the first
+	w.ring.update(map[string]interface{}{"key-2": keys[1]}, start)
+	e, err := w.Envelope(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Message.KeyID != keys[1].id {
+		t.Fatal(kv.NewError("rotated key not used").With("key_id", e.Message.KeyID).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	for _, aCase := range []*Envelope{old, e} {
+		decoded, err := w.Request(aCase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Experiment.Key != r.Experiment.Key {
+			t.Fatal(kv.NewError("payload mismatch").With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// Payloads without an identifier should still be decrypted by trying all keys
+	if _, err = w.unwrapRaw(old.Message.Payload, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the overlap has passed the retired key should no longer be accepted
+	w.ring.update(map[string]interface{}{"key-2": keys[1]}, start.Add(overlap+time.Minute))
+	if w.HasKey(old.Message.KeyID) {
+		t.Fatal(kv.NewError("retired key accepted after overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, err = w.Request(old); err == nil {
+		t.Fatal(kv.NewError("retired key decrypted payload after overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !w.HasKey(e.Message.KeyID) {
+		t.Fatal(kv.NewError("current key missing").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !w.KeyRevoked(old.Message.KeyID) || w.KeyRevoked(e.Message.KeyID) {
+		t.Fatal(kv.NewError("key revocation incorrect").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if w.KeyRevoked(KeyFingerprint(&keys[0].privateKey.PublicKey) + "unknown") {
+		t.Fatal(kv.NewError("unknown key treated as revoked").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Keys retired using a marker file are retired from the time recorded in the marker, which
+	// is retained when a new ring is loaded after a restart
+	marker, err := extract([]byte(start.Format(time.RFC3339) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Wrapper{ring: newKeyRing(overlap)}
+	items := map[string]interface{}{"key-1": keys[0], "key-1" + retiredSuffix: marker, "key-2": keys[1]}
+
+	restarted.ring.update(items, start.Add(overlap/2))
+	if restarted.KeyRevoked(old.Message.KeyID) {
+		t.Fatal(kv.NewError("retired key revoked within overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !restarted.HasKey(old.Message.KeyID) {
+		t.Fatal(kv.NewError("retired key rejected within overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if current := restarted.ring.current(); current != keys[1] {
+		t.Fatal(kv.NewError("retired key used as the current key").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	restarted.ring.update(items, start.Add(overlap+time.Minute))
+	if restarted.HasKey(old.Message.KeyID) {
+		t.Fatal(kv.NewError("marked key accepted after overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !restarted.KeyRevoked(old.Message.KeyID) {
+		t.Fatal(kv.NewError("marked key not revoked after overlap").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+// Unit tests for the envelope schema and strict decoding of envelopes
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	updateSchemaOpt = flag.Bool("update-schema", false, "regenerate the published schema files rather than checking them")
+)
+
+// TestEnvelopeSchema checks that the published envelope schema matches the go data structures
+//
+func TestEnvelopeSchema(t *testing.T) {
+	schema, err := request.GenerateSchema(&Envelope{}, "StudioML envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(*topDir, "docs", "schema", "envelope-v"+request.SchemaVersion+".json")
+	if *updateSchemaOpt {
+		if errGo := os.WriteFile(fn, schema, 0644); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	published, errGo := os.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !bytes.Equal(published, schema) {
+		t.Fatal(kv.NewError("published schema is out of date, regenerate it using go test -run TestEnvelopeSchema -update-schema").With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestDecodeEnvelope checks that envelopes using the legacy python version field are
+// still understood and that unknown fields are reported
+//
+func TestDecodeEnvelope(t *testing.T) {
+	data := []byte(`{
+		"message": {
+			"experiment": {"status": "waiting", "pthonver": "3.8"},
+			"time_added": 1.5,
+			"experiment_lifetime": "30m",
+			"resources_needed": {"cpus": 1, "gpus": 0, "hdd": "3gb", "ram": "2gb", "gpuMem": "0gb"},
+			"payload": "",
+			"fingerprint": "",
+			"signature": "",
+			"priority": 1
+		}
+	}`)
+
+	e, warnings, err := DecodeEnvelope(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Message.Experiment.PythonVer != "3.8" {
+		t.Fatal(kv.NewError("legacy python version ignored").With("experiment", e.Message.Experiment).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if diff := deep.Equal(warnings, []string{"unknown field message.priority"}); diff != nil {
+		t.Fatal(kv.NewError("unexpected warnings").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if _, _, err = DecodeEnvelope(data, true); err == nil {
+		t.Fatal(kv.NewError("strict decoding accepted unknown fields").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Envelopes are written with both python version fields so that older runners can read them
+	out, errGo := (&Envelope{Message: Message{Experiment: OpenExperiment{PythonVer: "3.9"}}}).Marshal()
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	for _, field := range []string{`"pythonver":"3.9"`, `"pthonver":"3.9"`} {
+		if !bytes.Contains(out, []byte(field)) {
+			t.Fatal(kv.NewError("python version field missing").With("field", field, "envelope", string(out)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
@@ -43,9 +43,15 @@ func StopSecret() {
 	defer memguard.Purge()
 }
 
+// Wrapper holds the keys used by the runner to decrypt request messages.  A single
+// statically mounted keypair can be used, along with a ring of keypairs that is
+// watched for changes allowing keys to be rotated while the runner is running.
+//
 type Wrapper struct {
 	publicPEM  []byte
 	privateKey *rsa.PrivateKey
+	keyID      string
+	ring       *keyRing
 }
 
 // KubertesWrapper is used to obtain, if available, the Kubernetes stored encryption
@@ -116,9 +122,35 @@ func NewWrapper(publicPEM []byte, privatePEM []byte, passphrase []byte) (w *Wrap
 		return nil, kv.NewError(strings.Join(msg, ", ")+" not supplied").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	privateKey, err := decodePrivatePEM(privatePEM, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wrapper{
+		publicPEM:  publicPEM,
+		privateKey: privateKey,
+		keyID:      KeyFingerprint(&privateKey.PublicKey),
+	}, nil
+}
+
+// NewPublicWrapper creates a wrapper that can only be used to encrypt requests, for
+// example by clients submitting work, using the public PEM of a runner
+//
+func NewPublicWrapper(publicPEM []byte) (w *Wrapper, err kv.Error) {
 	w = &Wrapper{
 		publicPEM: publicPEM,
 	}
+	// Validate the PEM before it is used
+	if _, _, err = w.getPublicKey(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// decodePrivatePEM extracts an RSA private key from a passphrase protected PEM
+//
+func decodePrivatePEM(privatePEM []byte, passphrase []byte) (privateKey *rsa.PrivateKey, err kv.Error) {
 	// Decrypt the RSA encrypted asymmetric key
 	prvBlock, _ := pem.Decode(privatePEM)
 	if prvBlock == nil {
@@ -135,46 +167,115 @@ func NewWrapper(publicPEM []byte, privatePEM []byte, passphrase []byte) (w *Wrap
 	}
 
 	// TODO Place the enclave handling here
-	w.privateKey, errGo = x509.ParsePKCS1PrivateKey(decryptedBlock)
+	privateKey, errGo = x509.ParsePKCS1PrivateKey(decryptedBlock)
 	if errGo != nil {
 		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
-	w.privateKey.Precompute()
+	privateKey.Precompute()
 
-	return w, nil
+	return privateKey, nil
 }
 
-func (w *Wrapper) getPrivateKey() (privateKey *rsa.PrivateKey, err kv.Error) {
-	return w.privateKey, nil
+// KeyFingerprint returns the identifier used within message envelopes to select the
+// private key needed to decrypt the payload
+//
+func KeyFingerprint(pub *rsa.PublicKey) (keyID string) {
+	digest := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
 }
 
-func (w *Wrapper) WrapRequest(r *request.Request) (encrypted string, err kv.Error) {
+// getPrivateKeys returns the private keys that should be tried when decrypting a payload
+// in order of preference.  If the key identifier is supplied only the matching key is
+// returned.
+//
+func (w *Wrapper) getPrivateKeys(keyID string) (privateKeys []*rsa.PrivateKey, err kv.Error) {
+	privateKeys = []*rsa.PrivateKey{}
+
+	if w.privateKey != nil && (len(keyID) == 0 || keyID == w.keyID) {
+		privateKeys = append(privateKeys, w.privateKey)
+	}
+	if w.ring != nil && (len(keyID) == 0 || keyID != w.keyID) {
+		privateKeys = append(privateKeys, w.ring.privateKeys(keyID)...)
+	}
 
+	if len(privateKeys) == 0 {
+		return nil, kv.NewError("private key missing").With("key_id", keyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	return privateKeys, nil
+}
+
+// HasKey is used to test if the private key needed to decrypt a payload is available
+// to the wrapper, an empty key identifier will match any available key
+//
+func (w *Wrapper) HasKey(keyID string) (isPresent bool) {
 	if w == nil {
-		return "", kv.NewError("wrapper missing").With("stack", stack.Trace().TrimRuntime())
+		return false
+	}
+	_, err := w.getPrivateKeys(keyID)
+	return err == nil
+}
+
+// KeyRevoked is used to test if the private key needed to decrypt a payload was retired for
+// longer than the overlap period and so will not become available.  Keys that are not known
+// to the wrapper might be yet to be loaded and are not considered to be revoked.
+//
+func (w *Wrapper) KeyRevoked(keyID string) (revoked bool) {
+	if w == nil || w.ring == nil || len(keyID) == 0 {
+		return false
+	}
+	return w.ring.isRevoked(keyID)
+}
+
+// getPublicKey returns the public key that should be used for encrypting payloads
+// along with its identifier, the most recent key within the ring is preferred
+//
+func (w *Wrapper) getPublicKey() (pub *rsa.PublicKey, keyID string, err kv.Error) {
+	if w.ring != nil {
+		if current := w.ring.current(); current != nil {
+			return &current.privateKey.PublicKey, current.id, nil
+		}
 	}
 
 	// Check to see if we have a public key
 	if len(w.publicPEM) == 0 {
-		return "", kv.NewError("public key missing").With("stack", stack.Trace().TrimRuntime())
+		return nil, "", kv.NewError("public key missing").With("stack", stack.Trace().TrimRuntime())
 	}
 
 	// Prepare the public key block for use with the serialized message
 	pubBlock, rest := pem.Decode(w.publicPEM)
 	if pubBlock == nil {
-		return "", kv.NewError("public key missing").With("remainder", spew.Sdump(rest)).With("stack", stack.Trace().TrimRuntime())
+		return nil, "", kv.NewError("public key missing").With("remainder", spew.Sdump(rest)).With("stack", stack.Trace().TrimRuntime())
 	}
 	pub, errGo := x509.ParsePKCS1PublicKey(pubBlock.Bytes)
 	if errGo != nil {
-		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return pub, KeyFingerprint(pub), nil
+}
+
+func (w *Wrapper) WrapRequest(r *request.Request) (encrypted string, err kv.Error) {
+	encrypted, _, err = w.wrapRequest(r)
+	return encrypted, err
+}
+
+func (w *Wrapper) wrapRequest(r *request.Request) (encrypted string, keyID string, err kv.Error) {
+
+	if w == nil {
+		return "", "", kv.NewError("wrapper missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pub, keyID, err := w.getPublicKey()
+	if err != nil {
+		return "", "", err
 	}
 
 	// Serialize the request
 	buffer, err := r.Marshal()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return HybridSeal(buffer, pub)
+	encrypted, err = HybridSeal(buffer, pub)
+	return encrypted, keyID, err
 }
 
 func HybridSeal(buffer []byte, pub *rsa.PublicKey) (output string, err kv.Error) {
@@ -198,17 +299,23 @@ func HybridSeal(buffer []byte, pub *rsa.PublicKey) (output string, err kv.Error)
 
 }
 
-func (w *Wrapper) unwrapRaw(encrypted string) (decrypted []byte, err kv.Error) {
+func (w *Wrapper) unwrapRaw(encrypted string, keyID string) (decrypted []byte, err kv.Error) {
 	// Check we have a private key and a passphrase
 	if w == nil {
 		return nil, kv.NewError("wrapper missing").With("stack", stack.Trace().TrimRuntime())
 	}
-	prvKey, err := w.getPrivateKey()
+	prvKeys, err := w.getPrivateKeys(keyID)
 	if err != nil {
 		return nil, err
 	}
 
-	return Unseal(encrypted, prvKey)
+	// Without a key identifier each of the candidate keys is tried in turn
+	for _, prvKey := range prvKeys {
+		if decrypted, err = Unseal(encrypted, prvKey); err == nil {
+			return decrypted, nil
+		}
+	}
+	return nil, err.With("key_id", keyID)
 }
 
 func Unseal(encrypted string, prvKey *rsa.PrivateKey) (decrypted []byte, err kv.Error) {
@@ -243,7 +350,11 @@ func Unseal(encrypted string, prvKey *rsa.PrivateKey) (decrypted []byte, err kv.
 }
 
 func (w *Wrapper) UnwrapRequest(encrypted string) (r *request.Request, err kv.Error) {
-	decryptedBody, err := w.unwrapRaw(encrypted)
+	return w.unwrapRequest(encrypted, "")
+}
+
+func (w *Wrapper) unwrapRequest(encrypted string, keyID string) (r *request.Request, err kv.Error) {
+	decryptedBody, err := w.unwrapRaw(encrypted, keyID)
 	if err != nil {
 		return nil, err
 	}
@@ -258,6 +369,7 @@ func (w *Wrapper) UnwrapRequest(encrypted string) (r *request.Request, err kv.Er
 
 func (w *Wrapper) Envelope(r *request.Request) (e *Envelope, err kv.Error) {
 	e = &Envelope{
+		SchemaVersion: request.SchemaVersion,
 		Message: Message{
 			Experiment: OpenExperiment{
 				Status:    r.Experiment.Status,
@@ -269,10 +381,16 @@ func (w *Wrapper) Envelope(r *request.Request) (e *Envelope, err kv.Error) {
 		},
 	}
 
-	e.Message.Payload, err = w.WrapRequest(r)
+	e.Message.Payload, e.Message.KeyID, err = w.wrapRequest(r)
 	return e, err
 }
 
 func (w *Wrapper) Request(e *Envelope) (r *request.Request, err kv.Error) {
-	return w.UnwrapRequest(e.Message.Payload)
+	return w.unwrapRequest(e.Message.Payload, e.Message.KeyID)
+}
+
+// Payload returns the decrypted, but not decoded, request carried by the envelope
+//
+func (w *Wrapper) Payload(e *Envelope) (decrypted []byte, err kv.Error) {
+	return w.unwrapRaw(e.Message.Payload, e.Message.KeyID)
 }
@@ -11,6 +11,7 @@ import (
 	"context"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"time"
 
@@ -116,6 +117,61 @@ func (s *PubkeyStore) Select(q string) (key *rsa.PublicKey, err kv.Error) {
 	return cast, nil
 }
 
+// VerifyEnvelope checks the signature of the payload inside an envelope using the
+// public key selected for the supplied queue name.  The fingerprint of the key that
+// was selected is returned so that callers can report keys that do not match the
+// fingerprint claimed by the message.
+//
+func (s *PubkeyStore) VerifyEnvelope(q string, e *Envelope) (fingerprint string, err kv.Error) {
+	if s == nil || s.store == nil {
+		return "", kv.NewError("signature store not initialized").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(e.Message.Signature) == 0 {
+		return "", kv.NewError("encrypted payload has no signature").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(e.Message.Fingerprint) == 0 {
+		return "", kv.NewError("payload signature has no fingerprint").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pubKey, fingerprint, err := s.SelectSSH(q)
+	if err != nil {
+		return "", err.With("queue", q)
+	}
+
+	sigBin, errGo := base64.StdEncoding.DecodeString(e.Message.Signature)
+	if errGo != nil {
+		return fingerprint, kv.Wrap(errGo).With("signature", e.Message.Signature).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = kv.Wrap(r.(error)).With("stack", stack.Trace().TrimRuntime())
+			}
+		}()
+
+		// First try for the RFC format using the parser
+		sig, errSig := ParseSSHSignature(sigBin)
+		if errSig != nil {
+			// We could have 64 byte blob so just try to use that
+			if len(sigBin) != 64 {
+				err = errSig
+				return
+			}
+			sig = &ssh.Signature{
+				Format: "ssh-ed25519",
+				Blob:   sigBin,
+			}
+		}
+		if errGo := pubKey.Verify([]byte(e.Message.Payload), sig); errGo != nil {
+			err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+	}()
+	return fingerprint, err
+}
+
 // InitRqstSigWatcher is used to initialize a watch for signatures and to spawn the file system backed
 // service function to perform the watching.
 //
@@ -125,6 +181,17 @@ func InitRqstSigWatcher(ctx context.Context, configuredDir string, errorC chan<-
 	return sigs, err
 }
 
+// ReadRqstSigs is used to load the signatures found within a directory once, without
+// watching the directory for changes.
+//
+func ReadRqstSigs(configuredDir string) (sigs *PubkeyStore, err kv.Error) {
+	sigs = &PubkeyStore{}
+	if sigs.store, err = ReadDynamicStore(configuredDir, extractRqstSigning); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
 // InitRspnsSigWatcher is used to initialize a watch for signatures and to spawn the file system backed
 // service function to perform the watching.
 //
@@ -0,0 +1,254 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+// This file contains the encryption and decryption of streams of data, such as experiment
+// archives, that are too large to be handled as a single block.
+//
+// A sealed stream starts with a single line JSON header that carries the identifier of the
+// RSA public key and the randomly generated data key encrypted, using OAEP, with that public key.
+// The header is followed by the data split into chunks, each of which is encrypted with the data
+// key using the block functions in block_crypto.go.  Each chunk is preceded by its encrypted
+// length as a 4 byte big endian integer.
+//
+// The nonce of every chunk is made up of a 15 byte random prefix shared by the stream, an 8 byte
+// big endian chunk counter, and a final byte that is set to 1 for the last chunk only.  Readers
+// check the nonces so that chunks that have been reordered, or a stream that has been truncated,
+// are detected.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+const (
+	// SealedFormat identifies the version of the sealed stream format
+	SealedFormat = "studioml-sealed-v1"
+
+	sealedChunkSize  = 64 * 1024
+	sealedMaxHeader  = 8 * 1024
+	sealedNonceFixed = 15
+	sealedOverhead   = 24 + 16 // The nonce and the secretbox authenticator
+)
+
+type sealedHeader struct {
+	Format    string `json:"format"`
+	KeyID     string `json:"key_id"`
+	SealedKey string `json:"sealed_key"`
+}
+
+type sealWriter struct {
+	w     io.WriteCloser
+	key   [32]byte
+	nonce [24]byte
+	count uint64
+	buf   []byte
+}
+
+// NewSealWriter returns a writer that encrypts the data written to it using a data key sealed
+// with the public key, and writes the sealed stream to w.  Close must be called to write the
+// final chunk, it also closes w.  The identifier of the public key is returned so that it can be
+// recorded alongside the stream.
+//
+func NewSealWriter(w io.WriteCloser, pub *rsa.PublicKey) (sw io.WriteCloser, keyID string, err kv.Error) {
+	s := &sealWriter{
+		w:   w,
+		buf: make([]byte, 0, sealedChunkSize),
+	}
+	if _, errGo := io.ReadFull(rand.Reader, s.key[:]); errGo != nil {
+		return nil, "", kv.Wrap(errGo, "secret could not be generated").With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := io.ReadFull(rand.Reader, s.nonce[:sealedNonceFixed]); errGo != nil {
+		return nil, "", kv.Wrap(errGo, "nonce could not be generated").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sealedKey, errGo := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, s.key[:], nil)
+	if errGo != nil {
+		return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	header, errGo := json.Marshal(&sealedHeader{
+		Format:    SealedFormat,
+		KeyID:     KeyFingerprint(pub),
+		SealedKey: base64.StdEncoding.EncodeToString(sealedKey),
+	})
+	if errGo != nil {
+		return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo = w.Write(append(header, '\n')); errGo != nil {
+		return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return s, KeyFingerprint(pub), nil
+}
+
+func (s *sealWriter) writeChunk(final bool) (errGo error) {
+	binary.BigEndian.PutUint64(s.nonce[sealedNonceFixed:23], s.count)
+	s.nonce[23] = 0
+	if final {
+		s.nonce[23] = 1
+	}
+	s.count++
+
+	enc := sealBlock(&s.key, &s.nonce, s.buf)
+	s.buf = s.buf[:0]
+
+	size := [4]byte{}
+	binary.BigEndian.PutUint32(size[:], uint32(len(enc)))
+	if _, errGo = s.w.Write(size[:]); errGo != nil {
+		return errGo
+	}
+	_, errGo = s.w.Write(enc)
+	return errGo
+}
+
+// Write buffers the data and writes each chunk once it is full
+//
+func (s *sealWriter) Write(p []byte) (n int, errGo error) {
+	for len(p) != 0 {
+		if len(s.buf) == sealedChunkSize {
+			if errGo = s.writeChunk(false); errGo != nil {
+				return n, errGo
+			}
+		}
+		added := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+added]
+		p = p[added:]
+		n += added
+	}
+	return n, nil
+}
+
+// Close writes the remaining data as the final chunk and then closes the underlying writer
+//
+func (s *sealWriter) Close() (errGo error) {
+	if errGo = s.writeChunk(true); errGo != nil {
+		s.w.Close()
+		return errGo
+	}
+	return s.w.Close()
+}
+
+// IsSealed tests whether the data starts with the header of a sealed stream
+//
+func IsSealed(data []byte) (isSealed bool) {
+	return bytes.HasPrefix(data, []byte(`{"format":"`+SealedFormat+`"`))
+}
+
+type unsealReader struct {
+	r       *bufio.Reader
+	key     [32]byte
+	prefix  [sealedNonceFixed]byte
+	count   uint64
+	final   bool
+	pending []byte
+}
+
+// NewUnsealReader returns a reader of the decrypted contents of a sealed stream, the data key
+// of the stream is decrypted using the private keys held by the wrapper
+//
+func (w *Wrapper) NewUnsealReader(r io.Reader) (clear io.Reader, keyID string, err kv.Error) {
+	if w == nil {
+		return nil, "", kv.NewError("wrapper missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	u := &unsealReader{
+		r: bufio.NewReader(r),
+	}
+	line, errGo := u.r.ReadSlice('\n')
+	if errGo != nil || len(line) > sealedMaxHeader {
+		return nil, "", kv.NewError("sealed stream header missing").With("stack", stack.Trace().TrimRuntime())
+	}
+	header := &sealedHeader{}
+	if errGo = json.Unmarshal(line, header); errGo != nil {
+		return nil, "", kv.Wrap(errGo, "sealed stream header invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	if header.Format != SealedFormat {
+		return nil, header.KeyID, kv.NewError("sealed stream format unsupported").With("format", header.Format).With("stack", stack.Trace().TrimRuntime())
+	}
+	sealedKey, errGo := base64.StdEncoding.DecodeString(header.SealedKey)
+	if errGo != nil {
+		return nil, header.KeyID, kv.Wrap(errGo, "sealed key bad").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	prvKeys, err := w.getPrivateKeys(header.KeyID)
+	if err != nil {
+		return nil, header.KeyID, err
+	}
+	for _, prvKey := range prvKeys {
+		key, errGo := rsa.DecryptOAEP(sha256.New(), rand.Reader, prvKey, sealedKey, nil)
+		if errGo != nil || len(key) != len(u.key) {
+			continue
+		}
+		copy(u.key[:], key)
+		return u, header.KeyID, nil
+	}
+	return nil, header.KeyID, kv.NewError("sealed key could not be decrypted").With("key_id", header.KeyID).With("stack", stack.Trace().TrimRuntime())
+}
+
+func (u *unsealReader) readChunk() (errGo error) {
+	size := [4]byte{}
+	if _, errGo = io.ReadFull(u.r, size[:]); errGo != nil {
+		if errors.Is(errGo, io.EOF) {
+			return kv.NewError("sealed stream truncated").With("stack", stack.Trace().TrimRuntime())
+		}
+		return errGo
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length < sealedOverhead || length > sealedChunkSize+sealedOverhead {
+		return kv.NewError("sealed stream chunk invalid").With("length", length).With("stack", stack.Trace().TrimRuntime())
+	}
+	enc := make([]byte, length)
+	if _, errGo = io.ReadFull(u.r, enc); errGo != nil {
+		return kv.Wrap(errGo, "sealed stream truncated").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Check the nonce belongs to this stream, and this position within it, before decrypting
+	if u.count == 0 {
+		copy(u.prefix[:], enc[:sealedNonceFixed])
+	}
+	nonce := [24]byte{}
+	copy(nonce[:sealedNonceFixed], u.prefix[:])
+	binary.BigEndian.PutUint64(nonce[sealedNonceFixed:23], u.count)
+	if !bytes.Equal(nonce[:23], enc[:23]) || enc[23] > 1 {
+		return kv.NewError("sealed stream chunk out of sequence").With("chunk", u.count).With("stack", stack.Trace().TrimRuntime())
+	}
+	u.final = enc[23] == 1
+	u.count++
+
+	clear, err := DecryptBlock(u.key, enc)
+	if err != nil {
+		return err
+	}
+	u.pending = clear
+	return nil
+}
+
+// Read returns decrypted data, an error is returned if the stream was altered or truncated
+//
+func (u *unsealReader) Read(p []byte) (n int, errGo error) {
+	for len(u.pending) == 0 {
+		if u.final {
+			// Nothing is permitted to follow the final chunk
+			if _, errGo = u.r.ReadByte(); errGo == nil {
+				return 0, kv.NewError("sealed stream has trailing data").With("stack", stack.Trace().TrimRuntime())
+			}
+			return 0, io.EOF
+		}
+		if errGo = u.readChunk(); errGo != nil {
+			return 0, errGo
+		}
+	}
+	n = copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
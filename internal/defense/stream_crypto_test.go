@@ -0,0 +1,107 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+// Unit tests for sealed streams
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	random "github.com/leaf-ai/studio-go-runner/pkg/rand"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func sealTestData(w *Wrapper, data []byte) (sealed []byte, err kv.Error) {
+	pub, _, err := w.getPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	out := &bufferCloser{}
+	sw, keyID, err := NewSealWriter(out, pub)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != KeyFingerprint(pub) {
+		return nil, kv.NewError("key identifier mismatched").With("key_id", keyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := sw.Write(data); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := sw.Close(); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return out.Bytes(), nil
+}
+
+// TestSealedStream checks that sealed streams of various sizes can be unsealed using the private
+// key, and that altered, or truncated, streams and the wrong keys are rejected
+//
+func TestSealedStream(t *testing.T) {
+	w, err := setupWrapper()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, sealedChunkSize, 3*sealedChunkSize + 7} {
+		data := []byte(random.RandomString(size + 1))[:size]
+		sealed, err := sealTestData(w, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsSealed(sealed) || (size > 16 && bytes.Contains(sealed, data[:size/2])) {
+			t.Fatal(kv.NewError("stream not sealed").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		r, _, err := w.NewUnsealReader(bytes.NewReader(sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clear, errGo := ioutil.ReadAll(r)
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !bytes.Equal(clear, data) {
+			t.Fatal(kv.NewError("unsealed data differs").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	data := []byte(random.RandomString(2*sealedChunkSize + 100))
+	sealed, err := sealTestData(w, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	altered := append([]byte{}, sealed...)
+	altered[len(altered)-100] ^= 0xff
+	truncated := sealed[:len(sealed)-(100+4+sealedOverhead)]
+
+	for name, candidate := range map[string][]byte{"altered": altered, "truncated": truncated, "trailing": append(append([]byte{}, sealed...), 0)} {
+		r, _, err := w.NewUnsealReader(bytes.NewReader(candidate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, errGo := ioutil.ReadAll(r); errGo == nil {
+			t.Fatal(kv.NewError("invalid stream accepted").With("case", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	other, err := setupWrapper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = other.NewUnsealReader(bytes.NewReader(sealed)); err == nil {
+		t.Fatal(kv.NewError("stream unsealed without the private key").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
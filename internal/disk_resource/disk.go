@@ -81,12 +81,37 @@ func GetPathFree(path string) (free uint64, err kv.Error) {
 	return fs.Bfree * uint64(fs.Bsize), nil
 }
 
-// SetDiskLimits is used to set a highwater mark for a device as a minimum free quantity
+// SameDevice tests whether two paths reside on the same file system
+//
+func SameDevice(path string, other string) (same bool, err kv.Error) {
+	devices := []uint64{}
+	for _, fn := range []string{path, other} {
+		fs := syscall.Stat_t{}
+		if errGo := syscall.Stat(fn, &fs); errGo != nil {
+			return false, kv.Wrap(errGo).With("path", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		devices = append(devices, uint64(fs.Dev))
+	}
+	return devices[0] == devices[1], nil
+}
+
+// CheckDiskLimits tests that the device can be used by SetDiskLimits
+//
+func CheckDiskLimits(device string) (err kv.Error) {
+	fs := syscall.Statfs_t{}
+	if errGo := syscall.Statfs(device, &fs); errGo != nil {
+		return kv.Wrap(errGo).With("device", device).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// SetDiskLimits is used to set a highwater mark for a device as a minimum free quantity.  Allocations
+// already made are retained unless the device being tracked changes.
 //
 func SetDiskLimits(device string, minFree uint64) (avail uint64, err kv.Error) {
 
 	fs := syscall.Statfs_t{}
-	if errGo := syscall.Statfs(device, &fs); err != nil {
+	if errGo := syscall.Statfs(device, &fs); errGo != nil {
 		return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 	blockSize := uint64(fs.Bsize)
@@ -99,7 +124,9 @@ func SetDiskLimits(device string, minFree uint64) (avail uint64, err kv.Error) {
 	diskTrack.Lock()
 	defer diskTrack.Unlock()
 
-	diskTrack.AllocSpace = 0
+	if diskTrack.Device != device {
+		diskTrack.AllocSpace = 0
+	}
 	diskTrack.MinFree = softMinFree
 	diskTrack.Device = device
 	diskTrack.InitErr = nil
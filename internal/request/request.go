@@ -35,6 +35,12 @@ type Config struct {
 	Runner                 RunnerCustom      `json:"runner"`
 }
 
+// additionalProperties marks the configuration as being able to carry values that are
+// not processed by the runner, for example values used by frameworks within experiments
+func (Config) additionalProperties() bool {
+	return true
+}
+
 // RunnerCustom defines a custom type of resource used by the go runner to implement a slack
 // notification mechanism
 //
@@ -55,6 +61,12 @@ type Database struct {
 	Credentials       Credentials `json:"credentials"`
 }
 
+// additionalProperties marks the database as being able to carry values that are
+// specific to the type of database being used
+func (Database) additionalProperties() bool {
+	return true
+}
+
 // Experiment marshalls the studioML experiment meta data
 type Experiment struct {
 	Args               []string            `json:"args"`
@@ -74,13 +86,17 @@ type Experiment struct {
 	TimeFinished       interface{}         `json:"time_finished"`
 	TimeLastCheckpoint interface{}         `json:"time_last_checkpoint"`
 	TimeStarted        interface{}         `json:"time_started"`
+	Author             string              `json:"author,omitempty"`
+	ProjectVersion     string              `json:"project_version,omitempty"`
+	ProjectExperiment  string              `json:"project_experiment,omitempty"`
 }
 
 // Request marshalls the requests made by studioML under which all of the other
 // meta data can be found
 type Request struct {
-	Config     Config     `json:"config"`
-	Experiment Experiment `json:"experiment"`
+	SchemaVersion string     `json:"schema_version,omitempty"`
+	Config        Config     `json:"config"`
+	Experiment    Experiment `json:"experiment"`
 }
 
 // Info is a marshalled item from the studioML experiment definition that
@@ -113,6 +129,7 @@ type AWSCredential struct {
 	AccessKey string                    `json:"access_key"`
 	SecretKey string                    `json:"secret_access_key"`
 	Region    string                    `json:"region"`
+	Session   string                    `json:"session_token,omitempty"`
 	Reference *vault.VaultReferenceRoot `json:"reference"`
 }
 
@@ -121,6 +138,7 @@ func (ac *AWSCredential) Clone() *AWSCredential {
 		AccessKey: ac.AccessKey[:],
 		SecretKey: ac.SecretKey[:],
 		Region:    ac.Region[:],
+		Session:   ac.Session[:],
 	}
 	if ac.Reference != nil {
 		c.Reference = ac.Reference.Clone()
@@ -153,19 +171,83 @@ type Credentials struct {
 	AWS   *AWSCredential   `json:"aws"`
 }
 
+// ServerSideEncryption selects the encryption applied by an S3 compliant storage platform
+// to the objects of an artifact.  Type is one of SSE-S3, SSE-KMS, or SSE-C.  KMSKeyID names the
+// key used for SSE-KMS, AWS managed keys are used if it is absent.  CustomerKey is the Base64
+// encoded 256 bit key used for SSE-C, it is needed to both upload and fetch the objects.
+type ServerSideEncryption struct {
+	Type        string `json:"type"`
+	KMSKeyID    string `json:"kms_key_id,omitempty"`
+	CustomerKey string `json:"customer_key,omitempty"`
+}
+
+// ObjectOptions contains the options applied by S3 compliant storage platforms to the
+// objects that are uploaded for an artifact, SSE-C keys are also used when objects are fetched
+type ObjectOptions struct {
+	SSE          *ServerSideEncryption `json:"sse,omitempty"`
+	StorageClass string                `json:"storage_class,omitempty"`
+	Tags         map[string]string     `json:"tags,omitempty"`
+	Metadata     map[string]string     `json:"metadata,omitempty"`
+}
+
+// Clone is a full on duplication of the original options
+func (o *ObjectOptions) Clone() (c *ObjectOptions) {
+	c = &ObjectOptions{
+		StorageClass: o.StorageClass[:],
+		Tags:         make(map[string]string, len(o.Tags)),
+		Metadata:     make(map[string]string, len(o.Metadata)),
+	}
+	if o.SSE != nil {
+		sse := *o.SSE
+		c.SSE = &sse
+	}
+	for k, v := range o.Tags {
+		c.Tags[k] = v
+	}
+	for k, v := range o.Metadata {
+		c.Metadata[k] = v
+	}
+	return c
+}
+
+// PresignedUpload contains the pre-signed URLs used to upload a mutable artifact whose
+// qualified location is a pre-signed URL for downloading it.  URL is a pre-signed PutObject
+// URL.  Alternatively Parts, Complete, and PartSize describe an S3 multipart upload created by
+// the experimenter, Parts holds the UploadPart URLs in part number order, each part other than
+// the last is PartSize bytes, and Complete is the CompleteMultipartUpload URL.
+type PresignedUpload struct {
+	URL      string   `json:"url,omitempty"`
+	Parts    []string `json:"parts,omitempty"`
+	PartSize int64    `json:"part_size,omitempty"`
+	Complete string   `json:"complete,omitempty"`
+}
+
+// Clone is a full on duplication of the original upload
+func (u *PresignedUpload) Clone() (c *PresignedUpload) {
+	return &PresignedUpload{
+		URL:      u.URL[:],
+		Parts:    append([]string{}, u.Parts...),
+		PartSize: u.PartSize,
+		Complete: u.Complete[:],
+	}
+}
+
 // Artifact is a marshalled component of a StudioML experiment definition that
 // is used to encapsulate files and other external data sources
 // that the runner retrieve and/or upload as the experiment progresses
 type Artifact struct {
-	Bucket      string      `json:"bucket"`
-	Key         string      `json:"key"`
-	Hash        string      `json:"hash,omitempty"`
-	Local       string      `json:"local,omitempty"`
-	Mutable     bool        `json:"mutable"`
-	Unpack      bool        `json:"unpack"`
-	Qualified   string      `json:"qualified"`
-	SaveFreq    int         `json:"saveFrequency"`
-	Credentials Credentials `json:"credentials"`
+	Bucket      string           `json:"bucket"`
+	Key         string           `json:"key"`
+	Hash        string           `json:"hash,omitempty"`
+	Local       string           `json:"local,omitempty"`
+	Mutable     bool             `json:"mutable"`
+	Unpack      bool             `json:"unpack"`
+	Qualified   string           `json:"qualified"`
+	SaveFreq    int              `json:"saveFrequency"`
+	Credentials Credentials      `json:"credentials"`
+	Encrypt     bool             `json:"encrypt,omitempty"`
+	Object      *ObjectOptions   `json:"object,omitempty"`
+	Upload      *PresignedUpload `json:"upload,omitempty"`
 }
 
 // Clone is a full on duplication of the original artifact
@@ -179,6 +261,13 @@ func (a *Artifact) Clone() (b *Artifact) {
 		Unpack:    a.Unpack,
 		Qualified: a.Qualified[:],
 		SaveFreq:  a.SaveFreq,
+		Encrypt:   a.Encrypt,
+	}
+	if a.Object != nil {
+		b.Object = a.Object.Clone()
+	}
+	if a.Upload != nil {
+		b.Upload = a.Upload.Clone()
 	}
 	b.Credentials = Credentials{}
 	if a.Credentials.Plain != nil {
@@ -0,0 +1,309 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package request
+
+// This file contains the implementation of the JSON Schema that is published for requests
+// and the strict decoding of requests.  Both are driven from the go data structures using
+// their json tags so that the published schema and the runner cannot drift apart.
+//
+// The schema is versioned using SchemaVersion, messages carry the version they were
+// written against in their schema_version field.  Messages without a version are
+// treated as being from clients that predate the schema.
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// SchemaVersion is the version of the request and envelope schemas implemented by
+	// this package
+	SchemaVersion = "1"
+)
+
+// openObject is implemented by structures whose JSON objects can carry properties
+// beyond those known to the runner
+type openObject interface {
+	additionalProperties() bool
+}
+
+var openObjectType = reflect.TypeOf((*openObject)(nil)).Elem()
+
+// isOpen tests whether the JSON objects for a structure can carry unknown properties
+//
+func isOpen(t reflect.Type) bool {
+	return t.Implements(openObjectType) || reflect.PtrTo(t).Implements(openObjectType)
+}
+
+// jsonField describes a field of a go structure as it appears within JSON documents
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields returns the fields of a structure that the encoding/json package will
+// encode and decode, fields of embedded structures without tags are promoted
+//
+func jsonFields(t reflect.Type) (fields []jsonField) {
+	fields = []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && len(name) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(embedded)...)
+				continue
+			}
+		}
+		if len(field.PkgPath) != 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{name: name, typ: field.Type})
+	}
+	return fields
+}
+
+// schemaBuilder accumulates the definitions of the named structures used by a schema
+type schemaBuilder struct {
+	definitions map[string]interface{}
+	names       map[reflect.Type]string
+}
+
+// GenerateSchema returns a JSON Schema, draft 07, describing the JSON encoding of the go
+// value supplied.  Objects do not permit properties other than those known to the go
+// structures, unless the structure is marked as being open.
+//
+func GenerateSchema(v interface{}, title string) (schema []byte, err kv.Error) {
+	builder := &schemaBuilder{
+		definitions: map[string]interface{}{},
+		names:       map[reflect.Type]string{},
+	}
+
+	// The document itself is described, rather than a pointer to it
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	root := builder.schema(t)
+
+	doc := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       title,
+		"$comment":    "schema_version " + SchemaVersion + ", generated from the go data structures of the runner",
+		"definitions": builder.definitions,
+	}
+	for k, v := range root {
+		doc[k] = v
+	}
+
+	schema, errGo := json.MarshalIndent(doc, "", "  ")
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return append(schema, '\n'), nil
+}
+
+func (builder *schemaBuilder) schema(t reflect.Type) (schema map[string]interface{}) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return map[string]interface{}{
+			"anyOf": []interface{}{map[string]interface{}{"type": "null"}, builder.schema(t.Elem())},
+		}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": []string{"string", "null"}}
+		}
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": builder.schema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 []string{"object", "null"},
+			"additionalProperties": builder.schema(t.Elem()),
+		}
+	case reflect.Struct:
+		return map[string]interface{}{"$ref": "#/definitions/" + builder.define(t)}
+	}
+	return map[string]interface{}{}
+}
+
+// define adds a definition for a structure to the schema and returns its name
+//
+func (builder *schemaBuilder) define(t reflect.Type) (name string) {
+	if name, isPresent := builder.names[t]; isPresent {
+		return name
+	}
+
+	name = t.Name()
+	if _, isPresent := builder.definitions[name]; isPresent || len(name) == 0 {
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+	}
+	builder.names[t] = name
+	// Reserve the name before the fields are examined to allow for recursive structures
+	builder.definitions[name] = nil
+
+	properties := map[string]interface{}{}
+	for _, field := range jsonFields(t) {
+		properties[field.name] = builder.schema(field.typ)
+	}
+	builder.definitions[name] = map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": isOpen(t),
+	}
+	return name
+}
+
+// UnknownFields returns the paths of any fields within the JSON document that are not
+// decoded into the go value supplied, and would be silently ignored by json.Unmarshal
+//
+func UnknownFields(data []byte, v interface{}) (fields []string, err kv.Error) {
+	var doc interface{}
+	if errGo := json.Unmarshal(data, &doc); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	fields = []string{}
+	unknownFields(doc, reflect.TypeOf(v), "", &fields)
+	sort.Strings(fields)
+	return fields, nil
+}
+
+func unknownFields(doc interface{}, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		items, isOK := doc.(map[string]interface{})
+		if !isOK {
+			return
+		}
+		fields := jsonFields(t)
+		for key, value := range items {
+			fieldPath := key
+			if len(path) != 0 {
+				fieldPath = path + "." + key
+			}
+			known := false
+			// encoding/json matches names without regard to case, prefering exact matches
+			for _, field := range fields {
+				if field.name == key {
+					unknownFields(value, field.typ, fieldPath, unknown)
+					known = true
+					break
+				}
+			}
+			if !known {
+				for _, field := range fields {
+					if strings.EqualFold(field.name, key) {
+						unknownFields(value, field.typ, fieldPath, unknown)
+						known = true
+						break
+					}
+				}
+			}
+			if !known && !isOpen(t) {
+				*unknown = append(*unknown, fieldPath)
+			}
+		}
+	case reflect.Map:
+		if items, isOK := doc.(map[string]interface{}); isOK {
+			for key, value := range items {
+				unknownFields(value, t.Elem(), path+"."+key, unknown)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if items, isOK := doc.([]interface{}); isOK {
+			for i, value := range items {
+				unknownFields(value, t.Elem(), path+"["+strconv.Itoa(i)+"]", unknown)
+			}
+		}
+	}
+}
+
+// CheckSchemaVersion returns an error if a message was written against a schema version
+// that is not supported, messages without a version are accepted
+//
+func CheckSchemaVersion(version string) (err kv.Error) {
+	if len(version) == 0 || version == SchemaVersion {
+		return nil
+	}
+	major := strings.Split(version, ".")[0]
+	if major != strings.Split(SchemaVersion, ".")[0] {
+		return kv.NewError("unsupported schema version").With("schema_version", version, "supported", SchemaVersion).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// SchemaWarnings examines a JSON document for fields unknown to the go value supplied and
+// for an unsupported schema version.  The problems are returned as warnings, or when strict
+// is set as an error.
+//
+func SchemaWarnings(data []byte, v interface{}, version string, strict bool) (warnings []string, err kv.Error) {
+	fields, err := UnknownFields(data, v)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings = make([]string, 0, len(fields)+1)
+	for _, field := range fields {
+		warnings = append(warnings, fmt.Sprintf("unknown field %s", field))
+	}
+	if err = CheckSchemaVersion(version); err != nil {
+		warnings = append(warnings, fmt.Sprintf("schema version %s is not supported, %s expected", version, SchemaVersion))
+	}
+
+	if strict && len(warnings) != 0 {
+		return warnings, kv.NewError("request does not match the schema").With("warnings", strings.Join(warnings, ", "), "schema_version", SchemaVersion).With("stack", stack.Trace().TrimRuntime())
+	}
+	return warnings, nil
+}
+
+// DecodeRequest takes an encoded StudioML request and extracts it into go data structures
+// in the same way as UnmarshalRequest.  Fields that are not part of the schema, and so
+// would be ignored, are returned as warnings or, when strict is set, cause the request to be
+// rejected.
+//
+func DecodeRequest(data []byte, strict bool) (r *Request, warnings []string, err kv.Error) {
+	if r, err = UnmarshalRequest(data); err != nil {
+		return nil, nil, err
+	}
+	if warnings, err = SchemaWarnings(data, r, r.SchemaVersion, strict); err != nil {
+		return nil, warnings, err.With("experiment_id", r.Experiment.Key)
+	}
+	return r, warnings, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package request
+
+// Unit tests for the request schema and strict decoding of requests
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	topDir          = flag.String("top-dir", "../..", "The location of the top level source directory for locating test files")
+	updateSchemaOpt = flag.Bool("update-schema", false, "regenerate the published schema files rather than checking them")
+)
+
+// TestRequestSchema checks that the published request schema matches the go data structures
+//
+func TestRequestSchema(t *testing.T) {
+	schema, err := GenerateSchema(&Request{}, "StudioML request")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(*topDir, "docs", "schema", "request-v"+SchemaVersion+".json")
+	if *updateSchemaOpt {
+		if errGo := os.WriteFile(fn, schema, 0644); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	published, errGo := os.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !bytes.Equal(published, schema) {
+		t.Fatal(kv.NewError("published schema is out of date, regenerate it using go test -run TestRequestSchema -update-schema").With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Spot check the schema contents
+	doc := map[string]interface{}{}
+	if errGo = json.Unmarshal(schema, &doc); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	definitions := doc["definitions"].(map[string]interface{})
+	experiment := definitions["Experiment"].(map[string]interface{})
+	if experiment["additionalProperties"] != false {
+		t.Fatal(kv.NewError("experiment permits unknown properties").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, isPresent := experiment["properties"].(map[string]interface{})["max_duration"]; !isPresent {
+		t.Fatal(kv.NewError("experiment max_duration missing").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if definitions["Config"].(map[string]interface{})["additionalProperties"] != true {
+		t.Fatal(kv.NewError("config does not permit framework properties").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if diff := deep.Equal(doc["$ref"], "#/definitions/Request"); diff != nil {
+		t.Fatal(kv.NewError("schema root incorrect").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestDecodeRequest checks that misspelt and unknown fields are reported
+//
+func TestDecodeRequest(t *testing.T) {
+	data := []byte(`{
+		"schema_version": "1",
+		"config": {"optimizer": {"popsize": 100}, "database": {"endpoint": "http://minio:9000"}, "env": {"A": "b"}},
+		"experiment": {
+			"key": "schema-test",
+			"Filename": "train.py",
+			"max_duraton": "20m",
+			"pythonver": "3.8",
+			"artifacts": {
+				"workspace": {
+					"qualified": "s3://minio:9000/bucket/workspace.tar",
+					"credentials": {"aws": {"access_key": "a", "secret_key": "b"}}
+				}
+			},
+			"pythonenv": ["numpy"],
+			"resources_needed": {"cpus": 1, "hdd": "10gb", "gpu_mem": "1gb"}
+		}
+	}`)
+
+	r, warnings, err := DecodeRequest(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Experiment.Filename != "train.py" || r.Experiment.PythonVer != "3.8" {
+		t.Fatal(kv.NewError("request not decoded").With("experiment", r.Experiment).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	expected := []string{
+		"unknown field experiment.artifacts.workspace.credentials.aws.secret_key",
+		"unknown field experiment.max_duraton",
+		"unknown field experiment.resources_needed.gpu_mem",
+	}
+	if diff := deep.Equal(warnings, expected); diff != nil {
+		t.Fatal(kv.NewError("unexpected warnings").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Strict decoding rejects the request
+	if _, _, err = DecodeRequest(data, true); err == nil {
+		t.Fatal(kv.NewError("strict decoding accepted unknown fields").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Requests from a future schema are flagged
+	data = []byte(`{"schema_version": "2.1", "experiment": {"key": "schema-test"}}`)
+	if _, warnings, err = DecodeRequest(data, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "schema version 2.1") {
+		t.Fatal(kv.NewError("schema version not checked").With("warnings", warnings).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Requests that predate the schema, or use a minor revision, are accepted
+	for _, version := range []string{"", SchemaVersion, SchemaVersion + ".1"} {
+		if err = CheckSchemaVersion(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ package runner
 //
 import (
 	"context"
+	"crypto/rsa"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -102,7 +103,7 @@ func readAllHash(dir string) (hash uint64, err kv.Error) {
 //
 func (cache *ArtifactCache) Hash(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, dir string) (hash string, err kv.Error) {
 
-	kv := kv.With("group", group).With("artifact", art.Qualified).With("project", projectId)
+	kv := kv.With("group", group).With("artifact", sourceURI(art.Qualified)).With("project", projectId)
 
 	storage, err := NewObjStore(
 		ctx,
@@ -120,7 +121,7 @@ func (cache *ArtifactCache) Hash(ctx context.Context, art *request.Artifact, pro
 	}
 
 	defer storage.Close()
-	return storage.Hash(ctx, art.Key)
+	return storage.Hash(ctx, objectName(art))
 }
 
 // Fetch can be used to retrieve an artifact from a storage layer implementation, while
@@ -128,7 +129,7 @@ func (cache *ArtifactCache) Hash(ctx context.Context, art *request.Artifact, pro
 //
 func (cache *ArtifactCache) Fetch(ctx context.Context, art *request.Artifact, projectId string, group string, maxBytes int64, env map[string]string, dir string) (size int64, warns []kv.Error, err kv.Error) {
 
-	kvList := kv.With("group", group).With("artifact", art.Qualified)
+	kvList := kv.With("group", group).With("artifact", sourceURI(art.Qualified))
 	defer func() {
 		if err != nil {
 			err = err.With(kvList)
@@ -156,7 +157,7 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *request.Artifact, pr
 		return 0, warns, err.With("stack", stack.Trace().TrimRuntime())
 	}
 
-	if art.Unpack && !archive.IsTar(art.Key) {
+	if art.Unpack && !archive.IsTar(objectName(art)) {
 		return 0, warns, kv.NewError("the unpack flag was set for an unsupported file format (tar gzip/bzip2 only supported)").With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -166,7 +167,7 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *request.Artifact, pr
 		// experiment related retries rather than downloading an entire hosts worth of activity
 		// size, warns, err = storage.Gather(ctx, "metadata/", dest)
 	default:
-		size, warns, err = storage.Fetch(ctx, art.Key, art.Unpack, dest, maxBytes)
+		size, warns, err = storage.Fetch(ctx, objectName(art), art.Unpack, dest, maxBytes)
 	}
 	storage.Close()
 
@@ -232,16 +233,17 @@ func (cache *ArtifactCache) Local(group string, dir string, file string) (fn str
 	return fn, nil
 }
 
-// Restore the artifacts that have been marked mutable and that have changed
+// Restore the artifacts that have been marked mutable and that have changed, when a seal key
+// is supplied the archives are encrypted before they are uploaded
 //
-func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, dir string) (uploaded bool, warns []kv.Error, err kv.Error) {
+func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, dir string, seal *rsa.PublicKey) (uploaded bool, warns []kv.Error, err kv.Error) {
 
 	// Immutable artifacts need just to be downloaded and nothing else
 	if !art.Mutable {
 		return false, warns, nil
 	}
 
-	kvDetails := []interface{}{"artifact", art.Qualified, "group", group, "dir", dir}
+	kvDetails := []interface{}{"artifact", sourceURI(art.Qualified), "group", group, "dir", dir}
 
 	source := filepath.Join(dir, group)
 	isValid, err := cache.checkHash(source)
@@ -262,6 +264,7 @@ func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact,
 			ProjectID: projectId,
 			Env:       env,
 			Validate:  true,
+			Seal:      seal,
 		},
 		cache.ErrorC)
 	if err != nil {
@@ -279,7 +282,7 @@ func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact,
 	case "_metadata":
 		// Ignore metadata processing.
 	default:
-		if warns, err = storage.Deposit(ctx, source, art.Key); err != nil {
+		if warns, err = storage.Deposit(ctx, source, objectName(art)); err != nil {
 			return false, warns, err.With("group", group)
 		}
 	}
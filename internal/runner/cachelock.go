@@ -0,0 +1,163 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of advisory file locks used to coordinate the use of
+// a cache directory shared by multiple runner processes on the same host.
+//
+// Every cache key has a lock file within the .locks directory of the cache.  A process downloading
+// an item holds an exclusive lock on the key from before the partial download is started until the
+// item has been renamed into the cache and indexed.  Processes reading an item hold a shared lock
+// while the item is being copied, the shared locks act as a reference count on the item that the
+// kernel maintains across processes.  Items are only removed by a process that can obtain an
+// exclusive lock without waiting, so items in use by any process are never groomed.
+//
+// Locks are released by the kernel when the process holding them exits, so the locks, and with them
+// the ownership of partial downloads, of a runner that has failed are recovered without needing to
+// detect that the runner is no longer running.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	cacheLocksDir = ".locks"
+
+	// cacheLockPoll is the interval at which a lock held by another process is retried
+	cacheLockPoll = time.Duration(100 * time.Millisecond)
+)
+
+// cacheLock is an advisory lock held on a single cache key
+type cacheLock struct {
+	fn   string
+	file *os.File
+}
+
+func cacheLockName(dir string, key string) (fn string) {
+	return filepath.Join(dir, cacheLocksDir, key+".lock")
+}
+
+// lockCacheItem obtains a lock on a cache key, either exclusive or shared.  When wait is false and
+// the lock is held by another process a nil lock and a nil error are returned.  When wait is true
+// the lock is retried until it is obtained or the ctx is Done.
+//
+func lockCacheItem(ctx context.Context, dir string, key string, exclusive bool, wait bool) (lock *cacheLock, err kv.Error) {
+	fn := cacheLockName(dir, key)
+	if errGo := os.MkdirAll(filepath.Dir(fn), 0700); errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", filepath.Dir(fn)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		file, errGo := os.OpenFile(fn, os.O_CREATE|os.O_RDWR, 0600)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if errGo = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); errGo != nil {
+			file.Close()
+			if errGo != syscall.EWOULDBLOCK {
+				return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			if !wait {
+				return nil, nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil, kv.NewError("waiting for cache lock terminated").With("key", key).With("stack", stack.Trace().TrimRuntime())
+			case <-time.After(cacheLockPoll):
+			}
+			continue
+		}
+
+		// Lock files are removed by the holder of an exclusive lock when an item is removed, if that
+		// happened while we were waiting the lock obtained is on a file that no longer exists and
+		// must be obtained again
+		held, errGo := file.Stat()
+		if errGo != nil {
+			file.Close()
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if current, errGo := os.Stat(fn); errGo != nil || !os.SameFile(held, current) {
+			file.Close()
+			continue
+		}
+
+		lock = &cacheLock{
+			fn:   fn,
+			file: file,
+		}
+		if exclusive {
+			// Record the owner to help with diagnosing items that appear to be stuck
+			_ = file.Truncate(0)
+			_, _ = file.WriteAt([]byte(fmt.Sprintf("%s %d %s\n", host, os.Getpid(), time.Now().Format(time.RFC3339))), 0)
+		}
+		return lock, nil
+	}
+}
+
+// unlock releases the lock
+//
+func (lock *cacheLock) unlock() {
+	_ = syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
+
+// remove deletes the lock file and releases the lock, it must only be used while holding an
+// exclusive lock
+//
+func (lock *cacheLock) remove() {
+	_ = os.Remove(lock.fn)
+	lock.unlock()
+}
+
+// groomLocks removes the lock files of items that are no longer present in the cache, these are left
+// when an item is removed by something other than an eviction, or by readers that found the item
+// gone after waiting for it.  Lock files held by any process are retained.
+//
+func groomLocks(dir string) {
+	locks, errGo := ioutil.ReadDir(filepath.Join(dir, cacheLocksDir))
+	if errGo != nil {
+		return
+	}
+	for _, file := range locks {
+		if !strings.HasSuffix(file.Name(), ".lock") {
+			continue
+		}
+		key := strings.TrimSuffix(file.Name(), ".lock")
+
+		// Trees and archives, along with their partial downloads, are found in different directories
+		item := filepath.Join(dir, key)
+		partial := filepath.Join(dir, ".partial", key)
+		if strings.HasSuffix(key, ".tree") {
+			item = filepath.Join(dir, cacheTreesDir, strings.TrimSuffix(key, ".tree"))
+			partial = filepath.Join(dir, cacheTreesDir, ".partial", strings.TrimSuffix(key, ".tree"))
+		}
+		if _, errGo := os.Stat(item); errGo == nil {
+			continue
+		}
+		if _, errGo := os.Stat(partial); errGo == nil {
+			continue
+		}
+
+		lock, err := lockCacheItem(context.Background(), dir, key, true, false)
+		if err != nil || lock == nil {
+			continue
+		}
+		lock.remove()
+	}
+}
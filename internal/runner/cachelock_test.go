@@ -0,0 +1,173 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the locks shared between runner processes using the same cache directory.  Locks
+// are held on open files, so separate opens within this process behave as other processes would.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// TestCacheLockSharing checks that shared locks exclude exclusive locks, and that waiting for a lock
+// that is removed by its holder results in a lock on a new lock file
+//
+func TestCacheLockSharing(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reader1, err := lockCacheItem(ctx, dir, "item", false, false)
+	if err != nil || reader1 == nil {
+		t.Fatal(kv.NewError("shared lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	reader2, err := lockCacheItem(ctx, dir, "item", false, false)
+	if err != nil || reader2 == nil {
+		t.Fatal(kv.NewError("second shared lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// An item with readers cannot be removed
+	if writer, err := lockCacheItem(ctx, dir, "item", true, false); err != nil || writer != nil {
+		t.Fatal(kv.NewError("exclusive lock obtained while shared").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	reader1.unlock()
+	if writer, err := lockCacheItem(ctx, dir, "item", true, false); err != nil || writer != nil {
+		t.Fatal(kv.NewError("exclusive lock obtained with a remaining reader").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	reader2.unlock()
+
+	writer, err := lockCacheItem(ctx, dir, "item", true, false)
+	if err != nil || writer == nil {
+		t.Fatal(kv.NewError("exclusive lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Wait for the lock while its holder removes the item
+	waiter := make(chan *cacheLock, 1)
+	go func() {
+		lock, err := lockCacheItem(ctx, dir, "item", true, true)
+		if err != nil {
+			t.Error(err)
+		}
+		waiter <- lock
+	}()
+
+	time.Sleep(3 * cacheLockPoll)
+	writer.remove()
+
+	select {
+	case lock := <-waiter:
+		if lock == nil {
+			t.Fatal(kv.NewError("lock not obtained").With("stack", stack.Trace().TrimRuntime()))
+		}
+		held, errGo := lock.file.Stat()
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		current, errGo := os.Stat(cacheLockName(dir, "item"))
+		if errGo != nil || !os.SameFile(held, current) {
+			t.Fatal(kv.NewError("lock held on a removed file").With("stack", stack.Trace().TrimRuntime()))
+		}
+		lock.unlock()
+	case <-ctx.Done():
+		t.Fatal(kv.NewError("waiting for lock timed out").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestCacheLockRecovery checks that locks held by a process that has exited, simulated by closing
+// the file without unlocking it, are recovered
+//
+func TestCacheLockRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	owner, err := lockCacheItem(context.Background(), dir, "item", true, false)
+	if err != nil || owner == nil {
+		t.Fatal(kv.NewError("exclusive lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	owner.file.Close()
+
+	lock, err := lockCacheItem(context.Background(), dir, "item", true, false)
+	if err != nil || lock == nil {
+		t.Fatal(kv.NewError("abandoned lock not recovered").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	lock.unlock()
+}
+
+// TestCacheLockReconcile checks that items in use by other processes are not evicted when a
+// runner starts
+//
+func TestCacheLockReconcile(t *testing.T) {
+	dir := t.TempDir()
+
+	idx, err := openCacheIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An item that cannot be verified, but which is being read by another runner
+	writeCacheItem(t, dir, "in-use.tar", "in use")
+	reader, err := lockCacheItem(context.Background(), dir, "in-use.tar", false, false)
+	if err != nil || reader == nil {
+		t.Fatal(kv.NewError("shared lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	result, err := idx.reconcile(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.evicted) != 0 {
+		t.Fatal(kv.NewError("item in use evicted").With("evicted", result.evicted).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo := os.Stat(filepath.Join(dir, "in-use.tar")); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Once released the item is evicted
+	reader.unlock()
+	if result, err = idx.reconcile(dir, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.evicted) != 1 {
+		t.Fatal(kv.NewError("released item not evicted").With("evicted", result.evicted).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo := os.Stat(cacheLockName(dir, "in-use.tar")); !os.IsNotExist(errGo) {
+		t.Fatal(kv.NewError("lock of evicted item retained").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestCacheLockGroom checks that the lock files of items no longer in the cache are removed
+// unless they are held
+//
+func TestCacheLockGroom(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCacheItem(t, dir, "present.tar", "present")
+	for _, key := range []string{"present.tar", "gone.tar", "gone.tar.tree"} {
+		lock, err := lockCacheItem(context.Background(), dir, key, false, false)
+		if err != nil || lock == nil {
+			t.Fatal(kv.NewError("shared lock not obtained").With("key", key, "error", err).With("stack", stack.Trace().TrimRuntime()))
+		}
+		lock.unlock()
+	}
+	held, err := lockCacheItem(context.Background(), dir, "held.tar", false, false)
+	if err != nil || held == nil {
+		t.Fatal(kv.NewError("shared lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer held.unlock()
+
+	groomLocks(dir)
+
+	expected := map[string]bool{"present.tar": true, "gone.tar": false, "gone.tar.tree": false, "held.tar": true}
+	for key, retained := range expected {
+		if _, errGo := os.Stat(cacheLockName(dir, key)); (errGo == nil) != retained {
+			t.Fatal(kv.NewError("lock file incorrectly groomed").With("key", key, "retained", retained).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of the optional second tier of the artifact cache which
+// retains the extracted contents of immutable archives.  Archives are extracted once per host into
+// the .trees directory of the cache, using the same key as the archive, and the extracted trees are
+// then materialized into experiment directories using reflinks, read-only hard links, or copies.
+//
+// Hard links share their inode with the cache, the files are made read-only but an experiment running
+// as the same user as the runner can make them writable again and so modify the cache.  For this
+// reason hard links are only used when they are requested explicitly, the auto method falls back to
+// copies, and the hardlink method should only be chosen for experiments that are trusted.
+//
+// A tree lives and dies with its archive, its size is added to that of the archive when the cache
+// size is being managed, and it is removed when the archive is groomed from the cache.
+//
+// Sealed archives, those encrypted by the runner when they were deposited, are held encrypted in
+// the cache and are never extracted into trees, they are unpacked directly into the experiment.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	cacheTreesDir = ".trees"
+
+	// ficlone is the Linux ioctl used to create a reflink, a copy on write clone, of a file
+	ficlone = 0x40049409
+)
+
+// The methods available for materializing trees from the cache into experiment directories
+const (
+	TreeMethodAuto     = "auto"     // Use reflinks, falling back to copies
+	TreeMethodReflink  = "reflink"  // Copy on write clones, requires a filesystem such as btrfs or xfs
+	TreeMethodHardlink = "hardlink" // Hard links to the read-only files of the cache, for trusted experiments only
+	TreeMethodCopy     = "copy"     // Plain copies
+)
+
+var (
+	treeMethod = struct {
+		method string // Empty when the tree cache is disabled
+		sync.Mutex
+	}{}
+)
+
+// CheckTreeMethod validates the name of a method for materializing unpacked trees
+//
+func CheckTreeMethod(method string) (err kv.Error) {
+	switch method {
+	case TreeMethodAuto, TreeMethodReflink, TreeMethodHardlink, TreeMethodCopy:
+		return nil
+	}
+	return kv.NewError("unknown method for materializing unpacked artifacts").With("method", method).With("stack", stack.Trace().TrimRuntime())
+}
+
+// EnableTreeCache turns on the caching of unpacked immutable artifacts, InitObjStore must have been
+// used to start the cache before this function is used
+//
+func EnableTreeCache(method string) (err kv.Error) {
+	if err = CheckTreeMethod(method); err != nil {
+		return err
+	}
+	if len(backingDir) == 0 {
+		return kv.NewError("unpacked artifact caching requires the cache to be enabled").With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := os.MkdirAll(filepath.Join(backingDir, cacheTreesDir, ".partial"), 0700); errGo != nil {
+		return kv.Wrap(errGo).With("dir", backingDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	treeMethod.Lock()
+	treeMethod.method = method
+	treeMethod.Unlock()
+	return nil
+}
+
+func getTreeMethod() (method string) {
+	treeMethod.Lock()
+	defer treeMethod.Unlock()
+	return treeMethod.method
+}
+
+func treeLockKey(key string) (lockKey string) {
+	return key + ".tree"
+}
+
+// fetchTree materializes the unpacked contents of an archive into the output directory, extracting the
+// archive into the tree cache if this has not already been done by this, or another, runner on the host
+//
+func (s *objStore) fetchTree(ctx context.Context, name string, hash string, cacheKey string, output string, maxBytes int64, method string) (size int64, warns []kv.Error, err kv.Error) {
+	treeDir := filepath.Join(backingDir, cacheTreesDir, cacheKey)
+	extracted := false
+
+	for {
+		// Use a tree already present, holding a shared lock to prevent it being removed
+		// while being materialized
+		if _, errGo := os.Stat(treeDir); errGo == nil {
+			lock, err := lockCacheItem(ctx, backingDir, treeLockKey(cacheKey), false, true)
+			if err != nil {
+				return 0, warns, err
+			}
+			if _, errGo := os.Stat(treeDir); errGo == nil {
+				size, err := materializeTree(treeDir, output, method)
+				lock.unlock()
+				if err != nil {
+					return 0, warns, err.With("name", name)
+				}
+				if !extracted {
+					addHit(hash)
+				}
+				return size, warns, nil
+			}
+			lock.unlock()
+		}
+
+		if extracted {
+			return 0, warns, kv.NewError("unpacked artifact removed before use").With("name", name).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if s.sealedItem(cacheKey) {
+			return s.fetchArchive(ctx, name, hash, cacheKey, true, output, maxBytes)
+		}
+
+		// Extract the archive into the tree cache, once only across all runners on the host
+		lock, err := lockCacheItem(ctx, backingDir, treeLockKey(cacheKey), true, true)
+		if err != nil {
+			return 0, warns, err
+		}
+		if _, errGo := os.Stat(treeDir); errGo == nil {
+			lock.unlock()
+			continue
+		}
+
+		sealed, w, err := s.extractTree(ctx, name, hash, cacheKey, treeDir, maxBytes)
+		warns = append(warns, w...)
+		if err != nil || sealed {
+			lock.remove()
+			if err != nil {
+				return 0, warns, err
+			}
+			// The archive is now in the cache and will be unpacked from there
+			continue
+		}
+		lock.unlock()
+		extracted = true
+	}
+}
+
+// extractTree unpacks an archive, obtained using the archive cache, into the tree cache.  The
+// caller must hold an exclusive lock on the tree.  Sealed archives are not retained as trees, in
+// which case sealed is returned as true and no tree is created.
+//
+func (s *objStore) extractTree(ctx context.Context, name string, hash string, cacheKey string, treeDir string, maxBytes int64) (sealed bool, warns []kv.Error, err kv.Error) {
+	// Anything in the staging directory was left by a runner that no longer holds the lock
+	staging := filepath.Join(backingDir, cacheTreesDir, ".partial", cacheKey)
+	_ = os.RemoveAll(staging)
+	if errGo := os.MkdirAll(staging, 0700); errGo != nil {
+		return false, warns, kv.Wrap(errGo).With("dir", staging).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if _, warns, err = s.fetchArchive(ctx, name, hash, cacheKey, true, staging, maxBytes); err != nil {
+		_ = os.RemoveAll(staging)
+		return false, warns, err
+	}
+	if s.sealedItem(cacheKey) {
+		_ = os.RemoveAll(staging)
+		return true, warns, nil
+	}
+
+	treeSize, err := sealTree(staging)
+	if err != nil {
+		_ = os.RemoveAll(staging)
+		return false, warns, err
+	}
+
+	if errGo := os.Rename(staging, treeDir); errGo != nil {
+		_ = os.RemoveAll(staging)
+		return false, warns, kv.Wrap(errGo).With("from", staging, "to", treeDir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Account for the tree within the size of the cached archive
+	if index != nil {
+		if err := index.setTreeSize(cacheKey, treeSize); err != nil {
+			warns = append(warns, err)
+		}
+	}
+	if info, errGo := os.Stat(filepath.Join(backingDir, cacheKey)); errGo == nil {
+		cache.Replace(cacheKey, &cachedItem{FileInfo: info, treeSize: treeSize})
+	}
+	return false, warns, nil
+}
+
+// sealedItem tests whether an item within the cache holds a sealed archive, either because the
+// artifact is marked for encryption or because the object was sealed when it was deposited
+//
+func (s *objStore) sealedItem(cacheKey string) (sealed bool) {
+	if s.encrypt {
+		return true
+	}
+	if index == nil {
+		return false
+	}
+	entry, err := index.get(cacheKey)
+	return err == nil && entry != nil && entry.Sealed
+}
+
+// sealTree makes the files of an extracted tree read-only, so that hard links to them cannot be
+// used to modify the cache, and returns the total size of the files
+//
+func sealTree(dir string) (size int64, err kv.Error) {
+	errGo := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, errGo := entry.Info()
+		if errGo != nil {
+			return errGo
+		}
+		size += info.Size()
+		return os.Chmod(path, info.Mode().Perm()&^0222)
+	})
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// materializeTree reproduces the tree held within the cache at src inside the output directory.  Directories
+// are always created so that experiments can add files to them.  Files are reproduced using the
+// method requested, for the auto method each file is reflinked, falling back to a copy when that
+// fails.  Reflinks are only abandoned for the remaining files once the filesystem has reported that
+// they are not supported, other failures affect only the file concerned.
+//
+func materializeTree(src string, output string, method string) (size int64, err kv.Error) {
+	methods := []string{method}
+	if method == TreeMethodAuto {
+		methods = []string{TreeMethodReflink, TreeMethodCopy}
+	}
+
+	errGo := filepath.WalkDir(src, func(path string, entry fs.DirEntry, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		rel, errGo := filepath.Rel(src, path)
+		if errGo != nil {
+			return errGo
+		}
+		dest := filepath.Join(output, rel)
+
+		info, errGo := entry.Info()
+		if errGo != nil {
+			return errGo
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(dest, info.Mode().Perm()|0700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, errGo := os.Readlink(path)
+			if errGo != nil {
+				return errGo
+			}
+			return os.Symlink(target, dest)
+		case !entry.Type().IsRegular():
+			return nil
+		}
+
+		for _, fileMethod := range methods {
+			if errGo = materializeFile(path, dest, info, fileMethod); errGo == nil {
+				size += info.Size()
+				return nil
+			}
+			_ = os.Remove(dest)
+
+			// Filesystems that do not support reflinks will fail for every file
+			if fileMethod == TreeMethodReflink && reflinkUnsupported(errGo) && len(methods) > 1 {
+				methods = methods[1:]
+			}
+		}
+		return errGo
+	})
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("src", src, "output", output, "method", method).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// reflinkUnsupported is used to distinguish the errors returned when reflinks cannot be used between the
+// source and destination filesystems from those that are specific to an individual file
+//
+func reflinkUnsupported(errGo error) (unsupported bool) {
+	for _, errno := range []syscall.Errno{syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS} {
+		if errors.Is(errGo, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func materializeFile(src string, dest string, info os.FileInfo, method string) (errGo error) {
+	if method == TreeMethodHardlink {
+		return os.Link(src, dest)
+	}
+
+	in, errGo := os.Open(src)
+	if errGo != nil {
+		return errGo
+	}
+	defer in.Close()
+
+	// Reflinked and copied files belong to the experiment and so are writable
+	out, errGo := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm()|0200)
+	if errGo != nil {
+		return errGo
+	}
+	defer out.Close()
+
+	if method == TreeMethodReflink {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+
+	if _, errGo = io.Copy(out, in); errGo != nil {
+		return errGo
+	}
+	return out.Close()
+}
+
+// removeTree deletes the unpacked tree for a cache key unless it is in use
+//
+func removeTree(key string) (removed bool) {
+	treeDir := filepath.Join(backingDir, cacheTreesDir, key)
+	if _, errGo := os.Stat(treeDir); errGo != nil {
+		return false
+	}
+	lock, err := lockCacheItem(context.Background(), backingDir, treeLockKey(key), true, false)
+	if err != nil || lock == nil {
+		return false
+	}
+	defer lock.remove()
+
+	return os.RemoveAll(treeDir) == nil
+}
+
+// groomTrees removes trees whose archives are no longer in the cache, these are trees that were in
+// use when their archive was removed, and abandoned partial extractions
+//
+func groomTrees(backingDir string) {
+	treesDir := filepath.Join(backingDir, cacheTreesDir)
+	trees, errGo := ioutil.ReadDir(treesDir)
+	if errGo != nil {
+		return
+	}
+	for _, tree := range trees {
+		if strings.HasPrefix(tree.Name(), ".") {
+			continue
+		}
+		if _, errGo := os.Stat(filepath.Join(backingDir, tree.Name())); os.IsNotExist(errGo) {
+			removeTree(tree.Name())
+		}
+	}
+
+	partials, errGo := ioutil.ReadDir(filepath.Join(treesDir, ".partial"))
+	if errGo != nil {
+		return
+	}
+	for _, partial := range partials {
+		lock, err := lockCacheItem(context.Background(), backingDir, treeLockKey(partial.Name()), true, false)
+		if err != nil || lock == nil {
+			continue
+		}
+		_ = os.RemoveAll(filepath.Join(treesDir, ".partial", partial.Name()))
+		lock.remove()
+	}
+}
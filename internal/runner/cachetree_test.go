@@ -0,0 +1,273 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the unpacked artifact tree cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/karlmutch/ccache"
+)
+
+func makeTestTree(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	files := map[string]string{
+		"data/train.csv":   "a,b\n1,2\n",
+		"data/test.csv":    "a,b\n3,4\n",
+		"model/weights.h5": "weights",
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if errGo := os.MkdirAll(filepath.Dir(fn), 0700); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if errGo := os.WriteFile(fn, []byte(content), 0640); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	return dir
+}
+
+// TestCacheTreeMaterialize checks that trees are sealed and then reproduced using each of
+// the materialization methods
+//
+func TestCacheTreeMaterialize(t *testing.T) {
+	src := makeTestTree(t)
+
+	size, err := sealTree(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 23 {
+		t.Fatal(kv.NewError("unexpected tree size").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+	}
+	info, errGo := os.Stat(filepath.Join(src, "data", "train.csv"))
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if info.Mode().Perm()&0222 != 0 {
+		t.Fatal(kv.NewError("sealed file writable").With("mode", info.Mode()).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	for _, method := range []string{TreeMethodCopy, TreeMethodHardlink, TreeMethodAuto} {
+		output := t.TempDir()
+		size, err := materializeTree(src, output, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 23 {
+			t.Fatal(kv.NewError("unexpected materialization").With("method", method, "size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		content, errGo := os.ReadFile(filepath.Join(output, "model", "weights.h5"))
+		if errGo != nil || string(content) != "weights" {
+			t.Fatal(kv.NewError("materialized file incorrect").With("method", method, "content", string(content)).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		info, errGo := os.Stat(filepath.Join(output, "data", "train.csv"))
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		linked := info.Sys().(*syscall.Stat_t).Nlink > 1
+		switch method {
+		case TreeMethodHardlink:
+			// Hard links share the read-only permissions of the cached files
+			if !linked || info.Mode().Perm()&0222 != 0 {
+				t.Fatal(kv.NewError("hard link not read-only").With("mode", info.Mode()).With("stack", stack.Trace().TrimRuntime()))
+			}
+		default:
+			// Copies and reflinks belong to the experiment, the auto method never uses hard links
+			if linked || info.Mode().Perm()&0200 == 0 {
+				t.Fatal(kv.NewError("copy not writable").With("method", method, "mode", info.Mode()).With("stack", stack.Trace().TrimRuntime()))
+			}
+		}
+
+		// Experiments must be able to add files to the directories of the tree
+		if errGo = os.WriteFile(filepath.Join(output, "data", "output.csv"), []byte("x"), 0600); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("method", method).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	if err = CheckTreeMethod("bind"); err == nil {
+		t.Fatal(kv.NewError("unknown method accepted").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// useTestTreeCache points the cache, with the tree cache enabled, at a temporary directory for
+// the duration of a test
+//
+func useTestTreeCache(t *testing.T) {
+	savedDir, savedCache, savedIndex := backingDir, cache, index
+	backingDir, cache, index = t.TempDir(), ccache.New(ccache.Configure()), nil
+	DownloaderFactory.SetBackingDir(backingDir)
+	t.Cleanup(func() {
+		cache.Stop()
+		backingDir, cache, index = savedDir, savedCache, savedIndex
+		DownloaderFactory.SetBackingDir(backingDir)
+	})
+	for _, dir := range []string{filepath.Join(backingDir, ".partial"), filepath.Join(backingDir, cacheTreesDir, ".partial")} {
+		if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
+
+// makeTestArchive returns a tar archive of a tree made using makeTestTree
+//
+func makeTestArchive(t *testing.T) (archive []byte) {
+	src := makeTestTree(t)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, dir := range []string{"data/", "model/"} {
+		if errGo := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0750, Typeflag: tar.TypeDir}); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	for _, name := range []string{"data/train.csv", "data/test.csv", "model/weights.h5"} {
+		content, errGo := os.ReadFile(filepath.Join(src, name))
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		hdr := &tar.Header{Name: name, Mode: 0640, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if errGo = tw.WriteHeader(hdr); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if _, errGo = tw.Write(content); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	if errGo := tw.Close(); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	return buf.Bytes()
+}
+
+// TestCacheTreeExtractOnce checks that an archive needed by several experiments at the same time
+// is downloaded and extracted once, and that the tree is then used by all of them
+//
+func TestCacheTreeExtractOnce(t *testing.T) {
+	useTestTreeCache(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := &prefetchStore{content: makeTestArchive(t)}
+	s := &objStore{store: store, immutable: true}
+	hash, _ := store.Hash(ctx, "data.tar")
+	cacheKey := hash + ".tar"
+
+	outputs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	errs := make([]kv.Error, len(outputs))
+	wg := sync.WaitGroup{}
+	for i, output := range outputs {
+		wg.Add(1)
+		go func(i int, output string) {
+			defer wg.Done()
+			_, _, errs[i] = s.fetchTree(ctx, "data.tar", hash, cacheKey, output, 1024*1024, TreeMethodCopy)
+		}(i, output)
+	}
+	wg.Wait()
+
+	for i, output := range outputs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		content, errGo := os.ReadFile(filepath.Join(output, "model", "weights.h5"))
+		if errGo != nil || string(content) != "weights" {
+			t.Fatal(kv.NewError("tree not materialized").With("output", output, "content", string(content)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	if store.fetches != 1 {
+		t.Fatal(kv.NewError("archive downloaded more than once").With("fetches", store.fetches).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo := os.Stat(filepath.Join(backingDir, cacheTreesDir, cacheKey, "data", "train.csv")); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if partials, errGo := os.ReadDir(filepath.Join(backingDir, cacheTreesDir, ".partial")); errGo != nil || len(partials) != 0 {
+		t.Fatal(kv.NewError("extraction staging retained").With("error", errGo, "partials", len(partials)).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestCacheTreeLocking checks that an experiment waits for a tree being extracted by another runner
+// rather than extracting it again, and that trees being materialized are not removed
+//
+func TestCacheTreeLocking(t *testing.T) {
+	useTestTreeCache(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := &prefetchStore{content: makeTestArchive(t)}
+	s := &objStore{store: store, immutable: true}
+	hash, _ := store.Hash(ctx, "data.tar")
+	cacheKey := hash + ".tar"
+	treeDir := filepath.Join(backingDir, cacheTreesDir, cacheKey)
+
+	// Another runner is extracting the tree
+	extractor, err := lockCacheItem(ctx, backingDir, treeLockKey(cacheKey), true, false)
+	if err != nil || extractor == nil {
+		t.Fatal(kv.NewError("exclusive lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	output := t.TempDir()
+	done := make(chan kv.Error, 1)
+	go func() {
+		_, _, err := s.fetchTree(ctx, "data.tar", hash, cacheKey, output, 1024*1024, TreeMethodCopy)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatal(kv.NewError("tree used while being extracted").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	case <-time.After(3 * cacheLockPoll):
+	}
+
+	// The other runner completes the extraction
+	if errGo := os.Rename(makeTestTree(t), treeDir); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	extractor.unlock()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal(kv.NewError("waiting for extraction timed out").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if store.fetches != 0 {
+		t.Fatal(kv.NewError("tree extracted by another runner extracted again").With("fetches", store.fetches).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo := os.Stat(filepath.Join(output, "data", "test.csv")); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// A tree being materialized by another runner is retained
+	reader, err := lockCacheItem(ctx, backingDir, treeLockKey(cacheKey), false, false)
+	if err != nil || reader == nil {
+		t.Fatal(kv.NewError("shared lock not obtained").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if removeTree(cacheKey) {
+		t.Fatal(kv.NewError("tree in use removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+	reader.unlock()
+	if !removeTree(cacheKey) {
+		t.Fatal(kv.NewError("released tree not removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo := os.Stat(cacheLockName(backingDir, treeLockKey(cacheKey))); !os.IsNotExist(errGo) {
+		t.Fatal(kv.NewError("lock of removed tree retained").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"unicode/utf8"
 )
 
+// LineTap is used to observe individual lines of output, after filtering, as they are written
+type LineTap func(line []byte)
+
 type LogOutputProvider interface {
 	GetWriters() (io.Writer, io.Writer)
 	Close() error
@@ -23,16 +26,18 @@ var (
 type OutputWriter struct {
 	output *os.File
 	filter OutputFilter
+	tap    LineTap
 	logger *log.Logger
 	bwOne  *BufferedWriter
 	bwTwo  *BufferedWriter
 	sync.Mutex
 }
 
-func GetFilteredOutputWriter(externOut *os.File, logger *log.Logger, filter OutputFilter) LogOutputProvider {
+func GetFilteredOutputWriter(externOut *os.File, logger *log.Logger, filter OutputFilter, tap LineTap) LogOutputProvider {
 	filterOutput := &OutputWriter{}
 	filterOutput.init(externOut, logger)
 	filterOutput.setFilter(filter)
+	filterOutput.tap = tap
 	return filterOutput
 }
 
@@ -64,10 +69,14 @@ func (or *OutputWriter) sendOut(name string, line []byte) {
 	or.Lock()
 	defer or.Unlock()
 
-	_, err := or.output.Write(or.filter.Filter(line))
+	filtered := or.filter.Filter(line)
+	_, err := or.output.Write(filtered)
 	if err != nil {
 		or.logger.Info("Error writing log output", "log:", name, "err:", err.Error())
 	}
+	if or.tap != nil {
+		or.tap(filtered)
+	}
 }
 
 type BufferedWriter struct {
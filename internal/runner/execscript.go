@@ -16,10 +16,11 @@ import (
 
 // Run will use a generated script file and will run it to completion while marshalling
 // results and files from the computation.  Run is a blocking call and will only return
-// upon completion or termination of the process it starts.
+// upon completion or termination of the process it starts.  The optional tap will be
+// called with each line of output from the script.
 //
 func RunScript(ctx context.Context, scriptPath string, output *os.File, tmpDir string,
-	runKey string, logger *log.Logger) (err kv.Error) {
+	runKey string, tap LineTap, logger *log.Logger) (err kv.Error) {
 
 	defer func() {
 		errMsg := "none"
@@ -48,7 +49,7 @@ func RunScript(ctx context.Context, scriptPath string, output *os.File, tmpDir s
 	cmd.Dir = path.Dir(scriptPath)
 
 	logFilter := GetLogFilterer(logger)
-	logWriter := GetFilteredOutputWriter(output, logger, logFilter)
+	logWriter := GetFilteredOutputWriter(output, logger, logFilter, tap)
 	stdOut, stdErr := logWriter.GetWriters()
 
 	cmd.Stdout = stdOut
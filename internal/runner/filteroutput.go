@@ -3,8 +3,14 @@
 package runner
 
 import (
-	"github.com/andreidenissov-cog/go-service/pkg/log"
+	"fmt"
 	"regexp"
+	"sync"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
 )
 
 type OutputFilter interface {
@@ -18,9 +24,33 @@ var (
 	logFilterReplace2 = []byte("${1}${2}${3}=****")
 )
 
+// LogFilterRule is an operator supplied regular expression, and its replacement text, that is
+// applied to experiment output in addition to the built-in credential filters.  The replacement
+// text can refer to the groups within the expression using ${1} etc.
+//
+type LogFilterRule struct {
+	Expr    string `yaml:"expr" json:"expr"`
+	Replace string `yaml:"replace" json:"replace"`
+}
+
+type logFilterExpr struct {
+	expr    *regexp.Regexp
+	replace []byte
+}
+
+var (
+	logFilterRules = struct {
+		exprs []logFilterExpr
+		sync.Mutex
+	}{
+		exprs: []logFilterExpr{},
+	}
+)
+
 type LogFilterer struct {
 	expr1 *regexp.Regexp
 	expr2 *regexp.Regexp
+	extra []logFilterExpr
 }
 
 func (lf *LogFilterer) Filter(input []byte) []byte {
@@ -30,9 +60,45 @@ func (lf *LogFilterer) Filter(input []byte) []byte {
 	if lf.expr2 != nil {
 		input = lf.expr2.ReplaceAll(input, logFilterReplace2)
 	}
+	for _, rule := range lf.extra {
+		input = rule.expr.ReplaceAll(input, rule.replace)
+	}
 	return input
 }
 
+func compileLogFilterRules(rules []LogFilterRule) (exprs []logFilterExpr, err kv.Error) {
+	exprs = make([]logFilterExpr, 0, len(rules))
+	for i, rule := range rules {
+		if len(rule.Expr) == 0 {
+			return nil, kv.NewError("log filter must have an expression").With("entry", i).With("stack", stack.Trace().TrimRuntime())
+		}
+		expr, errGo := regexp.Compile(rule.Expr)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("setting", fmt.Sprintf("log_filters[%d].expr", i)).With("stack", stack.Trace().TrimRuntime())
+		}
+		exprs = append(exprs, logFilterExpr{expr: expr, replace: []byte(rule.Replace)})
+	}
+	return exprs, nil
+}
+
+// SetLogFilterRules replaces the operator supplied filters applied to the output of experiments
+// that start after this call
+//
+func SetLogFilterRules(rules []LogFilterRule) (err kv.Error) {
+	exprs, err := compileLogFilterRules(rules)
+	if err != nil {
+		return err
+	}
+	setLogFilterExprs(exprs)
+	return nil
+}
+
+func setLogFilterExprs(exprs []logFilterExpr) {
+	logFilterRules.Lock()
+	logFilterRules.exprs = exprs
+	logFilterRules.Unlock()
+}
+
 func compileExpr(expr string, logger *log.Logger) (result *regexp.Regexp) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -49,5 +115,10 @@ func GetLogFilterer(logger *log.Logger) OutputFilter {
 	filter := &LogFilterer{}
 	filter.expr1 = compileExpr(logFilterExpr1, logger)
 	filter.expr2 = compileExpr(logFilterExpr2, logger)
+
+	logFilterRules.Lock()
+	filter.extra = logFilterRules.exprs
+	logFilterRules.Unlock()
+
 	return filter
 }
@@ -0,0 +1,409 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation for the storage sub system that will be used by the
+// runner to retrieve, and upload, artifacts using plain HTTP, typically with S3 pre-signed URLs.
+// Pre-signed URLs allow experimenters to grant time limited access to individual objects
+// without supplying credentials to the runner.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/andreidenissov-cog/go-service/pkg/archive"
+	"github.com/andreidenissov-cog/go-service/pkg/mime"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
+
+	bzip2w "github.com/dsnet/compress/bzip2"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+type httpStorage struct {
+	location string
+	endpoint string
+	name     string // The object name taken from the URL, used when callers supply none
+	upload   *request.PresignedUpload
+}
+
+// NewHTTPStorage is used to allocate and initialize a struct that acts as a receiver for an
+// artifact located using an http, or https, URL.  Options that would need to be included in
+// the signature of a pre-signed URL, such as server side encryption, cannot be honored and are
+// rejected.
+//
+func NewHTTPStorage(spec *StoreOpts) (s *httpStorage, err kv.Error) {
+	uri, errGo := url.Parse(spec.Art.Qualified)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(uri.Host) == 0 {
+		return nil, kv.NewError("the host name was not specified").With("artifact", sourceURI(spec.Art.Qualified)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if spec.Seal != nil {
+		return nil, kv.NewError("encrypted results are not supported by pre-signed URL artifacts").With("artifact", sourceURI(spec.Art.Qualified)).With("stack", stack.Trace().TrimRuntime())
+	}
+	// Metadata added by the runner is advisory and cannot be applied, other options are not
+	if opts := spec.Art.Object; opts != nil && (opts.SSE != nil || len(opts.StorageClass) != 0 || len(opts.Tags) != 0) {
+		return nil, kv.NewError("object options must be included in the signatures of pre-signed URLs").With("artifact", sourceURI(spec.Art.Qualified)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if upload := spec.Art.Upload; upload != nil && len(upload.Parts) != 0 {
+		if len(upload.Complete) == 0 || upload.PartSize < 1 {
+			return nil, kv.NewError("multipart uploads need a completion URL and a part size").With("artifact", sourceURI(spec.Art.Qualified)).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	return &httpStorage{
+		location: spec.Art.Qualified,
+		endpoint: uri.Host,
+		name:     artifactKey(spec.Art, uri),
+		upload:   spec.Art.Upload,
+	}, nil
+}
+
+// Close is a NoP unless overridden
+func (s *httpStorage) Close() {
+}
+
+// do sends a request and checks that a successful status was returned, the body of the
+// response is returned open unless an error is returned
+//
+func (s *httpStorage) do(ctx context.Context, method string, location string, body io.Reader, size int64, header http.Header) (resp *http.Response, err kv.Error) {
+	req, errGo := http.NewRequestWithContext(ctx, method, location, body)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if body != nil {
+		// Pre-signed uploads do not accept chunked transfer encoding
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, errGo = http.DefaultClient.Do(req)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("method", method).With("stack", stack.Trace().TrimRuntime())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// S3 returns an XML document with the reason for the failure
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return resp, kv.NewError("request failed").With("method", method, "status", resp.Status, "reason", string(reason)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return resp, nil
+}
+
+// stat retrieves the hash and size of the artifact.  Pre-signed URLs are signed for a single
+// method so a one byte range is requested using GET, rather than using HEAD.
+//
+func (s *httpStorage) stat(ctx context.Context) (hash string, size int64, err kv.Error) {
+	resp, err := s.do(ctx, http.MethodGet, s.location, nil, 0, http.Header{"Range": []string{"bytes=0-0"}})
+	if err != nil {
+		// Empty objects cannot satisfy the range
+		if resp == nil || resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			return "", 0, err.With("artifact", sourceURI(s.location))
+		}
+	} else {
+		resp.Body.Close()
+	}
+
+	size = resp.ContentLength
+	if contentRange := resp.Header.Get("Content-Range"); len(contentRange) != 0 {
+		// Content-Range: bytes 0-0/1234, or bytes */0
+		if i := strings.LastIndex(contentRange, "/"); i != -1 {
+			if total, errGo := strconv.ParseInt(contentRange[i+1:], 10, 64); errGo == nil {
+				size = total
+			}
+		}
+	}
+
+	hash = strings.Trim(resp.Header.Get("ETag"), `"`)
+	if len(hash) == 0 {
+		// Servers without entity tags are identified using the modification time and size
+		if modified := resp.Header.Get("Last-Modified"); len(modified) != 0 && size >= 0 {
+			hash = fmt.Sprintf("%x", sha256.Sum256([]byte(modified+"/"+strconv.FormatInt(size, 10))))
+		}
+	}
+	if len(hash) == 0 {
+		return "", 0, kv.NewError("server did not identify the artifact contents").With("artifact", sourceURI(s.location)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return hash, size, nil
+}
+
+// Hash returns the entity tag of the artifact, for S3 this is the same hash that would be
+// returned using the S3 storage implementation
+//
+func (s *httpStorage) Hash(ctx context.Context, name string) (hash string, err kv.Error) {
+	hash, _, err = s.stat(ctx)
+	return hash, err
+}
+
+// Size returns the size of the artifact without retrieving it
+//
+func (s *httpStorage) Size(ctx context.Context, name string) (size int64, err kv.Error) {
+	_, size, err = s.stat(ctx)
+	return size, err
+}
+
+// Gather is not supported as URLs address single objects
+//
+func (s *httpStorage) Gather(ctx context.Context, keyPrefix string, outputDir string, maxBytes int64, tap io.Writer, failFast bool) (size int64, warnings []kv.Error, err kv.Error) {
+	return 0, warnings, kv.NewError("unimplemented").With("stack", stack.Trace().TrimRuntime())
+}
+
+// Fetch is used to retrieve the artifact and either copy it directly into the output
+// directory, or unpack it into the output directory.  The name is used only to determine the
+// type of the artifact and the name of the file that is written.
+//
+// The tap can be used to make a side copy of the content that is being read, when no
+// output is supplied the content is only written to the tap.
+//
+func (s *httpStorage) Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64, tap io.Writer) (size int64, warns []kv.Error, err kv.Error) {
+
+	if len(name) == 0 {
+		name = s.name
+	}
+	errCtx := kv.With("output", output).With("name", name).With("artifact", sourceURI(s.location))
+
+	if len(output) != 0 {
+		info, errGo := os.Stat(output)
+		if errGo != nil {
+			return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		if !info.IsDir() {
+			return 0, warns, errCtx.NewError("a directory was not used, or did not exist").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	xfer, err := transfer.Start(ctx, s.endpoint, transfer.Download)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer xfer.Done()
+
+	resp, err := s.do(ctx, http.MethodGet, s.location, nil, 0, nil)
+	if err != nil {
+		return 0, warns, errCtx.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > maxBytes {
+		return 0, warns, errCtx.NewError("blob size exceeded").With("size", resp.ContentLength, "budget", maxBytes).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Reads are limited to the bandwidth available for the endpoint
+	in := xfer.Reader(resp.Body)
+
+	if len(output) == 0 {
+		// Special case when we just need to download file as it is.
+		size, errGo := io.CopyN(tap, in, maxBytes)
+		if errGo != nil && !errors.Is(errGo, io.EOF) {
+			return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return size, warns, nil
+	}
+
+	if tap != nil {
+		in = io.TeeReader(in, tap)
+	}
+
+	fileType, w := mime.MimeFromExt(name)
+	if w != nil {
+		warns = append(warns, w)
+	}
+
+	size, w2, err := fetcher(in, name, output, maxBytes, fileType, unpack)
+	warns = append(warns, w2...)
+	if err != nil {
+		return 0, warns, errCtx.Wrap(err)
+	}
+	return size, warns, nil
+}
+
+// writeArchive writes the files as a tar archive, compressed according to the extension of
+// the destination name
+//
+func writeArchive(out io.Writer, files *archive.TarWriter, dest string) (err kv.Error) {
+	typ, _ := mime.MimeFromExt(dest)
+
+	var outZ io.WriteCloser
+	switch typ {
+	case "application/tar", "application/octet-stream":
+	case "application/bzip2":
+		outZ, _ = bzip2w.NewWriter(out, &bzip2w.WriterConfig{Level: 6})
+	case "application/x-gzip":
+		outZ = gzip.NewWriter(out)
+	case "application/zip":
+		return kv.NewError("only tar archives are supported").With("stack", stack.Trace().TrimRuntime()).With("key", dest)
+	default:
+		return kv.NewError("unrecognized upload compression").With("stack", stack.Trace().TrimRuntime()).With("key", dest)
+	}
+
+	tw := tar.NewWriter(out)
+	if outZ != nil {
+		tw = tar.NewWriter(outZ)
+	}
+	if err = files.Write(tw); err != nil {
+		return err.With("key", dest)
+	}
+	if errGo := tw.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("key", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	if outZ != nil {
+		if errGo := outZ.Close(); errGo != nil {
+			return kv.Wrap(errGo).With("key", dest).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// Deposit archives the src directory and uploads it using a pre-signed PUT, or as a multipart
+// upload when part URLs were supplied.  Artifacts without a separate upload use the qualified
+// URL, which must then have been signed for PUT.
+//
+func (s *httpStorage) Deposit(ctx context.Context, src string, dest string) (warns []kv.Error, err kv.Error) {
+
+	if len(dest) == 0 {
+		dest = s.name
+	}
+	if !archive.IsTar(dest) {
+		return warns, kv.NewError("uploads must be tar, or tar compressed files").With("stack", stack.Trace().TrimRuntime()).With("key", dest)
+	}
+
+	files, err := archive.NewTarWriter(src)
+	if err != nil {
+		return warns, err
+	}
+
+	if !files.HasFiles() {
+		warns = append(warns, kv.NewError("no files found").With("src", src).With("stack", stack.Trace().TrimRuntime()))
+		return warns, nil
+	}
+
+	tf, errGo := os.CreateTemp("", "deposit")
+	if errGo != nil {
+		return warns, kv.Wrap(errGo).With("src", src, "dest", dest)
+	}
+	defer func() {
+		tf.Close()
+		os.Remove(tf.Name())
+	}()
+
+	if err = writeArchive(tf, files, dest); err != nil {
+		return warns, err.With("src", src)
+	}
+	size, errGo := tf.Seek(0, io.SeekCurrent)
+	if errGo != nil {
+		return warns, kv.Wrap(errGo).With("src", src, "dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	xfer, err := transfer.Start(ctx, s.endpoint, transfer.Upload)
+	if err != nil {
+		return warns, err
+	}
+	defer xfer.Done()
+
+	if s.upload != nil && len(s.upload.Parts) != 0 {
+		err = s.uploadParts(ctx, xfer, tf, size)
+	} else {
+		location := s.location
+		if s.upload != nil && len(s.upload.URL) != 0 {
+			location = s.upload.URL
+		}
+		_, err = s.put(ctx, xfer, location, io.NewSectionReader(tf, 0, size), size)
+	}
+	if err != nil {
+		return warns, err.With("src", src, "dest", dest, "artifact", sourceURI(s.location))
+	}
+	return warns, nil
+}
+
+// put uploads the contents of the reader using a pre-signed PUT and returns the entity tag
+// of the uploaded data
+//
+func (s *httpStorage) put(ctx context.Context, xfer *transfer.Transfer, location string, body io.Reader, size int64) (etag string, err kv.Error) {
+	resp, err := s.do(ctx, http.MethodPut, location, xfer.Reader(body), size, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// uploadParts uploads the archive using the UploadPart URLs of a multipart upload and then
+// completes the upload
+//
+func (s *httpStorage) uploadParts(ctx context.Context, xfer *transfer.Transfer, src io.ReaderAt, size int64) (err kv.Error) {
+	count := int((size + s.upload.PartSize - 1) / s.upload.PartSize)
+	if count == 0 {
+		count = 1
+	}
+	if count > len(s.upload.Parts) {
+		return kv.NewError("archive needs more parts than were supplied").With("parts", count, "supplied", len(s.upload.Parts), "size", size).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	complete := completeMultipartUpload{}
+	for i := 0; i != count; i++ {
+		offset := int64(i) * s.upload.PartSize
+		partSize := s.upload.PartSize
+		if offset+partSize > size {
+			partSize = size - offset
+		}
+		etag, err := s.put(ctx, xfer, s.upload.Parts[i], io.NewSectionReader(src, offset, partSize), partSize)
+		if err != nil {
+			return err.With("part", i+1)
+		}
+		if len(etag) == 0 {
+			return kv.NewError("part upload returned no entity tag").With("part", i+1).With("stack", stack.Trace().TrimRuntime())
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+
+	body, errGo := xml.Marshal(&complete)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp, err := s.do(ctx, http.MethodPost, s.upload.Complete, bytes.NewReader(body), int64(len(body)), http.Header{"Content-Type": []string{"application/xml"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report a failure to complete the upload after the status has been sent
+	result, errGo := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		return kv.NewError("multipart upload not completed").With("reason", string(result)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
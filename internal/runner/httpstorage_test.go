@@ -0,0 +1,220 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for artifacts located using pre-signed URLs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// presignedServer emulates the handling of pre-signed URLs by S3, the signature of each URL
+// names the only method it can be used with
+type presignedServer struct {
+	objects map[string][]byte
+	parts   map[int][]byte
+	sync.Mutex
+}
+
+func (ps *presignedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if r.URL.Query().Get("X-Amz-Signature") != r.Method {
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPut && r.ContentLength < 0 {
+		http.Error(w, "<Error><Code>MissingContentLength</Code></Error>", http.StatusLengthRequired)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(body))
+
+	switch {
+	case r.Method == http.MethodPut && len(r.URL.Query().Get("partNumber")) != 0:
+		part, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		ps.parts[part] = body
+		w.Header().Set("ETag", etag)
+	case r.Method == http.MethodPut:
+		ps.objects[r.URL.Path] = body
+		w.Header().Set("ETag", etag)
+	case r.Method == http.MethodPost:
+		complete := completeMultipartUpload{}
+		if errGo := xml.Unmarshal(body, &complete); errGo != nil {
+			http.Error(w, "<Error><Code>MalformedXML</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		object := []byte{}
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"%x"`, md5.Sum(ps.parts[i+1])) {
+				// S3 reports some failures after the status has been sent
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object = append(object, ps.parts[i+1]...)
+		}
+		ps.objects[r.URL.Path] = object
+	case r.Method == http.MethodGet:
+		object, isPresent := ps.objects[r.URL.Path]
+		if !isPresent {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(object)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	}
+}
+
+// TestHTTPStorage checks that artifacts can be deposited, hashed, and fetched using pre-signed
+// URLs, including multipart uploads, and that options which cannot be honored are rejected
+//
+func TestHTTPStorage(t *testing.T) {
+	ctx := context.Background()
+
+	ps := &presignedServer{objects: map[string][]byte{}, parts: map[int][]byte{}}
+	server := httptest.NewServer(ps)
+	defer server.Close()
+
+	src, errGo := ioutil.TempDir("", "http-storage")
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(src)
+
+	content := make([]byte, 300*1024)
+	if _, errGo = rand.Read(content); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(src, "model.bin"), content, 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	signed := func(path string, method string, query string) (location string) {
+		return server.URL + path + "?" + query + "X-Amz-Expires=3600&X-Amz-Signature=" + method
+	}
+
+	uploads := map[string]*request.PresignedUpload{
+		"put": {URL: signed("/results/put.tar", http.MethodPut, "")},
+		"multipart": {
+			Parts: []string{
+				signed("/results/multipart.tar", http.MethodPut, "partNumber=1&uploadId=1&"),
+				signed("/results/multipart.tar", http.MethodPut, "partNumber=2&uploadId=1&"),
+				signed("/results/multipart.tar", http.MethodPut, "partNumber=3&uploadId=1&"),
+			},
+			PartSize: 128 * 1024,
+			Complete: signed("/results/multipart.tar", http.MethodPost, "uploadId=1&"),
+		},
+	}
+
+	for name, upload := range uploads {
+		art := &request.Artifact{
+			Qualified: signed("/results/"+name+".tar", http.MethodGet, ""),
+			Mutable:   true,
+			Unpack:    true,
+			Upload:    upload,
+		}
+		store, err := NewStorage(ctx, &StoreOpts{Art: art, Validate: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(art.Key) != 0 {
+			t.Fatal(kv.NewError("artifact modified by the storage").With("key", art.Key).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if key := store.(*httpStorage).name; key != "results/"+name+".tar" {
+			t.Fatal(kv.NewError("key not taken from the URL").With("key", key).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		if _, err = store.Deposit(ctx, src, objectName(art)); err != nil {
+			t.Fatal(err.With("upload", name))
+		}
+
+		hash, err := store.Hash(ctx, objectName(art))
+		if err != nil {
+			t.Fatal(err.With("upload", name))
+		}
+		if expected := fmt.Sprintf("%x", md5.Sum(ps.objects["/results/"+name+".tar"])); hash != expected {
+			t.Fatal(kv.NewError("hash mismatched").With("upload", name, "hash", hash, "expected", expected).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if size, err := store.(*httpStorage).Size(ctx, objectName(art)); err != nil || size != int64(len(ps.objects["/results/"+name+".tar"])) {
+			t.Fatal(kv.NewError("size mismatched").With("upload", name, "size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		output, errGo := ioutil.TempDir("", "http-storage")
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		defer os.RemoveAll(output)
+
+		tap := &bytes.Buffer{}
+		if _, _, err = store.Fetch(ctx, objectName(art), true, output, 1024*1024, tap); err != nil {
+			t.Fatal(err.With("upload", name))
+		}
+		fetched, errGo := ioutil.ReadFile(filepath.Join(output, "model.bin"))
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("upload", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !bytes.Equal(fetched, content) || tap.Len() == 0 {
+			t.Fatal(kv.NewError("fetched artifact differs").With("upload", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+		store.Close()
+	}
+
+	// Too few parts for the archive
+	art := &request.Artifact{
+		Qualified: signed("/results/short.tar", http.MethodGet, ""),
+		Mutable:   true,
+		Upload: &request.PresignedUpload{
+			Parts:    uploads["multipart"].Parts[:1],
+			PartSize: 128 * 1024,
+			Complete: uploads["multipart"].Complete,
+		},
+	}
+	store, err := NewStorage(ctx, &StoreOpts{Art: art})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name of the object is taken from the URL when none is supplied
+	if _, err = store.Deposit(ctx, src, ""); err == nil {
+		t.Fatal(kv.NewError("archive uploaded using too few parts").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Options that need to be part of the signature are rejected
+	key, errGo := rsa.GenerateKey(rand.Reader, 1024)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	invalid := map[string]*StoreOpts{
+		"sealed": {Art: &request.Artifact{Qualified: signed("/results/a.tar", http.MethodGet, "")}, Seal: &key.PublicKey},
+		"sse": {Art: &request.Artifact{Qualified: signed("/results/a.tar", http.MethodGet, ""),
+			Object: &request.ObjectOptions{SSE: &request.ServerSideEncryption{Type: "SSE-S3"}}}},
+		"multipart": {Art: &request.Artifact{Qualified: signed("/results/a.tar", http.MethodGet, ""),
+			Upload: &request.PresignedUpload{Parts: []string{signed("/results/a.tar", http.MethodPut, "")}}}},
+	}
+	for name, spec := range invalid {
+		if _, err := NewStorage(ctx, spec); err == nil {
+			t.Fatal(kv.NewError("invalid artifact accepted").With("case", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
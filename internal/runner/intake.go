@@ -0,0 +1,321 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of an HTTP intake handler that accepts
+// signed StudioML requests from clients and places them onto local file queues,
+// allowing experiments to be submitted without any queue infrastructure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+	"github.com/rs/xid"
+)
+
+const (
+	// IntakePrefix is the URL path under which the intake handler serves requests
+	IntakePrefix = "/v1/queues/"
+
+	// intakeMsgLimit is the largest request body that will be accepted
+	intakeMsgLimit = 4 * 1024 * 1024
+
+	// intakeSeenDir is the directory under the queue root that holds a record of the
+	// signed payloads already accepted, preventing a captured request from being
+	// submitted again.  Queue names cannot start with a period so it cannot collide
+	// with a queue.
+	intakeSeenDir = ".intake-seen"
+
+	// intakePruneInterval is the shortest period between removals of expired records
+	// from the intakeSeenDir directory
+	intakePruneInterval = time.Minute
+)
+
+var (
+	// intakeQueueName restricts queue names to those that are safe to use as a single
+	// directory name under the queue root
+	intakeQueueName = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_\-.]*$`)
+)
+
+// IntakeReceipt is the JSON document returned to clients describing a request that
+// was accepted, or the current state of a request that was previously accepted
+type IntakeReceipt struct {
+	AccessionID string `json:"accession_id"`
+	Queue       string `json:"queue"`
+	Status      string `json:"status"`
+	StatusURL   string `json:"status_url"`
+}
+
+// Intake is an http.Handler that verifies signed request envelopes against the
+// request signature store and publishes them to local file queues
+type Intake struct {
+	queue   *LocalQueue
+	sigs    *defense.PubkeyStore
+	baseURL string        // The externally visible URL of the intake used in status URLs, derived from each request when empty
+	window  time.Duration // The period either side of the present within which the time_added of a request must fall
+	pruned  time.Time     // The last time expired records of accepted requests were removed
+	logger  *log.Logger
+	sync.Mutex
+}
+
+// NewIntake creates an intake handler that publishes verified requests to the local
+// file queues found under the root of the supplied queue.  The baseURL is the scheme
+// and host clients use to reach the intake, for example when it sits behind a proxy,
+// and can be left empty.  Requests added outside of the replay window are rejected and
+// the records of accepted requests are kept for the replay window.
+//
+func NewIntake(queue *LocalQueue, sigs *defense.PubkeyStore, baseURL string, window time.Duration, logger *log.Logger) (intake *Intake) {
+	return &Intake{
+		queue:   queue,
+		sigs:    sigs,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		window:  window,
+		logger:  logger,
+	}
+}
+
+// checkQueue validates that a queue name supplied by a client can be used as a directory
+// name and is one that the runner is configured to take work from
+//
+func checkQueue(queue string) (err kv.Error) {
+	if !intakeQueueName.MatchString(queue) {
+		return kv.NewError("invalid queue name").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+	matcher, mismatcher := GetQueuePatterns()
+	if matcher == nil || !matcher.MatchString(queue) {
+		return kv.NewError("queue name not matched").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+	if mismatcher != nil && mismatcher.MatchString(queue) {
+		return kv.NewError("queue name excluded").With("queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (in *Intake) reply(w http.ResponseWriter, code int, receipt *IntakeReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if errGo := json.NewEncoder(w).Encode(receipt); errGo != nil {
+		in.logger.Warn("intake reply failed", "error", errGo.Error(), "stack", stack.Trace().TrimRuntime())
+	}
+}
+
+func (in *Intake) reject(w http.ResponseWriter, r *http.Request, code int, err kv.Error) {
+	in.logger.Warn("intake request rejected", "remote", r.RemoteAddr, "path", r.URL.Path, "error", err.Error())
+	http.Error(w, http.StatusText(code), code)
+}
+
+// ServeHTTP handles POST requests to /v1/queues/{queue}/messages that submit work, and
+// GET requests to /v1/queues/{queue}/messages/{accession_id} that report on the state
+// of submitted work
+//
+func (in *Intake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, IntakePrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, IntakePrefix) || len(parts) < 2 || len(parts) > 3 || parts[1] != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+
+	queue := parts[0]
+	if err := checkQueue(queue); err != nil {
+		in.reject(w, r, http.StatusNotFound, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		in.submit(w, r, queue)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		in.status(w, r, queue, parts[2])
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// statusURL returns the URL a client can use to query an accepted request.  When no
+// base URL has been configured the X-Forwarded-Proto header set by proxies terminating
+// TLS is honoured.
+//
+func (in *Intake) statusURL(r *http.Request, queue string, id string) (url string) {
+	base := in.baseURL
+	if len(base) == 0 {
+		scheme := "https"
+		if r.TLS == nil {
+			scheme = "http"
+		}
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + IntakePrefix + queue + "/messages/" + id
+}
+
+// inWindow checks that the time a request was added falls within the replay window, requests
+// outside of the window may have had their record of acceptance expired
+//
+func (in *Intake) inWindow(added float64) (err kv.Error) {
+	addedAt := time.Unix(0, int64(added*float64(time.Second)))
+	if age := time.Since(addedAt); age > in.window || age < -in.window {
+		return kv.NewError("request outside of the replay window").With("time_added", addedAt, "window", in.window).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// prune removes the records of accepted requests that are older than the replay window,
+// requests that old are rejected by inWindow so the records are no longer needed
+//
+func (in *Intake) prune(seenDir string) {
+	in.Lock()
+	if time.Since(in.pruned) < intakePruneInterval {
+		in.Unlock()
+		return
+	}
+	in.pruned = time.Now()
+	in.Unlock()
+
+	entries, errGo := ioutil.ReadDir(seenDir)
+	if errGo != nil {
+		in.logger.Warn("intake records not pruned", "path", seenDir, "error", errGo.Error(), "stack", stack.Trace().TrimRuntime())
+		return
+	}
+	expired := time.Now().Add(-in.window)
+	for _, entry := range entries {
+		if entry.IsDir() || !entry.ModTime().Before(expired) {
+			continue
+		}
+		if errGo = os.Remove(filepath.Join(seenDir, entry.Name())); errGo != nil && !os.IsNotExist(errGo) {
+			in.logger.Warn("intake record not pruned", "path", filepath.Join(seenDir, entry.Name()), "error", errGo.Error(), "stack", stack.Trace().TrimRuntime())
+		}
+	}
+}
+
+// claim records the signed payload of a request as having been accepted, returning
+// false if it was seen before.  Payloads are encrypted using a fresh key for every
+// request so a repeated payload is a replay of an earlier submission.  The records
+// are files so that they survive restarts and are shared by runners using the same
+// queue root, records older than the replay window are removed.
+//
+func (in *Intake) claim(payload string) (fresh bool, unclaim func(), err kv.Error) {
+	seenDir := filepath.Join(in.queue.RootDir, intakeSeenDir)
+	if errGo := os.MkdirAll(seenDir, 0o700); errGo != nil {
+		return false, nil, kv.Wrap(errGo).With("path", seenDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	in.prune(seenDir)
+
+	digest := sha256.Sum256([]byte(payload))
+	fn := filepath.Join(seenDir, hex.EncodeToString(digest[:]))
+	f, errGo := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errGo != nil {
+		if os.IsExist(errGo) {
+			return false, nil, nil
+		}
+		return false, nil, kv.Wrap(errGo).With("path", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	f.Close()
+	return true, func() { os.Remove(fn) }, nil
+}
+
+func (in *Intake) submit(w http.ResponseWriter, r *http.Request, queue string) {
+	data, errGo := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, intakeMsgLimit))
+	if errGo != nil {
+		in.reject(w, r, http.StatusRequestEntityTooLarge, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		return
+	}
+
+	// Only signed envelopes are accepted, clear text requests cannot be attributed
+	// to a client
+	if isEnvelope, err := defense.IsEnvelope(data); !isEnvelope {
+		if err == nil {
+			err = kv.NewError("request is not an envelope").With("stack", stack.Trace().TrimRuntime())
+		}
+		in.reject(w, r, http.StatusBadRequest, err)
+		return
+	}
+	envelope, err := defense.UnmarshalEnvelope(data)
+	if err != nil {
+		in.reject(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	fp, err := in.sigs.VerifyEnvelope(queue, envelope)
+	if err != nil {
+		in.reject(w, r, http.StatusForbidden, err.With("fingerprint", fp, "message.Fingerprint", envelope.Message.Fingerprint))
+		return
+	}
+
+	if err = in.inWindow(envelope.Message.TimeAdded); err != nil {
+		in.reject(w, r, http.StatusBadRequest, err.With("fingerprint", fp))
+		return
+	}
+
+	fresh, unclaim, err := in.claim(envelope.Message.Payload)
+	if err != nil {
+		in.logger.Warn("intake replay check failed", "queue", queue, "error", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !fresh {
+		in.reject(w, r, http.StatusConflict, kv.NewError("request already submitted").With("fingerprint", fp).With("stack", stack.Trace().TrimRuntime()))
+		return
+	}
+
+	id, err := in.queue.PublishItem(queue, "application/json", data, true)
+	if err != nil {
+		// Allow the client to retry a request that was never queued
+		unclaim()
+		in.logger.Warn("intake publish failed", "queue", queue, "error", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	in.logger.Info("intake request accepted", "queue", queue, "accession_id", id, "fingerprint", fp, "remote", r.RemoteAddr)
+
+	in.reply(w, http.StatusAccepted, &IntakeReceipt{
+		AccessionID: id,
+		Queue:       queue,
+		Status:      "queued",
+		StatusURL:   in.statusURL(r, queue, id),
+	})
+}
+
+func (in *Intake) status(w http.ResponseWriter, r *http.Request, queue string, id string) {
+	if _, errGo := xid.FromString(id); errGo != nil {
+		in.reject(w, r, http.StatusNotFound, kv.Wrap(errGo).With("accession_id", id).With("stack", stack.Trace().TrimRuntime()))
+		return
+	}
+
+	queued, err := in.queue.IsQueued(queue, id)
+	if err != nil {
+		in.logger.Warn("intake status failed", "queue", queue, "accession_id", id, "error", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Once a runner has taken the request from the queue the accession ID is no longer
+	// tracked by the intake
+	status := "dequeued"
+	if queued {
+		status = "queued"
+	}
+	in.reply(w, http.StatusOK, &IntakeReceipt{
+		AccessionID: id,
+		Queue:       queue,
+		Status:      status,
+		StatusURL:   in.statusURL(r, queue, id),
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the signed request intake handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+	"golang.org/x/crypto/ssh"
+)
+
+func signedEnvelope(t *testing.T, signer ssh.Signer, payload string) (data []byte) {
+	envelope := &defense.Envelope{
+		Message: defense.Message{
+			TimeAdded: float64(time.Now().UnixNano()) / float64(time.Second),
+			Payload:   payload,
+		},
+	}
+	if err := envelope.Sign(signer); err != nil {
+		t.Fatal(err)
+	}
+	data, errGo := envelope.Marshal()
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	return data
+}
+
+func intakeDo(t *testing.T, intake *Intake, method string, url string, body []byte, headers ...string) (code int, receipt *IntakeReceipt) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, url, bytes.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	intake.ServeHTTP(w, r)
+
+	receipt = &IntakeReceipt{}
+	if w.Code == http.StatusOK || w.Code == http.StatusAccepted {
+		if errGo := json.Unmarshal(w.Body.Bytes(), receipt); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("body", w.Body.String()).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	return w.Code, receipt
+}
+
+// TestIntake exercises the acceptance of signed requests, the rejection of requests with
+// bad signatures or queue names, the status reporting for accepted requests, and the
+// verification of accepted requests once a runner takes them from the local queue
+//
+func TestIntake(t *testing.T) {
+	queue := "local_intake"
+
+	qDir, errGo := os.MkdirTemp("", "intake-queues")
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(qDir)
+
+	sigDir, errGo := os.MkdirTemp("", "intake-sigs")
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(sigDir)
+
+	_, prvKey, errGo := ed25519.GenerateKey(rand.Reader)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	signer, errGo := ssh.NewSignerFromKey(prvKey)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	fn := filepath.Join(sigDir, queue)
+	if errGo = os.WriteFile(fn, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errorC := make(chan kv.Error, 1)
+	go func() {
+		for {
+			select {
+			case err := <-errorC:
+				if err != nil {
+					t.Log(err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	sigs, err := defense.InitRqstSigWatcher(ctx, sigDir, errorC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the signature store to load the key
+	for sigs.GetRefresh() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	<-sigs.GetRefresh().Done()
+
+	match, mismatch := queueMatcher.getExprs()
+	intakeMatch, intakeMismatch := "^local_", "_response$"
+	queueMatcher.updatePatterns(&intakeMatch, &intakeMismatch)
+	defer queueMatcher.updatePatterns(&match, &mismatch)
+
+	window := time.Hour
+	intake := NewIntake(NewLocalQueue(qDir, nil, log.NewLogger("intake")), sigs, "", window, log.NewLogger("intake"))
+	url := IntakePrefix + queue + "/messages"
+
+	// A correctly signed request is queued
+	data := signedEnvelope(t, signer, "payload")
+	code, receipt := intakeDo(t, intake, http.MethodPost, url, data)
+	if code != http.StatusAccepted || receipt.Status != "queued" || len(receipt.AccessionID) == 0 {
+		t.Fatal(kv.NewError("request not accepted").With("code", code, "receipt", receipt).With("stack", stack.Trace().TrimRuntime()))
+	}
+	queued, errGo := os.ReadFile(path.Join(qDir, queue, receipt.AccessionID))
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !bytes.Equal(queued, data) {
+		t.Fatal(kv.NewError("queued request mismatch").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	statusURL := url + "/" + receipt.AccessionID
+	if receipt.StatusURL != "http://example.com"+statusURL {
+		t.Fatal(kv.NewError("unexpected status URL").With("status_url", receipt.StatusURL).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// The same signed request cannot be submitted a second time
+	if code, _ := intakeDo(t, intake, http.MethodPost, url, data); code != http.StatusConflict {
+		t.Fatal(kv.NewError("replayed request not rejected").With("code", code).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Proxies terminating TLS are honoured, and a configured base URL takes precedence
+	if code, receipt = intakeDo(t, intake, http.MethodGet, statusURL, nil, "X-Forwarded-Proto", "https"); code != http.StatusOK || receipt.Status != "queued" {
+		t.Fatal(kv.NewError("unexpected status").With("code", code, "receipt", receipt).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if receipt.StatusURL != "https://example.com"+statusURL {
+		t.Fatal(kv.NewError("unexpected status URL").With("status_url", receipt.StatusURL).With("stack", stack.Trace().TrimRuntime()))
+	}
+	proxied := NewIntake(intake.queue, sigs, "https://intake.example.org/", window, log.NewLogger("intake"))
+	if _, receipt = intakeDo(t, proxied, http.MethodGet, statusURL, nil); receipt.StatusURL != "https://intake.example.org"+statusURL {
+		t.Fatal(kv.NewError("unexpected status URL").With("status_url", receipt.StatusURL).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// A runner taking the request from the local queue verifies its signature using the
+	// same queue name as the intake did
+	handled := 0
+	qt := &task.QueueTask{
+		Subscription: filepath.Join(qDir, queue),
+		Handler: func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+			handled++
+			envelope, _, err := defense.DecodeEnvelope(qt.Msg, false)
+			if err != nil {
+				return nil, false, err
+			}
+			if _, err = sigs.VerifyEnvelope(qt.ShortQName, envelope); err != nil {
+				return nil, false, err.With("queue", qt.ShortQName)
+			}
+			return nil, true, nil
+		},
+	}
+	if processed, _, err := intake.queue.Work(ctx, qt); err != nil || !processed || handled != 1 {
+		t.Fatal(kv.NewError("queued request not verified").With("processed", processed, "handled", handled, "error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if code, receipt = intakeDo(t, intake, http.MethodGet, statusURL, nil); code != http.StatusOK || receipt.Status != "dequeued" {
+		t.Fatal(kv.NewError("unexpected status").With("code", code, "receipt", receipt).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// A request whose payload does not match the signature is rejected
+	tampered := &defense.Envelope{}
+	if errGo = json.Unmarshal(data, tampered); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	tampered.Message.Payload = "tampered"
+	tamperedData, _ := tampered.Marshal()
+
+	cases := []struct {
+		url    string
+		method string
+		body   []byte
+		code   int
+	}{
+		{url: url, method: http.MethodPost, body: tamperedData, code: http.StatusForbidden},
+		{url: url, method: http.MethodPost, body: []byte(`{"experiment": {}}`), code: http.StatusBadRequest},
+		{url: IntakePrefix + "local_other/messages", method: http.MethodPost, body: data, code: http.StatusForbidden},
+		{url: IntakePrefix + "sqs_intake/messages", method: http.MethodPost, body: data, code: http.StatusNotFound},
+		{url: IntakePrefix + "local_intake_response/messages", method: http.MethodPost, body: data, code: http.StatusNotFound},
+		{url: IntakePrefix + "..local/messages", method: http.MethodPost, body: data, code: http.StatusNotFound},
+		{url: url + "/not-an-id", method: http.MethodGet, code: http.StatusNotFound},
+		{url: url, method: http.MethodGet, code: http.StatusMethodNotAllowed},
+	}
+	for _, aCase := range cases {
+		if code, _ := intakeDo(t, intake, aCase.method, aCase.url, aCase.body); code != aCase.code {
+			t.Fatal(kv.NewError("unexpected response").With("url", aCase.url, "code", code, "expected", aCase.code).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// Requests added outside of the replay window are rejected as their record of
+	// acceptance could have been pruned
+	stale := &defense.Envelope{}
+	if errGo = json.Unmarshal(signedEnvelope(t, signer, "stale"), stale); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	stale.Message.TimeAdded -= (2 * window).Seconds()
+	staleData, _ := stale.Marshal()
+	if code, _ := intakeDo(t, intake, http.MethodPost, url, staleData); code != http.StatusBadRequest {
+		t.Fatal(kv.NewError("stale request not rejected").With("code", code).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Records of accepted requests older than the replay window are pruned
+	seen, errGo := os.ReadDir(filepath.Join(qDir, intakeSeenDir))
+	if errGo != nil || len(seen) != 1 {
+		t.Fatal(kv.NewError("unexpected intake records").With("records", len(seen), "error", errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	expired := time.Now().Add(-2 * window)
+	if errGo = os.Chtimes(filepath.Join(qDir, intakeSeenDir, seen[0].Name()), expired, expired); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	intake.pruned = time.Time{}
+	if code, _ := intakeDo(t, intake, http.MethodPost, url, signedEnvelope(t, signer, "fresh")); code != http.StatusAccepted {
+		t.Fatal(kv.NewError("request not accepted").With("code", code).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if pruned, _ := os.ReadDir(filepath.Join(qDir, intakeSeenDir)); len(pruned) != 1 || pruned[0].Name() == seen[0].Name() {
+		t.Fatal(kv.NewError("expired intake record not pruned").With("records", len(pruned)).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Only the accepted request should have been written to the queues, alongside the
+	// record of accepted requests
+	if entries, _ := os.ReadDir(qDir); len(entries) != 2 {
+		t.Fatal(kv.NewError("unexpected queues created").With("entries", len(entries)).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
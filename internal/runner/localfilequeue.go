@@ -13,6 +13,8 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/andreidenissov-cog/go-service/pkg/log"
@@ -70,31 +72,54 @@ func (fq *LocalQueue) ensureQueueExists(queueName string, allow_create bool) (qu
 }
 
 func (fq *LocalQueue) Publish(queueName string, contentType string, msg []byte, allow_create bool) (err kv.Error) {
+	_, err = fq.PublishItem(queueName, contentType, msg, allow_create)
+	return err
+}
+
+// PublishItem places a message on the named queue and returns the id of the
+// queue item that was created, the id remains on the queue until the item is
+// retrieved by a runner
+//
+func (fq *LocalQueue) PublishItem(queueName string, contentType string, msg []byte, allow_create bool) (id string, err kv.Error) {
 	queuePath := ""
 	if queuePath, err = fq.ensureQueueExists(queueName, allow_create); err != nil {
-		return err
+		return "", err
 	}
 	// Get a unique file name for our queue item:
 	fileName := xid.New().String()
 	tempDir := path.Join(queuePath, xid.New().String())
 	if errGo := os.Mkdir(tempDir, os.ModeDir|0o775); errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempDir)
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempDir)
 	}
 	defer os.Remove(tempDir)
 	tempFile := path.Join(tempDir, fileName)
 	itemFile, errGo := os.Create(tempFile)
 	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempFile)
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempFile)
 	}
 	_, errGo = itemFile.Write(msg)
 	itemFile.Close()
 	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempFile)
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", tempFile)
 	}
 	if errGo = os.Rename(tempFile, path.Join(queuePath, fileName)); errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("temp", tempFile).With("path", path.Join(queuePath, fileName))
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("temp", tempFile).With("path", path.Join(queuePath, fileName))
+	}
+	return fileName, nil
+}
+
+// IsQueued tests whether the item with the supplied id is still waiting on the
+// named queue
+//
+func (fq *LocalQueue) IsQueued(queueName string, id string) (queued bool, err kv.Error) {
+	itemPath := path.Join(fq.RootDir, queueName, id)
+	if _, errGo := os.Stat(itemPath); errGo != nil {
+		if os.IsNotExist(errGo) {
+			return false, nil
+		}
+		return false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", itemPath)
 	}
-	return nil
+	return true, nil
 }
 
 // Refresh will examine the local file queues "server" and extract a list of the queues
@@ -127,6 +152,11 @@ func (fq *LocalQueue) Refresh(ctx context.Context, matcher *regexp.Regexp, misma
 		}
 		dirName := info.Name()
 
+		// Hidden directories hold runner state, such as the intake records, rather than queues
+		if strings.HasPrefix(dirName, ".") {
+			continue
+		}
+
 		if matcher != nil {
 			if !matcher.MatchString(dirName) {
 				continue
@@ -177,9 +207,10 @@ func (fq *LocalQueue) Exists(ctx context.Context, subscription string) (exists b
 	return true, nil
 }
 
-// GetShortQName GetShortQueueName is useful for storing queue specific information in collections etc
+// GetShortQName GetShortQueueName is useful for storing queue specific information in collections etc,
+// for local queues this is the name of the queue directory
 func (fq *LocalQueue) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error) {
-	return qt.Subscription, nil
+	return filepath.Base(qt.Subscription), nil
 }
 
 func getOldest(listInfo []os.FileInfo) (result int) {
@@ -286,7 +317,9 @@ func (fq *LocalQueue) Work(ctx context.Context, qt *task.QueueTask) (msgProcesse
 	fq.logger.Info("Got request in:", filePath, "length", len(msgBytes))
 
 	qt.Msg = msgBytes
-	qt.ShortQName = qt.Subscription
+	// The subscription is the path of the queue directory, the queue name used for
+	// selecting signatures and options is the directory name, as it is for the intake
+	qt.ShortQName = filepath.Base(qt.Subscription)
 
 	fq.logger.Debug("About to handle task request: ", filePath)
 	rsc, ack, err := qt.Handler(ctx, qt)
@@ -321,10 +354,54 @@ func (fq *LocalQueue) HasWork(ctx context.Context, subscription string) (hasWork
 	return itemInfo != nil, nil
 }
 
+// Peek returns up to limit of the oldest messages waiting on the queue, oldest first, along with
+// the ids of their queue items.  The messages are left on the queue.
+//
+func (fq *LocalQueue) Peek(subscription string, limit int) (ids []string, msgs [][]byte, err kv.Error) {
+	queueDirPath := subscription
+
+	rootFile, errGo := os.Open(queueDirPath)
+	if errGo != nil {
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", queueDirPath)
+	}
+	listInfo, errGo := rootFile.Readdir(-1)
+	rootFile.Close()
+	if errGo != nil {
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", queueDirPath)
+	}
+
+	items := make([]os.FileInfo, 0, len(listInfo))
+	for _, item := range listInfo {
+		if !item.IsDir() {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].ModTime().Before(items[j].ModTime())
+	})
+
+	for _, item := range items {
+		if len(ids) >= limit {
+			break
+		}
+		msg, err := readBytes(path.Join(queueDirPath, item.Name()))
+		if err != nil {
+			// The item was claimed by a runner after the directory was read
+			if _, errGo := os.Stat(path.Join(queueDirPath, item.Name())); os.IsNotExist(errGo) {
+				continue
+			}
+			return ids, msgs, err
+		}
+		ids = append(ids, item.Name())
+		msgs = append(msgs, msg)
+	}
+	return ids, msgs, nil
+}
+
 // Responder is used to open a connection to an existing response queue if
 // one was made available and also to provision a channel into which the
 // runner can place report messages
-func (fq *LocalQueue) Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error) {
+func (fq *LocalQueue) Responder(ctx context.Context, qt *task.QueueTask, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error) {
 	return nil, kv.NewError("Not implemented").With("stack", stack.Trace().TrimRuntime())
 }
 
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/andreidenissov-cog/go-service/pkg/log"
 )
@@ -173,3 +174,48 @@ func TestFileQueue(t *testing.T) {
 		return
 	}
 }
+
+// TestFileQueuePeek checks that messages can be examined in order without removing them from the queue
+//
+func TestFileQueuePeek(t *testing.T) {
+	dir := t.TempDir()
+	server := NewLocalQueue(dir, nil, log.NewLogger("local-queue"))
+
+	queue := "queue-peek"
+	now := time.Now()
+	ids := []string{}
+	for i, name := range []string{"first", "second", "third"} {
+		buf, errGo := json.Marshal(&TestRequest{Name: name, Value: i})
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo))
+		}
+		id, err := server.PublishItem(queue, "application/json", buf, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Queue items are ordered using their modification times
+		when := now.Add(time.Duration(i-3) * time.Minute)
+		if errGo = os.Chtimes(path.Join(dir, queue, id), when, when); errGo != nil {
+			t.Fatal(kv.Wrap(errGo))
+		}
+		ids = append(ids, id)
+	}
+
+	peeked, msgs, err := server.Peek(path.Join(dir, queue), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked) != 2 || len(msgs) != 2 || peeked[0] != ids[0] || peeked[1] != ids[1] {
+		t.Fatal(kv.NewError("unexpected items").With("peeked", peeked, "expected", ids[:2]))
+	}
+	read := &TestRequest{}
+	if errGo := json.Unmarshal(msgs[1], read); errGo != nil || read.Name != "second" {
+		t.Fatal(kv.NewError("unexpected message").With("message", string(msgs[1])))
+	}
+
+	for _, id := range ids {
+		if queued, err := server.IsQueued(queue, id); err != nil || !queued {
+			t.Fatal(kv.NewError("item removed by peek").With("id", id, "error", err))
+		}
+	}
+}
@@ -20,6 +20,8 @@ import (
 
 	"github.com/andreidenissov-cog/go-service/pkg/mime"
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
 
 	"github.com/go-stack/stack"
 
@@ -27,12 +29,14 @@ import (
 )
 
 type localStorage struct {
+	unseal bool // Files hold sealed archives that are decrypted as they are read
 }
 
-// NewLocalStorage is used to allocate and initialize a struct that acts as a receiver
+// NewLocalStorage is used to allocate and initialize a struct that acts as a receiver, unseal
+// is set when the files being fetched hold sealed archives
 //
-func NewLocalStorage() (s *localStorage, err kv.Error) {
-	return &localStorage{}, nil
+func NewLocalStorage(unseal bool) (s *localStorage, err kv.Error) {
+	return &localStorage{unseal: unseal}, nil
 }
 
 // Close is a NoP unless overridden
@@ -80,16 +84,30 @@ func (s *localStorage) Fetch(ctx context.Context, name string, unpack bool, outp
 		warns = append(warns, kv.NewError("debug").With("fn", name).With("type", fileType).With("stack", stack.Trace().TrimRuntime()))
 	}
 
+	xfer, err := transfer.Start(ctx, transfer.LocalEndpoint, transfer.Download)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer xfer.Done()
+
 	obj, errGo := os.Open(filepath.Clean(name))
 	if errGo != nil {
 		return 0, warns, kv.Wrap(errGo, "could not open file "+name).With("stack", stack.Trace().TrimRuntime())
 	}
 	defer obj.Close()
 
-	return fetcher(obj, name, output, maxBytes, fileType, unpack)
+	// Sealed archives, which the artifact cache holds encrypted, are decrypted as they are read
+	in := xfer.Reader(obj)
+	if s.unseal {
+		if in, _, err = s3.UnsealStream(in); err != nil {
+			return 0, warns, err.With("name", name)
+		}
+	}
+
+	return fetcher(in, name, output, maxBytes, fileType, unpack)
 }
 
-func addReader(obj *os.File, fileType string) (inReader io.ReadCloser, err kv.Error) {
+func addReader(obj io.Reader, fileType string) (inReader io.ReadCloser, err kv.Error) {
 	switch fileType {
 	case "application/x-gzip", "application/zip":
 		reader, errGo := gzip.NewReader(obj)
@@ -105,7 +123,7 @@ func addReader(obj *os.File, fileType string) (inReader io.ReadCloser, err kv.Er
 	return inReader, err
 }
 
-func fetcher(obj *os.File, name string, output string, maxBytes int64, fileType string, unpack bool) (size int64, warns []kv.Error, err kv.Error) {
+func fetcher(obj io.Reader, name string, output string, maxBytes int64, fileType string, unpack bool) (size int64, warns []kv.Error, err kv.Error) {
 	// If the unpack flag is set then use a tar decompressor and unpacker
 	// but first make sure the output location is an existing directory
 	if unpack {
@@ -0,0 +1,97 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the retrieval of files from local storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// TestLocalStorageUnseal checks that files are only decrypted when the storage is told they hold
+// sealed archives, and that files that merely look like sealed archives are otherwise copied as is
+func TestLocalStorageUnseal(t *testing.T) {
+	passphrase := "local storage unseal test passphrase"
+	privatePEM, publicPEM, err := defense.GenerateKeyPair(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := defense.NewWrapper(publicPEM, privatePEM, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(publicPEM)
+	pub, errGo := x509.ParsePKCS1PublicKey(block.Bytes)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	dir, errGo := os.MkdirTemp("", "local-unseal")
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("archive contents")
+	fn := filepath.Join(dir, "sealed.dat")
+	f, errGo := os.Create(fn)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	sw, _, err := defense.NewSealWriter(f, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = sw.Write(data); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if errGo = sw.Close(); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	sealed, errGo := os.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	s3.SetUnsealKeys(w)
+	defer s3.SetUnsealKeys(nil)
+
+	for _, check := range []struct {
+		unseal   bool
+		expected []byte
+	}{
+		{unseal: true, expected: data},
+		{unseal: false, expected: sealed},
+	} {
+		output, errGo := os.MkdirTemp(dir, "output")
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		storage, err := NewLocalStorage(check.unseal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = storage.Fetch(context.Background(), fn, false, output, int64(len(sealed)*2), nil); err != nil {
+			t.Fatal(err.With("unseal", check.unseal))
+		}
+		fetched, errGo := os.ReadFile(filepath.Join(output, filepath.Base(fn)))
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !bytes.Equal(fetched, check.expected) {
+			t.Fatal(kv.NewError("file not fetched correctly").With("unseal", check.unseal, "contents", string(fetched)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
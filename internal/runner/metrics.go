@@ -0,0 +1,148 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of structured metric extraction from the
+// output of experiments.  Experiments emit single line json documents of the form
+//
+//   {"metric": {"name": "loss", "step": 10, "value": 0.25}}
+//
+// that are gathered into time series while the experiment is running.
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// metricSeriesLimit bounds the number of points retained for any one metric, once
+	// reached the oldest points are discarded
+	metricSeriesLimit = 100000
+)
+
+// MetricPoint is a single observation of a named metric emitted by an experiment
+//
+type MetricPoint struct {
+	Name  string    `json:"name"`
+	Step  int64     `json:"step"`
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+type metricLine struct {
+	Metric *struct {
+		Name  string   `json:"name"`
+		Step  int64    `json:"step"`
+		Value *float64 `json:"value"`
+	} `json:"metric"`
+}
+
+// ParseMetric examines a line of experiment output and if it is a metric document
+// returns the metric point it contains
+//
+func ParseMetric(line []byte) (point *MetricPoint, isMetric bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) < 2 || line[0] != '{' || line[len(line)-1] != '}' || !bytes.Contains(line, []byte(`"metric"`)) {
+		return nil, false
+	}
+
+	doc := metricLine{}
+	if errGo := json.Unmarshal(line, &doc); errGo != nil {
+		return nil, false
+	}
+	if doc.Metric == nil || len(doc.Metric.Name) == 0 || doc.Metric.Value == nil {
+		return nil, false
+	}
+	return &MetricPoint{
+		Name:  doc.Metric.Name,
+		Step:  doc.Metric.Step,
+		Value: *doc.Metric.Value,
+		Time:  time.Now().UTC(),
+	}, true
+}
+
+// MetricsRecorder gathers the metric points emitted by an experiment into time series
+//
+type MetricsRecorder struct {
+	series  map[string][]MetricPoint
+	updated bool
+	sync.Mutex
+}
+
+// NewMetricsRecorder is used to create a recorder for the metrics of a single experiment
+//
+func NewMetricsRecorder() (recorder *MetricsRecorder) {
+	return &MetricsRecorder{
+		series: map[string][]MetricPoint{},
+	}
+}
+
+// Observe is a LineTap that records any metric points found within experiment output
+//
+func (mr *MetricsRecorder) Observe(line []byte) {
+	point, isMetric := ParseMetric(line)
+	if !isMetric {
+		return
+	}
+
+	mr.Lock()
+	defer mr.Unlock()
+
+	series := mr.series[point.Name]
+	if len(series) >= metricSeriesLimit {
+		series = series[1:]
+	}
+	mr.series[point.Name] = append(series, *point)
+	mr.updated = true
+}
+
+// Latest returns the most recent point for every metric seen, and an indication of whether
+// new points have arrived since the last time Latest was called
+//
+func (mr *MetricsRecorder) Latest() (latest []MetricPoint, updated bool) {
+	mr.Lock()
+	defer mr.Unlock()
+
+	latest = make([]MetricPoint, 0, len(mr.series))
+	for _, series := range mr.series {
+		latest = append(latest, series[len(series)-1])
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].Name < latest[j].Name })
+
+	updated = mr.updated
+	mr.updated = false
+	return latest, updated
+}
+
+// Save writes the time series for all metrics seen so far into the named file as a json document
+//
+func (mr *MetricsRecorder) Save(fn string, experimentID string) (err kv.Error) {
+	mr.Lock()
+	if len(mr.series) == 0 {
+		mr.Unlock()
+		return nil
+	}
+	doc, errGo := json.Marshal(struct {
+		ExperimentID string                   `json:"experiment_id"`
+		Metrics      map[string][]MetricPoint `json:"metrics"`
+	}{
+		ExperimentID: experimentID,
+		Metrics:      mr.series,
+	})
+	mr.Unlock()
+
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = os.WriteFile(fn, doc, 0600); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseMetric exercises the recognition of metric documents within experiment output
+func TestParseMetric(t *testing.T) {
+	tests := []struct {
+		line     string
+		isMetric bool
+		name     string
+		step     int64
+		value    float64
+	}{
+		{line: `{"metric": {"name": "loss", "step": 10, "value": 0.25}}`, isMetric: true, name: "loss", step: 10, value: 0.25},
+		{line: `  {"metric":{"name":"acc","value":1}}  `, isMetric: true, name: "acc", step: 0, value: 1},
+		{line: `{"metric": {"name": "loss", "step": 10}}`, isMetric: false},
+		{line: `{"metric": {"step": 10, "value": 0.25}}`, isMetric: false},
+		{line: `{"studioml": {"log": "metric"}}`, isMetric: false},
+		{line: `{"metric": {"name": "loss", "value": 0.2`, isMetric: false},
+		{line: `metric loss 0.25`, isMetric: false},
+	}
+
+	for _, aTest := range tests {
+		point, isMetric := ParseMetric([]byte(aTest.line))
+		if isMetric != aTest.isMetric {
+			t.Fatal("metric detection failed", aTest.line)
+		}
+		if !isMetric {
+			continue
+		}
+		if point.Name != aTest.name || point.Step != aTest.step || point.Value != aTest.value {
+			t.Fatal("metric parsing failed", aTest.line, *point)
+		}
+	}
+}
+
+// TestMetricsRecorder checks that metric points are gathered into series and saved
+func TestMetricsRecorder(t *testing.T) {
+	recorder := NewMetricsRecorder()
+
+	if latest, updated := recorder.Latest(); updated || len(latest) != 0 {
+		t.Fatal("empty recorder reported metrics")
+	}
+
+	recorder.Observe([]byte(`{"metric": {"name": "loss", "step": 1, "value": 0.5}}`))
+	recorder.Observe([]byte(`not a metric`))
+	recorder.Observe([]byte(`{"metric": {"name": "loss", "step": 2, "value": 0.4}}`))
+	recorder.Observe([]byte(`{"metric": {"name": "acc", "step": 2, "value": 0.9}}`))
+
+	latest, updated := recorder.Latest()
+	if !updated || len(latest) != 2 {
+		t.Fatal("metrics not recorded", latest)
+	}
+	if latest[0].Name != "acc" || latest[1].Name != "loss" || latest[1].Step != 2 || latest[1].Value != 0.4 {
+		t.Fatal("unexpected latest metrics", latest)
+	}
+	if _, updated = recorder.Latest(); updated {
+		t.Fatal("metrics reported as updated without new points")
+	}
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "metrics.json")
+	if err := recorder.Save(fn, "experiment"); err != nil {
+		t.Fatal(err)
+	}
+	content, errGo := os.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	doc := struct {
+		ExperimentID string                   `json:"experiment_id"`
+		Metrics      map[string][]MetricPoint `json:"metrics"`
+	}{}
+	if errGo = json.Unmarshal(content, &doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if doc.ExperimentID != "experiment" || len(doc.Metrics["loss"]) != 2 || len(doc.Metrics["acc"]) != 1 {
+		t.Fatal("unexpected saved metrics", string(content))
+	}
+}
@@ -2,16 +2,23 @@
 
 package runner
 
-// This file contains the implementation of artifact objects downloaders.
+// This file contains the implementation of artifact objects downloaders.  Downloads of the same
+// item are shared within a process using the factory, and between processes using a lock on the
+// cache key, see cachelock.go.
 
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
+	"golang.org/x/time/rate"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type ObjDownloader struct {
@@ -19,11 +26,15 @@ type ObjDownloader struct {
 	store       Storage
 	cacheKey    string
 	remoteName  string
+	sourceURI   string
+	backingDir  string
 	partialName string
 	localName   string
 	unpack      bool
 	maxBytes    int64
+	limiter     *rate.Limiter // Optional limit on the bandwidth used for the download
 	dataSize    int64
+	contentHash string // Hex encoded SHA256 of the downloaded contents
 	result      kv.Error
 	warnings    []kv.Error
 }
@@ -59,7 +70,7 @@ func (f *ObjDownloaderFactory) RemoveDownloader(key string) {
 }
 
 func (f *ObjDownloaderFactory) GetDownloader(ctx context.Context, store Storage,
-	key string, name string, unpack bool, maxBytes int64) (loader *ObjDownloader, err kv.Error) {
+	key string, name string, sourceURI string, unpack bool, maxBytes int64, limiter *rate.Limiter) (loader *ObjDownloader, err kv.Error) {
 	f.Lock()
 	defer f.Unlock()
 
@@ -71,27 +82,34 @@ func (f *ObjDownloaderFactory) GetDownloader(ctx context.Context, store Storage,
 		store:       store,
 		cacheKey:    key,
 		remoteName:  name,
+		sourceURI:   sourceURI,
+		backingDir:  f.backingDir,
 		partialName: filepath.Join(f.backingDir, ".partial", key),
 		localName:   filepath.Join(f.backingDir, key),
 		unpack:      unpack,
 		maxBytes:    maxBytes,
+		limiter:     limiter,
 		dataSize:    0,
 		result:      nil,
 		warnings:    []kv.Error{},
 	}
-	// Create a "partial" file we will be downloading into:
-	file, errGo := os.OpenFile(loader.partialName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
-	if errGo != nil {
-		return loader, kv.Wrap(errGo, "file open failure").With("stack", stack.Trace().TrimRuntime()).With("file", loader.partialName)
-	} else {
-		file.Close()
-	}
 	loader.Add(1)
 	go loader.download(ctx)
 	f.loaders[key] = loader
 	return loader, nil
 }
 
+// cacheTap receives the contents of an item being placed into the cache, and records whether the
+// item is an object that was sealed when it was deposited, see s3.SealedTap
+type cacheTap struct {
+	*bufio.Writer
+	sealed bool
+}
+
+func (tap *cacheTap) MarkSealed() {
+	tap.sealed = true
+}
+
 func (d *ObjDownloader) cleanupPartial() {
 	if errGo := os.Remove(d.partialName); errGo != nil {
 		warn := kv.Wrap(errGo).With("partial", d.partialName, "file", d.remoteName, "stack", stack.Trace().TrimRuntime())
@@ -104,17 +122,43 @@ func (d *ObjDownloader) download(ctx context.Context) {
 
 	defer d.Done()
 
+	// Take ownership of the download from other runner processes sharing the cache
+	lock, err := lockCacheItem(ctx, d.backingDir, d.cacheKey, true, true)
+	if err != nil {
+		d.result = err
+		return
+	}
+
+	// Another process might have completed the download while we were waiting
+	if _, errGo := os.Stat(d.localName); errGo == nil {
+		lock.unlock()
+		return
+	}
+
+	// A partial download present at this point was abandoned by a process that no longer holds the lock
+	_ = os.Remove(d.partialName)
+
 	// Create a "partial" file we will be downloading into:
-	file, errGo := os.OpenFile(d.partialName, os.O_CREATE|os.O_WRONLY, 0600)
+	file, errGo := os.OpenFile(d.partialName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if errGo != nil {
 		d.result = kv.Wrap(errGo, "file open failure").With("stack", stack.Trace().TrimRuntime()).With("file", d.partialName)
+		lock.remove()
 		return
 	}
 
-	tapWriter := bufio.NewWriter(file)
+	// Hash the contents as they are written so that the cache index can later verify the file
+	hasher := sha256.New()
+	var sink io.Writer = io.MultiWriter(file, hasher)
+	if d.limiter != nil {
+		sink = &rateWriter{ctx: ctx, limiter: d.limiter, w: sink}
+	}
+	tapWriter := &cacheTap{Writer: bufio.NewWriter(sink)}
 	d.dataSize, w, d.result = d.store.Fetch(ctx, d.remoteName, false, "", d.maxBytes, tapWriter)
-	tapWriter.Flush()
+	if errGo = tapWriter.Flush(); errGo != nil && d.result == nil {
+		d.result = kv.Wrap(errGo, "file write failure").With("stack", stack.Trace().TrimRuntime()).With("file", d.partialName)
+	}
 	file.Close()
+	d.contentHash = hex.EncodeToString(hasher.Sum(nil))
 
 	d.warnings = append(d.warnings, w...)
 	if d.result == nil {
@@ -126,4 +170,29 @@ func (d *ObjDownloader) download(ctx context.Context) {
 	} else {
 		d.cleanupPartial()
 	}
+
+	if d.result != nil {
+		lock.remove()
+		return
+	}
+
+	// Index the item before releasing the lock so that other processes never see the item
+	// without its index entry
+	if index != nil {
+		if info, errGo := os.Stat(d.localName); errGo == nil {
+			entry := &cacheEntry{
+				Key:         d.cacheKey,
+				ContentHash: d.contentHash,
+				SourceURI:   d.sourceURI,
+				Size:        info.Size(),
+				ModTime:     info.ModTime(),
+				LastAccess:  time.Now(),
+				Sealed:      tapWriter.sealed,
+			}
+			if err := index.put(entry); err != nil {
+				d.warnings = append(d.warnings, err)
+			}
+		}
+	}
+	lock.unlock()
 }
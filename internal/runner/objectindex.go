@@ -0,0 +1,507 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of the persistent index for the artifact cache.  The
+// index is held within the cache directory and records, for every cached item, a hash of its
+// contents, where it was downloaded from, its size, when it was last used, and the cache hit
+// and miss counts.  When the runner starts the index is reconciled with the files found in
+// the cache directory so that items survive restarts without their contents being trusted
+// blindly, and so that the least recently used ordering is retained.
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// cacheIndexName is the name of the index file within the cache directory, names starting
+	// with a period are ignored by the cache
+	cacheIndexName = ".index.db"
+
+	// cacheItemTTL is the time an unused item is retained within the cache
+	cacheItemTTL = time.Duration(48 * time.Hour)
+
+	// cacheIndexTimeout is the time waited for other processes to finish using the index
+	cacheIndexTimeout = time.Duration(10 * time.Second)
+
+	// cacheStatsFlush is the interval at which cache hits and misses are written to the index
+	cacheStatsFlush = time.Duration(10 * time.Second)
+)
+
+var (
+	cacheEntriesBucket = []byte("entries")
+	cacheStatsBucket   = []byte("stats")
+
+	// md5Key matches cache keys that are the hex encoded MD5 of the items contents, followed
+	// by the file name extension of the original artifact
+	md5Key = regexp.MustCompile(`^[0-9a-f]{32}(\.[^.]*)?$`)
+)
+
+// cacheEntry is the persistent record of an item held within the artifact cache
+type cacheEntry struct {
+	Key         string    `json:"key"`
+	ContentHash string    `json:"content_hash"`
+	SourceURI   string    `json:"source_uri,omitempty"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	LastAccess  time.Time `json:"last_access"`
+	TreeSize    int64     `json:"tree_size,omitempty"` // The size of the unpacked contents, if present
+	Sealed      bool      `json:"sealed,omitempty"`    // The item is an object that was sealed when it was deposited
+}
+
+// cacheIndex is the on disk index of the artifact cache.  The index can be shared by runners on the
+// same host using the same cache directory so it is opened for each transaction, rather than being
+// held open, as the database permits only one process to have it open for writing.  Cache hits and
+// misses are accumulated in memory and written to the index periodically, see flushStats, so that
+// using the cache does not wait on the index.
+type cacheIndex struct {
+	fn string
+
+	pending map[string]*cacheStat // Hits and misses not yet written to the index
+	sync.Mutex
+}
+
+// reconcileResult summarizes the changes made while reconciling the index and the cache directory
+type reconcileResult struct {
+	entries  []cacheEntry // The entries retained, ordered from the least to the most recently used
+	verified []string     // Items whose contents were hashed again and found to be intact
+	adopted  []string     // Items found without index entries whose contents matched their key
+	evicted  []string     // Items removed from the cache as their contents could not be trusted
+	dropped  []string     // Index entries removed as their items were no longer present
+}
+
+func openCacheIndex(dir string) (idx *cacheIndex, err kv.Error) {
+	idx = &cacheIndex{
+		fn:      filepath.Join(dir, cacheIndexName),
+		pending: map[string]*cacheStat{},
+	}
+	errGo := idx.update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{cacheEntriesBucket, cacheStatsBucket} {
+			if _, errGo := tx.CreateBucketIfNotExists(bucket); errGo != nil {
+				return errGo
+			}
+		}
+		return nil
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "cache index unavailable").With("file", idx.fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return idx, nil
+}
+
+// close writes any cache hits and misses that have not yet been flushed to the index, the index
+// itself is not held open
+//
+func (idx *cacheIndex) close() {
+	_ = idx.flushStats()
+}
+
+// update runs a read-write transaction, waiting for any other process using the index
+//
+func (idx *cacheIndex) update(fn func(tx *bolt.Tx) error) (errGo error) {
+	db, errGo := bolt.Open(idx.fn, 0600, &bolt.Options{Timeout: cacheIndexTimeout})
+	if errGo != nil {
+		return errGo
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view runs a read-only transaction, read-only transactions from multiple processes can be
+// active at the same time
+//
+func (idx *cacheIndex) view(fn func(tx *bolt.Tx) error) (errGo error) {
+	db, errGo := bolt.Open(idx.fn, 0600, &bolt.Options{Timeout: cacheIndexTimeout, ReadOnly: true})
+	if errGo != nil {
+		return errGo
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (idx *cacheIndex) put(entry *cacheEntry) (err kv.Error) {
+	data, errGo := json.Marshal(entry)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("key", entry.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	errGo = idx.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheEntriesBucket).Put([]byte(entry.Key), data)
+	})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("key", entry.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (idx *cacheIndex) get(key string) (entry *cacheEntry, err kv.Error) {
+	errGo := idx.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(cacheEntriesBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		entry = &cacheEntry{}
+		return json.Unmarshal(data, entry)
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return entry, nil
+}
+
+// modify applies a change to the entry for an item, if the item is indexed
+//
+func (idx *cacheIndex) modify(key string, change func(entry *cacheEntry)) (err kv.Error) {
+	errGo := idx.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cacheEntriesBucket)
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		entry := &cacheEntry{}
+		if errGo := json.Unmarshal(data, entry); errGo != nil {
+			return errGo
+		}
+		change(entry)
+		data, errGo := json.Marshal(entry)
+		if errGo != nil {
+			return errGo
+		}
+		return bucket.Put([]byte(key), data)
+	})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// touch records that an item has been used
+//
+func (idx *cacheIndex) touch(key string, when time.Time) (err kv.Error) {
+	return idx.modify(key, func(entry *cacheEntry) {
+		entry.LastAccess = when
+	})
+}
+
+// setTreeSize records the size of the unpacked contents of an item
+//
+func (idx *cacheIndex) setTreeSize(key string, size int64) (err kv.Error) {
+	return idx.modify(key, func(entry *cacheEntry) {
+		entry.TreeSize = size
+	})
+}
+
+func (idx *cacheIndex) remove(key string) (err kv.Error) {
+	errGo := idx.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheEntriesBucket).Delete([]byte(key))
+	})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// clear removes all of the item entries from the index, statistics are retained
+//
+func (idx *cacheIndex) clear() (err kv.Error) {
+	errGo := idx.update(func(tx *bolt.Tx) error {
+		if errGo := tx.DeleteBucket(cacheEntriesBucket); errGo != nil {
+			return errGo
+		}
+		_, errGo := tx.CreateBucket(cacheEntriesBucket)
+		return errGo
+	})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (idx *cacheIndex) entries() (entries []cacheEntry, err kv.Error) {
+	entries = []cacheEntry{}
+	errGo := idx.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheEntriesBucket).ForEach(func(k []byte, v []byte) error {
+			entry := cacheEntry{}
+			if errGo := json.Unmarshal(v, &entry); errGo != nil {
+				// Unreadable entries are treated as being absent and the item will be
+				// verified against its key
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return entries, nil
+}
+
+// addStat records a cache hit, or miss, for the hash of an artifact.  The index is not updated
+// until the statistics are next flushed.
+//
+func (idx *cacheIndex) addStat(hash string, hit bool) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	stat, isPresent := idx.pending[hash]
+	if !isPresent {
+		stat = &cacheStat{}
+		idx.pending[hash] = stat
+	}
+	if hit {
+		stat.hits++
+	} else {
+		stat.misses++
+	}
+}
+
+// flushStats adds the hits and misses recorded since the last flush to the index using a single
+// transaction.  If the index cannot be updated the hits and misses are retained for the next flush.
+//
+func (idx *cacheIndex) flushStats() (err kv.Error) {
+	idx.Lock()
+	pending := idx.pending
+	idx.pending = map[string]*cacheStat{}
+	idx.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	errGo := idx.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cacheStatsBucket)
+		for hash, delta := range pending {
+			stat := struct {
+				Hits   int `json:"hits"`
+				Misses int `json:"misses"`
+			}{}
+			if data := bucket.Get([]byte(hash)); data != nil {
+				if errGo := json.Unmarshal(data, &stat); errGo != nil {
+					return errGo
+				}
+			}
+			stat.Hits += delta.hits
+			stat.Misses += delta.misses
+			data, errGo := json.Marshal(stat)
+			if errGo != nil {
+				return errGo
+			}
+			if errGo = bucket.Put([]byte(hash), data); errGo != nil {
+				return errGo
+			}
+		}
+		return nil
+	})
+	if errGo == nil {
+		return nil
+	}
+
+	idx.Lock()
+	for hash, delta := range pending {
+		if stat, isPresent := idx.pending[hash]; isPresent {
+			stat.hits += delta.hits
+			stat.misses += delta.misses
+		} else {
+			idx.pending[hash] = delta
+		}
+	}
+	idx.Unlock()
+	return kv.Wrap(errGo).With("file", idx.fn).With("stack", stack.Trace().TrimRuntime())
+}
+
+// flushStatsPeriodically writes the cache hits and misses to the index until the ctx is Done, when a
+// final flush is made
+//
+func (idx *cacheIndex) flushStatsPeriodically(ctx context.Context, errorC chan kv.Error) {
+	ticker := time.NewTicker(cacheStatsFlush)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := idx.flushStats(); err != nil {
+				select {
+				case errorC <- err:
+				case <-time.After(time.Second):
+					cacheLogger.Warn("cache statistics could not be saved", "error", err.Error())
+				}
+			}
+		case <-ctx.Done():
+			_ = idx.flushStats()
+			return
+		}
+	}
+}
+
+// stats returns the cache hits and misses recorded for all artifact hashes
+//
+func (idx *cacheIndex) stats() (stats map[string]*cacheStat, err kv.Error) {
+	stats = map[string]*cacheStat{}
+	errGo := idx.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(cacheStatsBucket).ForEach(func(k []byte, v []byte) error {
+			stat := struct {
+				Hits   int `json:"hits"`
+				Misses int `json:"misses"`
+			}{}
+			if errGo := json.Unmarshal(v, &stat); errGo != nil {
+				return nil
+			}
+			stats[string(k)] = &cacheStat{hits: stat.Hits, misses: stat.Misses}
+			return nil
+		})
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return stats, nil
+}
+
+// hashContents returns the hex encoded SHA256 and MD5 of the contents of a file
+//
+func hashContents(fn string) (sha string, md string, err kv.Error) {
+	f, errGo := os.Open(filepath.Clean(fn))
+	if errGo != nil {
+		return "", "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	shaHash := sha256.New()
+	mdHash := md5.New()
+	if _, errGo = io.Copy(io.MultiWriter(shaHash, mdHash), f); errGo != nil {
+		return "", "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return hex.EncodeToString(shaHash.Sum(nil)), hex.EncodeToString(mdHash.Sum(nil)), nil
+}
+
+// reconcile compares the index with the files in the cache directory.  Items whose size or
+// modification time have changed since they were indexed are hashed again and are evicted if their
+// contents differ from when they were downloaded.  Items without an index entry are retained only
+// when their key is the MD5 of their contents.  Index entries for missing items are removed.
+//
+func (idx *cacheIndex) reconcile(dir string, now time.Time) (result *reconcileResult, err kv.Error) {
+	result = &reconcileResult{
+		entries:  []cacheEntry{},
+		verified: []string{},
+		adopted:  []string{},
+		evicted:  []string{},
+		dropped:  []string{},
+	}
+
+	indexed, err := idx.entries()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]cacheEntry, len(indexed))
+	for _, entry := range indexed {
+		known[entry.Key] = entry
+	}
+
+	files, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Items that are in use, or being written, by other runner processes sharing the cache
+	// directory are left for those processes to manage
+	evict := func(key string) {
+		lock, err := lockCacheItem(context.Background(), dir, key, true, false)
+		if err != nil || lock == nil {
+			return
+		}
+		defer lock.remove()
+
+		_ = os.Remove(filepath.Join(dir, key))
+		_ = idx.remove(key)
+		result.evicted = append(result.evicted, key)
+	}
+
+	for _, file := range files {
+		key := file.Name()
+		if file.IsDir() || strings.HasPrefix(key, ".") {
+			continue
+		}
+
+		entry, isPresent := known[key]
+		delete(known, key)
+
+		if isPresent {
+			// Items that have not been used within their lifetime have expired
+			if entry.LastAccess.Add(cacheItemTTL).Before(now) {
+				evict(key)
+				continue
+			}
+			if entry.Size == file.Size() && entry.ModTime.Equal(file.ModTime()) {
+				result.entries = append(result.entries, entry)
+				continue
+			}
+			sha, _, err := hashContents(filepath.Join(dir, key))
+			if err != nil || sha != entry.ContentHash {
+				evict(key)
+				continue
+			}
+			entry.Size = file.Size()
+			entry.ModTime = file.ModTime()
+			if err = idx.put(&entry); err != nil {
+				return nil, err
+			}
+			result.verified = append(result.verified, key)
+			result.entries = append(result.entries, entry)
+			continue
+		}
+
+		// Items without an index entry can only be trusted if their contents can be checked
+		// against their key
+		if !md5Key.MatchString(key) || file.ModTime().Add(cacheItemTTL).Before(now) {
+			evict(key)
+			continue
+		}
+		sha, md, err := hashContents(filepath.Join(dir, key))
+		if err != nil || md != strings.TrimSuffix(key, filepath.Ext(key)) {
+			evict(key)
+			continue
+		}
+		entry = cacheEntry{
+			Key:         key,
+			ContentHash: sha,
+			Size:        file.Size(),
+			ModTime:     file.ModTime(),
+			LastAccess:  file.ModTime(),
+		}
+		if err = idx.put(&entry); err != nil {
+			return nil, err
+		}
+		result.adopted = append(result.adopted, key)
+		result.entries = append(result.entries, entry)
+	}
+
+	// Anything left in the index no longer has an item on disk
+	for key := range known {
+		if err = idx.remove(key); err != nil {
+			return nil, err
+		}
+		result.dropped = append(result.dropped, key)
+	}
+
+	sort.SliceStable(result.entries, func(i, j int) bool {
+		return result.entries[i].LastAccess.Before(result.entries[j].LastAccess)
+	})
+	return result, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the persistent artifact cache index
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+func writeCacheItem(t *testing.T, dir string, key string, content string) (entry *cacheEntry) {
+	fn := filepath.Join(dir, key)
+	if errGo := os.WriteFile(fn, []byte(content), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	info, errGo := os.Stat(fn)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	sha := sha256.Sum256([]byte(content))
+	return &cacheEntry{
+		Key:         key,
+		ContentHash: hex.EncodeToString(sha[:]),
+		SourceURI:   "s3://example/bucket/" + key,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	}
+}
+
+// TestCacheIndexReconcile checks that items are verified, adopted, or evicted when the index
+// is compared with the cache directory, and that the order of use is retained
+//
+func TestCacheIndexReconcile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	idx, err := openCacheIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items that are unchanged, the most recently used is added first
+	recent := writeCacheItem(t, dir, "recent.tar", "recent")
+	recent.LastAccess = now.Add(-time.Minute)
+	older := writeCacheItem(t, dir, "older.tar", "older")
+	older.LastAccess = now.Add(-time.Hour)
+
+	// An item whose file was touched, but whose contents are intact
+	touched := writeCacheItem(t, dir, "touched.tar", "touched")
+	touched.LastAccess = now.Add(-2 * time.Hour)
+	touched.ModTime = touched.ModTime.Add(-time.Hour)
+
+	// An item whose contents changed after it was downloaded
+	tampered := writeCacheItem(t, dir, "tampered.tar", "original")
+	tampered.LastAccess = now
+	writeCacheItem(t, dir, "tampered.tar", "modified contents")
+
+	// An item that has not been used within its lifetime
+	expired := writeCacheItem(t, dir, "expired.tar", "expired")
+	expired.LastAccess = now.Add(-2 * cacheItemTTL)
+
+	// An entry whose file has been removed
+	missing := &cacheEntry{Key: "missing.tar", LastAccess: now}
+
+	for _, entry := range []*cacheEntry{recent, older, touched, tampered, expired, missing} {
+		if err = idx.put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files from a runner without an index, one whose key is the MD5 of its contents, one
+	// whose contents do not match, and one that cannot be checked
+	md := md5.Sum([]byte("legacy"))
+	legacyKey := hex.EncodeToString(md[:]) + ".tar"
+	writeCacheItem(t, dir, legacyKey, "legacy")
+	md = md5.Sum([]byte("something else"))
+	corruptKey := hex.EncodeToString(md[:]) + ".tar"
+	writeCacheItem(t, dir, corruptKey, "corrupt")
+	writeCacheItem(t, dir, "unknown.tar", "unknown")
+
+	idx.close()
+
+	// Reopen the index as a restarted runner would
+	if idx, err = openCacheIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+
+	result, err := idx.reconcile(dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(result.evicted)
+	checks := map[string][2][]string{
+		"verified": {result.verified, {"touched.tar"}},
+		"adopted":  {result.adopted, {legacyKey}},
+		"evicted":  {result.evicted, {corruptKey, "expired.tar", "tampered.tar", "unknown.tar"}},
+		"dropped":  {result.dropped, {"missing.tar"}},
+	}
+	for name, check := range checks {
+		if diff := deep.Equal(check[0], check[1]); diff != nil {
+			t.Fatal(kv.NewError("unexpected reconciliation").With("outcome", name, "diff", diff).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// The adopted item was last modified now, so it is the most recently used
+	keys := []string{}
+	for _, entry := range result.entries {
+		keys = append(keys, entry.Key)
+	}
+	if diff := deep.Equal(keys, []string{"touched.tar", "older.tar", "recent.tar", legacyKey}); diff != nil {
+		t.Fatal(kv.NewError("order of use not retained").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	for _, key := range result.evicted {
+		if _, errGo := os.Stat(filepath.Join(dir, key)); !os.IsNotExist(errGo) {
+			t.Fatal(kv.NewError("evicted item present").With("key", key).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if entry, err := idx.get(key); err != nil || entry != nil {
+			t.Fatal(kv.NewError("evicted item indexed").With("key", key).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	entry, err := idx.get("touched.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.SourceURI != touched.SourceURI || entry.ModTime.Equal(touched.ModTime) {
+		t.Fatal(kv.NewError("verified item not updated").With("entry", entry).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestCacheIndexStats checks that cache hits and misses survive the index being reopened
+//
+func TestCacheIndexStats(t *testing.T) {
+	dir := t.TempDir()
+
+	idx, err := openCacheIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range []bool{true, true, false} {
+		idx.addStat("hash", hit)
+	}
+	if err = idx.clear(); err != nil {
+		t.Fatal(err)
+	}
+	idx.close()
+
+	if idx, err = openCacheIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+
+	stats, err := idx.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, isPresent := stats["hash"]; !isPresent || stat.hits != 2 || stat.misses != 1 {
+		t.Fatal(kv.NewError("statistics not retained").With("stats", stats).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
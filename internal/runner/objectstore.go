@@ -3,12 +3,14 @@
 package runner
 
 // This file contains the implementation of storage that can use an internal cache along with the MD5
-// hash of the files contents to avoid downloads that are not needed.
+// hash of the files contents to avoid downloads that are not needed.  The contents of the cache
+// are recorded in an index, see objectindex.go, so that they can be reused after a restart.
 
 import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -16,12 +18,16 @@ import (
 
 	"github.com/leaf-ai/studio-go-runner/internal/request"
 
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
 
 	"github.com/karlmutch/ccache"
 	"github.com/karlmutch/go-shortid"
 	"github.com/lthibault/jitterbug"
+
+	"golang.org/x/time/rate"
 )
 
 type cacheStat struct {
@@ -37,6 +43,10 @@ type cacheStats struct {
 var (
 	host = ""
 
+	// cacheLogger reports the state of the cache index when the cache is started, and
+	// failures that could not be sent to the error channel
+	cacheLogger = log.NewLogger("objectstore")
+
 	cacheHitsMisses = cacheStats{
 		stats: map[string]*cacheStat{},
 	}
@@ -44,24 +54,30 @@ var (
 
 func addHit(hash string) {
 	cacheHitsMisses.Lock()
-	defer cacheHitsMisses.Unlock()
-
 	if rec, isPresent := cacheHitsMisses.stats[hash]; !isPresent {
 		cacheHitsMisses.stats[hash] = &cacheStat{hits: 1, misses: 0}
 	} else {
 		rec.hits++
 	}
+	cacheHitsMisses.Unlock()
+
+	if index != nil {
+		index.addStat(hash, true)
+	}
 }
 
 func addMiss(hash string) {
 	cacheHitsMisses.Lock()
-	defer cacheHitsMisses.Unlock()
-
 	if rec, isPresent := cacheHitsMisses.stats[hash]; !isPresent {
 		cacheHitsMisses.stats[hash] = &cacheStat{hits: 0, misses: 1}
 	} else {
 		rec.misses++
 	}
+	cacheHitsMisses.Unlock()
+
+	if index != nil {
+		index.addStat(hash, false)
+	}
 }
 
 func GetHitsMisses(hash string) (hits int, misses int) {
@@ -80,8 +96,11 @@ func init() {
 }
 
 type objStore struct {
-	store  Storage
-	ErrorC chan kv.Error
+	store     Storage
+	uri       string
+	immutable bool
+	encrypt   bool // The artifact is marked as being encrypted when deposited
+	ErrorC    chan kv.Error
 }
 
 // NewObjStore is used to instantiate an object store for the running that includes a cache
@@ -93,11 +112,28 @@ func NewObjStore(ctx context.Context, spec *StoreOpts, errorC chan kv.Error) (oS
 	}
 
 	return &objStore{
-		store:  store,
-		ErrorC: errorC,
+		store:     store,
+		uri:       sourceURI(spec.Art.Qualified),
+		immutable: !spec.Art.Mutable,
+		encrypt:   spec.Art.Encrypt,
+		ErrorC:    errorC,
 	}, nil
 }
 
+// sourceURI returns the location of an artifact with any credentials and query parameters,
+// that might contain signatures, removed so that it can be safely recorded
+//
+func sourceURI(qualified string) (uri string) {
+	u, errGo := url.Parse(qualified)
+	if errGo != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
 var (
 	backingDir = ""
 
@@ -105,8 +141,80 @@ var (
 	cacheInit     sync.Once
 	cacheInitSync sync.Mutex
 	cache         *ccache.Cache
+
+	// index is the persistent record of the items in the cache
+	index *cacheIndex
+
+	// cacheKnown records the items this process has placed into the in memory cache, items that
+	// are absent from the in memory cache and are not known were placed into the cache directory
+	// by other runner processes sharing it
+	cacheKnown = struct {
+		keys map[string]bool
+		sync.Mutex
+	}{
+		keys: map[string]bool{},
+	}
 )
 
+// cachedItem is the value held by the in memory cache for an item, the size of the item includes
+// any unpacked tree for the item
+type cachedItem struct {
+	os.FileInfo
+	treeSize int64
+}
+
+// Size is used by the in memory cache when managing the size of the cache
+//
+func (item *cachedItem) Size() (size int64) {
+	return item.FileInfo.Size() + item.treeSize
+}
+
+// cacheAdd places an item into the in memory cache and records it as being known to this process
+//
+func cacheAdd(key string, info os.FileInfo, ttl time.Duration) {
+	cacheKnown.Lock()
+	cacheKnown.keys[key] = true
+	cacheKnown.Unlock()
+
+	item := &cachedItem{FileInfo: info}
+	if index != nil {
+		if entry, err := index.get(key); err == nil && entry != nil {
+			item.treeSize = entry.TreeSize
+		}
+	}
+
+	cache.Fetch(key, ttl,
+		func() (interface{}, error) {
+			return item, nil
+		})
+}
+
+func isCacheKnown(key string) (known bool) {
+	cacheKnown.Lock()
+	defer cacheKnown.Unlock()
+	return cacheKnown.keys[key]
+}
+
+func forgetCacheKey(key string) {
+	cacheKnown.Lock()
+	defer cacheKnown.Unlock()
+	delete(cacheKnown.keys, key)
+}
+
+// cacheEntryTTL returns the time remaining before an item expires, using the index which records
+// the use of the item by all of the processes sharing the cache
+//
+func cacheEntryTTL(key string, now time.Time) (ttl time.Duration) {
+	if index == nil {
+		return 0
+	}
+	entry, err := index.get(key)
+	if err != nil || entry == nil {
+		return 0
+	}
+	return cacheItemTTL - now.Sub(entry.LastAccess)
+}
+
 func groom(backingDir string, removedC chan os.FileInfo, errorC chan kv.Error) {
 	if cache == nil {
 		return
@@ -127,29 +235,72 @@ func groom(backingDir string, removedC chan os.FileInfo, errorC chan kv.Error) {
 		return
 	}
 
+	now := time.Now()
 	for _, file := range cachedFiles {
+		// Files starting with a period, such as the index, are not cached items
+		if file.Name()[0] == '.' || file.IsDir() {
+			continue
+		}
 		// Is an expired or missing file in cache data structure, if it is not a directory delete it
 		item := cache.Sample(file.Name())
-		if item == nil || item.Expired() {
-			info, err := os.Stat(filepath.Join(backingDir, file.Name()))
-			if err == nil {
-				if info.IsDir() {
-					continue
-				}
-				select {
-				case removedC <- info:
-				case <-time.After(time.Second):
-				}
-				if err = os.Remove(filepath.Join(backingDir, file.Name())); err != nil {
-					select {
-					case errorC <- kv.Wrap(err, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()):
-					case <-time.After(time.Second):
-						fmt.Printf("%s\n", kv.Wrap(err, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()))
-					}
-				}
+		if item != nil && !item.Expired() {
+			continue
+		}
+
+		// Items that were added, or used, by other runner processes sharing the cache are taken
+		// from the index.  Items this process has pruned to keep within its size limit are removed.
+		if ttl := cacheEntryTTL(file.Name(), now); ttl > 0 {
+			if item != nil {
+				item.Extend(ttl)
+				continue
+			}
+			if !isCacheKnown(file.Name()) {
+				cacheAdd(file.Name(), file, ttl)
+				continue
+			}
+		}
+
+		// Items in use, or being written, by any process cannot be locked and are left in place
+		lock, err := lockCacheItem(context.Background(), backingDir, file.Name(), true, false)
+		if err != nil {
+			select {
+			case errorC <- err:
+			case <-time.After(time.Second):
+				cacheLogger.Warn("cache item could not be locked for grooming", "error", err.Error())
+			}
+			continue
+		}
+		if lock == nil {
+			continue
+		}
+
+		info, errGo := os.Stat(filepath.Join(backingDir, file.Name()))
+		if errGo != nil {
+			lock.remove()
+			continue
+		}
+		select {
+		case removedC <- info:
+		case <-time.After(time.Second):
+		}
+		if index != nil {
+			_ = index.remove(file.Name())
+		}
+		if errGo = os.Remove(filepath.Join(backingDir, file.Name())); errGo != nil {
+			select {
+			case errorC <- kv.Wrap(errGo, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()):
+			case <-time.After(time.Second):
+				fmt.Printf("%s\n", kv.Wrap(errGo, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()))
 			}
 		}
+		forgetCacheKey(file.Name())
+		lock.remove()
+
+		removeTree(file.Name())
 	}
+
+	groomTrees(backingDir)
+	groomLocks(backingDir)
 }
 
 // groomDir will scan the in memory cache and if there are files that are on disk
@@ -194,9 +345,25 @@ func ClearObjStore() (err kv.Error) {
 			if info.IsDir() {
 				continue
 			}
-			if err = os.Remove(filepath.Join(backingDir, file.Name())); err != nil {
-				return kv.Wrap(err, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime())
+			// Items in use by any runner process sharing the cache are retained
+			lock, err := lockCacheItem(context.Background(), backingDir, file.Name(), true, false)
+			if err != nil {
+				return err
+			}
+			if lock == nil {
+				continue
+			}
+			// The index entries are removed while the hit and miss statistics are retained
+			if index != nil {
+				_ = index.remove(file.Name())
 			}
+			if errGo = os.Remove(filepath.Join(backingDir, file.Name())); errGo != nil {
+				lock.unlock()
+				return kv.Wrap(errGo, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime())
+			}
+			lock.remove()
+
+			removeTree(file.Name())
 		}
 	}
 	return nil
@@ -212,6 +379,10 @@ func ObjStoreFootPrint() (max int64) {
 // InitObjStore sets up the backing store for our object store cache.  The size specified
 // can be any byte amount.
 //
+// Items already present in the backing directory are reconciled with the cache index, items
+// that cannot be verified are removed and the remainder are retained using their previous
+// order of use.
+//
 // The triggerC channel is functional when the err value is nil, this channel can be used to manually
 // trigger the disk caching sub system
 //
@@ -232,8 +403,7 @@ func InitObjStore(ctx context.Context, backing string, size int64, removedC chan
 	// Now load a list of the files in the cache directory which further checks
 	// our ability to use the storage
 	//
-	cachedFiles, errGo := ioutil.ReadDir(backing)
-	if errGo != nil {
+	if _, errGo := ioutil.ReadDir(backing); errGo != nil {
 		return kv.Wrap(errGo, "cache directory not readable").With("backing", backing).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -271,36 +441,72 @@ func InitObjStore(ctx context.Context, backing string, size int64, removedC chan
 
 	DownloaderFactory.SetBackingDir(backingDir)
 
-	// The backing store might have partial downloads inside it.  We should clear those, ignoring kv.
-	// and then re-create the partial download directory
+	// The backing store might have partial downloads inside it.  Those that are not owned by another
+	// runner process sharing the cache were abandoned and are cleared, ignoring errors
 	partialDir := filepath.Join(backingDir, ".partial")
-	os.RemoveAll(partialDir)
-
-	if errGo = os.MkdirAll(partialDir, 0700); err != nil {
+	if errGo = os.MkdirAll(partialDir, 0700); errGo != nil {
 		return kv.Wrap(errGo, "unable to create the partial downloads dir ", partialDir).With("stack", stack.Trace().TrimRuntime())
 	}
+	if partials, errGo := ioutil.ReadDir(partialDir); errGo == nil {
+		for _, partial := range partials {
+			lock, err := lockCacheItem(ctx, backingDir, partial.Name(), true, false)
+			if err != nil || lock == nil {
+				continue
+			}
+			_ = os.Remove(filepath.Join(partialDir, partial.Name()))
+			lock.remove()
+		}
+	}
+
+	// Open the index and compare it with the files present in the cache directory
+	idx, err := openCacheIndex(backingDir)
+	if err != nil {
+		return err
+	}
+	result, err := idx.reconcile(backingDir, time.Now())
+	if err != nil {
+		return err
+	}
+
+	cacheLogger.Info("cache index reconciled", "retained", len(result.entries), "verified", len(result.verified),
+		"adopted", len(result.adopted), "evicted", len(result.evicted), "dropped", len(result.dropped))
+
+	stats, err := idx.stats()
+	if err != nil {
+		return err
+	}
+	cacheHitsMisses.Lock()
+	for hash, stat := range stats {
+		cacheHitsMisses.stats[hash] = stat
+	}
+	cacheHitsMisses.Unlock()
+
+	index = idx
 
 	// Size the cache appropriately, and track items that are in use through to their being released,
 	// which prevents items being read from being groomed and then new copies of the same
 	// data appearing
 	cache = ccache.New(ccache.Configure().MaxSize(size).GetsPerPromote(1).ItemsToPrune(1))
 
-	// Now populate the look-aside cache with the files found in the cache directory and their sizes
-	for i, file := range cachedFiles {
-		if file.IsDir() {
+	// Now populate the look-aside cache with the retained files, from the least to the most recently used,
+	// so that the order in which they will be pruned is the same as it was before the restart
+	now := time.Now()
+	for _, entry := range result.entries {
+		info, errGo := os.Stat(filepath.Join(backingDir, entry.Key))
+		if errGo != nil {
 			continue
 		}
-		if file.Name()[0] != '.' {
-			cache.Fetch(file.Name(), time.Hour*48,
-				func() (interface{}, error) {
-					return cachedFiles[i], nil
-				})
+		ttl := cacheItemTTL - now.Sub(entry.LastAccess)
+		if ttl <= 0 {
+			continue
 		}
+		cacheAdd(entry.Key, info, ttl)
 	}
 
 	// Now start the directory groomer
 	cacheInit.Do(func() {
 		groomDir(ctx, backingDir, removedC, errorC)
+		go idx.flushStatsPeriodically(ctx, errorC)
 	})
 
 	return nil
@@ -341,9 +547,27 @@ func (s *objStore) tryLocalCache(ctx context.Context, cacheName string, hash str
 	unpack bool, output string, maxBytes int64,
 	firstCall bool) (gotIt bool, size int64, warns []kv.Error, err kv.Error) {
 	if _, errGo := os.Stat(cacheName); errGo == nil {
+		// Hold a shared lock while the item is being copied so that no runner process sharing
+		// the cache can remove it
+		lock, err := lockCacheItem(ctx, backingDir, filepath.Base(cacheName), false, true)
+		if err != nil {
+			return false, 0, warns, err
+		}
+		defer lock.unlock()
+
+		// The item might have been removed before the lock was obtained
+		if _, errGo := os.Stat(cacheName); errGo != nil {
+			if firstCall {
+				addMiss(hash)
+			}
+			return false, 0, warns, nil
+		}
+
+		// Sealed items are held encrypted in the cache, and are decrypted as they are copied out
 		spec := StoreOpts{
 			Art: &request.Artifact{
 				Qualified: fmt.Sprintf("file:///%s", cacheName),
+				Encrypt:   s.sealedItem(filepath.Base(cacheName)),
 			},
 			Validate: true,
 		}
@@ -390,11 +614,28 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 	if len(cacheKey) != 0 {
 		if item := cache.Get(cacheKey); item != nil {
 			if !item.Expired() {
-				item.Extend(48 * time.Hour)
+				item.Extend(cacheItemTTL)
+				if index != nil {
+					_ = index.touch(cacheKey, time.Now())
+				}
 			}
 		}
 	}
 
+	// Immutable archives that are being unpacked can use the unpacked tree cache when it is enabled
+	if unpack && s.immutable {
+		if method := getTreeMethod(); len(method) != 0 {
+			return s.fetchTree(ctx, name, hash, cacheKey, output, maxBytes, method)
+		}
+	}
+
+	return s.fetchArchive(ctx, name, hash, cacheKey, unpack, output, maxBytes)
+}
+
+// fetchArchive retrieves an item using the archive cache, downloading it into the cache if it
+// is not already present
+//
+func (s *objStore) fetchArchive(ctx context.Context, name string, hash string, cacheKey string, unpack bool, output string, maxBytes int64) (size int64, warns []kv.Error, err kv.Error) {
 	// Construct local name for cache item,
 	// preserving filename extension for correct file processing.
 	localName := filepath.Join(backingDir, cacheKey)
@@ -435,40 +676,13 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 		}
 
 		// Initiate fresh artifact download:
-		tm := time.Now()
-		downloader, err := DownloaderFactory.GetDownloader(ctx, s.store, cacheKey, name, unpack, maxBytes)
+		w, err = s.download(ctx, name, cacheKey, unpack, maxBytes, nil)
+		warns = append(warns, w...)
 		if err != nil {
-			return 0, warns, err
-		}
-		// Wait for downloader to finish:
-		downloader.Wait()
-
-		warns = append(warns, downloader.warnings...)
-		if downloader.result == nil {
-			dbgErr := kv.NewError(fmt.Sprintf("=====DOWNLOADED local item: %s for name: %s in %v millisec\n", localName, name, time.Now().Sub(tm).Milliseconds()))
-			s.reportErr(ctx, dbgErr)
-
-			// Our item has been put in local cache, cleanup used downloader
-			// and repeat the main loop:
-			if info, goErr := os.Stat(localName); goErr == nil {
-				cache.Fetch(cacheKey, time.Hour*48,
-					func() (interface{}, error) {
-						return info, nil
-					})
-			} else {
-				err = kv.Wrap(goErr).With("cache item", localName).With("stack", stack.Trace().TrimRuntime())
-				if s.reportErr(ctx, err) {
-					return 0, warns, err
-				}
-				warns = append(warns, err)
+			if s.reportErr(ctx, err.With("stack", stack.Trace().TrimRuntime())) {
+				return 0, warns, err
 			}
-			DownloaderFactory.RemoveDownloader(cacheKey)
-		} else {
-			if s.reportErr(ctx, downloader.result.With("stack", stack.Trace().TrimRuntime())) {
-				return 0, warns, downloader.result
-			}
-			warns = append(warns, downloader.result)
-			DownloaderFactory.RemoveDownloader(cacheKey)
+			warns = append(warns, err)
 		}
 		select {
 		case <-ctx.Done():
@@ -479,6 +693,35 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 	// unreachable
 }
 
+// download places an item into the cache, sharing the download with any other callers that
+// need the same item.  The limiter, if supplied, limits the bandwidth used when this caller
+// starts the download.
+//
+func (s *objStore) download(ctx context.Context, name string, cacheKey string, unpack bool, maxBytes int64, limiter *rate.Limiter) (warns []kv.Error, err kv.Error) {
+	localName := filepath.Join(backingDir, cacheKey)
+
+	downloader, err := DownloaderFactory.GetDownloader(ctx, s.store, cacheKey, name, s.uri, unpack, maxBytes, limiter)
+	if err != nil {
+		return warns, err
+	}
+	// Wait for downloader to finish, and then cleanup the used downloader
+	downloader.Wait()
+	defer DownloaderFactory.RemoveDownloader(cacheKey)
+
+	warns = append(warns, downloader.warnings...)
+	if downloader.result != nil {
+		return warns, downloader.result
+	}
+
+	// Our item has been put in local cache
+	info, errGo := os.Stat(localName)
+	if errGo != nil {
+		return warns, kv.Wrap(errGo).With("cache item", localName).With("stack", stack.Trace().TrimRuntime())
+	}
+	cacheAdd(cacheKey, info, cacheItemTTL)
+	return warns, nil
+}
+
 // Deposit is used to place a file or other storage resource within the storage implemented
 // by a specific implementation.
 //
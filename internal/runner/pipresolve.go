@@ -0,0 +1,162 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the resolution of the pip specifiers of an experiment into the exact set
+// of packages pip would install, which is used to key the virtualenv cache
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	// resolverPip is the pip release used to resolve packages, the pip installed into
+	// virtualenvs by the build script predates the --report option
+	resolverPip = "pip==23.3.2"
+)
+
+// pipReport is the subset of the installation report, https://pip.pypa.io/en/stable/reference/installation-report/,
+// used to identify the packages pip would install
+type pipReport struct {
+	Install []struct {
+		Metadata struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"metadata"`
+		DownloadInfo struct {
+			URL     string `json:"url"`
+			VCSInfo *struct {
+				CommitID string `json:"commit_id"`
+			} `json:"vcs_info"`
+			DirInfo *struct{} `json:"dir_info"`
+		} `json:"download_info"`
+	} `json:"install"`
+}
+
+// resolvedPackage describes a package within the report that pip produces when resolving
+type resolvedPackage struct {
+	name    string // The PEP 503 normalized project name
+	version string
+	source  string // The URL, and commit, of a package not installed from an index, empty otherwise
+}
+
+func (pkg resolvedPackage) String() string {
+	if len(pkg.source) != 0 {
+		return pkg.name + "==" + pkg.version + " @ " + pkg.source
+	}
+	return pkg.name + "==" + pkg.version
+}
+
+// parsePipReport extracts the packages pip would install from an installation report, sorted
+// by name
+//
+func parsePipReport(data []byte) (pkgs []resolvedPackage, err kv.Error) {
+	report := &pipReport{}
+	if errGo := json.Unmarshal(data, report); errGo != nil {
+		return nil, kv.Wrap(errGo, "pip installation report invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pkgs = make([]resolvedPackage, 0, len(report.Install))
+	for _, install := range report.Install {
+		pkg := resolvedPackage{
+			name:    strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(install.Metadata.Name)),
+			version: install.Metadata.Version,
+		}
+		if len(pkg.name) == 0 || len(pkg.version) == 0 {
+			return nil, kv.NewError("pip installation report incomplete").With("package", install.Metadata.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		switch {
+		case install.DownloadInfo.VCSInfo != nil:
+			pkg.source = install.DownloadInfo.URL + "@" + install.DownloadInfo.VCSInfo.CommitID
+		case install.DownloadInfo.DirInfo != nil:
+			pkg.source = install.DownloadInfo.URL
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+	return pkgs, nil
+}
+
+// resolvePipArgs asks pip for the packages it would install given the arguments for a pip install,
+// including the dependencies of the requested packages.  A throwaway virtualenv holding a pip
+// release that supports installation reports is used for the resolution.
+//
+func resolvePipArgs(ctx context.Context, pythonVer string, env map[string]string, args []string) (pkgs []resolvedPackage, err kv.Error) {
+	tmpDir, errGo := ioutil.TempDir("", "venv-resolve")
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(tmpDir)
+
+	prefix, errGo := pyenvCmd(ctx, "prefix", pythonVer).Output()
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("pythonver", pythonVer).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Settings such as PIP_INDEX_URL supplied with the experiment apply to the resolution
+	cmdEnv := append(os.Environ(), "TMPDIR="+tmpDir)
+	for k, v := range env {
+		cmdEnv = append(cmdEnv, k+"="+v)
+	}
+	run := func(name string, arg ...string) (err kv.Error) {
+		// #nosec
+		cmd := exec.CommandContext(ctx, name, arg...)
+		cmd.Env = cmdEnv
+		cmd.Dir = tmpDir
+		if output, errGo := cmd.CombinedOutput(); errGo != nil {
+			return kv.Wrap(errGo, "pip resolution failed").With("output", string(output)).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	}
+
+	venvDir := filepath.Join(tmpDir, "resolver")
+	if err = run(filepath.Join(strings.TrimSpace(string(prefix)), "bin", "python3"), "-m", "venv", venvDir); err != nil {
+		return nil, err.With("pythonver", pythonVer)
+	}
+	python := filepath.Join(venvDir, "bin", "python3")
+	if err = run(python, "-m", "pip", "install", "--quiet", "--disable-pip-version-check", resolverPip); err != nil {
+		return nil, err.With("pythonver", pythonVer)
+	}
+
+	reportFN := filepath.Join(tmpDir, "report.json")
+	install := append([]string{"-m", "pip", "install", "--dry-run", "--ignore-installed", "--quiet", "--disable-pip-version-check", "--report", reportFN}, args...)
+	if err = run(python, install...); err != nil {
+		return nil, err.With("pythonver", pythonVer)
+	}
+
+	data, errGo := ioutil.ReadFile(reportFN)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return parsePipReport(data)
+}
+
+// resolvePythonEnv resolves the loose pip specifiers of an experiment into the packages pip would
+// install for them.  Hash pinned specifiers are not resolved as pip --require-hashes insists that
+// they name every package, and version, that is installed.
+//
+func (cache *VirtualEnvCache) resolvePythonEnv(ctx context.Context, pythonVer string, general []string, configured []string,
+	env map[string]string) (pkgs []resolvedPackage, err kv.Error) {
+
+	general, _ = splitPinnedModules(cache.expandPipSpecs(general, env))
+	configured, _ = splitPinnedModules(cache.expandPipSpecs(configured, env))
+
+	args, err := pipArgs(append(general, configured...))
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return []resolvedPackage{}, nil
+	}
+	return resolvePipArgs(ctx, pythonVer, env, args)
+}
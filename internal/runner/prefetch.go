@@ -0,0 +1,131 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of artifact prefetching which places the immutable artifacts
+// of requests that are waiting on queues into the cache before the requests are claimed.
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"golang.org/x/time/rate"
+)
+
+// storageSizer is implemented by storage that can report the size of an object without retrieving it
+type storageSizer interface {
+	Size(ctx context.Context, name string) (size int64, err kv.Error)
+}
+
+// PrefetchAdmit is called before a prefetch download is started with the size of the artifact.  It
+// returns an error if the download cannot be admitted, otherwise it returns a function that is called
+// once the download has finished.
+type PrefetchAdmit func(size int64) (release func(), err kv.Error)
+
+// Prefetch places an immutable artifact into the cache without retrieving it for an experiment.  Artifacts
+// already in the cache are skipped and a size of 0 is returned.  Prefetching does not alter the cache hit
+// and miss statistics, the experiment that later uses the artifact will record a hit.
+//
+func (cache *ArtifactCache) Prefetch(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, admit PrefetchAdmit, limiter *rate.Limiter) (size int64, warns []kv.Error, err kv.Error) {
+
+	kvList := kv.With("group", group).With("artifact", sourceURI(art.Qualified))
+	defer func() {
+		if err != nil {
+			err = err.With(kvList)
+		}
+	}()
+
+	if len(backingDir) == 0 {
+		return 0, warns, kv.NewError("prefetching requires the cache to be enabled").With("stack", stack.Trace().TrimRuntime())
+	}
+	if art.Mutable {
+		return 0, warns, kv.NewError("mutable artifacts cannot be prefetched").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	storage, err := NewObjStore(
+		ctx,
+		&StoreOpts{
+			Art:       art,
+			ProjectID: projectId,
+			Group:     group,
+			Env:       env,
+			Validate:  true,
+		},
+		cache.ErrorC)
+
+	if err != nil {
+		return 0, warns, err.With("stack", stack.Trace().TrimRuntime())
+	}
+	defer storage.Close()
+
+	return storage.prefetch(ctx, objectName(art), art.Unpack, admit, limiter)
+}
+
+func (s *objStore) prefetch(ctx context.Context, name string, unpack bool, admit PrefetchAdmit, limiter *rate.Limiter) (size int64, warns []kv.Error, err kv.Error) {
+	sizer, isSizer := s.store.(storageSizer)
+	if !isSizer {
+		return 0, warns, kv.NewError("storage cannot be prefetched").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	hash, err := s.store.Hash(ctx, name)
+	if err != nil {
+		return 0, warns, err
+	}
+	cacheKey := hash + filepath.Ext(name)
+	if _, errGo := os.Stat(filepath.Join(backingDir, cacheKey)); errGo == nil {
+		return 0, warns, nil
+	}
+
+	if size, err = sizer.Size(ctx, name); err != nil {
+		return 0, warns, err
+	}
+
+	release, err := admit(size)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer release()
+
+	// The size of the object is used as the limit on the download so that an object
+	// that has changed size since it was checked cannot exceed the space admitted
+	if warns, err = s.download(ctx, name, cacheKey, unpack, size, limiter); err != nil {
+		return 0, warns, err
+	}
+	return size, warns, nil
+}
+
+// rateWriter limits the rate at which data is written using a token bucket, with a token per byte
+type rateWriter struct {
+	ctx     context.Context
+	limiter *rate.Limiter
+	w       io.Writer
+}
+
+// Write blocks until the limiter allows the data to be written, data larger than the burst
+// of the limiter is written in chunks
+//
+func (rw *rateWriter) Write(p []byte) (n int, errGo error) {
+	for len(p) != 0 {
+		chunk := len(p)
+		if burst := rw.limiter.Burst(); burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if errGo = rw.limiter.WaitN(rw.ctx, chunk); errGo != nil {
+			return n, errGo
+		}
+		written, errGo := rw.w.Write(p[:chunk])
+		n += written
+		if errGo != nil {
+			return n, errGo
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
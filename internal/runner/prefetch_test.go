@@ -0,0 +1,137 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for artifact prefetching
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/karlmutch/ccache"
+
+	"golang.org/x/time/rate"
+)
+
+// prefetchStore is a Storage implementation holding a single object in memory
+type prefetchStore struct {
+	content []byte
+	fetches int
+}
+
+func (s *prefetchStore) Gather(ctx context.Context, keyPrefix string, outputDir string, maxBytes int64, tap io.Writer, failFast bool) (size int64, warnings []kv.Error, err kv.Error) {
+	return 0, nil, kv.NewError("not implemented").With("stack", stack.Trace().TrimRuntime())
+}
+
+func (s *prefetchStore) Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64, tap io.Writer) (size int64, warnings []kv.Error, err kv.Error) {
+	s.fetches++
+	if int64(len(s.content)) > maxBytes {
+		return 0, nil, kv.NewError("object exceeds the maximum size").With("stack", stack.Trace().TrimRuntime())
+	}
+	n, errGo := tap.Write(s.content)
+	if errGo != nil {
+		return 0, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return int64(n), nil, nil
+}
+
+func (s *prefetchStore) Deposit(ctx context.Context, src string, dest string) (warnings []kv.Error, err kv.Error) {
+	return nil, kv.NewError("not implemented").With("stack", stack.Trace().TrimRuntime())
+}
+
+func (s *prefetchStore) Hash(ctx context.Context, name string) (hash string, err kv.Error) {
+	return "0123456789abcdef0123456789abcdef", nil
+}
+
+func (s *prefetchStore) Size(ctx context.Context, name string) (size int64, err kv.Error) {
+	return int64(len(s.content)), nil
+}
+
+func (s *prefetchStore) Close() {}
+
+// TestPrefetch checks that prefetched artifacts are admitted against a budget, placed into
+// the cache, and are not downloaded again once cached
+//
+func TestPrefetch(t *testing.T) {
+	savedDir, savedCache, savedIndex := backingDir, cache, index
+	backingDir, cache, index = t.TempDir(), ccache.New(ccache.Configure()), nil
+	DownloaderFactory.SetBackingDir(backingDir)
+	defer func() {
+		cache.Stop()
+		backingDir, cache, index = savedDir, savedCache, savedIndex
+		DownloaderFactory.SetBackingDir(backingDir)
+	}()
+	if errGo := os.MkdirAll(filepath.Join(backingDir, ".partial"), 0700); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := &prefetchStore{content: []byte("training data")}
+	s := &objStore{store: store, immutable: true}
+
+	released := 0
+	budget := int64(4)
+	admit := func(size int64) (release func(), err kv.Error) {
+		if size > budget {
+			return nil, kv.NewError("prefetch budget exceeded").With("size", size).With("stack", stack.Trace().TrimRuntime())
+		}
+		return func() { released++ }, nil
+	}
+
+	if _, _, err := s.prefetch(ctx, "data.tar", false, admit, nil); err == nil {
+		t.Fatal(kv.NewError("prefetch exceeding the budget was admitted").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if store.fetches != 0 {
+		t.Fatal(kv.NewError("prefetch exceeding the budget was downloaded").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	budget = 1024
+	size, _, err := s.prefetch(ctx, "data.tar", false, admit, rate.NewLimiter(rate.Inf, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(store.content)) || released != 1 || store.fetches != 1 {
+		t.Fatal(kv.NewError("unexpected prefetch").With("size", size, "released", released, "fetches", store.fetches).With("stack", stack.Trace().TrimRuntime()))
+	}
+	content, errGo := os.ReadFile(filepath.Join(backingDir, "0123456789abcdef0123456789abcdef.tar"))
+	if errGo != nil || !bytes.Equal(content, store.content) {
+		t.Fatal(kv.NewError("prefetched item not cached").With("error", errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Cached items are skipped
+	if size, _, err = s.prefetch(ctx, "data.tar", false, admit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 || store.fetches != 1 {
+		t.Fatal(kv.NewError("cached item prefetched").With("size", size, "fetches", store.fetches).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestPrefetchRateWriter checks that writes are limited to the rate of the limiter
+//
+func TestPrefetchRateWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	// 1000 bytes a second with an initial burst of 100 bytes
+	rw := &rateWriter{ctx: context.Background(), limiter: rate.NewLimiter(rate.Limit(1000), 100), w: out}
+
+	start := time.Now()
+	if _, errGo := rw.Write(make([]byte, 300)); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatal(kv.NewError("write not limited").With("elapsed", elapsed).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if out.Len() != 300 {
+		t.Fatal(kv.NewError("write incomplete").With("written", out.Len()).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of python interpreter discovery
+// and provisioning using the pyenv installation shipped with the runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	pyenvInstallOpt = flag.Bool("pyenv-install", false, "install python versions requested by experiments that are not already present using pyenv")
+	pyenvCacheOpt   = flag.String("pyenv-cache", "", "optional shared directory used by pyenv to cache python source downloads between installs, built interpreters are not cached")
+
+	// pyenvRoot is the location of the pyenv installation used by the generated
+	// workload scripts
+	pyenvRoot = "/runner/.pyenv"
+
+	pythonVersions = pythonVersionsType{
+		versions: []string{},
+	}
+
+	pythonVersionAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_python_version_available",
+			Help: "Set to 1 for each python version installed on the host and available to experiments.",
+		},
+		[]string{"host", "version"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pythonVersionAvailable)
+}
+
+type pythonVersionsType struct {
+	versions []string
+	logger   *log.Logger
+	installs sync.Mutex
+	sync.Mutex
+}
+
+// pyenvCmd prepares a pyenv command with the runners pyenv installation present
+// on the path
+//
+func pyenvCmd(ctx context.Context, args ...string) (cmd *exec.Cmd) {
+	// #nosec
+	cmd = exec.CommandContext(ctx, filepath.Join(pyenvRoot, "bin", "pyenv"), args...)
+	cmd.Env = append(os.Environ(),
+		"PYENV_ROOT="+pyenvRoot,
+		"PATH="+filepath.Join(pyenvRoot, "bin")+":"+os.Getenv("PATH"),
+	)
+	if len(*pyenvCacheOpt) != 0 {
+		cmd.Env = append(cmd.Env, "PYTHON_BUILD_CACHE_PATH="+*pyenvCacheOpt)
+	}
+	return cmd
+}
+
+// scanPythonVersions retrieves the list of python interpreters known to pyenv, excluding
+// the virtual environments the runner itself has created
+//
+func scanPythonVersions(ctx context.Context) (versions []string, err kv.Error) {
+	output, errGo := pyenvCmd(ctx, "versions", "--bare").Output()
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("pyenv", pyenvRoot).With("stack", stack.Trace().TrimRuntime())
+	}
+	return parsePythonVersions(output), nil
+}
+
+func parsePythonVersions(output []byte) (versions []string) {
+	versions = []string{}
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		version := strings.TrimSpace(s.Text())
+		if len(version) == 0 || version == "system" {
+			continue
+		}
+		if strings.Contains(version, "venv-runner") || strings.Contains(version, "/envs/") {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// matchPythonVersion selects the interpreter that will be used for a requested version.  An exact
+// match is preferred, otherwise the highest of the installed versions that the request is a prefix of is used,
+// which will be the most recent patch release.  Versions are compared using their numeric components as
+// pyenv lists them in lexical order, 3.9.10 before 3.9.2 for example.
+//
+func matchPythonVersion(requested string, versions []string) (version string, isPresent bool) {
+	for _, aVersion := range versions {
+		if aVersion == requested {
+			return aVersion, true
+		}
+	}
+	for _, aVersion := range versions {
+		if len(requested) == 0 || strings.HasPrefix(aVersion, requested+".") || strings.HasPrefix(aVersion, requested+"-") {
+			if !isPresent || comparePythonVersions(aVersion, version) > 0 {
+				version = aVersion
+				isPresent = true
+			}
+		}
+	}
+	return version, isPresent
+}
+
+// comparePythonVersions orders two version strings such as 3.9.10, 3.10.0rc1, or pypy3.7-7.3.3
+// returning a negative number when a is the lower version, zero when they are equal and a
+// positive number when a is the higher.  Each dot, or dash, separated component is compared
+// using its leading number and then any suffix, a component without a suffix is a final release
+// and so is higher than a component with a suffix such as rc1.
+//
+func comparePythonVersions(a string, b string) (result int) {
+	splitter := func(r rune) bool { return r == '.' || r == '-' }
+	aParts := strings.FieldsFunc(a, splitter)
+	bParts := strings.FieldsFunc(b, splitter)
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aSuffix := splitVersionComponent(aParts[i])
+		bNum, bSuffix := splitVersionComponent(bParts[i])
+		switch {
+		case aNum != bNum:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case aSuffix == bSuffix:
+			continue
+		case len(aSuffix) == 0:
+			return 1
+		case len(bSuffix) == 0:
+			return -1
+		default:
+			return strings.Compare(aSuffix, bSuffix)
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+// splitVersionComponent separates the leading number of a version component from any suffix,
+// components without a leading number are treated as 0
+//
+func splitVersionComponent(component string) (num int, suffix string) {
+	digits := 0
+	for digits < len(component) && component[digits] >= '0' && component[digits] <= '9' {
+		digits++
+	}
+	num, _ = strconv.Atoi(component[:digits])
+	return num, component[digits:]
+}
+
+func (pv *pythonVersionsType) refresh(ctx context.Context) (versions []string, err kv.Error) {
+	if versions, err = scanPythonVersions(ctx); err != nil {
+		return nil, err
+	}
+	pv.Lock()
+	pv.versions = versions
+	pv.Unlock()
+
+	pythonVersionAvailable.Reset()
+	for _, version := range versions {
+		pythonVersionAvailable.With(prometheus.Labels{"host": host, "version": version}).Set(1)
+	}
+	return versions, nil
+}
+
+func (pv *pythonVersionsType) get() (versions []string) {
+	pv.Lock()
+	defer pv.Unlock()
+	return append([]string{}, pv.versions...)
+}
+
+// lockInstalls is used to serialize pyenv installs across all of the runners sharing
+// the pyenv installation on this host
+//
+func lockInstalls() (unlock func(), err kv.Error) {
+	lockFN := filepath.Join(pyenvRoot, ".runner-install.lock")
+	lockFile, errGo := os.OpenFile(lockFN, os.O_CREATE|os.O_RDWR, 0600)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("lock", lockFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); errGo != nil {
+		lockFile.Close()
+		return nil, kv.Wrap(errGo).With("lock", lockFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	return func() {
+		_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
+
+func (pv *pythonVersionsType) install(ctx context.Context, requested string) (err kv.Error) {
+	pv.installs.Lock()
+	defer pv.installs.Unlock()
+
+	unlock, err := lockInstalls()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another runner, or another experiment in this runner, might have done the install while
+	// we were waiting on the lock
+	versions, err := pv.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	if _, isPresent := matchPythonVersion(requested, versions); isPresent {
+		return nil
+	}
+
+	if pv.logger != nil {
+		pv.logger.Info("installing python version", "version", requested)
+	}
+
+	output, errGo := pyenvCmd(ctx, "install", "--skip-existing", requested).CombinedOutput()
+	if errGo != nil {
+		return kv.Wrap(errGo, "pyenv install failed").With("version", requested, "output", string(output)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	versions, err = pv.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	if pv.logger != nil {
+		pv.logger.Info("python versions available", "versions", strings.Join(versions, ","))
+	}
+	return nil
+}
+
+// InitPythonVersions discovers the python interpreters that are available to experiments and
+// advertises them via the log, and the runner_python_version_available prometheus gauge
+//
+func InitPythonVersions(ctx context.Context, logger *log.Logger) (versions []string, err kv.Error) {
+	pythonVersions.logger = logger
+
+	if versions, err = pythonVersions.refresh(ctx); err != nil {
+		return nil, err
+	}
+	logger.Info("python versions available", "versions", strings.Join(versions, ","), "install", *pyenvInstallOpt)
+	return versions, nil
+}
+
+// GetPythonVersions returns the python interpreters that were known at the last time
+// pyenv was scanned
+//
+func GetPythonVersions() (versions []string) {
+	return pythonVersions.get()
+}
+
+// ResolvePythonVersion maps the python version requested by an experiment onto an installed
+// interpreter.  When the version is not present and the runner has been configured to do so pyenv
+// will be used to install it.  Failing to find the version will result in an error, rather than
+// the experiment being run with a different interpreter.
+//
+func ResolvePythonVersion(ctx context.Context, requested string) (version string, err kv.Error) {
+	requested = strings.TrimSpace(requested)
+
+	version, install, err := LookupPythonVersion(ctx, requested)
+	if err != nil || !install {
+		return version, err
+	}
+
+	if err = pythonVersions.install(ctx, requested); err != nil {
+		return "", kv.Wrap(err, "python version not available").With("pythonver", requested).With("stack", stack.Trace().TrimRuntime())
+	}
+	if version, isPresent := matchPythonVersion(requested, pythonVersions.get()); isPresent {
+		return version, nil
+	}
+	return "", pythonVersionErr(requested)
+}
+
+// LookupPythonVersion maps the python version requested by an experiment onto an installed
+// interpreter without installing anything.  When the version is not present, and would be installed
+// by ResolvePythonVersion, no version is returned and install is set.
+//
+func LookupPythonVersion(ctx context.Context, requested string) (version string, install bool, err kv.Error) {
+	requested = strings.TrimSpace(requested)
+
+	if version, isPresent := matchPythonVersion(requested, pythonVersions.get()); isPresent {
+		return version, false, nil
+	}
+
+	// Check to see if the version has appeared since we last looked
+	versions, err := pythonVersions.refresh(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if version, isPresent := matchPythonVersion(requested, versions); isPresent {
+		return version, false, nil
+	}
+
+	if *pyenvInstallOpt && len(requested) != 0 {
+		return "", true, nil
+	}
+	return "", false, pythonVersionErr(requested)
+}
+
+func pythonVersionErr(requested string) (err kv.Error) {
+	return kv.NewError("python version not available").
+		With("pythonver", requested, "available", strings.Join(pythonVersions.get(), ","), "install", *pyenvInstallOpt).
+		With("stack", stack.Trace().TrimRuntime())
+}
@@ -24,138 +24,23 @@ import (
 	"github.com/jjeffery/kv" // MIT License
 )
 
-var (
-	hostname string
+const (
+	// DryRunVenvID is the virtualenv name placed into the scripts generated by DryRunScript
+	// when the virtualenv has yet to be built
+	DryRunVenvID = "venv-runner-dry-run"
+
+	// dryRunTmpDir is the directory placed into the virtualenv build script generated by
+	// DryRunScript in place of the temporary directory created for each build
+	dryRunTmpDir = "/tmp/venv-runner-dry-run"
 )
 
-func init() {
-	hostname, _ = os.Hostname()
-}
-
-// VirtualEnv encapsulated the context that a python virtual environment is to be
-// instantiated from including items such as the list of pip installables that should
-// be loaded and shell script to run.
-//
-type VirtualEnv struct {
-	Request   *request.Request
-	Script    string
-	workDir   string
-	uniqueID  string
-	venvID    string
-	venvEntry *VirtualEnvEntry
-	logger    *log.Logger
-}
-
-// NewVirtualEnv builds the VirtualEnv data structure from data received across the wire
-// from a studioml client.
-//
-func NewVirtualEnv(rqst *request.Request, dir string, uniqueID string, logger *log.Logger) (env *VirtualEnv, err kv.Error) {
-
-	if errGo := os.MkdirAll(filepath.Join(dir, "_runner"), 0700); errGo != nil {
-		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-	}
-
-	return &VirtualEnv{
-		Request:  rqst,
-		Script:   filepath.Join(dir, "_runner", "runner.sh"),
-		workDir:  dir,
-		uniqueID: uniqueID,
-		logger:   logger,
-	}, nil
-}
-
-// gpuEnv is used to pull out of the allocated GPU roster the needed environment variables for running
-// the python environment
-func gpuEnv(alloc *resources.Allocated) (envs []string) {
-	if len(alloc.GPU) != 0 {
-		gpuSettings := map[string][]string{}
-		for _, resource := range alloc.GPU {
-			for k, v := range resource.Env {
-				if k == "CUDA_VISIBLE_DEVICES" || k == "NVIDIA_VISIBLE_DEVICES" {
-					if setting, isPresent := gpuSettings[k]; isPresent {
-						gpuSettings[k] = append(setting, v)
-					} else {
-						gpuSettings[k] = []string{v}
-					}
-				} else {
-					envs = append(envs, k+"="+v)
-				}
-			}
-		}
-		for k, v := range gpuSettings {
-			envs = append(envs, k+"="+strings.Join(v, ","))
-		}
-	} else {
-		// Force CUDA GPUs offline manually rather than leaving this undefined
-		envs = append(envs, "CUDA_VISIBLE_DEVICES=\"-1\"")
-		envs = append(envs, "NVIDIA_VISIBLE_DEVICES=\"-1\"")
-	}
-	return envs
-}
-
-// Make is used to write a script file that is generated for the specific TF tasks studioml has sent.
-// It also receives Python virtual environment ID
-// for environment to be used for running given evaluation task.
-//
-func (p *VirtualEnv) Make(ctx context.Context, alloc *resources.Allocated, e interface{}) (err kv.Error, evalDone bool) {
-
-	// Get Python virtual environment ID:
-	if p.venvEntry, err = virtEnvCache.getEntry(ctx, p.Request, alloc, p.workDir); err != nil {
-		return err.With("stack", stack.Trace().TrimRuntime()).With("workDir", p.workDir), false
-	}
-
-	venvID, venvValid := p.venvEntry.addClient(p.uniqueID)
-	p.venvID = venvID
-
-	defer func() {
-		if err != nil {
-			p.venvEntry.removeClient(p.uniqueID)
-		}
-	}()
-
-	if !venvValid {
-		err = kv.NewError("venv is invalid").With("venv", venvID, "stack", stack.Trace().TrimRuntime()).With("workDir", p.workDir)
-		return err, true
-	}
-
-	// The tensorflow versions 1.5.x and above all support cuda 9 and 1.4.x is cuda 8,
-	// c.f. https://www.tensorflow.org/install/install_sources#tested_source_configurations.
-	// Insert the appropriate version explicitly into the LD_LIBRARY_PATH before other paths
-	cudaDir := "/usr/local/cuda-10.0/lib64"
-
-	params := struct {
-		AllocEnv []string
-		E        interface{}
-		VEnvID   string
-		CudaDir  string
-		Hostname string
-		Env      map[string]string
-	}{
-		AllocEnv: []string{},
-		E:        e,
-		VEnvID:   p.venvID,
-		CudaDir:  cudaDir,
-		Hostname: hostname,
-		Env:      p.Request.Config.Env,
-	}
-
-	if alloc.CPU != nil {
-		if alloc.CPU.Cores > 1 {
-			params.AllocEnv = append(params.AllocEnv, "OPENMP=True")
-			params.AllocEnv = append(params.AllocEnv, "MKL_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
-			params.AllocEnv = append(params.AllocEnv, "GOTO_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
-			params.AllocEnv = append(params.AllocEnv, "OMP_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
-		}
-	}
-
-	// Add GPU environment variables to the python process environment table
-	params.AllocEnv = append(params.AllocEnv, gpuEnv(alloc)...)
+var (
+	hostname string
 
-	// Create a shell script that will do everything needed to run
-	// the python environment in a virtual env
-	//tmpl, errGo := template.New("pythonRunner").Parse(
-	scriptText :=
-		`#!/bin/bash -x
+	// runScriptTemplate is the built-in template used to generate the script that runs an experiment,
+	// the template is executed using RunScriptParams.  Backticks are not permitted within go raw
+	// strings so ^^^ is used in their place and replaced before the template is parsed.
+	runScriptTemplate = `#!/bin/bash -x
 
 sleep 2
 # Credit https://github.com/fernandoacorreia/azure-docker-registry/blob/master/tools/scripts/create-registry-server
@@ -209,7 +94,7 @@ set -e
 echo "Using env"
 {{if .Env}}
 {{range $key, $value := .Env}}
-export {{$key}}="{{$value}}"
+export {{$key}}={{shellquote $value}}
 {{end}}
 {{end}}
 echo "Done env"
@@ -217,16 +102,9 @@ export LD_LIBRARY_PATH={{.CudaDir}}:$LD_LIBRARY_PATH:/usr/local/cuda/lib64/:/usr
 mkdir -p {{.E.RootDir}}/blob-cache
 mkdir -p {{.E.RootDir}}/queue
 mkdir -p {{.E.RootDir}}/artifact-mappings
-mkdir -p {{.E.RootDir}}/artifact-mappings/{{.E.Request.Experiment.Key}}
+mkdir -p {{.E.RootDir}}/artifact-mappings/{{shellquote .E.Request.Experiment.Key}}
 export PATH=/runner/.pyenv/bin:$PATH
-export PYENV_VERSION={{.E.Request.Experiment.PythonVer}}
-IFS=$'\n'; arr=( $(pyenv versions --bare | grep -v venv-runner || true) )
-for i in ${arr[@]} ; do
-    if [[ "$i" == ${PYENV_VERSION}* ]]; then
-		export PYENV_VERSION=$i
-		echo $PYENV_VERSION
-	fi
-done
+export PYENV_VERSION={{shellquote .E.Request.Experiment.PythonVer}}
 eval "$(pyenv init --path)"
 eval "$(pyenv init -)"
 eval "$(pyenv virtualenv-init -)"
@@ -242,6 +120,8 @@ export {{.}}
 export
 cd {{.E.ExprDir}}/workspace
 python3 -m pip freeze
+mkdir -p {{.E.ExprDir}}/_metadata
+python3 -m pip freeze --all > {{.E.ExprDir}}/_metadata/pip-freeze-{{.E.AccessionID}}.txt || true
 python3 -m pip -V
 set -x
 set -e
@@ -260,7 +140,7 @@ nvidia-smi 2>/dev/null || true
 # nvidia-smi  mig -i 7 -cgi 14,14,14 -C || true
 nvidia-smi 2>/dev/null || true
 
-stdbuf -oL -eL python {{.E.Request.Experiment.Filename}} {{range .E.Request.Experiment.Args}}{{.}} {{end}}
+stdbuf -oL -eL python {{shellquote .E.Request.Experiment.Filename}}{{range .E.Request.Experiment.Args}} {{shellquote .}}{{end}}
 result=$?
 echo $result
 set +e
@@ -274,24 +154,265 @@ date -u
 nvidia-smi 2>/dev/null || true
 exit $result
 `
-	// Now we have to do this thing about "`" in our text
-	scriptText = strings.ReplaceAll(scriptText, "^^^", "`")
-	tmpl, errGo := template.New("pythonRunner").Parse(scriptText)
-	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()), false
+)
+
+func init() {
+	hostname, _ = os.Hostname()
+}
+
+// VirtualEnv encapsulated the context that a python virtual environment is to be
+// instantiated from including items such as the list of pip installables that should
+// be loaded and shell script to run.
+//
+type VirtualEnv struct {
+	Request     *request.Request
+	Script      string
+	OutputTap   LineTap // Optional observer of the experiments output lines
+	workDir     string
+	uniqueID    string
+	queueName   string
+	runTemplate string
+	venvID      string
+	venvEntry   *VirtualEnvEntry
+	logger      *log.Logger
+}
+
+// NewVirtualEnv builds the VirtualEnv data structure from data received across the wire
+// from a studioml client.  The queueName is used to select any operator supplied script templates.
+//
+func NewVirtualEnv(rqst *request.Request, dir string, uniqueID string, queueName string, logger *log.Logger) (env *VirtualEnv, err kv.Error) {
+
+	if errGo := os.MkdirAll(filepath.Join(dir, "_runner"), 0700); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	content := new(bytes.Buffer)
-	if errGo = tmpl.Execute(content, params); errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()), false
+	return &VirtualEnv{
+		Request:   rqst,
+		Script:    filepath.Join(dir, "_runner", "runner.sh"),
+		workDir:   dir,
+		uniqueID:  uniqueID,
+		queueName: queueName,
+		logger:    logger,
+	}, nil
+}
+
+// gpuEnv is used to pull out of the allocated GPU roster the needed environment variables for running
+// the python environment
+func gpuEnv(alloc *resources.Allocated) (envs []string) {
+	if len(alloc.GPU) != 0 {
+		gpuSettings := map[string][]string{}
+		for _, resource := range alloc.GPU {
+			for k, v := range resource.Env {
+				if k == "CUDA_VISIBLE_DEVICES" || k == "NVIDIA_VISIBLE_DEVICES" {
+					if setting, isPresent := gpuSettings[k]; isPresent {
+						gpuSettings[k] = append(setting, v)
+					} else {
+						gpuSettings[k] = []string{v}
+					}
+				} else {
+					envs = append(envs, k+"="+v)
+				}
+			}
+		}
+		for k, v := range gpuSettings {
+			envs = append(envs, k+"="+strings.Join(v, ","))
+		}
+	} else {
+		// Force CUDA GPUs offline manually rather than leaving this undefined
+		envs = append(envs, "CUDA_VISIBLE_DEVICES=\"-1\"")
+		envs = append(envs, "NVIDIA_VISIBLE_DEVICES=\"-1\"")
 	}
+	return envs
+}
 
-	if errGo = ioutil.WriteFile(p.Script, content.Bytes(), 0700); errGo != nil {
+// validateScriptInput checks the experiment values that are used within generated scripts
+// for items that cannot be safely quoted
+//
+func validateScriptInput(rqst *request.Request) (err kv.Error) {
+	for key, value := range rqst.Config.Env {
+		if !IsValidEnvKey(key) {
+			return kv.NewError("invalid environment variable name").With("key", key).With("stack", stack.Trace().TrimRuntime())
+		}
+		if strings.ContainsRune(value, 0) {
+			return kv.NewError("invalid environment variable value").With("key", key).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if strings.ContainsRune(rqst.Experiment.Filename, 0) {
+		return kv.NewError("invalid experiment filename").With("stack", stack.Trace().TrimRuntime())
+	}
+	for i, arg := range rqst.Experiment.Args {
+		if strings.ContainsRune(arg, 0) {
+			return kv.NewError("invalid experiment argument").With("arg", i).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	for i, pip := range rqst.Experiment.Pythonenv {
+		if strings.ContainsRune(pip, 0) {
+			return kv.NewError("invalid experiment pip specifier").With("pip", i).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, err = SplitWords(pip); err != nil {
+			return err.With("pip", i)
+		}
+	}
+	for i, pip := range rqst.Config.Pip {
+		if strings.ContainsRune(pip, 0) {
+			return kv.NewError("invalid config pip specifier").With("pip", i).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, err = SplitWords(pip); err != nil {
+			return err.With("pip", i)
+		}
+	}
+	return nil
+}
+
+// Make is used to write a script file that is generated for the specific TF tasks studioml has sent.
+// It also receives Python virtual environment ID
+// for environment to be used for running given evaluation task.
+//
+func (p *VirtualEnv) Make(ctx context.Context, alloc *resources.Allocated, e interface{}) (err kv.Error, evalDone bool) {
+
+	// Locate, or install, the python interpreter the experiment asked for.  Running the experiment
+	// using a different interpreter is not an option so failures here complete the experiment
+	pythonVer, err := ResolvePythonVersion(ctx, p.Request.Experiment.PythonVer)
+	if err != nil {
+		return err.With("workDir", p.workDir), true
+	}
+	p.Request.Experiment.PythonVer = pythonVer
+
+	// Values from the request are placed into the generated scripts so check that they can be safely
+	// quoted before going any further
+	if err = validateScriptInput(p.Request); err != nil {
+		return err.With("workDir", p.workDir), true
+	}
+
+	// Locate the script templates to be used for the queue the experiment arrived on
+	venvTemplate := ""
+	if p.runTemplate, venvTemplate, err = GetScriptTemplates(p.queueName); err != nil {
+		return err.With("queue", p.queueName).With("workDir", p.workDir), false
+	}
+
+	// Get Python virtual environment ID:
+	if p.venvEntry, err = virtEnvCache.getEntry(ctx, p.Request, alloc, venvTemplate, p.workDir); err != nil {
+		return err.With("stack", stack.Trace().TrimRuntime()).With("workDir", p.workDir), false
+	}
+
+	venvID, venvValid := p.venvEntry.addClient(p.uniqueID)
+	p.venvID = venvID
+
+	defer func() {
+		if err != nil {
+			p.venvEntry.removeClient(p.uniqueID)
+		}
+	}()
+
+	if !venvValid {
+		err = kv.NewError("venv is invalid").With("venv", venvID, "stack", stack.Trace().TrimRuntime()).With("workDir", p.workDir)
+		return err, true
+	}
+
+	content, err := p.render(alloc, e)
+	if err != nil {
+		return err, false
+	}
+
+	if errGo := ioutil.WriteFile(p.Script, content, 0700); errGo != nil {
 		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("script", p.Script), false
 	}
 	return nil, false
 }
 
+// render generates the run script for the experiment using the run template and virtualenv
+// selected by Make
+//
+func (p *VirtualEnv) render(alloc *resources.Allocated, e interface{}) (content []byte, err kv.Error) {
+	// The tensorflow versions 1.5.x and above all support cuda 9 and 1.4.x is cuda 8,
+	// c.f. https://www.tensorflow.org/install/install_sources#tested_source_configurations.
+	// Insert the appropriate version explicitly into the LD_LIBRARY_PATH before other paths
+	cudaDir := "/usr/local/cuda-10.0/lib64"
+
+	params := RunScriptParams{
+		AllocEnv: []string{},
+		E:        e,
+		VEnvID:   p.venvID,
+		CudaDir:  cudaDir,
+		Hostname: hostname,
+		Env:      p.Request.Config.Env,
+	}
+
+	if alloc.CPU != nil {
+		if alloc.CPU.Cores > 1 {
+			params.AllocEnv = append(params.AllocEnv, "OPENMP=True")
+			params.AllocEnv = append(params.AllocEnv, "MKL_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+			params.AllocEnv = append(params.AllocEnv, "GOTO_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+			params.AllocEnv = append(params.AllocEnv, "OMP_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+		}
+	}
+
+	// Add GPU environment variables to the python process environment table
+	params.AllocEnv = append(params.AllocEnv, gpuEnv(alloc)...)
+
+	tmpl, errGo := template.New("pythonRunner").Funcs(template.FuncMap{"shellquote": ShellQuote}).Parse(p.runTemplate)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("queue", p.queueName).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	buffer := new(bytes.Buffer)
+	if errGo = tmpl.Execute(buffer, params); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return buffer.Bytes(), nil
+}
+
+// DryRunScript applies the checks Make performs to a request and returns the run script Make
+// would generate for it, without installing python versions, building the virtualenv or writing
+// any files.  When the virtualenv the request needs has already been built by this runner it is
+// used in the run script and venvScript is empty.  Otherwise venvScript is the script that would
+// build the virtualenv, and as the name of the virtualenv, and its temporary directory, are only
+// chosen once the build starts DryRunVenvID and a placeholder directory are used in their place.
+// Packages are not resolved by pip during a dry run, the packages resolved for the last identical
+// request seen by this runner are used when there was one.
+//
+func DryRunScript(ctx context.Context, rqst *request.Request, queueName string, alloc *resources.Allocated, e interface{}) (script []byte, venvScript []byte, err kv.Error) {
+	p := &VirtualEnv{
+		Request:   rqst,
+		queueName: queueName,
+		venvID:    DryRunVenvID,
+	}
+
+	pythonVer, install, err := LookupPythonVersion(ctx, rqst.Experiment.PythonVer)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Versions that are yet to be installed are used as requested
+	if install {
+		pythonVer = strings.TrimSpace(rqst.Experiment.PythonVer)
+	}
+	rqst.Experiment.PythonVer = pythonVer
+
+	if err = validateScriptInput(rqst); err != nil {
+		return nil, nil, err
+	}
+
+	venvTemplate := ""
+	if p.runTemplate, venvTemplate, err = GetScriptTemplates(queueName); err != nil {
+		return nil, nil, err.With("queue", queueName)
+	}
+
+	if venvID, resolved, isPresent := virtEnvCache.lookupEntry(rqst, alloc, venvTemplate); isPresent {
+		p.venvID = venvID
+	} else {
+		general, configured, _ := pythonModules(rqst, alloc)
+		if venvScript, _, err = virtEnvCache.renderVenvScript(venvTemplate, rqst.Config.Env, rqst.Experiment.PythonVer, general, configured,
+			resolved, p.venvID, virtEnvCache.rootDir, dryRunTmpDir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if script, err = p.render(alloc, e); err != nil {
+		return nil, nil, err
+	}
+	return script, venvScript, nil
+}
+
 // Run will use a generated script file and will run it to completion while marshalling
 // results and files from the computation.  Run is a blocking call and will only return
 // upon completion or termination of the process it starts.  Run is called by the processor
@@ -318,7 +439,7 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 	}
 	defer fOutput.Close()
 
-	err = RunScript(ctx, p.Script, fOutput, "", p.Request.Experiment.Key, p.logger)
+	err = RunScript(ctx, p.Script, fOutput, "", p.Request.Experiment.Key, p.OutputTap, p.logger)
 	p.venvEntry.removeClient(p.uniqueID)
 	return err
 }
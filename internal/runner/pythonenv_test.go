@@ -2,7 +2,10 @@
 package runner
 
 import (
+	"os/exec"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/go-test/deep"
@@ -98,3 +101,177 @@ func TestGPUEnv(t *testing.T) {
 		}
 	}
 }
+
+// TestPipSpecKeys exercises the normalization of pip specifiers used to key the virtualenv
+// cache, ensuring equivalent lock file style requests share a single virtualenv
+func TestPipSpecKeys(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{spec: "numpy==1.21.4", expected: "numpy==1.21.4"},
+		{spec: "  Typing_Extensions==4.0.1  ", expected: "typing-extensions==4.0.1"},
+		{spec: "six==1.16.0 --hash=sha256:bbb --hash=sha256:aaa", expected: "six==1.16.0 --hash=sha256:aaa --hash=sha256:bbb"},
+		{spec: "six==1.16.0 --hash sha256:bbb  --hash=sha256:aaa", expected: "six==1.16.0 --hash=sha256:aaa --hash=sha256:bbb"},
+		{spec: "git+https://github.com/leaf-ai/Studio.git", expected: "git+https://github.com/leaf-ai/Studio.git"},
+	}
+
+	for _, aTest := range tests {
+		if diff := deep.Equal(aTest.expected, normalizePipSpec(aTest.spec)); diff != nil {
+			t.Fatal(aTest.spec, diff)
+		}
+	}
+
+	loose, pinned := splitPinnedModules([]string{"numpy", "six==1.16.0 --hash=sha256:aaa"})
+	if diff := deep.Equal([]string{"numpy"}, loose); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal([]string{"six==1.16.0 --hash=sha256:aaa"}, pinned); diff != nil {
+		t.Fatal(diff)
+	}
+
+	cache := &VirtualEnvCache{}
+	first := cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"Six==1.16.0 --hash=sha256:b --hash=sha256:a", "numpy"}, []string{}, map[string]string{}, nil)
+	second := cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"numpy", "six==1.16.0 --hash=sha256:a --hash=sha256:b"}, []string{}, map[string]string{}, nil)
+	if first != second {
+		t.Fatal("equivalent requirements produced different virtualenv keys", first, second)
+	}
+	third := cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"numpy"}, []string{"six==1.16.0 --hash=sha256:a --hash=sha256:b"}, map[string]string{}, nil)
+	if first == third {
+		t.Fatal("requirements moved between lists produced the same virtualenv key")
+	}
+}
+
+// TestVenvPipArgs checks that environment variables within pip specifiers are expanded before
+// the virtualenv key is generated and the specifiers are quoted, and that specifiers holding
+// several pip arguments are passed to pip as separate words
+func TestVenvPipArgs(t *testing.T) {
+	cache := &VirtualEnvCache{}
+	env := map[string]string{"INDEX": "https://pypi.example.com/simple", "VER": "1.21.4"}
+	general := []string{"--index-url ${INDEX} numpy==${VER}", "-e ./pkg", `'requests; python_version < "3.8"'`}
+
+	content, _, err := cache.renderVenvScript(venvScriptTemplate, env, "3.8", general, []string{}, nil, "venv-runner-test", t.TempDir(), "/tmp/venv-runner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	install := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "retry python3 -m pip install '") {
+			install = strings.TrimPrefix(line, "retry python3 -m pip install")
+			break
+		}
+	}
+	expected := []string{"--index-url", "https://pypi.example.com/simple", "numpy==1.21.4", "-e", "./pkg", `requests; python_version < "3.8"`}
+	quoted := make([]string, 0, len(expected))
+	for _, arg := range expected {
+		quoted = append(quoted, ShellQuote(arg))
+	}
+	if install != " "+strings.Join(quoted, " ") {
+		t.Fatal("pip arguments were not expanded and quoted individually", install)
+	}
+
+	// Check that bash sees each of the arguments as a single word
+	if bash, errGo := exec.LookPath("bash"); errGo == nil {
+		// #nosec
+		output, errGo := exec.Command(bash, "-c", "printf '%s\\n'"+install).Output()
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if diff := deep.Equal(expected, strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+
+	// The key is generated from the same expanded specifiers that are installed
+	expanded := cache.getHashPythonEnv(venvScriptTemplate, "3.8", general, []string{}, env, nil)
+	literal := cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"--index-url https://pypi.example.com/simple numpy==1.21.4", "-e ./pkg", `'requests; python_version < "3.8"'`}, []string{}, nil, nil)
+	if expanded != literal {
+		t.Fatal("expanded pip specifiers produced a different virtualenv key", expanded, literal)
+	}
+	changed := cache.getHashPythonEnv(venvScriptTemplate, "3.8", general, []string{}, map[string]string{"INDEX": env["INDEX"], "VER": "1.22.0"}, nil)
+	if changed == expanded {
+		t.Fatal("a change to the environment of a pip specifier produced the same virtualenv key")
+	}
+}
+
+// TestPipResolution checks that the packages pip resolves a request to are used to key the
+// virtualenv cache and constrain the packages installed when the virtualenv is built
+func TestPipResolution(t *testing.T) {
+	report := []byte(`{"version": "1", "install": [
+		{"metadata": {"name": "Typing_Extensions", "version": "4.0.1"}, "download_info": {"url": "https://files/typing_extensions-4.0.1.whl", "archive_info": {}}},
+		{"metadata": {"name": "numpy", "version": "1.21.4"}, "download_info": {"url": "https://files/numpy-1.21.4.whl", "archive_info": {}}},
+		{"metadata": {"name": "studio", "version": "0.1"}, "download_info": {"url": "https://github.com/leaf-ai/Studio.git", "vcs_info": {"vcs": "git", "commit_id": "abc123"}}}
+	]}`)
+	pkgs, err := parsePipReport(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, pkg := range pkgs {
+		names = append(names, pkg.String())
+	}
+	if diff := deep.Equal([]string{"numpy==1.21.4", "studio==0.1 @ https://github.com/leaf-ai/Studio.git@abc123", "typing-extensions==4.0.1"}, names); diff != nil {
+		t.Fatal(diff)
+	}
+	if _, err = parsePipReport([]byte(`{"install": [{"metadata": {"name": "numpy"}}]}`)); err == nil {
+		t.Fatal("incomplete report was accepted")
+	}
+
+	// Identical requests resolved to different dependencies must not share a virtualenv
+	cache := &VirtualEnvCache{}
+	first := cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"numpy"}, []string{}, nil, pkgs)
+	newer := append([]resolvedPackage{{name: "numpy", version: "1.22.0"}}, pkgs[1:]...)
+	if first == cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"numpy"}, []string{}, nil, newer) {
+		t.Fatal("different resolved packages produced the same virtualenv key")
+	}
+	if first != cache.getHashPythonEnv(venvScriptTemplate, "3.8", []string{"numpy"}, []string{}, nil, pkgs) {
+		t.Fatal("identical resolved packages produced different virtualenv keys")
+	}
+
+	// Only packages from an index are used as constraints
+	dir := t.TempDir()
+	content, files, err := cache.renderVenvScript(venvScriptTemplate, nil, "3.8", []string{"numpy"}, []string{}, pkgs, "venv-runner-test", dir, "/tmp/venv-runner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	constraints := filepath.Join(dir, "constraints-venv-runner-test.txt")
+	if diff := deep.Equal("numpy==1.21.4\ntyping-extensions==4.0.1\n", string(files[constraints])); diff != nil {
+		t.Fatal(diff)
+	}
+	if !strings.Contains(string(content), "pip install -c "+ShellQuote(constraints)+" 'numpy'") {
+		t.Fatal("constraints were not used to install the packages", string(content))
+	}
+}
+
+// TestPythonVersionMatch exercises the selection of installed python interpreters using the
+// versions requested by experiments
+func TestPythonVersionMatch(t *testing.T) {
+	// pyenv lists versions in lexical order
+	versions := parsePythonVersions([]byte("system\n3.10.0rc1\n3.10.2\n3.7.12\n3.8.1\n3.8.12\n3.8.12/envs/venv-runner-abc\nvenv-runner-abc\n3.9.10\n3.9.2\n"))
+	if diff := deep.Equal([]string{"3.10.0rc1", "3.10.2", "3.7.12", "3.8.1", "3.8.12", "3.9.10", "3.9.2"}, versions); diff != nil {
+		t.Fatal(diff)
+	}
+
+	tests := []struct {
+		requested string
+		expected  string
+		isPresent bool
+	}{
+		{requested: "3.8.1", expected: "3.8.1", isPresent: true},
+		{requested: "3.8", expected: "3.8.12", isPresent: true},
+		{requested: "3.9", expected: "3.9.10", isPresent: true},
+		{requested: "3.10", expected: "3.10.2", isPresent: true},
+		{requested: "3", expected: "3.10.2", isPresent: true},
+		{requested: "", expected: "3.10.2", isPresent: true},
+		{requested: "3.8.2", expected: "", isPresent: false},
+		{requested: "3.11", expected: "", isPresent: false},
+	}
+
+	for _, aTest := range tests {
+		version, isPresent := matchPythonVersion(aTest.requested, versions)
+		if version != aTest.expected || isPresent != aTest.isPresent {
+			t.Fatal("unexpected python version", aTest.requested, version, isPresent)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,8 +38,96 @@ const (
 	entryStale
 )
 
+const (
+	// DefaultVEnvCacheExpiration is the period after which unused virtualenvs are removed
+	DefaultVEnvCacheExpiration = time.Duration(2 * time.Hour)
+)
+
 var (
 	virtEnvCache VirtualEnvCache
+
+	// venvScriptTemplate is the built-in template used to generate the script that builds a
+	// virtualenv, the template is executed using VenvScriptParams
+	venvScriptTemplate = `#!/bin/bash -x
+sleep 2
+# Credit https://github.com/fernandoacorreia/azure-docker-registry/blob/master/tools/scripts/create-registry-server
+function fail {
+  echo $1 >&2
+  exit 1
+}
+
+trap 'fail "The execution was aborted because a command exited with an error status code."' ERR
+
+function retry {
+  local n=0
+  local max=3
+  local delay=10
+  while true; do
+    "$@" && break || {
+      if [[ $n -lt $max ]]; then
+        ((n++))
+        echo "Command failed. Attempt $n/$max:"
+        sleep $delay;
+      else
+        fail "The command has failed after $n attempts."
+      fi
+    }
+  done
+}
+
+set -v
+date
+date -u
+export LC_ALL=en_US.utf8
+locale
+hostname
+set -e
+export PATH=/runner/.pyenv/bin:$PATH
+{{if .Env}}
+{{range $key, $value := .Env}}
+export {{$key}}={{shellquote $value}}
+{{end}}
+{{end}}
+echo "Done env"
+export PYENV_VERSION={{shellquote .PythonVer}}
+export TMPDIR={{shellquote .TmpDir}}
+eval "$(pyenv init --path)"
+eval "$(pyenv init -)"
+eval "$(pyenv virtualenv-init -)"
+pyenv doctor
+pyenv virtualenv-delete -f {{shellquote .EnvName}} || true
+pyenv virtualenv $PYENV_VERSION {{shellquote .EnvName}}
+pyenv activate {{shellquote .EnvName}}  
+set +e
+retry python3 -m pip install "pip==21.3.1" "setuptools==59.2.0" "wheel==0.37.0"
+python3 -m pip freeze --all
+{{if .Pips}}
+echo installing project pips{{range .Pips}} {{shellquote .}}{{end}}
+retry python3 -m pip install{{if .Constraints}} -c {{shellquote .Constraints}}{{end}}{{range .Pips}} {{shellquote .}}{{end}}
+{{end}}
+echo "finished installing project pips"
+retry python3 -m pip install pipdeptree==2.0.0
+{{if .CfgPips}}
+echo "installing cfg pips"
+retry python3 -m pip install{{if .Constraints}} -c {{shellquote .Constraints}}{{end}}{{range .CfgPips}} {{shellquote .}}{{end}}
+echo "finished installing cfg pips"
+{{end}}
+{{if .PinnedReqs}}
+echo "installing hash pinned pips"
+retry python3 -m pip install --require-hashes -r {{shellquote .PinnedReqs}}
+echo "finished installing hash pinned pips"
+{{end}}
+set -e
+python3 -m pip freeze
+python3 -m pip -V
+set -x
+cd - || true
+locale
+pyenv deactivate || true
+date
+date -u
+exit 0
+`
 )
 
 type VirtualEnvEntry struct {
@@ -54,6 +143,7 @@ type VirtualEnvEntry struct {
 
 type VirtualEnvCache struct {
 	entries         map[string]*VirtualEnvEntry
+	resolutions     map[string][]resolvedPackage // The packages last resolved for the specifiers of a request, used by dry runs
 	logger          *log.Logger
 	rootDir         string
 	maxUnusedPeriod time.Duration
@@ -70,21 +160,26 @@ func init() {
 	logger.Info("Root directory for VEnv cache", "path:", rootDir)
 	virtEnvCache = VirtualEnvCache{
 		entries:         map[string]*VirtualEnvEntry{},
+		resolutions:     map[string][]resolvedPackage{},
 		logger:          logger,
 		rootDir:         rootDir,
-		maxUnusedPeriod: time.Duration(2) * time.Hour,
+		maxUnusedPeriod: DefaultVEnvCacheExpiration,
 	}
 }
 
 func SetVEnvCacheExpirationPeriod(period time.Duration) {
+	virtEnvCache.Lock()
 	prev := virtEnvCache.maxUnusedPeriod
 	virtEnvCache.maxUnusedPeriod = period
+	virtEnvCache.Unlock()
+
 	if virtEnvCache.logger != nil {
 		virtEnvCache.logger.Info("VEnv Cache entry expiration period set to: ", period, "previous: ", prev)
 	}
 }
 
-func (entry *VirtualEnvEntry) create(ctx context.Context, rqst *request.Request, general []string, configured []string, expDir string) (err kv.Error) {
+func (entry *VirtualEnvEntry) create(ctx context.Context, rqst *request.Request, general []string, configured []string, resolved []resolvedPackage,
+	tmplText string, expDir string) (err kv.Error) {
 	// This venv entry is already locked:
 	defer entry.Unlock()
 
@@ -102,7 +197,7 @@ func (entry *VirtualEnvEntry) create(ctx context.Context, rqst *request.Request,
 	}
 
 	scriptPath := filepath.Join(entry.host.rootDir, fmt.Sprintf("genvenv-%s.sh", entry.uniqueID))
-	if err = entry.host.generateScript(rqst.Config.Env, rqst.Experiment.PythonVer, general, configured, entry.uniqueID, scriptPath, tmpDir); err != nil {
+	if err = entry.host.generateScript(tmplText, rqst.Config.Env, rqst.Experiment.PythonVer, general, configured, resolved, entry.uniqueID, scriptPath, tmpDir); err != nil {
 		return err
 	}
 
@@ -126,7 +221,7 @@ func (entry *VirtualEnvEntry) create(ctx context.Context, rqst *request.Request,
 	}
 	defer fOutput.Close()
 
-	if err = RunScript(ctx, scriptPath, fOutput, tmpDir, entry.uniqueID, entry.host.logger); err != nil {
+	if err = RunScript(ctx, scriptPath, fOutput, tmpDir, entry.uniqueID, nil, entry.host.logger); err != nil {
 		return err.With("script", scriptPath).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -164,7 +259,7 @@ func (entry *VirtualEnvEntry) delete(ctx context.Context) (err kv.Error) {
 	}
 	defer fOutput.Close()
 
-	if err = RunScript(ctx, scriptPath, fOutput, "", entry.uniqueID, entry.host.logger); err != nil {
+	if err = RunScript(ctx, scriptPath, fOutput, "", entry.uniqueID, nil, entry.host.logger); err != nil {
 		return err.With("script", scriptPath).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -215,16 +310,27 @@ func (entry *VirtualEnvEntry) removeClient(clientID string) {
 
 func (cache *VirtualEnvCache) getEntry(ctx context.Context,
 	rqst *request.Request,
-	alloc *resources.Allocated, expDir string) (entry *VirtualEnvEntry, err kv.Error) {
+	alloc *resources.Allocated, tmplText string, expDir string) (entry *VirtualEnvEntry, err kv.Error) {
 	// Get request dependencies
 	general, configured, _ := pythonModules(rqst, alloc)
 
+	// Virtualenvs are keyed on the packages pip resolves the request to, along with the request
+	// itself, so that packages, or dependencies, published since a virtualenv was built for an
+	// earlier request cause a new virtualenv to be built
+	resolved, err := cache.resolvePythonEnv(ctx, rqst.Experiment.PythonVer, general, configured, rqst.Config.Env)
+	if err != nil {
+		return nil, err
+	}
+
 	// Unique ID (hash) for virtual environment we need:
-	hashEnv := cache.getHashPythonEnv(rqst.Experiment.PythonVer, general, configured, rqst.Config.Env)
+	requested := cache.getHashPythonEnv(tmplText, rqst.Experiment.PythonVer, general, configured, rqst.Config.Env, nil)
+	hashEnv := cache.getHashPythonEnv(tmplText, rqst.Experiment.PythonVer, general, configured, rqst.Config.Env, resolved)
 
 	cache.Lock()
 	defer cache.Unlock()
 
+	cache.resolutions[requested] = resolved
+
 	if entry, isPresent := cache.entries[hashEnv]; isPresent {
 		cache.logger.Info("Found virtual env: reused", "envID: ", entry.uniqueID)
 		entry.touch()
@@ -242,7 +348,7 @@ func (cache *VirtualEnvCache) getEntry(ctx context.Context,
 	newEntry.Lock()
 	cache.entries[hashEnv] = newEntry
 
-	go newEntry.create(ctx, rqst, general, configured, expDir)
+	go newEntry.create(ctx, rqst, general, configured, resolved, tmplText, expDir)
 
 	return newEntry, nil
 }
@@ -278,6 +384,9 @@ func (cache *VirtualEnvCache) cleanupUnused(ctx context.Context) {
 		last := entry.lastUsed
 		if entry.numClients == 0 && last.Add(cache.maxUnusedPeriod).Before(time.Now()) {
 			delete(cache.entries, key)
+			// Resolutions are only retained for dry runs so they are discarded along with the
+			// virtualenvs, a later request will resolve its packages again
+			cache.resolutions = map[string][]resolvedPackage{}
 			cache.logger.Debug("Deleting stale cache entry:", "id: ", entry.uniqueID)
 			if err := entry.delete(ctx); err != nil {
 				cache.logger.Info("failed to delete stale VEnv", "err:", err.Error(), "venv:", entry.uniqueID)
@@ -287,124 +396,130 @@ func (cache *VirtualEnvCache) cleanupUnused(ctx context.Context) {
 	}
 }
 
-func (cache *VirtualEnvCache) generateScript(workEnv map[string]string, pythonVer string, general []string, configured []string,
-	envName string, scriptPath string, tmpDir string) (err kv.Error) {
+func (cache *VirtualEnvCache) generateScript(tmplText string, workEnv map[string]string, pythonVer string, general []string, configured []string,
+	resolved []resolvedPackage, envName string, scriptPath string, tmpDir string) (err kv.Error) {
 
-	params := struct {
-		PythonVer string
-		EnvName   string
-		Pips      []string
-		CfgPips   []string
-		TmpDir    string
-		Env       map[string]string
-	}{
-		PythonVer: pythonVer,
-		EnvName:   envName,
-		Pips:      general,
-		CfgPips:   configured,
-		TmpDir:    tmpDir,
-		Env:       workEnv,
+	content, files, err := cache.renderVenvScript(tmplText, workEnv, pythonVer, general, configured, resolved, envName, filepath.Dir(scriptPath), tmpDir)
+	if err != nil {
+		return err
 	}
 
-	// Create a shell script that will do everything needed
-	// to create required virtual python environment
-	tmpl, errGo := template.New("virtEnvCreator").Parse(
-		`#!/bin/bash -x
-sleep 2
-# Credit https://github.com/fernandoacorreia/azure-docker-registry/blob/master/tools/scripts/create-registry-server
-function fail {
-  echo $1 >&2
-  exit 1
+	for fn, data := range files {
+		if errGo := ioutil.WriteFile(fn, data, 0600); errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+	}
+
+	if errGo := ioutil.WriteFile(scriptPath, content, 0700); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("script", scriptPath)
+	}
+	return nil
 }
 
-trap 'fail "The execution was aborted because a command exited with an error status code."' ERR
+// renderVenvScript generates the script that builds a virtualenv along with the names, and
+// contents, of the files the script uses.  These are a requirements file holding any hash pinned
+// specifiers, and a constraints file holding the versions of the packages the loose specifiers were
+// resolved to, both are placed into scriptDir.  Environment variables within the pip specifiers are expanded
+// here, using the same values as getHashPythonEnv, and each specifier is split into the words
+// that are passed to pip so that the script template can quote them individually.
+//
+func (cache *VirtualEnvCache) renderVenvScript(tmplText string, workEnv map[string]string, pythonVer string, general []string, configured []string,
+	resolved []resolvedPackage, envName string, scriptDir string, tmpDir string) (content []byte, files map[string][]byte, err kv.Error) {
+
+	general = cache.expandPipSpecs(general, workEnv)
+	configured = cache.expandPipSpecs(configured, workEnv)
+
+	// Hash pinned specifiers cannot be passed on the pip command line so they are
+	// gathered into a requirements file and installed using --require-hashes
+	general, pinned := splitPinnedModules(general)
+	configured, cfgPinned := splitPinnedModules(configured)
+	pinned = append(pinned, cfgPinned...)
+
+	files = map[string][]byte{}
+	pinnedReqs := ""
+	if len(pinned) != 0 {
+		pinnedReqs = filepath.Join(scriptDir, fmt.Sprintf("requirements-%s.txt", envName))
+		files[pinnedReqs] = []byte(strings.Join(pinned, "\n") + "\n")
+	}
+
+	// Packages installed from an index are held to the versions the virtualenv was keyed on,
+	// pip does not accept constraints for packages installed from URLs
+	constraints := []string{}
+	for _, pkg := range resolved {
+		if len(pkg.source) == 0 {
+			constraints = append(constraints, pkg.String())
+		}
+	}
+	constraintsFN := ""
+	if len(constraints) != 0 {
+		constraintsFN = filepath.Join(scriptDir, fmt.Sprintf("constraints-%s.txt", envName))
+		files[constraintsFN] = []byte(strings.Join(constraints, "\n") + "\n")
+	}
 
-function retry {
-  local n=0
-  local max=3
-  local delay=10
-  while true; do
-    "$@" && break || {
-      if [[ $n -lt $max ]]; then
-        ((n++))
-        echo "Command failed. Attempt $n/$max:"
-        sleep $delay;
-      else
-        fail "The command has failed after $n attempts."
-      fi
-    }
-  done
-}
+	pips, err := pipArgs(general)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfgPips, err := pipArgs(configured)
+	if err != nil {
+		return nil, nil, err
+	}
 
-set -v
-date
-date -u
-export LC_ALL=en_US.utf8
-locale
-hostname
-set -e
-export PATH=/runner/.pyenv/bin:$PATH
-{{if .Env}}
-{{range $key, $value := .Env}}
-export {{$key}}="{{$value}}"
-{{end}}
-{{end}}
-echo "Done env"
-export PYENV_VERSION={{.PythonVer}}
-export TMPDIR={{.TmpDir}}
-IFS=$'\n'; arr=( $(pyenv versions --bare | grep -v venv-runner || true) )
-for i in ${arr[@]} ; do
-    if [[ "$i" == ${PYENV_VERSION}* ]]; then
-		export PYENV_VERSION=$i
-		echo $PYENV_VERSION
-	fi
-done
-eval "$(pyenv init --path)"
-eval "$(pyenv init -)"
-eval "$(pyenv virtualenv-init -)"
-pyenv doctor
-pyenv virtualenv-delete -f {{.EnvName}} || true
-pyenv virtualenv $PYENV_VERSION {{.EnvName}}
-pyenv activate {{.EnvName}}  
-set +e
-retry python3 -m pip install "pip==21.3.1" "setuptools==59.2.0" "wheel==0.37.0"
-python3 -m pip freeze --all
-{{if .Pips}}
-echo "installing project pip {{ .Pips }}"
-retry python3 -m pip install {{range .Pips }} {{.}}{{end}}
-{{end}}
-echo "finished installing project pips"
-retry python3 -m pip install pipdeptree==2.0.0
-{{if .CfgPips}}
-echo "installing cfg pips"
-retry python3 -m pip install {{range .CfgPips}} {{.}}{{end}}
-echo "finished installing cfg pips"
-{{end}}
-set -e
-python3 -m pip freeze
-python3 -m pip -V
-set -x
-cd - || true
-locale
-pyenv deactivate || true
-date
-date -u
-exit 0
-`)
+	params := VenvScriptParams{
+		PythonVer:   pythonVer,
+		EnvName:     envName,
+		Pips:        pips,
+		CfgPips:     cfgPips,
+		PinnedReqs:  pinnedReqs,
+		Constraints: constraintsFN,
+		TmpDir:      tmpDir,
+		Env:         workEnv,
+	}
 
+	// Create a shell script that will do everything needed
+	// to create required virtual python environment
+	tmpl, errGo := template.New("virtEnvCreator").Funcs(template.FuncMap{"shellquote": ShellQuote}).Parse(tmplText)
 	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	content := new(bytes.Buffer)
-	if errGo = tmpl.Execute(content, params); errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	buffer := new(bytes.Buffer)
+	if errGo = tmpl.Execute(buffer, params); errGo != nil {
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
+	return buffer.Bytes(), files, nil
+}
 
-	if errGo = ioutil.WriteFile(scriptPath, content.Bytes(), 0700); errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("script", scriptPath)
+// lookupEntry returns the ID of the virtualenv that getEntry would use for a request if one
+// has already been built, without building one.  Packages are not resolved, the packages last
+// resolved for the same request are returned and when there are none no virtualenv is returned.
+//
+func (cache *VirtualEnvCache) lookupEntry(rqst *request.Request, alloc *resources.Allocated, tmplText string) (uniqueID string, resolved []resolvedPackage, isPresent bool) {
+	general, configured, _ := pythonModules(rqst, alloc)
+	requested := cache.getHashPythonEnv(tmplText, rqst.Experiment.PythonVer, general, configured, rqst.Config.Env, nil)
+
+	cache.Lock()
+	resolved, isPresent = cache.resolutions[requested]
+	if !isPresent {
+		cache.Unlock()
+		return "", nil, false
 	}
-	return nil
+	hashEnv := cache.getHashPythonEnv(tmplText, rqst.Experiment.PythonVer, general, configured, rqst.Config.Env, resolved)
+	entry, isPresent := cache.entries[hashEnv]
+	cache.Unlock()
+	if !isPresent {
+		return "", resolved, false
+	}
+
+	// Entries remain locked while they are being built, and are not yet usable
+	if !entry.TryLock() {
+		return "", resolved, false
+	}
+	defer entry.Unlock()
+	if entry.status != entryReady {
+		return "", resolved, false
+	}
+	return entry.uniqueID, resolved, true
 }
 
 func (cache *VirtualEnvCache) generateRemoveScript(envName string, scriptPath string) (err kv.Error) {
@@ -417,7 +532,7 @@ func (cache *VirtualEnvCache) generateRemoveScript(envName string, scriptPath st
 
 	// Create a shell script that will do everything needed
 	// to delete specified virtual python environment
-	tmpl, errGo := template.New("virtEnvDeleter").Parse(
+	tmpl, errGo := template.New("virtEnvDeleter").Funcs(template.FuncMap{"shellquote": ShellQuote}).Parse(
 		`#!/bin/bash -x
 sleep 2
 set -e
@@ -425,7 +540,7 @@ export PATH=/runner/.pyenv/bin:$PATH
 eval "$(pyenv init --path)"
 eval "$(pyenv init -)"
 eval "$(pyenv virtualenv-init -)"
-pyenv virtualenv-delete -f {{.EnvName}} || true
+pyenv virtualenv-delete -f {{shellquote .EnvName}} || true
 date -u
 exit 0
 `)
@@ -479,7 +594,9 @@ func scanPythonModules(pipList []string, hasGPU bool, gpuSeen bool, name string)
 			sawGPU = true
 		}
 
-		if hasGPU && !sawGPU {
+		// Hash pinned packages are installed exactly as specified, substituting
+		// the GPU variant would invalidate the hashes supplied with them
+		if hasGPU && !sawGPU && !isPinnedSpec(pkg) {
 			if strings.HasPrefix(pkg, "tensorflow==") || pkg == "tensorflow" {
 				spec := strings.Split(pkg, "==")
 
@@ -505,30 +622,153 @@ type EnvSubstituter struct {
 func (s *EnvSubstituter) replace(in string) string {
 	result, hasIt := s.table[in]
 	if !hasIt {
+		if s.logger == nil {
+			return in
+		}
 		s.logger.Warn("Env. Var NOT substituted.", "var", in, "stack", stack.Trace().TrimRuntime())
 		return in
 	}
 	return result
 }
 
-func (cache *VirtualEnvCache) getHashPythonEnv(pythonVer string,
-	general []string, configured []string,
-	subst map[string]string) string {
-
+// expandPipSpecs replaces the environment variable references within pip specifiers using
+// the environment supplied with the experiment
+//
+func (cache *VirtualEnvCache) expandPipSpecs(pips []string, env map[string]string) (expanded []string) {
 	s := &EnvSubstituter{
-		table:  subst,
+		table:  env,
 		logger: cache.logger,
 	}
 
+	expanded = make([]string, 0, len(pips))
+	for _, pip := range pips {
+		expanded = append(expanded, os.Expand(pip, s.replace))
+	}
+	return expanded
+}
+
+// pipArgs splits pip specifiers into the individual arguments passed to pip, allowing
+// specifiers such as "-e ./pkg" or "--index-url URL pkg" to be used
+//
+func pipArgs(pips []string) (args []string, err kv.Error) {
+	args = []string{}
+	for _, pip := range pips {
+		words, err := SplitWords(pip)
+		if err != nil {
+			return nil, err.With("pip", pip)
+		}
+		args = append(args, words...)
+	}
+	return args, nil
+}
+
+// isPinnedSpec is used to detect lock file style pip specifiers that carry --hash entries
+// and which must be installed using pip --require-hashes
+//
+func isPinnedSpec(spec string) bool {
+	return strings.Contains(spec, "--hash")
+}
+
+// splitPinnedModules separates hash pinned pip specifiers from loose specifiers
+// retaining the original order of each
+//
+func splitPinnedModules(pips []string) (loose []string, pinned []string) {
+	loose = []string{}
+	pinned = []string{}
+	for _, pkg := range pips {
+		if isPinnedSpec(pkg) {
+			pinned = append(pinned, pkg)
+			continue
+		}
+		loose = append(loose, pkg)
+	}
+	return loose, pinned
+}
+
+// normalizePipSpec produces a canonical form of a pip specifier so that trivially different
+// spellings of the same requirement, for example differences in whitespace, project name case,
+// or the order of --hash options, result in the same virtualenv
+//
+func normalizePipSpec(spec string) string {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	name := fields[0]
+	// URL and path style specifiers are left alone, otherwise project names are
+	// normalized using the rules from PEP 503
+	if !strings.Contains(name, "/") {
+		split := strings.IndexAny(name, "=<>!~;[@")
+		if split < 0 {
+			split = len(name)
+		}
+		project := strings.ToLower(name[:split])
+		project = strings.NewReplacer("_", "-", ".", "-").Replace(project)
+		name = project + name[split:]
+	}
+
+	opts := []string{}
+	hashes := []string{}
+	for i := 1; i < len(fields); i++ {
+		field := fields[i]
+		if field == "--hash" && i+1 < len(fields) {
+			i++
+			field = "--hash=" + fields[i]
+		}
+		if strings.HasPrefix(field, "--hash=") {
+			hashes = append(hashes, field)
+			continue
+		}
+		opts = append(opts, field)
+	}
+	sort.Strings(hashes)
+
+	return strings.Join(append(append([]string{name}, opts...), hashes...), " ")
+}
+
+// getHashPythonEnv generates the key used to identify a virtualenv within the cache.  The
+// specifiers are expanded using the experiment environment and normalized before being used
+// so that trivially different spellings of a request share a virtualenv.  The packages pip
+// resolved the loose specifiers to, including their dependencies, are also part of the key so that
+// a request will only reuse a virtualenv built from exactly the same packages.  The build template
+// is included as virtualenvs built using different templates cannot be shared.
+//
+func (cache *VirtualEnvCache) getHashPythonEnv(tmplText string, pythonVer string,
+	general []string, configured []string,
+	subst map[string]string, resolved []resolvedPackage) string {
+
+	resolve := func(pips []string) (resolved []string) {
+		resolved = make([]string, 0, len(pips))
+		for _, elem := range cache.expandPipSpecs(pips, subst) {
+			resolved = append(resolved, normalizePipSpec(elem))
+		}
+		sort.Strings(resolved)
+		return resolved
+	}
+
 	hasher := fnv.New64()
 	hasher.Reset()
 
+	hasher.Write([]byte(tmplText))
+	hasher.Write([]byte{0})
 	hasher.Write([]byte(pythonVer))
-	for _, elem := range general {
-		hasher.Write([]byte(os.Expand(elem, s.replace)))
-	}
-	for _, elem := range configured {
-		hasher.Write([]byte(os.Expand(elem, s.replace)))
+	hasher.Write([]byte{0})
+	for _, elem := range resolve(general) {
+		hasher.Write([]byte(elem))
+		hasher.Write([]byte{0})
+	}
+	// Separate the configured pips so that moving a package from one list to the
+	// other is seen as a change
+	hasher.Write([]byte{1})
+	for _, elem := range resolve(configured) {
+		hasher.Write([]byte(elem))
+		hasher.Write([]byte{0})
+	}
+	hasher.Write([]byte{2})
+	for _, pkg := range resolved {
+		hasher.Write([]byte(pkg.String()))
+		hasher.Write([]byte{0})
 	}
 	return strconv.FormatUint(hasher.Sum64(), 10)
 }
@@ -20,7 +20,8 @@ import (
 )
 
 // This file contains the implementation of configuration updater
-// for task queues match/mismatch regular expressions.
+// for task queues match/mismatch regular expressions.  The expressions can
+// also be changed using the runtime configuration file, see runtimeconfig.go.
 
 var (
 	queueMatch             = flag.String("queue-match", "^(rmq|sqs|local)_.*$", "User supplied regular expression that needs to match a queues name to be considered for work")
@@ -47,42 +48,55 @@ var (
 	}
 )
 
-func (qm *queueMatcherType) updatePatterns(match string, mismatch string) (errs []kv.Error) {
+// updatePatterns replaces the match and mismatch expressions, an expression that is nil
+// is left unchanged.  Updates arrive from both the configuration map listener and the
+// runtime configuration file.
+//
+func (qm *queueMatcherType) updatePatterns(match *string, mismatch *string) (errs []kv.Error) {
 	errs = []kv.Error{}
-	qm.match = match
-	qm.mismatch = mismatch
-	matcherReg, errGo := regexp.Compile(match)
-	if errGo != nil {
-		if len(match) != 0 {
-			err := kv.Wrap(errGo).With("matcher", match).With("stack", stack.Trace().TrimRuntime())
-			qm.logger.Warn(err.Error())
-			errs = append(errs, err)
-		}
-		matcherReg = nil
-	}
 
-	// If the length of the mismatcherReg is 0 then we will get a nil and because this
-	// was checked in the main we can ignore that as this is optional
-	mismatcherReg := &regexp.Regexp{}
-	_ = mismatcherReg // Bypass the ineffectual assignment check
+	qm.Lock()
+	defer qm.Unlock()
 
-	if len(strings.Trim(mismatch, " \n\r\t")) == 0 {
-		mismatcherReg = nil
-	} else {
-		mismatcherReg, errGo = regexp.Compile(mismatch)
+	if match != nil {
+		qm.match = *match
+		matcherReg, errGo := regexp.Compile(*match)
 		if errGo != nil {
-			err := kv.Wrap(errGo).With("mismatcher", mismatch).With("stack", stack.Trace().TrimRuntime())
-			qm.logger.Warn(err.Error())
-			errs = append(errs, err)
+			if len(*match) != 0 {
+				err := kv.Wrap(errGo).With("matcher", *match).With("stack", stack.Trace().TrimRuntime())
+				qm.logger.Warn(err.Error())
+				errs = append(errs, err)
+			}
+			matcherReg = nil
+		}
+		qm.matchRegExp = matcherReg
+	}
+
+	if mismatch != nil {
+		qm.mismatch = *mismatch
+
+		// If the length of the mismatcherReg is 0 then we will get a nil and because this
+		// was checked in the main we can ignore that as this is optional
+		var mismatcherReg *regexp.Regexp
+		if len(strings.Trim(*mismatch, " \n\r\t")) != 0 {
+			var errGo error
+			if mismatcherReg, errGo = regexp.Compile(*mismatch); errGo != nil {
+				err := kv.Wrap(errGo).With("mismatcher", *mismatch).With("stack", stack.Trace().TrimRuntime())
+				qm.logger.Warn(err.Error())
+				errs = append(errs, err)
+			}
 		}
+		qm.mismatchRegExp = mismatcherReg
 	}
+	return errs
+}
 
+// getExprs returns the text of the match and mismatch expressions in use
+//
+func (qm *queueMatcherType) getExprs() (match string, mismatch string) {
 	qm.Lock()
 	defer qm.Unlock()
-
-	qm.matchRegExp = matcherReg
-	qm.mismatchRegExp = mismatcherReg
-	return errs
+	return qm.match, qm.mismatch
 }
 
 func (qm *queueMatcherType) getPatterns() (matcher *regexp.Regexp, mismatcher *regexp.Regexp) {
@@ -97,7 +111,7 @@ func (qm *queueMatcherType) getPatterns() (matcher *regexp.Regexp, mismatcher *r
 
 func (qm *queueMatcherType) init(ctx context.Context, namespace string, mapname string, logger *log.Logger) (err []kv.Error) {
 	qm.logger = logger
-	err = qm.updatePatterns(*queueMatch, *queueMismatch)
+	err = qm.updatePatterns(queueMatch, queueMismatch)
 
 	listeners := server.K8sConfigUpdates()
 	listeners.Add(qm.updater)
@@ -117,17 +131,17 @@ func (qm *queueMatcherType) listen(ctx context.Context, namespace string, mapnam
 		select {
 		case cmap := <-qm.updater:
 			if cmap.NameSpace == namespace && cmap.Name == mapname {
-				matchUpdate := ""
-				mismatchUpdate := ""
+				var matchUpdate, mismatchUpdate *string
 				updated := false
-				if match, isPresent := cmap.State[queueMatchConfigKey]; isPresent && match != qm.match {
+				current, currentMismatch := qm.getExprs()
+				if match, isPresent := cmap.State[queueMatchConfigKey]; isPresent && match != current {
 					qm.logger.Debug("queues matcher listener got update", "match:", match, "namespace:", namespace, "map:", mapname)
-					matchUpdate = match
+					matchUpdate = &match
 					updated = true
 				}
-				if mismatch, isPresent := cmap.State[queueMismatchConfigKey]; isPresent && mismatch != qm.mismatch {
+				if mismatch, isPresent := cmap.State[queueMismatchConfigKey]; isPresent && mismatch != currentMismatch {
 					qm.logger.Debug("queues matcher listener got update", "mismatch:", mismatch, "namespace:", namespace, "map:", mapname)
-					mismatchUpdate = mismatch
+					mismatchUpdate = &mismatch
 					updated = true
 				}
 				if updated {
@@ -0,0 +1,557 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of the runtime configuration file.  The file holds
+// settings that operators can change while the runner is running, it is written using YAML,
+// or JSON when the file name has a .json extension.  The file is watched for changes and each
+// new version is validated in its entirety before any of it is applied, a version that fails
+// validation is reported and the settings already in use are retained.
+//
+// Settings that are not present within the file take the values given on the command line,
+// except for the queue patterns which are left unchanged.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// runtimeConfigSettle is the time allowed for a burst of file system events, such as those
+	// generated by editors and kubernetes configmap updates, to finish before the file is read
+	runtimeConfigSettle = time.Duration(250 * time.Millisecond)
+)
+
+// RuntimeConfig contains the settings that can be changed while the runner is running
+//
+type RuntimeConfig struct {
+	QueueMatch          *string          `yaml:"queue_match,omitempty" json:"queue_match,omitempty"`
+	QueueMismatch       *string          `yaml:"queue_mismatch,omitempty" json:"queue_mismatch,omitempty"`
+	Resources           RuntimeResources `yaml:"resources,omitempty" json:"resources,omitempty"`
+	Limiter             RuntimeLimiter   `yaml:"limiter,omitempty" json:"limiter,omitempty"`
+	VEnvCacheExpiration string           `yaml:"venv_cache_expiration,omitempty" json:"venv_cache_expiration,omitempty"`
+	LogFilters          []LogFilterRule  `yaml:"log_filters,omitempty" json:"log_filters,omitempty"`
+	Queues              []QueueOptions   `yaml:"queues,omitempty" json:"queues,omitempty"`
+	Transfers           RuntimeTransfers `yaml:"transfers,omitempty" json:"transfers,omitempty"`
+	Mirrors             []StorageMirrors `yaml:"mirrors,omitempty" json:"mirrors,omitempty"`
+}
+
+// RuntimeResources contains the limits on the resources the runner will allocate to experiments,
+// they replace the max-cores, max-mem, and max-disk options
+//
+type RuntimeResources struct {
+	MaxCores *uint  `yaml:"max_cores,omitempty" json:"max_cores,omitempty"`
+	MaxMem   string `yaml:"max_mem,omitempty" json:"max_mem,omitempty"`
+	MaxDisk  string `yaml:"max_disk,omitempty" json:"max_disk,omitempty"`
+}
+
+// RuntimeLimiter contains the conditions under which the runner will drain and terminate, they
+// replace the limit-tasks, and limit-idle-duration options
+//
+type RuntimeLimiter struct {
+	Tasks        *uint  `yaml:"tasks,omitempty" json:"tasks,omitempty"`
+	IdleDuration string `yaml:"idle_duration,omitempty" json:"idle_duration,omitempty"`
+}
+
+// RuntimeTransfers contains the limits on the transfer of artifacts with storage, the runner wide
+// limits replace the transfer-download-limit, transfer-upload-limit, and transfer-concurrency options
+//
+type RuntimeTransfers struct {
+	DownloadLimit string             `yaml:"download_limit,omitempty" json:"download_limit,omitempty"`
+	UploadLimit   string             `yaml:"upload_limit,omitempty" json:"upload_limit,omitempty"`
+	Concurrency   *uint              `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+	Endpoints     []EndpointTransfer `yaml:"endpoints,omitempty" json:"endpoints,omitempty"`
+}
+
+// EndpointTransfer contains the limits on the transfers with a single storage endpoint, the host
+// and port of an S3 endpoint, or file for the local file system.  Absent limits are unlimited.
+//
+type EndpointTransfer struct {
+	Endpoint      string `yaml:"endpoint" json:"endpoint"`
+	DownloadLimit string `yaml:"download_limit,omitempty" json:"download_limit,omitempty"`
+	UploadLimit   string `yaml:"upload_limit,omitempty" json:"upload_limit,omitempty"`
+	Concurrency   uint   `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+}
+
+// StorageMirrors contains a set of S3 endpoints that hold replicas of the same buckets.  Reads
+// from any member of the set fail over to the other members when an endpoint is unhealthy, and
+// writes go to the primary.  Buckets limits the set to the named buckets.
+//
+type StorageMirrors struct {
+	Name      string          `yaml:"name,omitempty" json:"name,omitempty"`
+	Buckets   []string        `yaml:"buckets,omitempty" json:"buckets,omitempty"`
+	Primary   StorageMirror   `yaml:"primary" json:"primary"`
+	Fallbacks []StorageMirror `yaml:"fallbacks,omitempty" json:"fallbacks,omitempty"`
+	Replicate bool            `yaml:"replicate,omitempty" json:"replicate,omitempty"`
+}
+
+// StorageMirror contains a single S3 endpoint within a set of mirrors.  When no credentials are
+// given those of the artifact are used.  Credentials can reference environment variables using
+// the ${NAME} syntax.
+//
+type StorageMirror struct {
+	Endpoint     string `yaml:"endpoint" json:"endpoint"`
+	SSL          bool   `yaml:"ssl,omitempty" json:"ssl,omitempty"`
+	AccessKey    string `yaml:"access_key,omitempty" json:"access_key,omitempty"`
+	SecretKey    string `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`
+	SessionToken string `yaml:"session_token,omitempty" json:"session_token,omitempty"`
+	Region       string `yaml:"region,omitempty" json:"region,omitempty"`
+}
+
+// QueueOptions contains settings that apply to the queues whose short names are matched by
+// the regular expression in Match.  Where more than one entry matches a queue the first is used.
+//
+type QueueOptions struct {
+	Match          string `yaml:"match" json:"match"`
+	Paused         bool   `yaml:"paused,omitempty" json:"paused,omitempty"`
+	StrictRequests *bool  `yaml:"strict_requests,omitempty" json:"strict_requests,omitempty"`
+	EncryptResults bool   `yaml:"encrypt_results,omitempty" json:"encrypt_results,omitempty"`
+}
+
+// RuntimeConfigChange describes a single setting that differs between two versions of the
+// runtime configuration
+//
+type RuntimeConfigChange struct {
+	Setting  string
+	Previous string
+	Value    string
+}
+
+type queueOptionsEntry struct {
+	match *regexp.Regexp
+	opts  QueueOptions
+}
+
+var (
+	queueOptions = struct {
+		entries []queueOptionsEntry
+		sync.Mutex
+	}{
+		entries: []queueOptionsEntry{},
+	}
+)
+
+// LoadRuntimeConfig reads and validates the runtime configuration file.  Fields that are not
+// known to the runner are treated as errors so that misspelt settings are not silently ignored.
+//
+func LoadRuntimeConfig(fn string) (cfg *RuntimeConfig, err kv.Error) {
+	data, errGo := os.ReadFile(filepath.Clean(fn))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return ParseRuntimeConfig(data, strings.ToLower(filepath.Ext(fn)) == ".json")
+}
+
+// ParseRuntimeConfig decodes and validates the contents of a runtime configuration file
+//
+func ParseRuntimeConfig(data []byte, isJSON bool) (cfg *RuntimeConfig, err kv.Error) {
+	cfg = &RuntimeConfig{}
+	if isJSON {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if errGo := dec.Decode(cfg); errGo != nil {
+			return nil, kv.Wrap(errGo, "invalid runtime configuration").With("stack", stack.Trace().TrimRuntime())
+		}
+	} else {
+		if errGo := yaml.UnmarshalStrict(data, cfg); errGo != nil {
+			return nil, kv.Wrap(errGo, "invalid runtime configuration").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if errs := cfg.Validate(); len(errs) != 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, kv.NewError("invalid runtime configuration").With("errors", strings.Join(msgs, ", ")).With("stack", stack.Trace().TrimRuntime())
+	}
+	return cfg, nil
+}
+
+// Validate checks all of the settings within the configuration and returns all of the
+// problems found
+//
+func (cfg *RuntimeConfig) Validate() (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	if cfg.QueueMatch != nil {
+		if len(strings.TrimSpace(*cfg.QueueMatch)) == 0 {
+			errs = append(errs, kv.NewError("queue_match must not be empty").With("stack", stack.Trace().TrimRuntime()))
+		} else if _, errGo := regexp.Compile(*cfg.QueueMatch); errGo != nil {
+			errs = append(errs, kv.Wrap(errGo).With("setting", "queue_match").With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	if cfg.QueueMismatch != nil {
+		if _, errGo := regexp.Compile(*cfg.QueueMismatch); errGo != nil {
+			errs = append(errs, kv.Wrap(errGo).With("setting", "queue_mismatch").With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	if _, err := parseRuntimeSize("resources.max_mem", cfg.Resources.MaxMem); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseRuntimeSize("resources.max_disk", cfg.Resources.MaxDisk); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseRuntimeDuration("limiter.idle_duration", cfg.Limiter.IdleDuration); err != nil {
+		errs = append(errs, err)
+	}
+	if period, err := parseRuntimeDuration("venv_cache_expiration", cfg.VEnvCacheExpiration); err != nil {
+		errs = append(errs, err)
+	} else if len(cfg.VEnvCacheExpiration) != 0 && period <= 0 {
+		errs = append(errs, kv.NewError("venv_cache_expiration must be positive").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if _, err := compileLogFilterRules(cfg.LogFilters); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parseRuntimeSize("transfers.download_limit", cfg.Transfers.DownloadLimit); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseRuntimeSize("transfers.upload_limit", cfg.Transfers.UploadLimit); err != nil {
+		errs = append(errs, err)
+	}
+	endpoints := map[string]bool{}
+	for i, limits := range cfg.Transfers.Endpoints {
+		if len(limits.Endpoint) == 0 {
+			errs = append(errs, kv.NewError("transfer limits must have an endpoint").With("entry", i).With("stack", stack.Trace().TrimRuntime()))
+			continue
+		}
+		if endpoints[limits.Endpoint] {
+			errs = append(errs, kv.NewError("transfer limits duplicated").With("endpoint", limits.Endpoint).With("stack", stack.Trace().TrimRuntime()))
+		}
+		endpoints[limits.Endpoint] = true
+		if _, err := parseRuntimeSize(fmt.Sprintf("transfers.endpoints[%d].download_limit", i), limits.DownloadLimit); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := parseRuntimeSize(fmt.Sprintf("transfers.endpoints[%d].upload_limit", i), limits.UploadLimit); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, validateMirrors(cfg.Mirrors)...)
+
+	for i, opts := range cfg.Queues {
+		if len(opts.Match) == 0 {
+			errs = append(errs, kv.NewError("queue options must have a match expression").With("entry", i).With("stack", stack.Trace().TrimRuntime()))
+			continue
+		}
+		if _, errGo := regexp.Compile(opts.Match); errGo != nil {
+			errs = append(errs, kv.Wrap(errGo).With("setting", fmt.Sprintf("queues[%d].match", i)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	return errs
+}
+
+// validateMirrors checks the mirror sets, an endpoint and bucket can only be held by one set
+//
+func validateMirrors(sets []StorageMirrors) (errs []kv.Error) {
+	errs = []kv.Error{}
+
+	// The buckets each endpoint has been placed into a set for, an empty name is all of them
+	claimed := map[string][]string{}
+
+	for i, set := range sets {
+		members := append([]StorageMirror{set.Primary}, set.Fallbacks...)
+		endpoints := map[string]bool{}
+		for j, m := range members {
+			setting := fmt.Sprintf("mirrors[%d].primary", i)
+			if j != 0 {
+				setting = fmt.Sprintf("mirrors[%d].fallbacks[%d]", i, j-1)
+			}
+			if len(m.Endpoint) == 0 {
+				errs = append(errs, kv.NewError("mirrors must have an endpoint").With("setting", setting).With("stack", stack.Trace().TrimRuntime()))
+				continue
+			}
+			if (len(m.AccessKey) == 0) != (len(m.SecretKey) == 0) {
+				errs = append(errs, kv.NewError("mirror credentials need both an access_key and a secret_key").With("setting", setting).With("stack", stack.Trace().TrimRuntime()))
+			}
+			endpoint := strings.ToLower(m.Endpoint)
+			if endpoints[endpoint] {
+				errs = append(errs, kv.NewError("mirror endpoint duplicated").With("setting", setting, "endpoint", m.Endpoint).With("stack", stack.Trace().TrimRuntime()))
+				continue
+			}
+			endpoints[endpoint] = true
+
+			buckets := set.Buckets
+			if len(buckets) == 0 {
+				buckets = []string{""}
+			}
+			for _, bucket := range buckets {
+				for _, other := range claimed[endpoint] {
+					if other == bucket || len(other) == 0 || len(bucket) == 0 {
+						errs = append(errs, kv.NewError("mirror endpoint present in more than one set for the same bucket").With("setting", setting, "endpoint", m.Endpoint, "bucket", bucket).With("stack", stack.Trace().TrimRuntime()))
+						break
+					}
+				}
+				claimed[endpoint] = append(claimed[endpoint], bucket)
+			}
+		}
+	}
+	return errs
+}
+
+func parseRuntimeSize(setting string, text string) (size uint64, err kv.Error) {
+	if len(text) == 0 {
+		return 0, nil
+	}
+	size, errGo := humanize.ParseBytes(text)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("setting", setting).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+func parseRuntimeDuration(setting string, duration string) (period time.Duration, err kv.Error) {
+	if len(duration) == 0 {
+		return 0, nil
+	}
+	period, errGo := time.ParseDuration(duration)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("setting", setting).With("stack", stack.Trace().TrimRuntime())
+	}
+	return period, nil
+}
+
+// RuntimeSettings holds the settings managed by this package once they have been prepared
+// from a version of the runtime configuration, applying them cannot fail
+//
+type RuntimeSettings struct {
+	match      *string
+	mismatch   *string
+	period     time.Duration
+	logFilters []logFilterExpr
+	queues     []queueOptionsEntry
+}
+
+// Prepare checks, and compiles, the settings managed by this package, queue patterns, the
+// virtualenv cache expiration period, log filters, and the per queue options, so that they
+// can be applied as a whole.  Settings absent from the configuration revert to their command
+// line, or default, values.
+//
+// The queue patterns can also be changed using the Kubernetes configuration map so they are
+// only included when the configuration sets them and they differ from prev, the version of
+// the configuration already in effect which can be nil.  Patterns absent from the file are
+// left unchanged.
+//
+func (cfg *RuntimeConfig) Prepare(prev *RuntimeConfig) (settings *RuntimeSettings, err kv.Error) {
+	if errs := cfg.Validate(); len(errs) != 0 {
+		return nil, errs[0]
+	}
+
+	settings = &RuntimeSettings{
+		period: DefaultVEnvCacheExpiration,
+	}
+	if prev == nil {
+		prev = &RuntimeConfig{}
+	}
+	if cfg.QueueMatch != nil && (prev.QueueMatch == nil || *prev.QueueMatch != *cfg.QueueMatch) {
+		settings.match = cfg.QueueMatch
+	}
+	if cfg.QueueMismatch != nil && (prev.QueueMismatch == nil || *prev.QueueMismatch != *cfg.QueueMismatch) {
+		settings.mismatch = cfg.QueueMismatch
+	}
+
+	if len(cfg.VEnvCacheExpiration) != 0 {
+		if settings.period, err = parseRuntimeDuration("venv_cache_expiration", cfg.VEnvCacheExpiration); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.logFilters, err = compileLogFilterRules(cfg.LogFilters); err != nil {
+		return nil, err
+	}
+
+	settings.queues = make([]queueOptionsEntry, 0, len(cfg.Queues))
+	for _, opts := range cfg.Queues {
+		match, errGo := regexp.Compile(opts.Match)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("match", opts.Match).With("stack", stack.Trace().TrimRuntime())
+		}
+		settings.queues = append(settings.queues, queueOptionsEntry{match: match, opts: opts})
+	}
+	return settings, nil
+}
+
+// Apply puts prepared settings into effect
+//
+func (settings *RuntimeSettings) Apply() {
+	// The patterns were compiled when the configuration was validated
+	if settings.match != nil || settings.mismatch != nil {
+		_ = queueMatcher.updatePatterns(settings.match, settings.mismatch)
+	}
+
+	SetVEnvCacheExpirationPeriod(settings.period)
+
+	setLogFilterExprs(settings.logFilters)
+
+	queueOptions.Lock()
+	queueOptions.entries = settings.queues
+	queueOptions.Unlock()
+}
+
+// GetQueueOptions returns the options from the runtime configuration for the first entry that
+// matches the short name of a queue, the zero value is returned when no entry matches
+//
+func GetQueueOptions(queue string) (opts QueueOptions) {
+	queueOptions.Lock()
+	defer queueOptions.Unlock()
+
+	for _, entry := range queueOptions.entries {
+		if entry.match.MatchString(queue) {
+			return entry.opts
+		}
+	}
+	return QueueOptions{}
+}
+
+// settings returns the configuration as a flat collection of setting names, using the names
+// found within the configuration file, and their values
+//
+func (cfg *RuntimeConfig) settings() (settings map[string]string) {
+	settings = map[string]string{}
+	if cfg == nil {
+		return settings
+	}
+	data, errGo := json.Marshal(cfg)
+	if errGo != nil {
+		return settings
+	}
+	var doc interface{}
+	if errGo = json.Unmarshal(data, &doc); errGo != nil {
+		return settings
+	}
+	flattenSettings(doc, "", settings)
+	return settings
+}
+
+func flattenSettings(doc interface{}, path string, settings map[string]string) {
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			if len(path) == 0 {
+				flattenSettings(v, k, settings)
+			} else {
+				flattenSettings(v, path+"."+k, settings)
+			}
+		}
+	case []interface{}:
+		for i, v := range value {
+			flattenSettings(v, path+"["+strconv.Itoa(i)+"]", settings)
+		}
+	default:
+		settings[path] = fmt.Sprint(value)
+		if strings.HasSuffix(path, ".secret_key") || strings.HasSuffix(path, ".session_token") {
+			// Secrets are not logged when settings change
+			settings[path] = "[redacted]"
+		}
+	}
+}
+
+// Changes returns the settings that differ between a previous version of the configuration,
+// which can be nil, and this one.  Settings that are absent have empty values.
+//
+func (cfg *RuntimeConfig) Changes(prev *RuntimeConfig) (changes []RuntimeConfigChange) {
+	before := prev.settings()
+	after := cfg.settings()
+
+	changes = []RuntimeConfigChange{}
+	for setting, value := range after {
+		if previous, isPresent := before[setting]; !isPresent || previous != value {
+			changes = append(changes, RuntimeConfigChange{Setting: setting, Previous: previous, Value: value})
+		}
+	}
+	for setting, previous := range before {
+		if _, isPresent := after[setting]; !isPresent {
+			changes = append(changes, RuntimeConfigChange{Setting: setting, Previous: previous})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Setting < changes[j].Setting })
+	return changes
+}
+
+// WatchRuntimeConfig watches the runtime configuration file and sends each new version that
+// passes validation to the updates channel.  The directory holding the file is watched so that
+// files replaced by renaming, as editors and kubernetes configmap volumes do, are seen.
+//
+// The watch runs until the ctx is Done.
+//
+func WatchRuntimeConfig(ctx context.Context, fn string, logger *log.Logger, updates chan<- *RuntimeConfig) (err kv.Error) {
+	watcher, errGo := fsnotify.NewWatcher()
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = watcher.Add(filepath.Dir(fn)); errGo != nil {
+		watcher.Close()
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Remember what was last read so that events that do not change the contents are ignored
+	last, _ := os.ReadFile(filepath.Clean(fn))
+
+	go func() {
+		defer watcher.Close()
+
+		settle := time.NewTimer(runtimeConfigSettle)
+		settle.Stop()
+		defer settle.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, isOK := <-watcher.Events:
+				if !isOK {
+					return
+				}
+				logger.Trace("runtime configuration event", "file", fn, "event", event.String())
+				settle.Reset(runtimeConfigSettle)
+			case errGo, isOK := <-watcher.Errors:
+				if !isOK {
+					return
+				}
+				logger.Warn("runtime configuration watch failed", "file", fn, "error", errGo.Error())
+			case <-settle.C:
+				data, errGo := os.ReadFile(filepath.Clean(fn))
+				if errGo != nil {
+					logger.Warn("runtime configuration unavailable, current settings retained", "file", fn, "error", errGo.Error())
+					continue
+				}
+				if bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+
+				cfg, err := ParseRuntimeConfig(data, strings.ToLower(filepath.Ext(fn)) == ".json")
+				if err != nil {
+					logger.Warn("runtime configuration rejected, current settings retained", "file", fn, "error", err.Error())
+					continue
+				}
+				select {
+				case updates <- cfg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the runtime configuration file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/go-test/deep"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	testRuntimeYAML = `
+queue_match: "^local_.*$"
+queue_mismatch: "_response$"
+resources:
+  max_cores: 2
+  max_mem: 4gb
+limiter:
+  tasks: 10
+  idle_duration: 30m
+venv_cache_expiration: 1h
+log_filters:
+  - expr: "(token=)[a-z0-9]+"
+    replace: "${1}****"
+queues:
+  - match: "^local_paused"
+    paused: true
+  - match: "^local_"
+    strict_requests: true
+transfers:
+  download_limit: 100mb
+  concurrency: 8
+  endpoints:
+    - endpoint: "minio:9000"
+      upload_limit: 20mb
+      concurrency: 2
+mirrors:
+  - name: datasets
+    buckets: [datasets]
+    primary:
+      endpoint: "minio-east:9000"
+    fallbacks:
+      - endpoint: "minio-west:9000"
+        ssl: true
+        access_key: "${WEST_ACCESS_KEY}"
+        secret_key: "${WEST_SECRET_KEY}"
+    replicate: true
+`
+	testRuntimeJSON = `{
+	"queue_match": "^local_.*$",
+	"queue_mismatch": "_response$",
+	"resources": {"max_cores": 2, "max_mem": "4gb"},
+	"limiter": {"tasks": 10, "idle_duration": "30m"},
+	"venv_cache_expiration": "1h",
+	"log_filters": [{"expr": "(token=)[a-z0-9]+", "replace": "${1}****"}],
+	"queues": [{"match": "^local_paused", "paused": true}, {"match": "^local_", "strict_requests": true}],
+	"transfers": {"download_limit": "100mb", "concurrency": 8, "endpoints": [{"endpoint": "minio:9000", "upload_limit": "20mb", "concurrency": 2}]},
+	"mirrors": [{"name": "datasets", "buckets": ["datasets"], "primary": {"endpoint": "minio-east:9000"},
+		"fallbacks": [{"endpoint": "minio-west:9000", "ssl": true, "access_key": "${WEST_ACCESS_KEY}", "secret_key": "${WEST_SECRET_KEY}"}], "replicate": true}]
+}`
+)
+
+// TestRuntimeConfigParse checks that YAML and JSON runtime configurations are decoded identically
+// and that invalid settings are rejected
+//
+func TestRuntimeConfigParse(t *testing.T) {
+	fromYAML, err := ParseRuntimeConfig([]byte(testRuntimeYAML), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseRuntimeConfig([]byte(testRuntimeJSON), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(fromYAML, fromJSON); diff != nil {
+		t.Fatal(kv.NewError("YAML and JSON configurations differ").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	invalid := map[string]string{
+		"misspelt setting":  "queue_mach: \"^local_\"\n",
+		"match expression":  "queue_match: \"(\"\n",
+		"memory size":       "resources:\n  max_mem: lots\n",
+		"idle duration":     "limiter:\n  idle_duration: forever\n",
+		"log filter":        "log_filters:\n  - replace: \"****\"\n",
+		"queue options":     "queues:\n  - paused: true\n",
+		"transfer limit":    "transfers:\n  upload_limit: fast\n",
+		"transfer endpoint": "transfers:\n  endpoints:\n    - concurrency: 2\n",
+		"mirror endpoint":   "mirrors:\n  - fallbacks:\n      - endpoint: \"minio:9000\"\n",
+		"mirror secret":     "mirrors:\n  - primary:\n      endpoint: \"minio:9000\"\n      access_key: key\n",
+		"mirror duplicated": "mirrors:\n  - primary:\n      endpoint: \"minio:9000\"\n  - primary:\n      endpoint: \"MINIO:9000\"\n",
+	}
+	for name, text := range invalid {
+		if _, err = ParseRuntimeConfig([]byte(text), false); err == nil {
+			t.Fatal(kv.NewError("invalid configuration accepted").With("case", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
+
+// TestRuntimeConfigChanges checks that the differences between versions of the configuration
+// are reported using the setting names from the file
+//
+func TestRuntimeConfigChanges(t *testing.T) {
+	prev, err := ParseRuntimeConfig([]byte("queue_match: \"^local_\"\nlimiter:\n  tasks: 10\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseRuntimeConfig([]byte("queue_match: \"^sqs_\"\nvenv_cache_expiration: 1h\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RuntimeConfigChange{
+		{Setting: "limiter.tasks", Previous: "10"},
+		{Setting: "queue_match", Previous: "^local_", Value: "^sqs_"},
+		{Setting: "venv_cache_expiration", Value: "1h"},
+	}
+	if diff := deep.Equal(cfg.Changes(prev), expected); diff != nil {
+		t.Fatal(kv.NewError("unexpected changes").With("diff", diff).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if changes := cfg.Changes(cfg); len(changes) != 0 {
+		t.Fatal(kv.NewError("unchanged configuration reported changes").With("changes", changes).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Mirror credentials must not appear in the changes that are logged
+	mirrors, err := ParseRuntimeConfig([]byte("mirrors:\n  - primary:\n      endpoint: \"minio:9000\"\n      access_key: key\n      secret_key: secret\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range mirrors.Changes(cfg) {
+		if strings.Contains(change.Value, "secret") {
+			t.Fatal(kv.NewError("mirror secret logged").With("setting", change.Setting).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
+
+func applyRuntimeConfig(t *testing.T, prev *RuntimeConfig, cfg *RuntimeConfig) {
+	settings, err := cfg.Prepare(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Apply()
+}
+
+// TestRuntimeConfigApply checks that the settings managed by this package take effect, and
+// are restored once removed from the configuration
+//
+func TestRuntimeConfigApply(t *testing.T) {
+	cfg, err := ParseRuntimeConfig([]byte(testRuntimeYAML), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyRuntimeConfig(t, nil, cfg)
+	defer func() {
+		applyRuntimeConfig(t, nil, &RuntimeConfig{})
+		queueMatcher.updatePatterns(queueMatch, queueMismatch)
+	}()
+
+	if opts := GetQueueOptions("local_paused_gpu"); !opts.Paused {
+		t.Fatal(kv.NewError("queue not paused").With("opts", opts).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if opts := GetQueueOptions("local_cpu"); opts.Paused || opts.StrictRequests == nil || !*opts.StrictRequests {
+		t.Fatal(kv.NewError("queue options incorrect").With("opts", opts).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if opts := GetQueueOptions("sqs_cpu"); opts.Paused || opts.StrictRequests != nil {
+		t.Fatal(kv.NewError("unmatched queue has options").With("opts", opts).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if matcher, mismatcher := GetQueuePatterns(); matcher.String() != "^local_.*$" || mismatcher == nil || mismatcher.String() != "_response$" {
+		t.Fatal(kv.NewError("queue patterns not applied").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	filtered := string(GetLogFilterer(log.NewLogger("test")).Filter([]byte("url?token=abc123")))
+	if filtered != "url?token=****" {
+		t.Fatal(kv.NewError("log filter not applied").With("output", filtered).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Patterns changed using the configuration map are not replaced when a version of the file
+	// that leaves the patterns unchanged is applied
+	cmMatch := "^sqs_"
+	queueMatcher.updatePatterns(&cmMatch, nil)
+	changed := &RuntimeConfig{QueueMatch: cfg.QueueMatch, QueueMismatch: cfg.QueueMismatch, VEnvCacheExpiration: "2h"}
+	applyRuntimeConfig(t, cfg, changed)
+	if matcher, _ := GetQueuePatterns(); matcher.String() != cmMatch {
+		t.Fatal(kv.NewError("configuration map patterns replaced").With("matcher", matcher.String()).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Remove the settings and check the defaults are restored, other than the queue patterns
+	// which are left as they are
+	applyRuntimeConfig(t, changed, &RuntimeConfig{})
+	if opts := GetQueueOptions("local_paused_gpu"); opts.Paused {
+		t.Fatal(kv.NewError("queue still paused").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if matcher, mismatcher := GetQueuePatterns(); matcher.String() != cmMatch || mismatcher == nil || mismatcher.String() != "_response$" {
+		t.Fatal(kv.NewError("queue patterns changed").With("matcher", matcher.String()).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestRuntimeConfigWatch checks that changes to the file are picked up and that invalid versions
+// of the file are not passed on
+//
+func TestRuntimeConfigWatch(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "runtime.yaml")
+	if errGo := os.WriteFile(fn, []byte("queue_match: \"^local_\"\n"), 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	updates := make(chan *RuntimeConfig, 1)
+	if err := WatchRuntimeConfig(ctx, fn, log.NewLogger("test"), updates); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file using a rename, as editors and configmap volumes do
+	update := func(text string) {
+		tmp := fn + ".tmp"
+		if errGo := os.WriteFile(tmp, []byte(text), 0600); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if errGo := os.Rename(tmp, fn); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	update("queue_match: \"(\"\n")
+	select {
+	case cfg := <-updates:
+		t.Fatal(kv.NewError("invalid configuration passed on").With("cfg", cfg).With("stack", stack.Trace().TrimRuntime()))
+	case <-time.After(4 * runtimeConfigSettle):
+	}
+
+	update("queue_match: \"^sqs_\"\n")
+	select {
+	case cfg := <-updates:
+		if cfg.QueueMatch == nil || !strings.HasPrefix(*cfg.QueueMatch, "^sqs_") {
+			t.Fatal(kv.NewError("unexpected configuration").With("cfg", cfg).With("stack", stack.Trace().TrimRuntime()))
+		}
+	case <-ctx.Done():
+		t.Fatal(kv.NewError("configuration change not seen").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of operator supplied script templates.  Templates
+// are grouped into named sets, each set being made up of up to three entries:
+//
+//   <name>.match     a regular expression matched against the short queue name
+//   <name>.run.tmpl  a text/template used to generate the experiment run script
+//   <name>.venv.tmpl a text/template used to generate the virtualenv build script
+//
+// The entries can be supplied as files within the directory specified using the
+// script-templates option, or as keys within the runner configuration map.  Sets
+// are examined in name order and the first set with a matching expression is used,
+// a set without a match entry matches every queue.  Entries from the configuration
+// map take precedence over files with the same name.  When a set does not supply
+// one of the templates the built-in template is used.
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	scriptTemplatesOpt = flag.String("script-templates", "", "optional directory containing operator supplied run and virtualenv build script templates selected using queue name patterns")
+)
+
+const (
+	templateMatchSuffix = ".match"
+	templateRunSuffix   = ".run.tmpl"
+	templateVenvSuffix  = ".venv.tmpl"
+)
+
+// RunScriptParams is the contract between the runner and run script templates, operator
+// supplied templates are executed using this structure.
+//
+type RunScriptParams struct {
+	AllocEnv []string          // Environment variable assignments, KEY=VALUE, derived from the resources allocated to the experiment
+	E        interface{}       // The processor handling the experiment, exposes RootDir, ExprDir, ExprSubDir, AccessionID, and the Request
+	VEnvID   string            // The name of the pyenv virtualenv that has been built for the experiment
+	CudaDir  string            // The preferred CUDA library directory
+	Hostname string            // The name of the host running the experiment
+	Env      map[string]string // The environment variables supplied by the experiment, keys are validated and values should be quoted using shellquote
+}
+
+// VenvScriptParams is the contract between the runner and virtualenv build script templates, operator
+// supplied templates are executed using this structure.
+//
+type VenvScriptParams struct {
+	PythonVer   string            // The pyenv python version the virtualenv is to be built from
+	EnvName     string            // The name for the pyenv virtualenv being built
+	Pips        []string          // Arguments for pip from the loose specifiers supplied by the experiment, should be quoted using shellquote
+	CfgPips     []string          // Arguments for pip from the loose specifiers supplied by the experiment configuration, should be quoted using shellquote
+	PinnedReqs  string            // The path of a requirements file of hash pinned specifiers, empty when there are none
+	Constraints string            // The path of a pip constraints file holding the package versions the virtualenv is keyed on, empty when there are none
+	TmpDir      string            // A scratch directory that is removed after the script has run
+	Env         map[string]string // The environment variables supplied by the experiment, keys are validated and values should be quoted using shellquote
+}
+
+type scriptTemplatesType struct {
+	cfgMap  map[string]string
+	updater chan server.K8sConfigUpdate
+	logger  *log.Logger
+	sync.Mutex
+}
+
+var (
+	scriptTemplates = scriptTemplatesType{
+		cfgMap:  map[string]string{},
+		updater: make(chan server.K8sConfigUpdate, 1),
+	}
+)
+
+func isTemplateKey(key string) bool {
+	return strings.HasSuffix(key, templateMatchSuffix) ||
+		strings.HasSuffix(key, templateRunSuffix) ||
+		strings.HasSuffix(key, templateVenvSuffix)
+}
+
+func (st *scriptTemplatesType) listen(ctx context.Context, namespace string, mapname string) {
+	for {
+		select {
+		case cmap := <-st.updater:
+			if cmap.NameSpace != namespace || cmap.Name != mapname {
+				continue
+			}
+			entries := map[string]string{}
+			for k, v := range cmap.State {
+				if isTemplateKey(k) {
+					entries[k] = v
+				}
+			}
+			st.Lock()
+			st.cfgMap = entries
+			st.Unlock()
+			if st.logger != nil {
+				st.logger.Debug("script templates updated", "namespace", namespace, "map", mapname, "entries", len(entries))
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// entries gathers the template entries from the directory and the configuration map
+//
+func (st *scriptTemplatesType) entries() (entries map[string]string, err kv.Error) {
+	entries = map[string]string{}
+
+	if len(*scriptTemplatesOpt) != 0 {
+		files, errGo := os.ReadDir(*scriptTemplatesOpt)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("dir", *scriptTemplatesOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, file := range files {
+			if file.IsDir() || !isTemplateKey(file.Name()) {
+				continue
+			}
+			fn := filepath.Join(*scriptTemplatesOpt, file.Name())
+			content, errGo := os.ReadFile(filepath.Clean(fn))
+			if errGo != nil {
+				return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			}
+			entries[file.Name()] = string(content)
+		}
+	}
+
+	st.Lock()
+	for k, v := range st.cfgMap {
+		entries[k] = v
+	}
+	st.Unlock()
+
+	return entries, nil
+}
+
+// selectTemplates locates the set of operator templates that applies to the named queue.  Empty
+// strings are returned for templates that are not being overridden.
+//
+func selectTemplates(entries map[string]string, queueName string) (set string, run string, venv string, err kv.Error) {
+	names := map[string]struct{}{}
+	for k := range entries {
+		for _, suffix := range []string{templateMatchSuffix, templateRunSuffix, templateVenvSuffix} {
+			if strings.HasSuffix(k, suffix) {
+				names[strings.TrimSuffix(k, suffix)] = struct{}{}
+			}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if match, isPresent := entries[name+templateMatchSuffix]; isPresent {
+			matcher, errGo := regexp.Compile(strings.TrimSpace(match))
+			if errGo != nil {
+				return "", "", "", kv.Wrap(errGo).With("set", name, "match", match).With("stack", stack.Trace().TrimRuntime())
+			}
+			if !matcher.MatchString(queueName) {
+				continue
+			}
+		}
+		return name, entries[name+templateRunSuffix], entries[name+templateVenvSuffix], nil
+	}
+	return "", "", "", nil
+}
+
+// InitScriptTemplates starts listening to the runner configuration map for operator supplied script templates
+//
+func InitScriptTemplates(ctx context.Context, namespace string, mapname string, logger *log.Logger) (err kv.Error) {
+	scriptTemplates.logger = logger
+
+	if len(*scriptTemplatesOpt) != 0 {
+		if _, errGo := os.Stat(*scriptTemplatesOpt); errGo != nil {
+			return kv.Wrap(errGo).With("dir", *scriptTemplatesOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	server.K8sConfigUpdates().Add(scriptTemplates.updater)
+	go scriptTemplates.listen(ctx, namespace, mapname)
+
+	return nil
+}
+
+// GetScriptTemplates returns the text of the run and virtualenv build script templates that
+// should be used for experiments arriving on the named queue.  The built-in templates are returned
+// when the operator has not supplied replacements.
+//
+func GetScriptTemplates(queueName string) (run string, venv string, err kv.Error) {
+	entries, err := scriptTemplates.entries()
+	if err != nil {
+		return "", "", err
+	}
+
+	set, run, venv, err := selectTemplates(entries, queueName)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(run) == 0 {
+		run = strings.ReplaceAll(runScriptTemplate, "^^^", "`")
+	}
+	if len(venv) == 0 {
+		venv = venvScriptTemplate
+	}
+
+	if len(set) != 0 && scriptTemplates.logger != nil {
+		scriptTemplates.logger.Debug("using operator script templates", "set", set, "queue", queueName)
+	}
+	return run, venv, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+// TestSelectTemplates exercises the selection of operator supplied template sets using queue names
+func TestSelectTemplates(t *testing.T) {
+	entries := map[string]string{
+		"a-gpu.match":      "^sqs_gpu_.*$",
+		"a-gpu.run.tmpl":   "gpu run",
+		"b-site.run.tmpl":  "site run",
+		"b-site.venv.tmpl": "site venv",
+		"c-never.match":    "^never$",
+		"c-never.run.tmpl": "never run",
+	}
+
+	tests := []struct {
+		queue string
+		set   string
+		run   string
+		venv  string
+	}{
+		{queue: "sqs_gpu_large", set: "a-gpu", run: "gpu run", venv: ""},
+		{queue: "sqs_cpu_large", set: "b-site", run: "site run", venv: "site venv"},
+		{queue: "never", set: "b-site", run: "site run", venv: "site venv"},
+	}
+
+	for _, aTest := range tests {
+		set, run, venv, err := selectTemplates(entries, aTest.queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set != aTest.set || run != aTest.run || venv != aTest.venv {
+			t.Fatal("unexpected template set", aTest.queue, set, run, venv)
+		}
+	}
+
+	if set, _, _, _ := selectTemplates(map[string]string{}, "any"); len(set) != 0 {
+		t.Fatal("template set selected from empty entries", set)
+	}
+
+	if _, _, _, err := selectTemplates(map[string]string{"bad.match": "(", "bad.run.tmpl": ""}, "any"); err == nil {
+		t.Fatal("invalid match expression was accepted")
+	}
+}
+
+// TestBuiltinTemplates checks that the built-in templates honor the parameter contracts
+// offered to operator supplied templates
+func TestBuiltinTemplates(t *testing.T) {
+	run, venv, err := GetScriptTemplates("any")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := struct {
+		RootDir     string
+		ExprDir     string
+		ExprSubDir  string
+		AccessionID string
+		Request     *request.Request
+	}{
+		RootDir:     "/tmp/root",
+		ExprDir:     "/tmp/root/experiment",
+		ExprSubDir:  "experiment",
+		AccessionID: "host-1",
+		Request: &request.Request{
+			Experiment: request.Experiment{
+				Key:       "key",
+				Filename:  "train.py",
+				Args:      []string{"--name", "it's $(here)"},
+				PythonVer: "3.8.12",
+			},
+		},
+	}
+
+	content := new(bytes.Buffer)
+	tmpl := template.Must(template.New("run").Funcs(template.FuncMap{"shellquote": ShellQuote}).Parse(run))
+	if errGo := tmpl.Execute(content, RunScriptParams{E: e, Env: map[string]string{"A": "b c"}}); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.Contains(content.String(), `python 'train.py' '--name' 'it'\''s $(here)'`) {
+		t.Fatal("experiment command was not quoted", content.String())
+	}
+	if strings.Contains(content.String(), "^^^") {
+		t.Fatal("backtick placeholders were left in the run script")
+	}
+
+	content.Reset()
+	tmpl = template.Must(template.New("venv").Funcs(template.FuncMap{"shellquote": ShellQuote}).Parse(venv))
+	if errGo := tmpl.Execute(content, VenvScriptParams{PythonVer: "3.8.12", EnvName: "venv-runner-test", Pips: []string{"numpy; curl x|sh"}, CfgPips: []string{"$(id)"}}); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.Contains(content.String(), `pip install 'numpy; curl x|sh'`) || !strings.Contains(content.String(), `pip install '$(id)'`) {
+		t.Fatal("pip specifiers were not quoted", content.String())
+	}
+}
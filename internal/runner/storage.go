@@ -7,6 +7,7 @@ package runner
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"io"
 	"net/url"
@@ -55,6 +56,69 @@ type StoreOpts struct {
 	Group     string
 	Env       map[string]string
 	Validate  bool
+	Seal      *rsa.PublicKey // When present deposited archives are encrypted using this key
+}
+
+// checkArtifact applies the checks made to the description of an artifact before the storage
+// holding it is accessed.  It is used both by NewStorage and when requests are validated
+// without being run.  The parsed location of the artifact is returned.
+//
+func checkArtifact(art *request.Artifact) (uri *url.URL, err kv.Error) {
+	uri, errGo := url.ParseRequestURI(art.Qualified)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	switch uri.Scheme {
+	case "s3":
+		if art.Credentials.AWS == nil {
+			return nil, kv.NewError("missing AWS credentials").With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(uri.Host) == 0 {
+			return nil, kv.NewError("S3/minio endpoint lacks a scheme, or the host name was not specified").With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(strings.Split(uri.EscapedPath(), "/")) < 2 && (len(art.Bucket) == 0 || len(art.Key) == 0) {
+			return nil, kv.NewError("S3/minio location lacks a bucket").With("stack", stack.Trace().TrimRuntime())
+		}
+	case "http", "https":
+		// Pre-signed URLs carry their own authorization
+		if len(uri.Host) == 0 {
+			return nil, kv.NewError("the host name was not specified").With("stack", stack.Trace().TrimRuntime())
+		}
+	case "file":
+	default:
+		return nil, kv.NewError(fmt.Sprintf("unknown, or unsupported URI scheme %s, s3 or gs expected", uri.Scheme)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return uri, nil
+}
+
+// artifactKey returns the key naming an artifact within its storage, which is taken from
+// the location of the artifact when the artifact does not supply one
+//
+func artifactKey(art *request.Artifact, uri *url.URL) (key string) {
+	if len(art.Key) != 0 {
+		return art.Key
+	}
+	switch uri.Scheme {
+	case "s3":
+		return strings.Join(strings.Split(uri.EscapedPath(), "/")[2:], "/")
+	case "http", "https":
+		// The key is used only to name the file and to determine the type of the archive
+		return strings.TrimPrefix(uri.Path, "/")
+	default:
+		return uri.Path
+	}
+}
+
+// objectName returns the name of the object an artifact refers to, either the key supplied
+// with the artifact or the key derived from its URL, without modifying the artifact
+//
+func objectName(art *request.Artifact) (name string) {
+	uri, errGo := url.Parse(art.Qualified)
+	if errGo != nil {
+		return art.Key
+	}
+	return artifactKey(art, uri)
 }
 
 // NewStorage is used to create a receiver for a storage implementation
@@ -65,38 +129,37 @@ func NewStorage(ctx context.Context, spec *StoreOpts) (stor Storage, err kv.Erro
 		return nil, kv.Wrap(err, "empty specification supplied").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	uri, errGo := url.ParseRequestURI(spec.Art.Qualified)
-	if errGo != nil {
-		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	uri, err := checkArtifact(spec.Art)
+	if err != nil {
+		return nil, err
 	}
 
 	switch uri.Scheme {
 	case "s3":
-
-		if spec.Art.Credentials.AWS == nil {
-			return nil, kv.NewError("missing AWS credentials")
-		}
-
-		uriPath := strings.Split(uri.EscapedPath(), "/")
-		if len(spec.Art.Key) == 0 {
-			spec.Art.Key = strings.Join(uriPath[2:], "/")
-		}
+		spec.Art.Key = artifactKey(spec.Art, uri)
 		if len(spec.Art.Bucket) == 0 {
-			spec.Art.Bucket = uriPath[1]
-		}
-
-		if len(uri.Host) == 0 {
-			return nil, kv.NewError("S3/minio endpoint lacks a scheme, or the host name was not specified").With("stack", stack.Trace().TrimRuntime())
+			spec.Art.Bucket = strings.Split(uri.EscapedPath(), "/")[1]
 		}
 
 		useSSL := uri.Scheme == "https"
 
-		return s3.NewS3storage(ctx, *spec.Art.Credentials.AWS, spec.Env, uri.Host,
+		s, err := s3.NewS3storage(ctx, *spec.Art.Credentials.AWS, spec.Env, uri.Host,
 			spec.Art.Bucket, spec.Art.Key, spec.Validate, useSSL)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.SetObjectOptions(spec.Art.Object); err != nil {
+			return nil, err
+		}
+		s.SealDeposits(spec.Seal)
+		return s, nil
+
+	case "http", "https":
+		return NewHTTPStorage(spec)
 
-	case "file":
-		return NewLocalStorage()
 	default:
-		return nil, kv.NewError(fmt.Sprintf("unknown, or unsupported URI scheme %s, s3 or gs expected", uri.Scheme)).With("stack", stack.Trace().TrimRuntime())
+		// Only file locations remain once checkArtifact has accepted the artifact
+		// Files are only decrypted when they are known to hold sealed archives
+		return NewLocalStorage(spec.Art.Encrypt)
 	}
 }
@@ -4,7 +4,17 @@ package runner
 
 // This file contains string functions used within the runner package
 
-import "strings"
+import (
+	"regexp"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	envKeyRE = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+)
 
 func Reverse(in string) (reversed string) {
 	sb := strings.Builder{}
@@ -15,3 +25,62 @@ func Reverse(in string) (reversed string) {
 	}
 	return sb.String()
 }
+
+// ShellQuote returns the input quoted so that bash will treat it as a single word
+// without performing any expansion or substitution on it
+func ShellQuote(in string) (quoted string) {
+	return "'" + strings.ReplaceAll(in, "'", `'\''`) + "'"
+}
+
+// IsValidEnvKey tests that a string can be used as an environment variable name
+// within a generated script, "_" is excluded as bash overwrites it after every command
+func IsValidEnvKey(key string) bool {
+	return key != "_" && envKeyRE.MatchString(key)
+}
+
+// SplitWords breaks the input into words at unquoted white space in the same way bash would
+// but without performing any expansion or substitution.  Single and double quotes group characters
+// into a word and a backslash outside of single quotes escapes the following character.
+func SplitWords(in string) (words []string, err kv.Error) {
+	words = []string{}
+	word := strings.Builder{}
+	inWord := false
+	quote := rune(0)
+	escaped := false
+
+	for _, c := range in {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				continue
+			}
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, kv.NewError("unterminated quote or escape").With("input", in).With("stack", stack.Trace().TrimRuntime())
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// FuzzShellQuote checks that strings quoted for use within generated scripts are seen by
+// bash as a single word that is passed through without expansion or command substitution
+func FuzzShellQuote(f *testing.F) {
+	bash, errGo := exec.LookPath("bash")
+	if errGo != nil {
+		f.Skip("bash not available")
+	}
+
+	for _, seed := range []string{
+		"",
+		"simple",
+		"with spaces",
+		"'single' \"double\"",
+		"$(touch /tmp/fuzzed)",
+		"`id`",
+		"${HOME} $HOME \\$HOME",
+		"; rm -rf / #",
+		"line\nbreak",
+		"'\\''",
+		"*?[a-z]",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, arg string) {
+		if strings.ContainsRune(arg, 0) {
+			t.Skip()
+		}
+		// #nosec
+		output, errGo := exec.Command(bash, "-c", "printf %s "+ShellQuote(arg)).Output()
+		if errGo != nil {
+			t.Fatal(errGo, arg)
+		}
+		if string(output) != arg {
+			t.Fatalf("quoting altered the argument %q became %q", arg, string(output))
+		}
+	})
+}
+
+// FuzzEnvKey checks that any environment variable name accepted for use within generated
+// scripts is passed through bash unaltered
+func FuzzEnvKey(f *testing.F) {
+	bash, errGo := exec.LookPath("bash")
+	if errGo != nil {
+		f.Skip("bash not available")
+	}
+
+	for _, seed := range []string{"PATH", "_A1", "_", "1A", "A-B", "A=B", "$(id)", "A B", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, key string) {
+		if !IsValidEnvKey(key) {
+			return
+		}
+		// #nosec
+		output, errGo := exec.Command(bash, "-c", "export "+key+"=value; printf %s \"${"+key+"}\"").Output()
+		if errGo != nil {
+			t.Fatal(errGo, key)
+		}
+		if string(output) != "value" {
+			t.Fatalf("environment variable %q was not set", key)
+		}
+	})
+}
+
+// TestSplitWords checks that strings are split into words at unquoted white space
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected []string
+	}{
+		{in: "", expected: []string{}},
+		{in: "  numpy==1.21.4  ", expected: []string{"numpy==1.21.4"}},
+		{in: "-e ./pkg", expected: []string{"-e", "./pkg"}},
+		{in: `'requests; python_version < "3.8"'`, expected: []string{`requests; python_version < "3.8"`}},
+		{in: `a"b c"d e\ f ''`, expected: []string{"ab cd", "e f", ""}},
+		{in: `$(id) ${HOME}`, expected: []string{"$(id)", "${HOME}"}},
+	}
+	for _, aTest := range tests {
+		words, err := SplitWords(aTest.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(words, "|") != strings.Join(aTest.expected, "|") || len(words) != len(aTest.expected) {
+			t.Fatalf("%q split into %q", aTest.in, words)
+		}
+	}
+
+	for _, in := range []string{`'open`, `"open`, `trailing\`} {
+		if _, err := SplitWords(in); err == nil {
+			t.Fatalf("%q was accepted", in)
+		}
+	}
+}
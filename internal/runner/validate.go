@@ -0,0 +1,153 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of the checks applied to requests when they
+// are being validated without being run, and the report into which the results of
+// those checks are gathered
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/archive"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// ValidationCheck is the outcome of a single check applied to a request
+//
+type ValidationCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidationReport gathers the outcome of all of the checks applied to a request along with
+// the run script that would be used for it
+//
+type ValidationReport struct {
+	Source       string            `json:"source"`
+	Envelope     bool              `json:"envelope"`
+	ExperimentID string            `json:"experiment_id,omitempty"`
+	Valid        bool              `json:"valid"`
+	Checks       []ValidationCheck `json:"checks"`
+	Warnings     []string          `json:"warnings,omitempty"`
+	Script       string            `json:"script,omitempty"`
+	VenvScript   string            `json:"venv_script,omitempty"`
+}
+
+// NewValidationReport returns an empty report for the request read from source
+//
+func NewValidationReport(source string) (report *ValidationReport) {
+	return &ValidationReport{
+		Source: source,
+		Valid:  true,
+		Checks: []ValidationCheck{},
+	}
+}
+
+// Add records the outcome of a check, any error marks the request as invalid.  The
+// outcome is returned to allow callers to skip checks that depend on this one.
+//
+func (report *ValidationReport) Add(name string, detail string, err kv.Error) (passed bool) {
+	check := ValidationCheck{
+		Name:   name,
+		Passed: err == nil,
+		Detail: detail,
+	}
+	if err != nil {
+		check.Error = err.Error()
+		report.Valid = false
+	}
+	report.Checks = append(report.Checks, check)
+	return check.Passed
+}
+
+// ValidateArtifacts applies the checks made while artifacts are fetched to the artifacts of a
+// request.  When probe is set the storage holding each artifact is asked for its hash to check
+// that the artifact can be reached using the credentials supplied.
+//
+func ValidateArtifacts(ctx context.Context, rqst *request.Request, probe bool, timeout time.Duration, report *ValidationReport) {
+	// The workspace is used to select how the experiment is run
+	if _, isPresent := rqst.Experiment.Artifacts["workspace"]; !isPresent {
+		report.Add("workspace", "", kv.NewError("unable to determine execution class from artifacts").With("stack", stack.Trace().TrimRuntime()))
+	} else {
+		report.Add("workspace", "", nil)
+	}
+
+	groups := make([]string, 0, len(rqst.Experiment.Artifacts))
+	for group := range rqst.Experiment.Artifacts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		art := rqst.Experiment.Artifacts[group]
+		name := "artifact " + group
+
+		// Artifacts that have no qualified location are ignored by the runner
+		if len(art.Qualified) == 0 {
+			report.Add(name, "no qualified location, ignored", nil)
+			continue
+		}
+
+		if err := checkFetch(&art); err != nil {
+			report.Add(name, sourceURI(art.Qualified), err.With("group", group))
+			continue
+		}
+
+		if !probe {
+			report.Add(name, sourceURI(art.Qualified), nil)
+			continue
+		}
+
+		hash, err := probeArtifact(ctx, art.Clone(), timeout)
+		switch {
+		case err == nil:
+			report.Add(name, fmt.Sprintf("%s reachable, hash %s", sourceURI(art.Qualified), hash), nil)
+		case art.Mutable:
+			// Mutable artifacts can be create-only items that don't yet exist on the storage platform
+			report.Add(name, fmt.Sprintf("%s not reachable, mutable artifacts are created by the experiment (%s)", sourceURI(art.Qualified), err.Error()), nil)
+		default:
+			report.Add(name, sourceURI(art.Qualified), err.With("group", group))
+		}
+	}
+}
+
+// checkFetch applies the checks to the artifact description that NewStorage and the
+// artifact cache apply before an artifact is fetched
+//
+func checkFetch(art *request.Artifact) (err kv.Error) {
+	uri, err := checkArtifact(art)
+	if err != nil {
+		return err
+	}
+
+	if key := artifactKey(art, uri); art.Unpack && !archive.IsTar(key) {
+		return kv.NewError("the unpack flag was set for an unsupported file format (tar gzip/bzip2 only supported)").With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func probeArtifact(ctx context.Context, art *request.Artifact, timeout time.Duration) (hash string, err kv.Error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	storage, err := NewStorage(ctx, &StoreOpts{
+		Art:      art,
+		Validate: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer storage.Close()
+
+	return storage.Hash(ctx, objectName(art))
+}
@@ -0,0 +1,137 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the checks applied to requests that are validated without being run
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// TestValidateArtifacts checks that the problems with artifacts that would only be seen
+// once a runner has claimed a request are reported
+//
+func TestValidateArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	workspace := filepath.Join(dir, "workspace.tar")
+	if errGo := os.WriteFile(workspace, []byte{}, 0600); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	rqst := &request.Request{
+		Experiment: request.Experiment{
+			Key: "validate",
+			Artifacts: map[string]request.Artifact{
+				"workspace": {Qualified: "file://" + workspace, Key: workspace, Unpack: true},
+				"modeldir":  {Qualified: "s3://minio:9000/bucket/modeldir.zip", Key: "modeldir.zip", Unpack: true, Credentials: request.Credentials{AWS: &request.AWSCredential{}}},
+				"data":      {Qualified: "gs://bucket/data.tar", Key: "data.tar"},
+				"creds":     {Qualified: "s3://minio:9000/bucket/creds.tar", Key: "creds.tar"},
+				"unused":    {},
+			},
+		},
+	}
+
+	report := NewValidationReport("test")
+	ValidateArtifacts(context.Background(), rqst, true, time.Second, report)
+	if report.Valid {
+		t.Fatal(kv.NewError("invalid artifacts accepted").With("report", report).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	expected := map[string]bool{
+		"workspace":          true,
+		"artifact creds":     false,
+		"artifact data":      false,
+		"artifact modeldir":  false,
+		"artifact unused":    true,
+		"artifact workspace": true,
+	}
+	for _, check := range report.Checks {
+		passed, isPresent := expected[check.Name]
+		if !isPresent || passed != check.Passed {
+			t.Fatal(kv.NewError("unexpected check outcome").With("check", check).With("stack", stack.Trace().TrimRuntime()))
+		}
+		delete(expected, check.Name)
+	}
+	if len(expected) != 0 {
+		t.Fatal(kv.NewError("checks missing").With("missing", expected).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Without a workspace the execution class cannot be determined
+	report = NewValidationReport("test")
+	ValidateArtifacts(context.Background(), &request.Request{}, false, time.Second, report)
+	if report.Valid || len(report.Checks) != 1 {
+		t.Fatal(kv.NewError("missing workspace accepted").With("report", report).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestDryRunScript checks that the run script is rendered for a request without any
+// virtualenv being built
+//
+func TestDryRunScript(t *testing.T) {
+	pythonVersions.Lock()
+	saved := pythonVersions.versions
+	pythonVersions.versions = []string{"3.8.12"}
+	pythonVersions.Unlock()
+	defer func() {
+		pythonVersions.Lock()
+		pythonVersions.versions = saved
+		pythonVersions.Unlock()
+	}()
+
+	rqst := &request.Request{
+		Experiment: request.Experiment{
+			Key:       "validate",
+			Filename:  "train.py",
+			Args:      []string{"--epochs", "2"},
+			PythonVer: "3.8",
+		},
+	}
+	e := struct {
+		RootDir     string
+		ExprDir     string
+		ExprSubDir  string
+		AccessionID string
+		Request     *request.Request
+	}{
+		RootDir:     "/tmp/root",
+		ExprDir:     "/tmp/root/experiments/validate.0",
+		ExprSubDir:  "validate.0",
+		AccessionID: "dry-run",
+		Request:     rqst,
+	}
+
+	rqst.Experiment.Pythonenv = []string{"numpy==1.21.0"}
+
+	script, venvScript, err := DryRunScript(context.Background(), rqst, "local_validate", &resources.Allocated{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"PYENV_VERSION='3.8.12'", DryRunVenvID, "python 'train.py' '--epochs' '2'"} {
+		if !strings.Contains(string(script), expected) {
+			t.Fatal(kv.NewError("run script incomplete").With("expected", expected, "script", string(script)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	// The virtualenv has not been built so the script that would build it is included
+	for _, expected := range []string{"pyenv virtualenv", "'" + DryRunVenvID + "'", "'numpy==1.21.0'"} {
+		if !strings.Contains(string(venvScript), expected) {
+			t.Fatal(kv.NewError("virtualenv script incomplete").With("expected", expected, "script", string(venvScript)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// Values that cannot be quoted are rejected just as they would be by Make
+	rqst.Experiment.Args = []string{"\x00"}
+	if _, _, err = DryRunScript(context.Background(), rqst, "local_validate", &resources.Allocated{}, e); err == nil {
+		t.Fatal(kv.NewError("invalid argument accepted").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
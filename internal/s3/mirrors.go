@@ -0,0 +1,502 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains the implementation of mirror sets, groups of S3 endpoints that hold
+// replicas of the same buckets.  An artifact whose endpoint, and bucket, belong to a mirror set
+// is read from the first healthy member of the set, and reads that fail because an endpoint is
+// unhealthy fail over to the next healthy member.  Writes always go to the primary, the first
+// member, and can optionally be replicated to the other members in the background.
+//
+// The health of endpoints is tracked using circuit breakers that are shared by all of the
+// storage clients within the runner.  A breaker opens after a number of consecutive failures
+// and the endpoint is then avoided until a cooldown has passed, after which the breaker is
+// half open and admits a single trial request, other requests continuing to avoid the endpoint
+// until the trial has finished.  A successful trial closes the breaker while a failed one
+// reopens it with a cooldown twice as long as before.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	// breakerThreshold is the number of consecutive failures that opens the breaker of an endpoint
+	breakerThreshold = 3
+
+	// breakerCooldown is the time an endpoint is avoided once its breaker first opens
+	breakerCooldown = 30 * time.Second
+
+	// breakerMaxCooldown is the longest time an endpoint is avoided after repeated failed trials
+	breakerMaxCooldown = 5 * time.Minute
+
+	// breakerTrialTimeout is the time after which a trial whose outcome was never recorded, for
+	// example because the request failed for reasons unrelated to the endpoint, is abandoned and
+	// another trial admitted
+	breakerTrialTimeout = time.Minute
+
+	// replicationTimeout limits the time spent replicating a single object to the mirrors
+	replicationTimeout = 30 * time.Minute
+)
+
+// Mirror is a single S3 endpoint within a mirror set
+//
+type Mirror struct {
+	Endpoint string                 // The host, and optional port, of the endpoint
+	UseSSL   bool                   // Use TLS when accessing the endpoint
+	Creds    *request.AWSCredential // The credentials for the endpoint, nil to use those of the artifact
+}
+
+// MirrorSet is a set of S3 endpoints holding replicas of the same buckets
+//
+type MirrorSet struct {
+	Name      string
+	Buckets   []string // The buckets replicated within the set, empty when all of them are
+	Mirrors   []Mirror // The primary followed by the fallbacks in the order they are tried
+	Replicate bool     // Copy objects written to the primary to the fallbacks
+}
+
+var (
+	mirrorSets = struct {
+		sets   []MirrorSet
+		logger *log.Logger
+		sync.Mutex
+	}{
+		sets: []MirrorSet{},
+	}
+
+	endpointHealth = struct {
+		breakers map[string]*breaker
+		sync.Mutex
+	}{
+		breakers: map[string]*breaker{},
+	}
+)
+
+var (
+	mirrorAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_storage_mirror_available",
+			Help: "Set to 1 when the breaker of a mirrored storage endpoint is closed, and 0 while it is open.",
+		},
+		[]string{"endpoint"},
+	)
+	mirrorFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_storage_mirror_failovers_total",
+			Help: "The number of times reads have moved from one mirrored storage endpoint to another.",
+		},
+		[]string{"from", "to"},
+	)
+	mirrorReplications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_storage_mirror_replications_total",
+			Help: "The number of objects written, or removed, on the primary that were replicated to a mirrored storage endpoint.",
+		},
+		[]string{"endpoint", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(mirrorAvailable)
+	prometheus.MustRegister(mirrorFailovers)
+	prometheus.MustRegister(mirrorReplications)
+}
+
+// SetMirrors replaces the mirror sets used by storage clients created from this point on, the
+// logger is used to report failovers and replication failures and can be nil
+//
+func SetMirrors(sets []MirrorSet, logger *log.Logger) {
+	mirrorSets.Lock()
+	defer mirrorSets.Unlock()
+
+	mirrorSets.sets = make([]MirrorSet, 0, len(sets))
+	for _, set := range sets {
+		if len(set.Mirrors) != 0 {
+			mirrorSets.sets = append(mirrorSets.sets, set)
+		}
+	}
+	mirrorSets.logger = logger
+}
+
+// findMirrors returns the first mirror set holding the endpoint and bucket, or nil
+//
+func findMirrors(endpoint string, bucket string) (set *MirrorSet) {
+	mirrorSets.Lock()
+	defer mirrorSets.Unlock()
+
+	for i, candidate := range mirrorSets.sets {
+		if !candidate.holds(endpoint, bucket) {
+			continue
+		}
+		set = &MirrorSet{}
+		*set = mirrorSets.sets[i]
+		return set
+	}
+	return nil
+}
+
+func mirrorLogger() (logger *log.Logger) {
+	mirrorSets.Lock()
+	defer mirrorSets.Unlock()
+	return mirrorSets.logger
+}
+
+func (set *MirrorSet) holds(endpoint string, bucket string) (holds bool) {
+	if len(set.Buckets) != 0 {
+		found := false
+		for _, name := range set.Buckets {
+			if name == bucket {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, m := range set.Mirrors {
+		if strings.EqualFold(m.Endpoint, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+func (set *MirrorSet) useSSL() (useSSL bool) {
+	if set == nil {
+		return false
+	}
+	for _, m := range set.Mirrors {
+		if m.UseSSL {
+			return true
+		}
+	}
+	return false
+}
+
+// breaker tracks the consecutive failures of a single endpoint
+type breaker struct {
+	endpoint   string
+	failures   int
+	cooldown   time.Duration
+	openUntil  time.Time
+	trialUntil time.Time // Set while the breaker is half open and a trial is in progress
+	sync.Mutex
+}
+
+func getBreaker(endpoint string) (b *breaker) {
+	endpointHealth.Lock()
+	defer endpointHealth.Unlock()
+
+	key := strings.ToLower(endpoint)
+	if b = endpointHealth.breakers[key]; b == nil {
+		b = &breaker{endpoint: key}
+		endpointHealth.breakers[key] = b
+		mirrorAvailable.WithLabelValues(key).Set(1)
+	}
+	return b
+}
+
+// available tests whether requests can be sent to the endpoint, either because the breaker is
+// closed or because the cooldown has passed and no other trial is in progress.  When a trial is
+// permitted the caller is expected to make it and so the breaker is moved to the half open state.
+//
+func (b *breaker) available(now time.Time) (available bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) || now.Before(b.trialUntil) {
+		return false
+	}
+	b.trialUntil = now.Add(breakerTrialTimeout)
+	return true
+}
+
+// failure records a failed request and returns true when the breaker was opened as a result
+//
+func (b *breaker) failure(now time.Time) (opened bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	switch {
+	case b.failures < breakerThreshold:
+		return false
+	case b.failures == breakerThreshold:
+		b.cooldown = breakerCooldown
+	case b.trialUntil.IsZero():
+		// Requests that were already running when the breaker opened
+		return false
+	default:
+		// The trial made after the cooldown failed
+		if b.cooldown *= 2; b.cooldown > breakerMaxCooldown {
+			b.cooldown = breakerMaxCooldown
+		}
+	}
+	b.openUntil = now.Add(b.cooldown)
+	b.trialUntil = time.Time{}
+	mirrorAvailable.WithLabelValues(b.endpoint).Set(0)
+	return true
+}
+
+func (b *breaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trialUntil = time.Time{}
+	if b.failures != 0 {
+		b.failures = 0
+		mirrorAvailable.WithLabelValues(b.endpoint).Set(1)
+	}
+}
+
+// isEndpointFailure tests whether an error indicates that the endpoint is unhealthy, rather than
+// there being a problem with the request or the object, these being network errors and server
+// side errors
+//
+func isEndpointFailure(ctx context.Context, errGo error) (failed bool) {
+	if errGo == nil || ctx.Err() != nil {
+		return false
+	}
+	resp := minio.ToErrorResponse(errGo)
+	if resp.StatusCode == 0 {
+		// No response was received from the endpoint
+		return len(resp.Code) == 0
+	}
+	return resp.StatusCode >= 500
+}
+
+// useMirror switches the client to a member of the mirror set
+//
+func (s *s3Storage) useMirror(i int) (err kv.Error) {
+	m := s.mirrors.Mirrors[i]
+
+	creds := s.artCreds
+	if m.Creds != nil {
+		creds = m.Creds
+	}
+	s.endpoint = m.Endpoint
+	s.useSSL = s.mirrorSSL(m)
+	s.creds = creds.Clone()
+
+	if err = s.setRegion(s.env); err != nil {
+		return err.With("mirror_set", s.mirrors.Name)
+	}
+	if err = s.refreshClients(); err != nil {
+		return err.With("mirror_set", s.mirrors.Name)
+	}
+	s.current = i
+	return nil
+}
+
+// mirrorSSL returns true when the member of the mirror set is accessed using TLS
+//
+func (s *s3Storage) mirrorSSL(m Mirror) (useSSL bool) {
+	return m.UseSSL || s.forceSSL || (s.artSSL && strings.EqualFold(m.Endpoint, s.artEndpoint))
+}
+
+// firstMirror returns the first member of the mirror set that is available
+//
+func (s *s3Storage) firstMirror() (i int) {
+	now := time.Now()
+	for i, m := range s.mirrors.Mirrors {
+		if getBreaker(m.Endpoint).available(now) {
+			return i
+		}
+	}
+	return 0
+}
+
+// usePrimary switches the client to the primary of the mirror set, which is used for all writes
+//
+func (s *s3Storage) usePrimary() (err kv.Error) {
+	if s.mirrors == nil || s.current == 0 {
+		return nil
+	}
+	return s.useMirror(0)
+}
+
+// succeeded records a successful request to the current endpoint of a mirror set
+//
+func (s *s3Storage) succeeded() {
+	if s.mirrors == nil {
+		return
+	}
+	getBreaker(s.mirrors.Mirrors[s.current].Endpoint).success()
+}
+
+// failed records a failed request to the current endpoint of a mirror set, returning true when
+// the error indicates the endpoint is unhealthy
+//
+func (s *s3Storage) failed(ctx context.Context, errGo error) (unhealthy bool) {
+	if s.mirrors == nil || !isEndpointFailure(ctx, errGo) {
+		return false
+	}
+	endpoint := s.mirrors.Mirrors[s.current].Endpoint
+	if getBreaker(endpoint).failure(time.Now()) {
+		if logger := mirrorLogger(); logger != nil {
+			logger.Warn("storage endpoint unavailable", "endpoint", endpoint, "mirror_set", s.mirrors.Name, "error", errGo.Error())
+		}
+	}
+	return true
+}
+
+// failover records a failed read and, when the error indicates the current endpoint is unhealthy,
+// switches the client to the next available member of the mirror set.  True is returned when
+// the client was switched and the read can be retried immediately.
+//
+func (s *s3Storage) failover(ctx context.Context, errGo error) (switched bool) {
+	if !s.failed(ctx, errGo) || len(s.mirrors.Mirrors) < 2 {
+		return false
+	}
+
+	from := s.mirrors.Mirrors[s.current].Endpoint
+	now := time.Now()
+	for i := 1; i < len(s.mirrors.Mirrors); i++ {
+		next := (s.current + i) % len(s.mirrors.Mirrors)
+		if !getBreaker(s.mirrors.Mirrors[next].Endpoint).available(now) {
+			continue
+		}
+		if err := s.useMirror(next); err != nil {
+			continue
+		}
+		to := s.mirrors.Mirrors[next].Endpoint
+		mirrorFailovers.WithLabelValues(from, to).Inc()
+		if logger := mirrorLogger(); logger != nil {
+			logger.Info("storage reads failed over", "from", from, "to", to, "mirror_set", s.mirrors.Name, "bucket", s.bucket)
+		}
+		return true
+	}
+	return false
+}
+
+// replication holds what is needed to copy objects from the primary of a mirror set to the other
+// members.  It is taken from the storage client when the object is written so that the client can
+// continue to be used, and moved between members, while the replication is running.
+type replication struct {
+	mirrors *MirrorSet
+	bucket  string
+	source  *minio.Client // The client for the primary
+	getOpts minio.GetObjectOptions
+
+	// The settings used to create clients for the other members, see useMirror
+	transport   *http.Transport
+	env         map[string]string
+	forceSSL    bool
+	artEndpoint string
+	artSSL      bool
+	artCreds    *request.AWSCredential
+	options     objectOptions
+}
+
+// replicate copies an object that was written to the primary to the other members of the mirror
+// set in the background, or when remove is true removes it from them
+//
+func (s *s3Storage) replicate(key string, remove bool) {
+	if s.mirrors == nil || !s.mirrors.Replicate || len(s.mirrors.Mirrors) < 2 {
+		return
+	}
+
+	r := &replication{
+		mirrors:     s.mirrors,
+		bucket:      s.bucket,
+		source:      s.client,
+		getOpts:     s.getOptions(),
+		transport:   s.transport,
+		env:         s.env,
+		forceSSL:    s.forceSSL,
+		artEndpoint: s.artEndpoint,
+		artSSL:      s.artSSL,
+		artCreds:    s.artCreds,
+		options:     s.options,
+	}
+	go r.run(key, remove)
+}
+
+func (r *replication) run(key string, remove bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+
+	for i := 1; i < len(r.mirrors.Mirrors); i++ {
+		endpoint := r.mirrors.Mirrors[i].Endpoint
+		if err := r.replicateTo(ctx, i, key, remove); err != nil {
+			mirrorReplications.WithLabelValues(endpoint, "failed").Inc()
+			if logger := mirrorLogger(); logger != nil {
+				logger.Warn("storage replication failed", "endpoint", endpoint, "mirror_set", r.mirrors.Name, "bucket", r.bucket, "key", key, "error", err.Error())
+			}
+			continue
+		}
+		mirrorReplications.WithLabelValues(endpoint, "success").Inc()
+	}
+}
+
+func (r *replication) replicateTo(ctx context.Context, i int, key string, remove bool) (err kv.Error) {
+	dst := &s3Storage{
+		bucket:      r.bucket,
+		transport:   r.transport,
+		mirrors:     r.mirrors,
+		env:         r.env,
+		forceSSL:    r.forceSSL,
+		artEndpoint: r.artEndpoint,
+		artSSL:      r.artSSL,
+		artCreds:    r.artCreds,
+		options:     r.options,
+	}
+	if err = dst.useMirror(i); err != nil {
+		return err
+	}
+
+	if remove {
+		if errGo := dst.client.RemoveObject(ctx, dst.bucket, key, minio.RemoveObjectOptions{}); errGo != nil {
+			dst.failed(ctx, errGo)
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		dst.succeeded()
+		return nil
+	}
+
+	obj, errGo := r.source.GetObject(ctx, r.bucket, key, r.getOpts)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer obj.Close()
+
+	info, errGo := obj.Stat()
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	xfer, err := transfer.Start(ctx, dst.endpoint, transfer.Upload)
+	if err != nil {
+		return err
+	}
+	defer xfer.Done()
+
+	// User metadata, such as the marking of sealed objects, is carried over to the mirrors along
+	// with the encryption, and other options, of the artifact
+	opts := dst.putOptions(info.ContentType, info.UserMetadata)
+	if _, errGo = dst.client.PutObject(ctx, dst.bucket, key, xfer.Reader(obj), info.Size, opts); errGo != nil {
+		dst.failed(ctx, errGo)
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	dst.succeeded()
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// Unit tests for mirror sets and the health tracking of their endpoints
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// TestMirrorBreaker checks that breakers open after consecutive failures, permit a trial once
+// the cooldown has passed, and back off when the trial fails
+//
+func TestMirrorBreaker(t *testing.T) {
+	b := getBreaker("breaker:9000")
+	now := time.Now()
+
+	for i := 0; i != breakerThreshold-1; i++ {
+		if b.failure(now) {
+			t.Fatal(kv.NewError("breaker opened early").With("failures", i+1).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	b.success()
+	for i := 0; i != breakerThreshold; i++ {
+		b.failure(now)
+	}
+	if b.available(now) {
+		t.Fatal(kv.NewError("breaker not opened").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Failures of requests that were running when the breaker opened do not extend the cooldown
+	if b.failure(now.Add(time.Second)) {
+		t.Fatal(kv.NewError("open breaker reopened").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	trial := now.Add(breakerCooldown)
+	if !b.available(trial) {
+		t.Fatal(kv.NewError("trial not permitted after the cooldown").With("stack", stack.Trace().TrimRuntime()))
+	}
+	// Only a single trial is admitted while the breaker is half open
+	if b.available(trial) || b.available(trial.Add(time.Second)) {
+		t.Fatal(kv.NewError("second trial permitted while half open").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !b.available(trial.Add(breakerTrialTimeout)) {
+		t.Fatal(kv.NewError("abandoned trial not replaced").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !b.failure(trial) || b.available(trial.Add(breakerCooldown)) || !b.available(trial.Add(2*breakerCooldown)) {
+		t.Fatal(kv.NewError("failed trial did not double the cooldown").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	b.success()
+	if !b.available(trial) {
+		t.Fatal(kv.NewError("breaker not closed by a success").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestMirrorFailover checks that clients start on the primary, fail over to healthy mirrors for
+// unhealthy endpoints only, and return to the primary for writes
+//
+func TestMirrorFailover(t *testing.T) {
+	set := MirrorSet{
+		Name:    "test",
+		Buckets: []string{"datasets"},
+		Mirrors: []Mirror{
+			{Endpoint: "failover-a:9000"},
+			{Endpoint: "failover-b:9000", Creds: &request.AWSCredential{AccessKey: "b", SecretKey: "b-secret"}},
+			{Endpoint: "failover-c:9000"},
+		},
+	}
+	SetMirrors([]MirrorSet{set}, nil)
+	defer SetMirrors(nil, nil)
+
+	ctx := context.Background()
+	creds := request.AWSCredential{AccessKey: "artifact", SecretKey: "artifact-secret"}
+
+	if s, err := NewS3storage(ctx, creds, map[string]string{}, "failover-c:9000", "other", "", false, false); err != nil {
+		t.Fatal(err)
+	} else if s.mirrors != nil {
+		t.Fatal(kv.NewError("mirror set used for a bucket outside of the set").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	s, err := NewS3storage(ctx, creds, map[string]string{}, "failover-c:9000", "datasets", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.endpoint != "failover-a:9000" || s.creds.AccessKey != "artifact" {
+		t.Fatal(kv.NewError("client not started on the primary").With("endpoint", s.endpoint).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Errors returned by a healthy endpoint are not failed over
+	if s.failover(ctx, minio.ErrorResponse{StatusCode: 404, Code: "NoSuchKey"}) {
+		t.Fatal(kv.NewError("missing object failed over").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if !s.failover(ctx, errors.New("connection refused")) {
+		t.Fatal(kv.NewError("network error not failed over").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if s.endpoint != "failover-b:9000" || s.creds.AccessKey != "b" {
+		t.Fatal(kv.NewError("mirror credentials not used").With("endpoint", s.endpoint).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Mirrors with open breakers are skipped
+	for i := 0; i != breakerThreshold; i++ {
+		getBreaker("failover-c:9000").failure(time.Now())
+	}
+	if !s.failover(ctx, minio.ErrorResponse{StatusCode: 503, Code: "SlowDown"}) || s.endpoint != "failover-a:9000" {
+		t.Fatal(kv.NewError("unavailable mirror not skipped").With("endpoint", s.endpoint).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if !s.failover(ctx, errors.New("connection refused")) || s.endpoint != "failover-b:9000" {
+		t.Fatal(kv.NewError("failover did not rotate").With("endpoint", s.endpoint).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = s.usePrimary(); err != nil {
+		t.Fatal(err)
+	}
+	if s.endpoint != "failover-a:9000" || s.current != 0 {
+		t.Fatal(kv.NewError("writes not sent to the primary").With("endpoint", s.endpoint).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains the handling of the options experimenters can specify for the objects
+// of an artifact, such as server side encryption, storage classes and object tags, that are
+// applied when objects are uploaded and, in the case of SSE-C keys, when they are fetched.
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// objectOptions holds the options that have been validated for use with the storage platform
+type objectOptions struct {
+	sse          encrypt.ServerSide
+	storageClass string
+	tags         map[string]string
+	metadata     map[string]string
+}
+
+// newSSE returns the server side encryption described by the artifact
+//
+func newSSE(sse *request.ServerSideEncryption) (result encrypt.ServerSide, err kv.Error) {
+	if sse == nil {
+		return nil, nil
+	}
+	switch strings.ToUpper(sse.Type) {
+	case "SSE-S3":
+		return encrypt.NewSSE(), nil
+	case "SSE-KMS":
+		result, errGo := encrypt.NewSSEKMS(sse.KMSKeyID, nil)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return result, nil
+	case "SSE-C":
+		key, errGo := base64.StdEncoding.DecodeString(sse.CustomerKey)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo, "SSE-C customer key is not valid Base64").With("stack", stack.Trace().TrimRuntime())
+		}
+		result, errGo := encrypt.NewSSEC(key)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return result, nil
+	default:
+		return nil, kv.NewError("server side encryption type unrecognized").With("type", sse.Type).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+// SetObjectOptions validates the options for the objects of an artifact and applies them to
+// the objects the storage uploads, and fetches.  Options that cannot be honored are reported as
+// errors so that objects are never uploaded without the encryption, or tags, that were asked for.
+//
+func (s *s3Storage) SetObjectOptions(opts *request.ObjectOptions) (err kv.Error) {
+	if opts == nil {
+		s.options = objectOptions{}
+		return nil
+	}
+
+	sse, err := newSSE(opts.SSE)
+	if err != nil {
+		return err.With("bucket", s.bucket)
+	}
+	if sse != nil && sse.Type() == encrypt.SSEC {
+		if err = s.checkSSECTransport(); err != nil {
+			return err
+		}
+	}
+	if _, errGo := tags.NewTags(opts.Tags, true); errGo != nil {
+		return kv.Wrap(errGo, "object tags invalid").With("bucket", s.bucket).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	s.options = objectOptions{
+		sse:          sse,
+		storageClass: opts.StorageClass,
+		tags:         opts.Tags,
+		metadata:     opts.Metadata,
+	}
+	return nil
+}
+
+// checkSSECTransport ensures that every endpoint the objects could be sent to, or read from, is
+// accessed using TLS.  SSE-C keys travel with each request and storage platforms refuse them over
+// plain http so the artifact is rejected up front rather than failing once the experiment is done.
+//
+func (s *s3Storage) checkSSECTransport() (err kv.Error) {
+	if !s.useSSL {
+		return kv.NewError("SSE-C requires the artifact endpoint to be accessed using TLS").With("endpoint", s.endpoint).With("bucket", s.bucket).With("stack", stack.Trace().TrimRuntime())
+	}
+	if s.mirrors == nil {
+		return nil
+	}
+	for _, m := range s.mirrors.Mirrors {
+		if !s.mirrorSSL(m) {
+			return kv.NewError("SSE-C requires every member of the mirror set to be accessed using TLS").With("mirror_set", s.mirrors.Name).With("endpoint", m.Endpoint).With("bucket", s.bucket).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// putOptions returns the options used for uploading an object, userMeta is merged with the
+// metadata requested for the artifact and takes precedence
+//
+func (s *s3Storage) putOptions(contentType string, userMeta map[string]string) (opts minio.PutObjectOptions) {
+	meta := make(map[string]string, len(s.options.metadata)+len(userMeta))
+	for k, v := range s.options.metadata {
+		meta[k] = v
+	}
+	for k, v := range userMeta {
+		meta[k] = v
+	}
+
+	return minio.PutObjectOptions{
+		ContentType:          contentType,
+		UserMetadata:         meta,
+		UserTags:             s.options.tags,
+		ServerSideEncryption: s.options.sse,
+		StorageClass:         s.options.storageClass,
+	}
+}
+
+// getOptions returns the options used for reading an object, only SSE-C encryption
+// needs the key to be supplied when reading
+//
+func (s *s3Storage) getOptions() (opts minio.GetObjectOptions) {
+	if s.options.sse != nil && s.options.sse.Type() == encrypt.SSEC {
+		opts.ServerSideEncryption = s.options.sse
+	}
+	return opts
+}
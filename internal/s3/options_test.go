@@ -0,0 +1,89 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// Unit tests for the options applied to the objects of artifacts
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// TestObjectOptions checks that artifact options are validated, applied to uploads, and that
+// only SSE-C keys are supplied when reading objects
+//
+func TestObjectOptions(t *testing.T) {
+	s := &s3Storage{bucket: "results", useSSL: true}
+
+	customerKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	invalid := map[string]*request.ObjectOptions{
+		"type":     {SSE: &request.ServerSideEncryption{Type: "SSE-X"}},
+		"key size": {SSE: &request.ServerSideEncryption{Type: "SSE-C", CustomerKey: base64.StdEncoding.EncodeToString(make([]byte, 16))}},
+		"key":      {SSE: &request.ServerSideEncryption{Type: "SSE-C", CustomerKey: "not base64!"}},
+		"tags":     {Tags: map[string]string{"": "empty"}},
+	}
+	for name, opts := range invalid {
+		if err := s.SetObjectOptions(opts); err == nil {
+			t.Fatal(kv.NewError("invalid options accepted").With("case", name).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	for sseType, expected := range map[string]encrypt.Type{"sse-s3": encrypt.S3, "SSE-KMS": encrypt.KMS, "SSE-C": encrypt.SSEC} {
+		opts := &request.ObjectOptions{
+			SSE:          &request.ServerSideEncryption{Type: sseType, KMSKeyID: "arn:aws:kms:us-west-2:1:key/1", CustomerKey: customerKey},
+			StorageClass: "STANDARD_IA",
+			Tags:         map[string]string{"retention": "90d"},
+			Metadata:     map[string]string{"Owner": "experimenter", "Studioml-Sealed": "replaced"},
+		}
+		if err := s.SetObjectOptions(opts); err != nil {
+			t.Fatal(err)
+		}
+
+		put := s.putOptions("application/octet-stream", map[string]string{"Studioml-Sealed": "studioml-sealed-v1"})
+		if put.ServerSideEncryption == nil || put.ServerSideEncryption.Type() != expected {
+			t.Fatal(kv.NewError("encryption not applied to uploads").With("type", sseType).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if put.StorageClass != "STANDARD_IA" || put.UserTags["retention"] != "90d" || put.UserMetadata["Owner"] != "experimenter" {
+			t.Fatal(kv.NewError("options not applied to uploads").With("type", sseType).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if put.UserMetadata["Studioml-Sealed"] != "studioml-sealed-v1" {
+			t.Fatal(kv.NewError("runner metadata replaced").With("type", sseType).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		get := s.getOptions()
+		if (get.ServerSideEncryption != nil) != (expected == encrypt.SSEC) {
+			t.Fatal(kv.NewError("read encryption options incorrect").With("type", sseType).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// SSE-C keys cannot be sent to endpoints, including mirrors, that are accessed without TLS
+	sseC := &request.ObjectOptions{SSE: &request.ServerSideEncryption{Type: "SSE-C", CustomerKey: customerKey}}
+	plain := &s3Storage{bucket: "results", endpoint: "minio:9000"}
+	if err := plain.SetObjectOptions(sseC); err == nil {
+		t.Fatal(kv.NewError("SSE-C accepted without TLS").With("stack", stack.Trace().TrimRuntime()))
+	}
+	mirrored := &s3Storage{bucket: "results", endpoint: "primary:9000", useSSL: true, artSSL: true, artEndpoint: "primary:9000",
+		mirrors: &MirrorSet{Name: "test", Mirrors: []Mirror{{Endpoint: "primary:9000"}, {Endpoint: "fallback:9000"}}}}
+	if err := mirrored.SetObjectOptions(sseC); err == nil {
+		t.Fatal(kv.NewError("SSE-C accepted with a mirror accessed without TLS").With("stack", stack.Trace().TrimRuntime()))
+	}
+	mirrored.mirrors.Mirrors[1].UseSSL = true
+	if err := mirrored.SetObjectOptions(sseC); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetObjectOptions(nil); err != nil {
+		t.Fatal(err)
+	}
+	if put := s.putOptions("application/octet-stream", nil); put.ServerSideEncryption != nil || len(put.UserTags) != 0 {
+		t.Fatal(kv.NewError("options not cleared").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains the implementation of functions for storing and retrieving small
+// in-memory payloads, such as queue messages that are too large for the queue itself
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+type bytesSrcProvider struct {
+	name    string
+	payload []byte
+}
+
+func (bp *bytesSrcProvider) getSource() (io.ReadCloser, int64, string, kv.Error) {
+	return ioutil.NopCloser(bytes.NewReader(bp.payload)), int64(len(bp.payload)), bp.name, nil
+}
+
+// GetPayload retrieves the contents of the named object into memory, objects larger than
+// maxBytes are rejected
+//
+func (s *s3Storage) GetPayload(ctx context.Context, key string, maxBytes int64) (payload []byte, err kv.Error) {
+	obj, size, err := s.retryGetObject(ctx, key, s.getOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	if maxBytes > 0 && size > maxBytes {
+		return nil, kv.NewError("object too large").With("size", size, "max_bytes", maxBytes, "bucket", s.bucket, "key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	payload, errGo := ioutil.ReadAll(io.LimitReader(obj, size+1))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("bucket", s.bucket, "key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	if int64(len(payload)) != size {
+		return nil, kv.NewError("object size mismatch").With("size", size, "read", len(payload), "bucket", s.bucket, "key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return payload, nil
+}
+
+// PutPayload stores an in-memory payload as the named object
+//
+func (s *s3Storage) PutPayload(ctx context.Context, key string, payload []byte) (err kv.Error) {
+	return s.retryPutObject(ctx, &bytesSrcProvider{name: key, payload: payload}, key, nil)
+}
+
+// Remove deletes the named object
+//
+func (s *s3Storage) Remove(ctx context.Context, key string) (err kv.Error) {
+	// Writes always go to the primary of a mirror set
+	if err = s.usePrimary(); err != nil {
+		return err.With("bucket", s.bucket, "key", key)
+	}
+
+	var errGo error
+	tries := numRetries
+	for tries > 0 {
+		if errGo = s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); errGo == nil {
+			s.succeeded()
+			s.replicate(key, true)
+			return nil
+		}
+		s.failed(ctx, errGo)
+		if !isAccessDenied(errGo) {
+			break
+		}
+		s.waitAndRefreshClient()
+		tries -= 1
+	}
+	return kv.Wrap(errGo).With("bucket", s.bucket, "key", key).With("stack", stack.Trace().TrimRuntime())
+}
@@ -11,6 +11,7 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -31,6 +32,7 @@ import (
 
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/transfer"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -50,6 +52,10 @@ var (
 var (
 	numRetries = 6
 	retryWait  = 3 * time.Second
+
+	// uploadAllowance is the time allowed for uploads, and their retries, beyond any time needed
+	// to stay within bandwidth limits
+	uploadAllowance = 10 * time.Minute
 )
 
 // StorageImpl is a type that describes the implementation of an S3 storage entity
@@ -63,6 +69,22 @@ type s3Storage struct {
 	creds     *request.AWSCredential
 	transport *http.Transport
 	client    *minio.Client
+
+	// Mirror sets replace the endpoint and credentials of the artifact with those of the
+	// member of the set currently in use
+	mirrors     *MirrorSet
+	current     int
+	env         map[string]string
+	forceSSL    bool
+	artEndpoint string
+	artSSL      bool
+	artCreds    *request.AWSCredential
+
+	// When present deposited archives are sealed using this public key
+	sealKey *rsa.PublicKey
+
+	// Options applied to the objects of the artifact, see options.go
+	options objectOptions
 }
 
 func (s *s3Storage) setRegion(env map[string]string) (err kv.Error) {
@@ -112,7 +134,7 @@ func (s *s3Storage) refreshClients() (err kv.Error) {
 	}
 	// Using the BucketLookupPath strategy to avoid using DNS lookups for the buckets first
 	options := minio.Options{
-		Creds:        credentials.NewStaticV4(s.creds.AccessKey, s.creds.SecretKey, ""),
+		Creds:        credentials.NewStaticV4(s.creds.AccessKey, s.creds.SecretKey, s.creds.Session),
 		Secure:       s.useSSL,
 		Region:       s.creds.Region,
 		BucketLookup: minio.BucketLookupPath,
@@ -139,6 +161,12 @@ func NewS3storage(ctx context.Context, creds request.AWSCredential, env map[stri
 		key:      key,
 		useSSL:   useSSL,
 		creds:    creds.Clone(),
+
+		mirrors:     findMirrors(endpoint, bucket),
+		env:         env,
+		artEndpoint: endpoint,
+		artSSL:      useSSL,
+		artCreds:    creds.Clone(),
 	}
 
 	if err = s.setRegion(env); err != nil {
@@ -176,6 +204,7 @@ func NewS3storage(ctx context.Context, creds request.AWSCredential, env map[stri
 			return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
 		s.useSSL = true
+		s.forceSSL = true
 	}
 
 	if len(*s3CA) != 0 {
@@ -194,9 +223,10 @@ func NewS3storage(ctx context.Context, creds request.AWSCredential, env map[stri
 			return nil, kv.NewError("PEM, or Certificate file was empty, PEM data is needed when the file name is specified")
 		}
 		s.useSSL = true
+		s.forceSSL = true
 	}
 
-	if s.useSSL {
+	if s.useSSL || s.mirrors.useSSL() {
 		caCerts := &x509.CertPool{}
 
 		if len(*s3CA) != 0 {
@@ -219,6 +249,14 @@ func NewS3storage(ctx context.Context, creds request.AWSCredential, env map[stri
 		}
 	}
 
+	if s.mirrors != nil {
+		// Start with the first member of the mirror set that is healthy
+		if err = s.useMirror(s.firstMirror()); err != nil {
+			return nil, err.With("stack", stack.Trace().TrimRuntime())
+		}
+		return s, nil
+	}
+
 	if err = s.refreshClients(); err != nil {
 		return nil, err.With("stack", stack.Trace().TrimRuntime())
 	}
@@ -263,6 +301,7 @@ func (s *s3Storage) retryGetObject(ctx context.Context, objectName string, opts
 		if errGo == nil {
 			stat, errGoStat := obj.Stat()
 			if errGoStat == nil {
+				s.succeeded()
 				return obj, stat.Size, nil
 			}
 			errGo = errGoStat
@@ -270,8 +309,11 @@ func (s *s3Storage) retryGetObject(ctx context.Context, objectName string, opts
 		fmt.Printf(">>>>>>>> retryGetObject ERROR %s/%s [%s]\n", s.bucket, objectName, errGo.Error())
 
 		if isAccessDenied(errGo) {
-			// Possible AWS credentials rotation, reset client and retry:
-			s.waitAndRefreshClient()
+			// Possible AWS credentials rotation, or an unhealthy endpoint, use a healthy
+			// mirror, or reset client, and retry:
+			if !s.failover(ctx, errGo) {
+				s.waitAndRefreshClient()
+			}
 			tries -= 1
 		} else {
 			return nil, 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
@@ -284,7 +326,7 @@ type SrcProvider interface {
 	getSource() (io.ReadCloser, int64, string, kv.Error)
 }
 
-func (s *s3Storage) retryPutObject(ctx context.Context, sp SrcProvider, dest string) (err kv.Error) {
+func (s *s3Storage) retryPutObject(ctx context.Context, sp SrcProvider, dest string, userMeta map[string]string) (err kv.Error) {
 	src, srcSize, srcName, err := sp.getSource()
 
 	defer func() {
@@ -300,16 +342,22 @@ func (s *s3Storage) retryPutObject(ctx context.Context, sp SrcProvider, dest str
 		return kv.NewError("upload context cancelled").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	// Writes always go to the primary of a mirror set
+	if err = s.usePrimary(); err != nil {
+		return err
+	}
+
 	var errGo error
 	tries := numRetries
 	for tries > 0 {
-		_, errGo = s.client.PutObject(ctx, s.bucket, dest, src, srcSize, minio.PutObjectOptions{
-			ContentType: "application/octet-stream",
-		})
+		_, errGo = s.client.PutObject(ctx, s.bucket, dest, src, srcSize, s.putOptions("application/octet-stream", userMeta))
 
 		if errGo == nil {
+			s.succeeded()
+			s.replicate(dest, false)
 			return nil
 		}
+		s.failed(ctx, errGo)
 
 		if isAccessDenied(errGo) {
 			// Possible AWS credentials rotation, reset client and retry:
@@ -352,19 +400,56 @@ func (s *s3Storage) Hash(ctx context.Context, name string) (hash string, err kv.
 	var errGo error
 	tries := numRetries
 	for tries > 0 {
-		info, errGo := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
-		if errGo == nil {
+		info, errStat := s.client.StatObject(ctx, s.bucket, key, s.getOptions())
+		if errGo = errStat; errGo == nil {
+			s.succeeded()
 			return info.ETag, nil
 		}
 		if !isAccessDenied(errGo) {
 			return "", kv.Wrap(errGo)
 		}
-		s.waitAndRefreshClient()
+		if !s.failover(ctx, errGo) {
+			s.waitAndRefreshClient()
+		}
 		tries -= 1
 	}
 	return "", kv.Wrap(errGo)
 }
 
+// Size returns the size of the stored object without retrieving it, this can be used to check
+// the space needed for an object before it is downloaded
+//
+func (s *s3Storage) Size(ctx context.Context, name string) (size int64, err kv.Error) {
+	key := name
+	if len(key) == 0 {
+		key = s.key
+	}
+
+	defer func() {
+		if err != nil {
+			err = err.With("bucket", s.bucket).With("name", name)
+		}
+	}()
+
+	var errGo error
+	tries := numRetries
+	for tries > 0 {
+		info, errStat := s.client.StatObject(ctx, s.bucket, key, s.getOptions())
+		if errGo = errStat; errGo == nil {
+			s.succeeded()
+			return info.Size, nil
+		}
+		if !isAccessDenied(errGo) {
+			return 0, kv.Wrap(errGo)
+		}
+		if !s.failover(ctx, errGo) {
+			s.waitAndRefreshClient()
+		}
+		tries -= 1
+	}
+	return 0, kv.Wrap(errGo)
+}
+
 func (s *s3Storage) ListObjects(ctx context.Context, keyPrefix string) (names []string, warnings []kv.Error, err kv.Error) {
 	// Create a done context to control 'ListObjects' go routine.
 	doneCtx, cancel := context.WithCancel(ctx)
@@ -376,7 +461,7 @@ func (s *s3Storage) ListObjects(ctx context.Context, keyPrefix string) (names []
 	return names, nil, err
 }
 
-func (s *s3Storage) retryListObjectsOnce(ctx context.Context, keyPrefix string) (names []string, err kv.Error, retry bool) {
+func (s *s3Storage) retryListObjectsOnce(ctx context.Context, keyPrefix string) (names []string, errGo error, retry bool) {
 	names = []string{}
 
 	opts := minio.ListObjectsOptions{
@@ -387,14 +472,11 @@ func (s *s3Storage) retryListObjectsOnce(ctx context.Context, keyPrefix string)
 	objectCh := s.client.ListObjects(ctx, s.bucket, opts)
 	for object := range objectCh {
 		if object.Err != nil {
-			if isAccessDenied(object.Err) {
-				return names, kv.Wrap(object.Err), true
-			}
-			return names, kv.Wrap(object.Err).With("stack", stack.Trace().TrimRuntime()),
-				false
+			return names, object.Err, isAccessDenied(object.Err)
 		}
 		names = append(names, object.Key)
 	}
+	s.succeeded()
 	return names, nil, false
 }
 
@@ -406,17 +488,24 @@ func (s *s3Storage) retryListObjects(ctx context.Context, keyPrefix string) (nam
 		}
 	}()
 
+	var errGo error
 	tries := numRetries
 	for tries > 0 {
-		names, err, retry := s.retryListObjectsOnce(ctx, keyPrefix)
+		names, errList, retry := s.retryListObjectsOnce(ctx, keyPrefix)
+		if errGo = errList; errGo == nil {
+			return names, nil
+		}
 		if !retry {
-			return names, err
+			return names, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		// Possible AWS credentials rotation, or an unhealthy endpoint, use a healthy
+		// mirror, or reset client and retry:
+		if !s.failover(ctx, errGo) {
+			s.waitAndRefreshClient()
 		}
-		// Possible AWS credentials rotation, reset client and retry:
-		s.waitAndRefreshClient()
 		tries -= 1
 	}
-	return names, err
+	return names, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 }
 
 // Gather is used to retrieve files prefixed with a specific key.
@@ -455,7 +544,7 @@ func (s *s3Storage) Gather(ctx context.Context, keyPrefix string, outputDir stri
 }
 
 func (s *s3Storage) getObject(ctx context.Context, key string, maxBytes int64, errCtx kv.List) (obj *minio.Object, err kv.Error) {
-	obj, size, err := s.retryGetObject(ctx, key, minio.GetObjectOptions{})
+	obj, size, err := s.retryGetObject(ctx, key, s.getOptions())
 	if err != nil {
 		return nil, err.With("stack", stack.Trace().TrimRuntime())
 	}
@@ -464,21 +553,60 @@ func (s *s3Storage) getObject(ctx context.Context, key string, maxBytes int64, e
 	// blow the disk space budget assigned to it.  Doing this saves downloading the file
 	// if there is an honest issue.
 	if size > maxBytes {
+		obj.Close()
 		return nil, errCtx.NewError("blob size exceeded").With("size", humanize.Bytes(uint64(size)), "budget", humanize.Bytes(uint64(maxBytes))).With("stack", stack.Trace().TrimRuntime())
 	}
 	return obj, nil
 }
 
+// objectReader returns a reader for the contents of an object, limited to the bandwidth available
+// for the transfer, that decrypts objects that were sealed when they were deposited
+//
+func objectReader(obj *minio.Object, xfer *transfer.Transfer, errCtx kv.List) (in io.Reader, err kv.Error) {
+	in = xfer.Reader(obj)
+
+	// The information about the object was retrieved by getObject
+	info, errGo := obj.Stat()
+	if errGo != nil {
+		return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if sealed, keyID := isSealed(info); sealed {
+		if in, err = unseal(in, keyID); err != nil {
+			return nil, errCtx.Wrap(err)
+		}
+	}
+	return in, nil
+}
+
 func (s *s3Storage) fetchSideCopy(ctx context.Context, key string, maxBytes int64, tap io.Writer) (size int64, warns []kv.Error, err kv.Error) {
 	errCtx := kv.With("name", key).With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint)
 
+	xfer, err := transfer.Start(ctx, s.endpoint, transfer.Download)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer xfer.Done()
+
 	obj, err := s.getObject(ctx, key, maxBytes, errCtx)
 	if err != nil {
 		return 0, warns, err
 	}
 	defer obj.Close()
 
-	size, errGo := io.CopyN(tap, obj, maxBytes)
+	// Side copies are used to place objects into the artifact cache, sealed objects are copied
+	// as they are stored so that the cache does not hold their decrypted contents, and the tap
+	// told so that the cache can decrypt them when they are copied out of it
+	if marker, isMarker := tap.(SealedTap); isMarker {
+		info, errGo := obj.Stat()
+		if errGo != nil {
+			return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		if sealed, _ := isSealed(info); sealed {
+			marker.MarkSealed()
+		}
+	}
+
+	size, errGo := io.CopyN(tap, xfer.Reader(obj), maxBytes)
 	if errGo != nil {
 		if !errors.Is(errGo, io.EOF) {
 			return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
@@ -520,12 +648,25 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 		return 0, warns, errCtx.NewError("a directory was not used, or did not exist").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	xfer, err := transfer.Start(ctx, s.endpoint, transfer.Download)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer xfer.Done()
+
 	obj, err := s.getObject(ctx, key, maxBytes, errCtx)
 	if err != nil {
 		return 0, warns, err
 	}
 	defer obj.Close()
 
+	// Reads from the object are limited to the bandwidth available for the endpoint, and
+	// decrypted when the object was sealed
+	in, err := objectReader(obj, xfer, errCtx)
+	if err != nil {
+		return 0, warns, err
+	}
+
 	fileType, w := mime.MimeFromExt(name)
 	if w != nil {
 		warns = append(warns, w)
@@ -543,9 +684,9 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 				// the tap being able to send data to things like caches etc
 				//
 				// Second in the stack of readers after the TAP is a decompression reader
-				inReader, errGo = gzip.NewReader(io.TeeReader(obj, tap))
+				inReader, errGo = gzip.NewReader(io.TeeReader(in, tap))
 			} else {
-				inReader, errGo = gzip.NewReader(obj)
+				inReader, errGo = gzip.NewReader(in)
 			}
 		case "application/bzip2", "application/octet-stream":
 			if tap != nil {
@@ -553,9 +694,9 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 				// the tap being able to send data to things like caches etc
 				//
 				// Second in the stack of readers after the TAP is a decompression reader
-				inReader = ioutil.NopCloser(bzip2.NewReader(io.TeeReader(obj, tap)))
+				inReader = ioutil.NopCloser(bzip2.NewReader(io.TeeReader(in, tap)))
 			} else {
-				inReader = ioutil.NopCloser(bzip2.NewReader(obj))
+				inReader = ioutil.NopCloser(bzip2.NewReader(in))
 			}
 		default:
 			if tap != nil {
@@ -563,9 +704,9 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 				// the tap being able to send data to things like caches etc
 				//
 				// Second in the stack of readers after the TAP is a decompression reader
-				inReader = ioutil.NopCloser(io.TeeReader(obj, tap))
+				inReader = ioutil.NopCloser(io.TeeReader(in, tap))
 			} else {
-				inReader = ioutil.NopCloser(obj)
+				inReader = ioutil.NopCloser(in)
 			}
 		}
 		if errGo != nil {
@@ -663,7 +804,7 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 			// the tap being able to send data to things like caches etc
 			//
 			// Second in the stack of readers after the TAP is a decompression reader
-			size, errGo = io.CopyN(outf, io.TeeReader(obj, tap), maxBytes)
+			size, errGo = io.CopyN(outf, io.TeeReader(in, tap), maxBytes)
 			if errGo != nil {
 				if !errors.Is(errGo, io.EOF) {
 					return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -671,7 +812,7 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 				errGo = nil
 			}
 		} else {
-			size, errGo = io.CopyN(outf, obj, maxBytes)
+			size, errGo = io.CopyN(outf, in, maxBytes)
 			if errGo != nil {
 				if !errors.Is(errGo, io.EOF) {
 					return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -700,10 +841,27 @@ func (fp *FileSrcProvider) getSource() (io.ReadCloser, int64, string, kv.Error)
 	return file, fileStat.Size(), fp.Name, nil
 }
 
+// transferSrcProvider limits the bandwidth used when reading the sources of another provider
+type transferSrcProvider struct {
+	sp   SrcProvider
+	xfer *transfer.Transfer
+}
+
+func (tp *transferSrcProvider) getSource() (io.ReadCloser, int64, string, kv.Error) {
+	src, size, name, err := tp.sp.getSource()
+	if src == nil {
+		return src, size, name, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tp.xfer.Reader(src), src}, size, name, err
+}
+
 // uploadFile can be used to transmit a file to the S3 server using a fully qualified file
 // name and key
 //
-func (s *s3Storage) uploadFile(ctx context.Context, src string, dest string) (err kv.Error) {
+func (s *s3Storage) uploadFile(ctx context.Context, src string, dest string, userMeta map[string]string) (err kv.Error) {
 	if ctx.Err() != nil {
 		return kv.NewError("upload context cancelled").With("stack", stack.Trace().TrimRuntime()).With("src", src, "bucket", s.bucket, "key", dest)
 	}
@@ -712,13 +870,41 @@ func (s *s3Storage) uploadFile(ctx context.Context, src string, dest string) (er
 		Name: filepath.Clean(src),
 	}
 
-	uploadCtx, cancel := context.WithDeadline(ctx, time.Now().Add(10*time.Minute))
-	defer cancel()
+	// Writes always go to the primary of a mirror set
+	if err = s.usePrimary(); err != nil {
+		return err.With("src", src, "bucket", s.bucket, "key", dest)
+	}
+
+	// The deadline for the upload starts once the upload is permitted to start
+	xfer, err := transfer.Start(ctx, s.endpoint, transfer.Upload)
+	if err != nil {
+		return err.With("src", src, "bucket", s.bucket, "key", dest)
+	}
+	defer xfer.Done()
+
+	// Uploads are allowed the time needed for their share of any bandwidth limits in addition to
+	// the usual allowance.  When the share cannot be determined the upload is left to the ctx.
+	uploadCtx := ctx
+	if throttled, bounded := xfer.Duration(fileSize(fileSrc.Name)); bounded {
+		var cancel context.CancelFunc
+		uploadCtx, cancel = context.WithTimeout(ctx, uploadAllowance+throttled)
+		defer cancel()
+	}
 
-	err = s.retryPutObject(uploadCtx, fileSrc, dest)
+	err = s.retryPutObject(uploadCtx, &transferSrcProvider{sp: fileSrc, xfer: xfer}, dest, userMeta)
 	return err
 }
 
+// fileSize returns the size of a file, or zero if it cannot be determined
+//
+func fileSize(fn string) (size int64) {
+	info, errGo := os.Stat(fn)
+	if errGo != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 // Return directories as compressed artifacts to the AWS storage for an
 // experiment
 //
@@ -750,23 +936,37 @@ func (s *s3Storage) Deposit(ctx context.Context, src string, dest string) (warns
 	}
 	tfName := tf.Name()
 
-	err = tarFileWriter(tf, files, dest)
-	if err != nil {
-		return warns, err
-	}
-
 	defer func() {
 		os.Remove(tfName)
 	}()
 
+	// Sealed archives are encrypted as they are written and marked as sealed using metadata
+	var out io.WriteCloser = tf
+	userMeta := map[string]string{}
+	if s.sealKey != nil {
+		sealed, keyID, err := defense.NewSealWriter(tf, s.sealKey)
+		if err != nil {
+			tf.Close()
+			return warns, err.With("src", src, "dest", dest)
+		}
+		out = sealed
+		userMeta[sealedMeta] = defense.SealedFormat
+		userMeta[sealedKeyMeta] = keyID
+	}
+
+	err = tarFileWriter(out, files, dest)
+	if err != nil {
+		return warns, err
+	}
+
 	// "tf" is closed by now
 	uploadCtx := context.Background()
-	err = s.uploadFile(uploadCtx, tfName, dest)
+	err = s.uploadFile(uploadCtx, tfName, dest, userMeta)
 
 	return warns, err
 }
 
-func tarFileWriter(pw *os.File, files *archive.TarWriter, dest string) (err kv.Error) {
+func tarFileWriter(pw io.WriteCloser, files *archive.TarWriter, dest string) (err kv.Error) {
 	err = nil
 
 	defer func() {
@@ -781,7 +981,10 @@ func tarFileWriter(pw *os.File, files *archive.TarWriter, dest string) (err kv.E
 				err = kv.NewError(fmt.Sprint(r)).With("stack", stack.Trace().TrimRuntime())
 			}
 		}
-		pw.Close()
+		// Sealed archives write their final chunk when closed
+		if errGo := pw.Close(); errGo != nil && err == nil {
+			err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
 	}()
 
 	typ, _ := mime.MimeFromExt(dest)
@@ -0,0 +1,129 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains the handling of archives that are encrypted on the client side, by the
+// runner, before being deposited so that they cannot be read by those administering the storage.
+// Archives are written as sealed streams, see defense/stream_crypto.go, and are marked using
+// user metadata on the object so that they can be decrypted when fetched by a runner that holds
+// the private key.
+//
+// Archives are sealed using the public key of the response queue, whose private key is held by
+// the experimenter.  Runners only hold the private keys mounted for decrypting requests, so a
+// runner can only read sealed archives when the response queue private key has been added to
+// those keys by the administrator.
+//
+// Sealed objects are placed into the artifact cache as they are stored, encrypted, and are only
+// decrypted when they are copied out of the cache into an experiment, see UnsealStream.  The cache
+// learns that an object was sealed using a SealedTap.
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// sealedMeta is the user metadata naming the format of a sealed object
+	sealedMeta = "Studioml-Sealed"
+
+	// sealedKeyMeta is the user metadata holding the identifier of the public key a sealed object
+	// was sealed with
+	sealedKeyMeta = "Studioml-Key-Id"
+)
+
+// SealedTap is implemented by the taps that receive side copies of objects, such as those used
+// to place objects into the artifact cache, that need to know which objects were sealed when
+// they were deposited
+type SealedTap interface {
+	io.Writer
+
+	// MarkSealed is called before the sealed contents of an object are written to the tap
+	MarkSealed()
+}
+
+var (
+	unsealKeys = struct {
+		w *defense.Wrapper
+		sync.Mutex
+	}{}
+)
+
+// SetUnsealKeys supplies the wrapper holding the private keys used to decrypt sealed objects
+// when they are fetched, nil prevents sealed objects from being fetched
+//
+func SetUnsealKeys(w *defense.Wrapper) {
+	unsealKeys.Lock()
+	defer unsealKeys.Unlock()
+	unsealKeys.w = w
+}
+
+// SealDeposits causes archives deposited using the storage to be encrypted with a data key that
+// is sealed using the public key, nil deposits archives in clear text
+//
+func (s *s3Storage) SealDeposits(pub *rsa.PublicKey) {
+	s.sealKey = pub
+}
+
+// isSealed tests the user metadata of an object to see if it was sealed
+//
+func isSealed(info minio.ObjectInfo) (sealed bool, keyID string) {
+	for k, v := range info.UserMetadata {
+		switch {
+		case strings.EqualFold(k, sealedMeta):
+			sealed = len(v) != 0
+		case strings.EqualFold(k, sealedKeyMeta):
+			keyID = v
+		}
+	}
+	return sealed, keyID
+}
+
+// unseal returns a reader of the decrypted contents of a sealed object
+//
+func unseal(in io.Reader, keyID string) (clear io.Reader, err kv.Error) {
+	unsealKeys.Lock()
+	w := unsealKeys.w
+	unsealKeys.Unlock()
+
+	if !w.HasKey(keyID) {
+		return nil, kv.NewError("the key for a sealed object is not held by the runner, the response queue private key must be added to the request decryption keys").With("key_id", keyID).With("stack", stack.Trace().TrimRuntime())
+	}
+	clear, _, err = w.NewUnsealReader(in)
+	return clear, err
+}
+
+// UnsealStream returns a reader of the decrypted contents of in when it is a sealed stream, such
+// as a sealed object held within the artifact cache, otherwise the contents of in are returned
+// unchanged.  Callers should only use this for streams known to hold a sealed object, for example
+// those of artifacts marked for encryption, as the contents of other streams are not trusted to
+// select whether they are decrypted.
+//
+func UnsealStream(in io.Reader) (out io.Reader, sealed bool, err kv.Error) {
+	buffered := bufio.NewReader(in)
+	prefix, _ := buffered.Peek(len(`{"format":"` + defense.SealedFormat + `"`))
+	if !defense.IsSealed(prefix) {
+		return buffered, false, nil
+	}
+
+	unsealKeys.Lock()
+	w := unsealKeys.w
+	unsealKeys.Unlock()
+
+	if w == nil {
+		return nil, true, kv.NewError("sealed objects cannot be read without the request decryption keys").With("stack", stack.Trace().TrimRuntime())
+	}
+	if out, _, err = w.NewUnsealReader(buffered); err != nil {
+		return nil, true, err
+	}
+	return out, true, nil
+}
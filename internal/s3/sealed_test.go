@@ -0,0 +1,88 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// Unit tests for reading sealed archives held outside of the storage, such as in the artifact cache
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+type sealBuffer struct {
+	bytes.Buffer
+}
+
+func (b *sealBuffer) Close() error {
+	return nil
+}
+
+// TestUnsealStream checks that sealed streams are decrypted using the keys supplied for unsealing,
+// and that other streams are returned unchanged
+//
+func TestUnsealStream(t *testing.T) {
+	passphrase := "unseal stream test passphrase"
+	privatePEM, publicPEM, err := defense.GenerateKeyPair(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := defense.NewWrapper(publicPEM, privatePEM, []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(publicPEM)
+	pub, errGo := x509.ParsePKCS1PublicKey(block.Bytes)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	data := []byte("archive contents")
+	sealed := &sealBuffer{}
+	sw, _, err := defense.NewSealWriter(sealed, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = sw.Write(data); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if errGo = sw.Close(); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	defer SetUnsealKeys(nil)
+
+	// Sealed streams cannot be read without the keys
+	SetUnsealKeys(nil)
+	if _, isSealed, err := UnsealStream(bytes.NewReader(sealed.Bytes())); err == nil || !isSealed {
+		t.Fatal(kv.NewError("sealed stream read without keys").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	SetUnsealKeys(w)
+	for _, check := range []struct {
+		in     []byte
+		sealed bool
+	}{
+		{in: sealed.Bytes(), sealed: true},
+		{in: data, sealed: false},
+	} {
+		out, isSealed, err := UnsealStream(bytes.NewReader(check.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clear, errGo := ioutil.ReadAll(out)
+		if errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if isSealed != check.sealed || !bytes.Equal(clear, data) {
+			t.Fatal(kv.NewError("stream not read correctly").With("sealed", isSealed, "contents", string(clear)).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
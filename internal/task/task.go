@@ -32,6 +32,7 @@ type QueueTask struct {
 	ShortQName   string // The short queue name for the current task, will be used to retrieve signing keys
 	Credentials  string
 	Msg          []byte
+	MsgGroup     string // The ordering group of the message for queues that support ordered delivery, for example SQS FIFO
 	Handler      MsgHandler
 	Wrapper      *defense.Wrapper // A store of encryption related information for messages
 	ResponseQ    chan string      // A response message queue the runner can use to send progress updates
@@ -60,8 +61,9 @@ type TaskQueue interface {
 
 	// Responder is used to open a connection to an existing response queue if
 	// one was made available and also to provision a channel into which the
-	// runner can place report messages
-	Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error)
+	// runner can place report messages for the task.  Queues that support ordered
+	// delivery send the reports using the MsgGroup of the task.
+	Responder(ctx context.Context, qt *QueueTask, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error)
 
 	// ExtractShortQName is useful for getting the short unique queue name useful for indexing collections etc
 	GetShortQName(qt *QueueTask) (shortName string, err kv.Error)
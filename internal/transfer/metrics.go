@@ -0,0 +1,61 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package transfer
+
+// This file contains the prometheus metrics for transfers and their limits
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transferBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_transfer_bytes_total",
+			Help: "The number of bytes transferred with storage endpoints.",
+		},
+		[]string{"endpoint", "direction"},
+	)
+	transferThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_transfer_throttled_seconds_total",
+			Help: "The time transfers with storage endpoints have spent waiting for bandwidth.",
+		},
+		[]string{"endpoint", "direction"},
+	)
+	transferActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_transfer_active",
+			Help: "The number of transfers with storage endpoints currently running.",
+		},
+		[]string{"endpoint", "direction"},
+	)
+	transferWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_transfer_waiting",
+			Help: "The number of transfers with storage endpoints waiting to start within the concurrency limits.",
+		},
+		[]string{"endpoint", "direction"},
+	)
+	transferLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_transfer_limit",
+			Help: "The limits on transfers with storage endpoints, the all endpoint holds the runner wide limits, 0 is unlimited.",
+		},
+		[]string{"endpoint", "limit"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(transferBytes)
+	prometheus.MustRegister(transferThrottled)
+	prometheus.MustRegister(transferActive)
+	prometheus.MustRegister(transferWaiting)
+	prometheus.MustRegister(transferLimit)
+}
+
+func reportLimits(endpoint string, limits Limits) {
+	transferLimit.WithLabelValues(endpoint, "download_bytes_per_second").Set(float64(limits.Download))
+	transferLimit.WithLabelValues(endpoint, "upload_bytes_per_second").Set(float64(limits.Upload))
+	transferLimit.WithLabelValues(endpoint, "concurrency").Set(float64(limits.Concurrency))
+}
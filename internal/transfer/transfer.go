@@ -0,0 +1,330 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package transfer // import "github.com/leaf-ai/studio-go-runner/internal/transfer"
+
+// This file contains the implementation of the limits on the bandwidth and the number of
+// concurrent transfers used by the storage implementations when moving artifacts.
+//
+// Limits are held for each storage endpoint, and shared by all of the experiments within the
+// runner.  Transfers with remote endpoints are also subject to a set of runner wide limits that
+// apply to all of the remote endpoints combined so that the network interface of the host is not
+// saturated.  Transfers with the local file system, which include copies out of the artifact
+// cache, are only limited when limits are configured for the LocalEndpoint.
+//
+// Bandwidth is limited using token buckets with a token for each byte, and concurrency using a
+// count of the active transfers.  Limits can be changed while transfers are running.
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"golang.org/x/time/rate"
+)
+
+// Direction is the direction of the data within a transfer
+type Direction string
+
+const (
+	Download Direction = "download"
+	Upload   Direction = "upload"
+
+	// LocalEndpoint is the name used for the endpoint of the local file system
+	LocalEndpoint = "file"
+
+	// runnerEndpoint is the name used when reporting the runner wide limits
+	runnerEndpoint = "all"
+
+	// maxBurst is the largest number of bytes admitted by a token bucket in one go
+	maxBurst = 1024 * 1024
+)
+
+// Limits holds the limits for transfers, zero values are unlimited
+//
+type Limits struct {
+	Download    int64 // Bytes per second
+	Upload      int64 // Bytes per second
+	Concurrency int   // The maximum number of transfers, in either direction, at any one time
+}
+
+// limiter holds the token buckets and the count of active transfers for a set of limits
+type limiter struct {
+	name     string
+	download *rate.Limiter
+	upload   *rate.Limiter
+
+	concurrency int
+	active      int
+	freeC       chan struct{} // Closed, and replaced, when the active count or the concurrency changes
+	sync.Mutex
+}
+
+var (
+	limiters = struct {
+		runner    *limiter
+		endpoints map[string]*limiter
+		limits    map[string]Limits // The limits configured for individual endpoints
+		sync.Mutex
+	}{
+		runner:    newLimiter(runnerEndpoint, Limits{}),
+		endpoints: map[string]*limiter{},
+		limits:    map[string]Limits{},
+	}
+)
+
+func newBucket(bytesPerSec int64) (bucket *rate.Limiter) {
+	if bytesPerSec <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	burst := bytesPerSec
+	if burst > maxBurst {
+		burst = maxBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+func setBucket(bucket *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		bucket.SetLimit(rate.Inf)
+		bucket.SetBurst(0)
+		return
+	}
+	burst := bytesPerSec
+	if burst > maxBurst {
+		burst = maxBurst
+	}
+	bucket.SetBurst(int(burst))
+	bucket.SetLimit(rate.Limit(bytesPerSec))
+}
+
+func newLimiter(name string, limits Limits) (l *limiter) {
+	l = &limiter{
+		name:        name,
+		download:    newBucket(limits.Download),
+		upload:      newBucket(limits.Upload),
+		concurrency: limits.Concurrency,
+		freeC:       make(chan struct{}),
+	}
+	reportLimits(name, limits)
+	return l
+}
+
+func (l *limiter) set(limits Limits) {
+	setBucket(l.download, limits.Download)
+	setBucket(l.upload, limits.Upload)
+
+	l.Lock()
+	l.concurrency = limits.Concurrency
+	close(l.freeC)
+	l.freeC = make(chan struct{})
+	l.Unlock()
+
+	reportLimits(l.name, limits)
+}
+
+func (l *limiter) bucket(direction Direction) (bucket *rate.Limiter) {
+	if direction == Upload {
+		return l.upload
+	}
+	return l.download
+}
+
+// acquire waits until the number of active transfers is below the concurrency limit and then
+// counts the caller as active
+//
+func (l *limiter) acquire(ctx context.Context) (errGo error) {
+	for {
+		l.Lock()
+		if l.concurrency <= 0 || l.active < l.concurrency {
+			l.active++
+			l.Unlock()
+			return nil
+		}
+		freeC := l.freeC
+		l.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freeC:
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.Lock()
+	l.active--
+	close(l.freeC)
+	l.freeC = make(chan struct{})
+	l.Unlock()
+}
+
+// SetLimits replaces the runner wide limits that apply to all of the remote endpoints combined, and
+// the limits for individual endpoints.  Endpoints that are absent from the endpoints map become
+// unlimited.  Transfers that are already running use the new limits immediately.
+//
+func SetLimits(runner Limits, endpoints map[string]Limits) {
+	limiters.Lock()
+	defer limiters.Unlock()
+
+	limiters.runner.set(runner)
+
+	limiters.limits = make(map[string]Limits, len(endpoints))
+	for name, limits := range endpoints {
+		limiters.limits[name] = limits
+	}
+	for name, l := range limiters.endpoints {
+		l.set(limiters.limits[name])
+	}
+}
+
+func getLimiter(endpoint string) (l *limiter) {
+	limiters.Lock()
+	defer limiters.Unlock()
+
+	if l = limiters.endpoints[endpoint]; l == nil {
+		l = newLimiter(endpoint, limiters.limits[endpoint])
+		limiters.endpoints[endpoint] = l
+	}
+	return l
+}
+
+// Transfer represents a single transfer of data with a storage endpoint that has been admitted
+// within the concurrency limits
+//
+type Transfer struct {
+	ctx       context.Context
+	endpoint  string
+	direction Direction
+	limiters  []*limiter
+	once      sync.Once
+}
+
+// Start waits until a transfer with the endpoint can be started within the concurrency limits.
+// Done must be called once the transfer has finished.
+//
+func Start(ctx context.Context, endpoint string, direction Direction) (xfer *Transfer, err kv.Error) {
+	xfer = &Transfer{
+		ctx:       ctx,
+		endpoint:  endpoint,
+		direction: direction,
+		limiters:  []*limiter{getLimiter(endpoint)},
+	}
+	if endpoint != LocalEndpoint {
+		limiters.Lock()
+		xfer.limiters = append(xfer.limiters, limiters.runner)
+		limiters.Unlock()
+	}
+
+	transferWaiting.WithLabelValues(endpoint, string(direction)).Inc()
+	defer transferWaiting.WithLabelValues(endpoint, string(direction)).Dec()
+
+	// Limiters are always acquired in the same order, the endpoint first, to avoid deadlocks
+	for i, l := range xfer.limiters {
+		if errGo := l.acquire(ctx); errGo != nil {
+			for _, held := range xfer.limiters[:i] {
+				held.release()
+			}
+			return nil, kv.Wrap(errGo, "waiting to start a transfer terminated").With("endpoint", endpoint, "direction", direction).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	transferActive.WithLabelValues(endpoint, string(direction)).Inc()
+	return xfer, nil
+}
+
+// Done releases the concurrency held by the transfer, it is safe to call more than once
+//
+func (xfer *Transfer) Done() {
+	xfer.once.Do(func() {
+		for _, l := range xfer.limiters {
+			l.release()
+		}
+		transferActive.WithLabelValues(xfer.endpoint, string(xfer.direction)).Dec()
+	})
+}
+
+// Duration returns the longest time that moving size bytes should take within the bandwidth limits of
+// the transfer.  Bandwidth is shared by the active transfers so the share of each transfer is taken
+// to be the bandwidth divided by the concurrency limit.  When a bandwidth limit applies without a
+// concurrency limit the share of the transfer cannot be determined and bounded is false.  Limits
+// changed after the duration has been obtained are not reflected in it.
+//
+func (xfer *Transfer) Duration(size int64) (duration time.Duration, bounded bool) {
+	for _, l := range xfer.limiters {
+		limit := l.bucket(xfer.direction).Limit()
+		if limit == rate.Inf || limit <= 0 {
+			continue
+		}
+
+		l.Lock()
+		concurrency := l.concurrency
+		l.Unlock()
+		if concurrency <= 0 {
+			return 0, false
+		}
+
+		if d := time.Duration(float64(size) * float64(concurrency) / float64(limit) * float64(time.Second)); d > duration {
+			duration = d
+		}
+	}
+	return duration, true
+}
+
+// Reader returns a reader that limits the rate at which data is read from r to the bandwidth
+// limits for the transfer, and which counts the data transferred
+//
+func (xfer *Transfer) Reader(r io.Reader) (limited io.Reader) {
+	return &reader{xfer: xfer, r: r}
+}
+
+// wait blocks until n bytes have been admitted by the token buckets for the transfer
+//
+func (xfer *Transfer) wait(n int) (errGo error) {
+	transferBytes.WithLabelValues(xfer.endpoint, string(xfer.direction)).Add(float64(n))
+
+	start := time.Now()
+	defer func() {
+		transferThrottled.WithLabelValues(xfer.endpoint, string(xfer.direction)).Add(time.Since(start).Seconds())
+	}()
+
+	for _, l := range xfer.limiters {
+		bucket := l.bucket(xfer.direction)
+		for remaining := n; remaining > 0; {
+			chunk := remaining
+			if burst := bucket.Burst(); burst > 0 && chunk > burst {
+				chunk = burst
+			}
+			if errGo = bucket.WaitN(xfer.ctx, chunk); errGo != nil {
+				return errGo
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	xfer *Transfer
+	r    io.Reader
+}
+
+// Read reads no more than the burst of the token buckets at a time, and then waits for the
+// data read to be admitted before returning it
+//
+func (r *reader) Read(p []byte) (n int, errGo error) {
+	if len(p) > maxBurst {
+		p = p[:maxBurst]
+	}
+	n, errGo = r.r.Read(p)
+	if n > 0 {
+		if errWait := r.xfer.wait(n); errWait != nil {
+			return n, errWait
+		}
+	}
+	return n, errGo
+}
@@ -0,0 +1,150 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package transfer
+
+// Unit tests for the transfer limits
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestTransferConcurrency checks that transfers wait for the concurrency limits of their endpoint,
+// and that the runner wide limits do not apply to the local file system
+//
+func TestTransferConcurrency(t *testing.T) {
+	SetLimits(Limits{Concurrency: 1}, map[string]Limits{"minio:9000": {Concurrency: 2}})
+	defer SetLimits(Limits{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, err := Start(ctx, "minio:9000", Download)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The runner wide limit of a single transfer prevents a second remote transfer
+	waitCtx, waitCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	if _, err = Start(waitCtx, "minio:9000", Upload); err == nil {
+		t.Fatal(kv.NewError("transfer started beyond the runner concurrency").With("stack", stack.Trace().TrimRuntime()))
+	}
+	waitCancel()
+
+	local, err := Start(ctx, LocalEndpoint, Download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Done()
+
+	// A waiting transfer starts once the active transfer is done
+	startedC := make(chan *Transfer, 1)
+	go func() {
+		xfer, err := Start(ctx, "minio:9000", Upload)
+		if err != nil {
+			t.Error(err)
+		}
+		startedC <- xfer
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if got := testutil.ToFloat64(transferWaiting.WithLabelValues("minio:9000", string(Upload))); got != 1 {
+		t.Fatal(kv.NewError("waiting transfer not reported").With("waiting", got).With("stack", stack.Trace().TrimRuntime()))
+	}
+	first.Done()
+	first.Done()
+
+	select {
+	case xfer := <-startedC:
+		if xfer == nil {
+			t.FailNow()
+		}
+		xfer.Done()
+	case <-ctx.Done():
+		t.Fatal(kv.NewError("waiting transfer not started").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Raising the limits releases waiting transfers
+	SetLimits(Limits{Concurrency: 2}, map[string]Limits{"minio:9000": {Concurrency: 2}})
+	xfers := []*Transfer{}
+	for i := 0; i != 2; i++ {
+		xfer, err := Start(ctx, "minio:9000", Download)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xfers = append(xfers, xfer)
+	}
+	for _, xfer := range xfers {
+		xfer.Done()
+	}
+}
+
+// TestTransferBandwidth checks that reads are limited to the bandwidth of the endpoint and are counted
+//
+func TestTransferBandwidth(t *testing.T) {
+	// 10Kb a second with an initial burst of 10Kb
+	SetLimits(Limits{}, map[string]Limits{"bandwidth:9000": {Download: 10 * 1024}})
+	defer SetLimits(Limits{}, nil)
+
+	xfer, err := Start(context.Background(), "bandwidth:9000", Download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xfer.Done()
+
+	data := make([]byte, 15*1024)
+	start := time.Now()
+	n, errGo := io.Copy(ioutil.Discard, xfer.Reader(bytes.NewReader(data)))
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatal(kv.NewError("read not limited").With("elapsed", elapsed).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if got := testutil.ToFloat64(transferBytes.WithLabelValues("bandwidth:9000", string(Download))); got != float64(n) || n != int64(len(data)) {
+		t.Fatal(kv.NewError("transfer not counted").With("counted", got, "read", n).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if got := testutil.ToFloat64(transferLimit.WithLabelValues("bandwidth:9000", "download_bytes_per_second")); got != 10*1024 {
+		t.Fatal(kv.NewError("limit not reported").With("limit", got).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestTransferDuration checks the time allowed for transfers within bandwidth limits
+//
+func TestTransferDuration(t *testing.T) {
+	defer SetLimits(Limits{}, nil)
+
+	checks := []struct {
+		limits   Limits
+		duration time.Duration
+		bounded  bool
+	}{
+		{limits: Limits{}, duration: 0, bounded: true},
+		{limits: Limits{Download: 1024}, duration: 0, bounded: true},
+		{limits: Limits{Upload: 1024}, duration: 0, bounded: false},
+		{limits: Limits{Upload: 1024, Concurrency: 2}, duration: 20 * time.Second, bounded: true},
+	}
+	for _, check := range checks {
+		SetLimits(Limits{}, map[string]Limits{"duration:9000": check.limits})
+
+		xfer, err := Start(context.Background(), "duration:9000", Upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration, bounded := xfer.Duration(10 * 1024)
+		xfer.Done()
+
+		if duration != check.duration || bounded != check.bounded {
+			t.Fatal(kv.NewError("unexpected transfer duration").With("limits", check.limits, "duration", duration, "bounded", bounded).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+// This file contains the implementation of large SQS message payloads that are stored
+// in S3 using the format of the Amazon SQS Extended Client libraries.  The body of
+// the SQS message contains a pointer to the S3 object holding the payload, for example
+//
+//   ["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"key"}]
+//
+// and the size of the payload is held within the ExtendedPayloadSize message attribute.
+// Producers can also supply the hex encoded SHA256 digest of the payload using the
+// ExtendedPayloadSHA256 message attribute which is verified when present.
+//
+// Pointers are supplied by anyone able to send to the queue and the objects they reference
+// are removed once the message is done with, so only pointers into the payload bucket, or
+// the buckets explicitly allowed using sqs-payload-buckets, are followed.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/dustin/go-humanize"
+	"github.com/rs/xid"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	sqsPayloadBucketOpt   = flag.String("sqs-payload-bucket", "", "an S3 bucket used to store response queue messages that are too large to be sent using SQS")
+	sqsPayloadBucketsOpt  = flag.String("sqs-payload-buckets", "", "a comma separated list of S3 buckets, in addition to sqs-payload-bucket, from which large SQS message payloads will be retrieved")
+	sqsPayloadEndpointOpt = flag.String("sqs-payload-endpoint", "", "an optional endpoint for the S3 storage used for large SQS message payloads, defaults to AWS S3, prefix with http:// to disable TLS")
+	sqsPayloadLimitOpt    = flag.String("sqs-payload-limit", "64mib", "the maximum size of SQS message payloads that will be retrieved from S3")
+	sqsPayloadDigestOpt   = flag.Bool("sqs-payload-digest", false, "reject SQS message payloads retrieved from S3 that do not have an ExtendedPayloadSHA256 message attribute")
+)
+
+const (
+	// sqsMessageLimit is the largest message body that will be sent directly using SQS, messages
+	// are limited to 256KB including attributes
+	sqsMessageLimit = 256*1024 - 1024
+
+	payloadPointerClass       = "software.amazon.payloadoffloading.PayloadS3Pointer"
+	legacyPayloadPointerClass = "com.amazon.sqs.javamessaging.MessageS3Pointer"
+
+	payloadSizeAttribute       = "ExtendedPayloadSize"
+	legacyPayloadSizeAttribute = "SQSLargePayloadSize"
+	payloadDigestAttribute     = "ExtendedPayloadSHA256"
+
+	// The visibility timeouts, in seconds, used when a payload cannot be retrieved, doubling
+	// on each receive of the message between the two limits
+	payloadRetryMinVisibility = int64(10)
+	payloadRetryMaxVisibility = int64(15 * 60)
+)
+
+// payloadStore is the subset of the S3 storage operations used for message payloads
+//
+type payloadStore interface {
+	GetPayload(ctx context.Context, key string, maxBytes int64) (payload []byte, err kv.Error)
+	PutPayload(ctx context.Context, key string, payload []byte) (err kv.Error)
+	Remove(ctx context.Context, key string) (err kv.Error)
+	Close()
+}
+
+// payloadPointer references an S3 object containing the payload of an SQS message
+//
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// parsePayloadPointer extracts the S3 pointer from an extended client message body.  The
+// size of the payload is needed to recognize the older object form of the pointer.
+//
+func parsePayloadPointer(body string, hasSize bool) (pointer *payloadPointer, isPointer bool) {
+	body = strings.TrimSpace(body)
+
+	pointer = &payloadPointer{}
+	switch {
+	case strings.HasPrefix(body, "["):
+		items := []json.RawMessage{}
+		if errGo := json.Unmarshal([]byte(body), &items); errGo != nil || len(items) != 2 {
+			return nil, false
+		}
+		class := ""
+		if errGo := json.Unmarshal(items[0], &class); errGo != nil {
+			return nil, false
+		}
+		if class != payloadPointerClass && class != legacyPayloadPointerClass {
+			return nil, false
+		}
+		if errGo := json.Unmarshal(items[1], pointer); errGo != nil {
+			return nil, false
+		}
+	case strings.HasPrefix(body, "{") && hasSize:
+		fields := map[string]json.RawMessage{}
+		if errGo := json.Unmarshal([]byte(body), &fields); errGo != nil || len(fields) != 2 {
+			return nil, false
+		}
+		if errGo := json.Unmarshal([]byte(body), pointer); errGo != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if len(pointer.Bucket) == 0 || len(pointer.Key) == 0 {
+		return nil, false
+	}
+	return pointer, true
+}
+
+// payloadSize retrieves the size of the payload an extended client message refers to
+//
+func payloadSize(msg *sqs.Message) (size int64, isPresent bool, err kv.Error) {
+	for _, name := range []string{payloadSizeAttribute, legacyPayloadSizeAttribute} {
+		attr, isPresent := msg.MessageAttributes[name]
+		if !isPresent || attr == nil || attr.StringValue == nil {
+			continue
+		}
+		size, errGo := strconv.ParseInt(*attr.StringValue, 10, 64)
+		if errGo != nil || size < 0 {
+			return 0, true, kv.NewError("invalid payload size").With("attribute", name, "value", *attr.StringValue).With("stack", stack.Trace().TrimRuntime())
+		}
+		return size, true, nil
+	}
+	return 0, false, nil
+}
+
+// payloadDigest retrieves the SHA256 digest of the payload an extended client message refers to
+//
+func payloadDigest(msg *sqs.Message) (digest string, isPresent bool) {
+	attr, isPresent := msg.MessageAttributes[payloadDigestAttribute]
+	if !isPresent || attr == nil || attr.StringValue == nil {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimSpace(*attr.StringValue)), true
+}
+
+// payloadRetryVisibility returns the visibility timeout used to return a message to the queue
+// when its payload could not be retrieved.  The timeout doubles with each receive of the message
+// so that payloads which are unavailable do not result in the message being redelivered continuously.
+//
+func payloadRetryVisibility(msg *sqs.Message) (visibility int64) {
+	received, _ := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+
+	visibility = payloadRetryMinVisibility
+	for i := 1; i < received && visibility < payloadRetryMaxVisibility; i++ {
+		visibility *= 2
+	}
+	if visibility > payloadRetryMaxVisibility {
+		visibility = payloadRetryMaxVisibility
+	}
+	return visibility
+}
+
+// checkPayloadBucket ensures that a bucket is one that payloads are permitted to be retrieved
+// from, and removed from
+//
+func checkPayloadBucket(bucket string) (err kv.Error) {
+	if len(bucket) != 0 {
+		if bucket == *sqsPayloadBucketOpt {
+			return nil
+		}
+		for _, allowed := range strings.Split(*sqsPayloadBucketsOpt, ",") {
+			if bucket == strings.TrimSpace(allowed) {
+				return nil
+			}
+		}
+	}
+	return kv.NewError("payload bucket not permitted").With("bucket", bucket).With("stack", stack.Trace().TrimRuntime())
+}
+
+// payloadStorage creates a client for the S3 storage holding large payloads using
+// the credentials of the queue.  Buckets other than those configured for payloads are
+// refused as the bucket is taken from messages that cannot be trusted.
+//
+func (sq *SQS) payloadStorage(ctx context.Context, bucket string) (storage payloadStore, err kv.Error) {
+	if err = checkPayloadBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	value, errGo := sq.creds.Creds.GetWithContext(ctx)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	creds := request.AWSCredential{
+		AccessKey: value.AccessKeyID,
+		SecretKey: value.SecretAccessKey,
+		Session:   value.SessionToken,
+		Region:    sq.creds.Region,
+	}
+
+	endpoint := "s3.amazonaws.com"
+	useSSL := true
+	if len(*sqsPayloadEndpointOpt) != 0 {
+		endpoint = *sqsPayloadEndpointOpt
+		if strings.HasPrefix(endpoint, "http://") {
+			useSSL = false
+		}
+		endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+	}
+
+	s, err := s3.NewS3storage(ctx, creds, map[string]string{}, endpoint, bucket, "", false, useSSL)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fetchPayload returns the payload for a message, retrieving it from S3 when the message
+// is an extended client pointer.  The pointer is returned so that the object can be removed
+// once the message has been deleted from the queue.
+//
+func (sq *SQS) fetchPayload(ctx context.Context, msg *sqs.Message) (payload []byte, pointer *payloadPointer, err kv.Error) {
+	body := aws.StringValue(msg.Body)
+
+	size, hasSize, err := payloadSize(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pointer, isPointer := parsePayloadPointer(body, hasSize)
+	if !isPointer {
+		return []byte(body), nil, nil
+	}
+	if err = checkPayloadBucket(pointer.Bucket); err != nil {
+		return nil, nil, err.With("key", pointer.Key)
+	}
+	if !hasSize {
+		return nil, nil, kv.NewError("payload size missing").With("bucket", pointer.Bucket, "key", pointer.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	digest, hasDigest := payloadDigest(msg)
+	if !hasDigest && *sqsPayloadDigestOpt {
+		return nil, nil, kv.NewError("payload digest missing").With("bucket", pointer.Bucket, "key", pointer.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	maxBytes, errGo := humanize.ParseBytes(*sqsPayloadLimitOpt)
+	if errGo != nil {
+		return nil, nil, kv.Wrap(errGo).With("sqs-payload-limit", *sqsPayloadLimitOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if uint64(size) > maxBytes {
+		return nil, nil, kv.NewError("payload too large").With("size", size, "max_bytes", maxBytes, "bucket", pointer.Bucket, "key", pointer.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	storage, err := sq.payloadStorage(ctx, pointer.Bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer storage.Close()
+
+	if payload, err = storage.GetPayload(ctx, pointer.Key, int64(maxBytes)); err != nil {
+		return nil, nil, err
+	}
+	if int64(len(payload)) != size {
+		return nil, nil, kv.NewError("payload size mismatch").With("size", size, "retrieved", len(payload), "bucket", pointer.Bucket, "key", pointer.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	if hasDigest {
+		if sum := sha256.Sum256(payload); hex.EncodeToString(sum[:]) != digest {
+			return nil, nil, kv.NewError("payload digest mismatch").With("digest", digest, "bucket", pointer.Bucket, "key", pointer.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return payload, pointer, nil
+}
+
+// removePayload deletes the S3 object holding a message payload
+//
+func (sq *SQS) removePayload(ctx context.Context, pointer *payloadPointer) (err kv.Error) {
+	storage, err := sq.payloadStorage(ctx, pointer.Bucket)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	return storage.Remove(ctx, pointer.Key)
+}
+
+// storePayload places a message payload that is too large for SQS into the payload bucket
+// and returns the extended client message body and attributes that refer to it
+//
+func (sq *SQS) storePayload(ctx context.Context, queue string, payload []byte) (body string, attrs map[string]*sqs.MessageAttributeValue, err kv.Error) {
+	if len(*sqsPayloadBucketOpt) == 0 {
+		return "", nil, kv.NewError("message too large and sqs-payload-bucket not set").With("size", len(payload), "queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pointer := &payloadPointer{
+		Bucket: *sqsPayloadBucketOpt,
+		Key:    queue + "/" + xid.New().String(),
+	}
+
+	storage, err := sq.payloadStorage(ctx, pointer.Bucket)
+	if err != nil {
+		return "", nil, err
+	}
+	defer storage.Close()
+
+	if err = storage.PutPayload(ctx, pointer.Key, payload); err != nil {
+		return "", nil, err
+	}
+
+	encoded, errGo := json.Marshal([]interface{}{payloadPointerClass, pointer})
+	if errGo != nil {
+		return "", nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	sum := sha256.Sum256(payload)
+	attrs = map[string]*sqs.MessageAttributeValue{
+		payloadSizeAttribute: {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(len(payload))),
+		},
+		payloadDigestAttribute: {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(hex.EncodeToString(sum[:])),
+		},
+	}
+	return string(encoded), attrs, nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+// This file contains tests for SQS messages that carry their payloads in S3
+
+const fakeBucket = "payloads"
+
+// TestPayloadPointer checks the recognition of the extended client pointer formats
+func TestPayloadPointer(t *testing.T) {
+	cases := []struct {
+		body      string
+		hasSize   bool
+		isPointer bool
+	}{
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"b","s3Key":"k"}]`, true, true},
+		{`["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"b","s3Key":"k"}]`, true, true},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"b","s3Key":"k"}]`, false, true},
+		{`{"s3BucketName":"b","s3Key":"k"}`, true, true},
+		// The legacy object form is only recognized when the payload size is present
+		{`{"s3BucketName":"b","s3Key":"k"}`, false, false},
+		// Ordinary experiment messages should not be treated as pointers
+		{`{"experiment": {"key": "k"}, "s3BucketName":"b","s3Key":"k"}`, true, false},
+		{`["some.other.Class",{"s3BucketName":"b","s3Key":"k"}]`, true, false},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"b"}]`, true, false},
+		{`[1, 2]`, true, false},
+		{`not json`, true, false},
+	}
+	for i, c := range cases {
+		pointer, isPointer := parsePayloadPointer(c.body, c.hasSize)
+		if isPointer != c.isPointer {
+			t.Fatal(kv.NewError("pointer recognition failed").With("case", i, "body", c.body).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if isPointer && (pointer.Bucket != "b" || pointer.Key != "k") {
+			t.Fatal(kv.NewError("pointer mismatch").With("case", i, "pointer", *pointer).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
+
+// setupFakeS3 starts a fake S3 server and points the payload storage at it
+func setupFakeS3(t *testing.T) (fake *fakeS3) {
+	fake = newFakeS3()
+	t.Cleanup(fake.Close)
+
+	endpoint, bucket := *sqsPayloadEndpointOpt, *sqsPayloadBucketOpt
+	*sqsPayloadEndpointOpt = fake.server.URL
+	*sqsPayloadBucketOpt = fakeBucket
+	t.Cleanup(func() {
+		*sqsPayloadEndpointOpt, *sqsPayloadBucketOpt = endpoint, bucket
+	})
+	return fake
+}
+
+// TestSQSExtendedWork checks that a message payload held in S3 is retrieved, verified,
+// and removed once the message is acknowledged, and that messages whose payloads fail
+// verification are delayed before being redelivered
+func TestSQSExtendedWork(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, qt := newFakeSQSQueue(t, fake, credFiles)
+	storage := setupFakeS3(t)
+
+	payload := bytes.Repeat([]byte("x"), 300*1024)
+	storage.put(fakeBucket+"/large", payload)
+
+	pointer := `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"` + fakeBucket + `","s3Key":"large"}]`
+
+	// Pointers into buckets other than those configured for payloads are refused without the
+	// object being retrieved, or removed
+	storage.put("private/secret", payload)
+	fake.sendAttrs(fakeQueue, `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"private","s3Key":"secret"}]`,
+		map[string]string{payloadSizeAttribute: strconv.Itoa(len(payload))})
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		t.Fatal(kv.NewError("handler called for a payload outside of the payload bucket").With("stack", stack.Trace().TrimRuntime()))
+		return nil, false, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err == nil || !processed {
+		t.Fatal(kv.NewError("payload outside of the payload bucket accepted").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if storage.requests("private/secret") != 0 {
+		t.Fatal(kv.NewError("object outside of the payload bucket accessed").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err := (&SQS{}).removePayload(context.Background(), &payloadPointer{Bucket: "private", Key: "secret"}); err == nil {
+		t.Fatal(kv.NewError("object outside of the payload bucket removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, isPresent := storage.get("private/secret"); !isPresent {
+		t.Fatal(kv.NewError("object outside of the payload bucket removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Buckets can be explicitly allowed
+	allowed := *sqsPayloadBucketsOpt
+	*sqsPayloadBucketsOpt = "other, private"
+	if err := checkPayloadBucket("private"); err != nil {
+		t.Fatal(err)
+	}
+	*sqsPayloadBucketsOpt = allowed
+
+	fake.Lock()
+	fake.queues[fakeQueue] = []*fakeSQSMsg{}
+	fake.Unlock()
+
+	// A payload that does not match the size in the message should be returned to the queue
+	fake.sendAttrs(fakeQueue, pointer, map[string]string{payloadSizeAttribute: strconv.Itoa(len(payload) + 1)})
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		t.Fatal(kv.NewError("handler called for invalid payload").With("stack", stack.Trace().TrimRuntime()))
+		return nil, false, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err == nil || !processed {
+		t.Fatal(kv.NewError("invalid payload accepted").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	msgs := fake.messages(fakeQueue)
+	if len(msgs) != 1 || time.Until(msgs[0].visibleAt) < time.Duration(payloadRetryMinVisibility-1)*time.Second {
+		t.Fatal(kv.NewError("message not released with a delay").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, isPresent := storage.get(fakeBucket + "/large"); !isPresent {
+		t.Fatal(kv.NewError("payload of released message removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// A payload that does not match its digest should also be returned to the queue
+	fake.Lock()
+	fake.queues[fakeQueue] = []*fakeSQSMsg{}
+	fake.Unlock()
+	fake.sendAttrs(fakeQueue, pointer, map[string]string{payloadSizeAttribute: strconv.Itoa(len(payload)), payloadDigestAttribute: strings.Repeat("0", 64)})
+	if processed, _, err := sq.Work(context.Background(), qt); err == nil || !processed {
+		t.Fatal(kv.NewError("payload with mismatched digest accepted").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Replace the invalid message with one having the correct size and digest
+	fake.Lock()
+	fake.queues[fakeQueue] = []*fakeSQSMsg{}
+	fake.Unlock()
+	digest := sha256.Sum256(payload)
+	fake.sendAttrs(fakeQueue, pointer, map[string]string{payloadSizeAttribute: strconv.Itoa(len(payload)), payloadDigestAttribute: hex.EncodeToString(digest[:])})
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		if !bytes.Equal(qt.Msg, payload) {
+			t.Fatal(kv.NewError("payload mismatch").With("size", len(qt.Msg)).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return &server.Resource{}, true, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs := fake.messages(fakeQueue); len(msgs) != 0 {
+		t.Fatal(kv.NewError("message not deleted").With("remaining", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, isPresent := storage.get(fakeBucket + "/large"); isPresent {
+		t.Fatal(kv.NewError("payload not removed").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSResponder checks that responses are encrypted and that large responses
+// are sent using S3
+func TestSQSResponder(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, _ := newFakeSQSQueue(t, fake, credFiles)
+	storage := setupFakeS3(t)
+
+	responseQ := fakeQueue + "_response"
+	fake.Lock()
+	fake.queues[responseQ] = []*fakeSQSMsg{}
+	fake.Unlock()
+
+	key, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender, err := sq.Responder(ctx, &task.QueueTask{}, responseQ, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := `{"experiment_id": "small"}`
+	large := `{"experiment_id": "large", "output": "` + strings.Repeat("y", 512*1024) + `"}`
+	for _, msg := range []string{"", small, large} {
+		select {
+		case sender <- msg:
+		case <-time.After(10 * time.Second):
+			t.Fatal(kv.NewError("responder blocked").With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	msgs := []fakeSQSMsg{}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if msgs = fake.messages(responseQ); len(msgs) == 2 {
+			break
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatal(kv.NewError("responses not sent").With("sent", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	decrypted, err := defense.Unseal(msgs[0].body, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != small {
+		t.Fatal(kv.NewError("small response mismatch").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	pointer, isPointer := parsePayloadPointer(msgs[1].body, true)
+	if !isPointer || pointer.Bucket != fakeBucket || !strings.HasPrefix(pointer.Key, responseQ+"/") {
+		t.Fatal(kv.NewError("large response not sent using S3").With("body", msgs[1].body).With("stack", stack.Trace().TrimRuntime()))
+	}
+	data, isPresent := storage.get(pointer.Bucket + "/" + pointer.Key)
+	if !isPresent {
+		t.Fatal(kv.NewError("large response payload missing").With("keys", storage.keys()).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs[1].attrs[payloadSizeAttribute] != strconv.Itoa(len(data)) {
+		t.Fatal(kv.NewError("payload size attribute mismatch").With("attrs", msgs[1].attrs, "size", len(data)).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if digest := sha256.Sum256(data); msgs[1].attrs[payloadDigestAttribute] != hex.EncodeToString(digest[:]) {
+		t.Fatal(kv.NewError("payload digest attribute mismatch").With("attrs", msgs[1].attrs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if decrypted, err = defense.Unseal(string(data), key); err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != large {
+		t.Fatal(kv.NewError("large response mismatch").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	close(sender)
+}
@@ -0,0 +1,157 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+// This file contains the implementation of SQS FIFO queue handling and of the continuation
+// of messages whose processing outlives the SQS visibility limit.
+//
+// FIFO queues deliver the messages within a message group in order and will not deliver
+// another message from a group while one is being processed, so that for example
+// messages grouped using a user ID are run one at a time, in order, for each user.  For
+// this reason messages are not deleted while they are being processed, their visibility
+// is extended using the receipt handle they were received with.
+//
+// SQS will not extend the visibility of a message beyond 12 hours from when it was
+// received.  When the runner is still working on a message as this limit approaches it
+// publishes a continuation, a copy of the message within the same message group, deletes
+// the original and then receives the continuation itself so that the work remains owned
+// by the runner.  This is done for both standard and FIFO queues.
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// fifoSuffix is the mandatory suffix for the names of SQS FIFO queues
+	fifoSuffix = ".fifo"
+
+	// continuationAttribute holds the number of times a message has been continued
+	continuationAttribute = "StudioContinuation"
+
+	// continuationOfAttribute holds the ID of the message that was first received
+	// for a chain of continuations
+	continuationOfAttribute = "StudioContinuationOf"
+
+	// continuationReclaimAttempts is the number of receives that will be tried when
+	// looking for a continuation that has just been published
+	continuationReclaimAttempts = 5
+)
+
+// isFIFO is used to test a queue name, or URL, for an SQS FIFO queue
+//
+func isFIFO(queue string) bool {
+	return strings.HasSuffix(queue, fifoSuffix)
+}
+
+// continuationInput creates the message that continues the processing of a message
+// whose visibility can no longer be extended
+//
+func continuationInput(urlString string, msg *sqs.Message) (input *sqs.SendMessageInput) {
+	attrs := make(map[string]*sqs.MessageAttributeValue, len(msg.MessageAttributes)+2)
+	for name, value := range msg.MessageAttributes {
+		attrs[name] = value
+	}
+
+	count := 1
+	if attr, isPresent := attrs[continuationAttribute]; isPresent && attr != nil {
+		if previous, errGo := strconv.Atoi(aws.StringValue(attr.StringValue)); errGo == nil {
+			count = previous + 1
+		}
+	}
+	origin := aws.StringValue(msg.MessageId)
+	if attr, isPresent := attrs[continuationOfAttribute]; isPresent && attr != nil && len(aws.StringValue(attr.StringValue)) != 0 {
+		origin = aws.StringValue(attr.StringValue)
+	}
+
+	attrs[continuationAttribute] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(count)),
+	}
+	attrs[continuationOfAttribute] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(origin),
+	}
+
+	input = &sqs.SendMessageInput{
+		QueueUrl:          aws.String(urlString),
+		MessageBody:       msg.Body,
+		MessageAttributes: attrs,
+	}
+	if isFIFO(urlString) {
+		// The continuation stays within the group of the original message, and is
+		// deduplicated should the send be retried
+		input.MessageGroupId = msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		input.MessageDeduplicationId = aws.String(origin + "-" + strconv.Itoa(count))
+	}
+	return input
+}
+
+// continueMsg publishes a continuation for a message, deletes the message, and then attempts
+// to receive the continuation.  If the continuation could not be received it remains in the
+// queue for another runner to resume the work.
+//
+func (sq *SQS) continueMsg(svc *sqs.SQS, urlString string, msg *sqs.Message, visTimeout int64) (next *sqs.Message, published bool, err kv.Error) {
+	sent, errGo := svc.SendMessage(continuationInput(urlString, msg))
+	if errGo != nil {
+		err = kv.Wrap(errGo).With("url", urlString).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if _, errGo = svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(urlString),
+		ReceiptHandle: msg.ReceiptHandle,
+	}); errGo != nil && err == nil {
+		err = kv.Wrap(errGo).With("url", urlString).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if sent == nil || sent.MessageId == nil {
+		return nil, false, err
+	}
+
+	next, errReclaim := sq.reclaim(svc, urlString, *sent.MessageId, visTimeout)
+	if errReclaim != nil && err == nil {
+		err = errReclaim
+	}
+	return next, true, err
+}
+
+// reclaim receives a continuation that has just been published, other messages that are
+// received while looking for it are returned to the queue
+//
+func (sq *SQS) reclaim(svc *sqs.SQS, urlString string, id string, visTimeout int64) (msg *sqs.Message, err kv.Error) {
+	waitTimeout := int64(1)
+	for attempt := 0; attempt < continuationReclaimAttempts; attempt++ {
+		msgs, errGo := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(urlString),
+			VisibilityTimeout:     aws.Int64(visTimeout),
+			WaitTimeSeconds:       aws.Int64(waitTimeout),
+			MaxNumberOfMessages:   aws.Int64(10),
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("url", urlString).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, received := range msgs.Messages {
+			if aws.StringValue(received.MessageId) == id {
+				msg = received
+				continue
+			}
+			_, _ = svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(urlString),
+				ReceiptHandle:     received.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+		}
+		if msg != nil {
+			return msg, nil
+		}
+	}
+	return nil, kv.NewError("continuation not received").With("url", urlString, "message_id", id).With("stack", stack.Trace().TrimRuntime())
+}
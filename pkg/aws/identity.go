@@ -0,0 +1,234 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+// This file contains the implementation of AWS identities that are obtained from the
+// environment the runner is deployed into, rather than from credential files.  Identities
+// are declared as a list of regions with optional role ARNs, using the default AWS credential
+// chain, which covers EC2 instance profiles, ECS task roles, and EKS IRSA web identity tokens,
+// as the source of the base credentials.  Credentials obtained in this way are refreshed
+// by the AWS SDK before they expire.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/andreidenissov-cog/go-service/pkg/aws_gsc"
+
+	"github.com/go-stack/stack"
+	"github.com/go-yaml/yaml"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// identityCredPrefix is used within the credentials descriptor of SQS projects that
+	// use identities rather than credential files
+	identityCredPrefix = "identity:"
+
+	// identityExpiryWindow is the period before the expiry of temporary credentials
+	// at which they will be refreshed
+	identityExpiryWindow = 5 * time.Minute
+)
+
+// SQSIdentity declares an AWS identity that the runner will use to discover and
+// service SQS queues.  When only the region is specified the default credential chain
+// is used.  When a role ARN is specified the role is assumed using the default credential
+// chain, or if a web identity token file is also specified using the web identity token.
+//
+type SQSIdentity struct {
+	Name                 string `json:"name" yaml:"name"`
+	Region               string `json:"region" yaml:"region"`
+	RoleARN              string `json:"role_arn,omitempty" yaml:"role_arn,omitempty"`
+	ExternalID           string `json:"external_id,omitempty" yaml:"external_id,omitempty"`
+	SessionName          string `json:"session_name,omitempty" yaml:"session_name,omitempty"`
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty" yaml:"web_identity_token_file,omitempty"`
+	EndpointURL          string `json:"endpoint_url,omitempty" yaml:"endpoint_url,omitempty"`
+}
+
+type identityCred struct {
+	identity SQSIdentity
+	cred     *aws_gsc.AWSCred
+}
+
+var (
+	// identityCreds holds the credentials for identities, these are retained between
+	// refreshes of the identities so that the SDK can cache and renew temporary credentials
+	identityCreds = map[string]*identityCred{}
+	identityLock  sync.Mutex
+)
+
+// ParseSQSIdentities extracts a list of identities from a YAML, or JSON, document
+//
+func ParseSQSIdentities(data []byte) (identities []SQSIdentity, err kv.Error) {
+	identities = []SQSIdentity{}
+	if errGo := yaml.UnmarshalStrict(data, &identities); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	names := make(map[string]struct{}, len(identities))
+	for i, identity := range identities {
+		if len(identity.Region) == 0 {
+			return nil, kv.NewError("region missing").With("identity", i).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(identity.WebIdentityTokenFile) != 0 && len(identity.RoleARN) == 0 {
+			return nil, kv.NewError("web identity requires a role ARN").With("identity", i, "region", identity.Region).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(identity.Name) == 0 {
+			identities[i].Name = identity.Region
+			if len(identity.RoleARN) != 0 {
+				identities[i].Name = identity.Region + "-" + identity.RoleARN[strings.LastIndex(identity.RoleARN, "/")+1:]
+			}
+		}
+		if strings.ContainsAny(identities[i].Name, ",:") {
+			return nil, kv.NewError("identity name invalid").With("identity", identities[i].Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if _, isPresent := names[identities[i].Name]; isPresent {
+			return nil, kv.NewError("identity name duplicated").With("identity", identities[i].Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		names[identities[i].Name] = struct{}{}
+	}
+	return identities, nil
+}
+
+// LoadSQSIdentities reads the list of identities from the named file
+//
+func LoadSQSIdentities(fn string) (identities []SQSIdentity, err kv.Error) {
+	data, errGo := os.ReadFile(filepath.Clean(fn))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if identities, err = ParseSQSIdentities(data); err != nil {
+		return nil, err.With("file", fn)
+	}
+	return identities, nil
+}
+
+// IdentityCreds returns the credentials descriptor for an identity that is used when
+// creating SQS task queues
+//
+func (identity *SQSIdentity) IdentityCreds() (creds string) {
+	return identityCredPrefix + identity.Name
+}
+
+func (identity *SQSIdentity) newCred() (cred *aws_gsc.AWSCred, err kv.Error) {
+	sess, errGo := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:                        aws.String(identity.Region),
+			CredentialsChainVerboseErrors: aws.Bool(true),
+		},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("identity", identity.Name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	sessionName := identity.SessionName
+	if len(sessionName) == 0 {
+		host, _ := os.Hostname()
+		sessionName = "studio-go-runner-" + host
+	}
+	// Role session names are limited in length by AWS
+	if len(sessionName) > 64 {
+		sessionName = sessionName[:64]
+	}
+
+	var creds *credentials.Credentials
+	switch {
+	case len(identity.WebIdentityTokenFile) != 0:
+		provider := stscreds.NewWebIdentityRoleProvider(sts.New(sess), identity.RoleARN, sessionName, identity.WebIdentityTokenFile)
+		provider.ExpiryWindow = identityExpiryWindow
+		creds = credentials.NewCredentials(provider)
+	case len(identity.RoleARN) != 0:
+		creds = stscreds.NewCredentials(sess, identity.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = sessionName
+			provider.ExpiryWindow = identityExpiryWindow
+			if len(identity.ExternalID) != 0 {
+				provider.ExternalID = aws.String(identity.ExternalID)
+			}
+		})
+	default:
+		creds = sess.Config.Credentials
+	}
+
+	return &aws_gsc.AWSCred{
+		Project: "aws_" + identity.Name,
+		Region:  identity.Region,
+		Creds:   creds,
+	}, nil
+}
+
+// cred returns the credentials for an identity, credentials are only
+// created when the identity is first seen or its definition has changed
+//
+func (identity *SQSIdentity) cred() (cred *aws_gsc.AWSCred, err kv.Error) {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+
+	if existing, isPresent := identityCreds[identity.Name]; isPresent && reflect.DeepEqual(existing.identity, *identity) {
+		return existing.cred, nil
+	}
+
+	if cred, err = identity.newCred(); err != nil {
+		return nil, err
+	}
+	identityCreds[identity.Name] = &identityCred{
+		identity: *identity,
+		cred:     cred,
+	}
+	return cred, nil
+}
+
+// lookupIdentityCred retrieves the credentials, and the SQS endpoint, for an identity descriptor
+//
+func lookupIdentityCred(creds string) (cred *aws_gsc.AWSCred, endpoint string, err kv.Error) {
+	name := strings.TrimPrefix(creds, identityCredPrefix)
+
+	identityLock.Lock()
+	defer identityLock.Unlock()
+
+	existing, isPresent := identityCreds[name]
+	if !isPresent {
+		return nil, "", kv.NewError("identity not known").With("identity", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return existing.cred, existing.identity.EndpointURL, nil
+}
+
+// IsIdentityCreds is used to test if a credentials descriptor is for an identity
+//
+func IsIdentityCreds(creds string) (isIdentity bool) {
+	return strings.HasPrefix(creds, identityCredPrefix)
+}
+
+// GetSQSIdentityProjects validates that the identity is able to access SQS and returns the
+// main URLs for the SQS servers accessible to it
+//
+func GetSQSIdentityProjects(ctx context.Context, identity *SQSIdentity) (urls map[string]struct{}, err kv.Error) {
+	cred, err := identity.cred()
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieving the credentials up front gives a more precise error when the identity
+	// is not usable than the listing of queues would
+	if _, errGo := cred.Creds.GetWithContext(ctx); errGo != nil {
+		return nil, kv.Wrap(errGo, "identity credentials unavailable").With("identity", identity.Name, "region", identity.Region).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	q := newSQS("aws_probe", cred, identity.EndpointURL, nil, nil)
+	found, err := q.refresh(nil, nil)
+	if err != nil {
+		return nil, kv.Wrap(err, "failed to refresh sqs").With("identity", identity.Name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return projectURLs(found), nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+import (
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/go-test/deep"
+	"github.com/jjeffery/kv"
+)
+
+// TestParseSQSIdentities checks the declarative identity documents used for
+// ambient AWS credentials
+func TestParseSQSIdentities(t *testing.T) {
+	doc := `
+- region: us-west-2
+- region: us-east-1
+  role_arn: arn:aws:iam::123456789012:role/studioml-runner
+  external_id: studioml
+- name: irsa
+  region: eu-west-1
+  role_arn: arn:aws:iam::123456789012:role/studioml-irsa
+  web_identity_token_file: /var/run/secrets/eks.amazonaws.com/serviceaccount/token
+`
+	identities, err := ParseSQSIdentities([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SQSIdentity{
+		{Name: "us-west-2", Region: "us-west-2"},
+		{Name: "us-east-1-studioml-runner", Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/studioml-runner", ExternalID: "studioml"},
+		{Name: "irsa", Region: "eu-west-1", RoleARN: "arn:aws:iam::123456789012:role/studioml-irsa", WebIdentityTokenFile: "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+	}
+	if diff := deep.Equal(expected, identities); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// JSON documents are also accepted
+	if identities, err = ParseSQSIdentities([]byte(`[{"region": "us-west-2"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].IdentityCreds() != "identity:us-west-2" || !IsIdentityCreds(identities[0].IdentityCreds()) {
+		t.Fatal(kv.NewError("unexpected identity").With("identities", identities).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	invalid := []string{
+		`[{"role_arn": "arn:aws:iam::123456789012:role/r"}]`,
+		`[{"region": "us-west-2", "web_identity_token_file": "/token"}]`,
+		`[{"region": "us-west-2"}, {"region": "us-west-2"}]`,
+		`[{"region": "us-west-2", "access_key": "AKIA"}]`,
+	}
+	for _, aCase := range invalid {
+		if _, err = ParseSQSIdentities([]byte(aCase)); err == nil {
+			t.Fatal(kv.NewError("invalid identities accepted").With("doc", aCase).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+}
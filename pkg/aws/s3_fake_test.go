@@ -0,0 +1,149 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+// This file contains a minimal in-process stand-in for an S3 server that supports
+// the path style object operations used for large SQS message payloads
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeS3 struct {
+	server   *httptest.Server
+	objects  map[string][]byte
+	accesses map[string]int
+	sync.Mutex
+}
+
+func newFakeS3() (fake *fakeS3) {
+	fake = &fakeS3{
+		objects:  map[string][]byte{},
+		accesses: map[string]int{},
+	}
+	fake.server = httptest.NewServer(fake)
+	return fake
+}
+
+func (fake *fakeS3) Close() {
+	fake.server.Close()
+}
+
+func (fake *fakeS3) put(name string, data []byte) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.objects[name] = data
+}
+
+// get retrieves an object using its bucket/key name
+func (fake *fakeS3) get(name string) (data []byte, isPresent bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	data, isPresent = fake.objects[name]
+	return data, isPresent
+}
+
+func (fake *fakeS3) remove(name string) {
+	fake.Lock()
+	defer fake.Unlock()
+	delete(fake.objects, name)
+}
+
+// requests returns the number of requests made for an object using its bucket/key name
+func (fake *fakeS3) requests(name string) (count int) {
+	fake.Lock()
+	defer fake.Unlock()
+	return fake.accesses[name]
+}
+
+func (fake *fakeS3) keys() (keys []string) {
+	fake.Lock()
+	defer fake.Unlock()
+	keys = make([]string, 0, len(fake.objects))
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// decodeChunked extracts the data from an aws-chunked body that is used by
+// clients for streaming signed uploads
+func decodeChunked(body io.Reader) (data []byte, err error) {
+	buffer := &bytes.Buffer{}
+	reader := bufio.NewReader(body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(buffer, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err = reader.Discard(2); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return buffer.Bytes(), nil
+		}
+	}
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+
+	fake.Lock()
+	fake.accesses[name]++
+	fake.Unlock()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, isPresent := fake.get(name)
+		if !isPresent {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Key>%s</Key></Error>`, name)
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"fake"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = decodeChunked(bytes.NewReader(data))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.put(name, data)
+		w.Header().Set("ETag", `"fake"`)
+
+	case http.MethodDelete:
+		fake.remove(name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
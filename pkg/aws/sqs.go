@@ -6,25 +6,30 @@ package aws_ext
 // as they are used by studioML
 
 import (
+	"bufio"
 	"context"
 	"crypto/rsa"
 	"flag"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rs/xid"
 
 	"github.com/andreidenissov-cog/go-service/pkg/aws_gsc"
 	"github.com/andreidenissov-cog/go-service/pkg/log"
 	"github.com/andreidenissov-cog/go-service/pkg/server"
 
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
 	"github.com/leaf-ai/studio-go-runner/internal/task"
 	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
 
@@ -33,36 +38,120 @@ import (
 )
 
 var (
-	sqsTimeoutOpt = flag.Duration("sqs-timeout", time.Duration(15*time.Second), "the period of time for discrete SQS operations to use for timeouts")
+	sqsTimeoutOpt  = flag.Duration("sqs-timeout", time.Duration(15*time.Second), "the period of time for discrete SQS operations to use for timeouts")
+	sqsEndpointOpt = flag.String("sqs-endpoint", "", "an optional endpoint URL used for SQS operations in place of the AWS endpoint for the region, for example http://localhost:9324 when using ElasticMQ")
+)
+
+const (
+	// defaultVisibility is the visibility timeout, in seconds, used for messages being
+	// processed, it is extended at the half way mark until the work is done
+	defaultVisibility = int64(30)
+
+	// defaultHardVisibility is the period after which a message being processed is
+	// continued, or deleted from the queue, as SQS will not extend the visibility beyond 12 hours
+	defaultHardVisibility = 12*time.Hour - 10*time.Minute
 )
 
 // SQS encapsulates an AWS based SQS queue and associated it with a project
 //
 type SQS struct {
-	project string           // Fully qualified SQS queue reference
-	creds   *aws_gsc.AWSCred // AWS credentials for access queues
-	wrapper wrapper.Wrapper  // Decryption information for messages with encrypted payloads
-	logger  *log.Logger
+	project        string           // Fully qualified SQS queue reference
+	creds          *aws_gsc.AWSCred // AWS credentials for access queues
+	endpoint       string           // Optional endpoint URL that overrides the AWS endpoint for the region
+	visibility     int64            // Visibility timeout in seconds for messages being processed
+	hardVisibility time.Duration    // Period after which messages still being processed are continued
+	wrapper        wrapper.Wrapper  // Decryption information for messages with encrypted payloads
+	logger         *log.Logger
+}
+
+func newSQS(project string, creds *aws_gsc.AWSCred, endpoint string, w wrapper.Wrapper, l *log.Logger) (queue *SQS) {
+	if len(endpoint) == 0 {
+		endpoint = *sqsEndpointOpt
+	}
+	return &SQS{
+		project:        project,
+		creds:          creds,
+		endpoint:       endpoint,
+		visibility:     defaultVisibility,
+		hardVisibility: defaultHardVisibility,
+		wrapper:        w,
+		logger:         l,
+	}
+}
+
+// SQSEndpoint returns the endpoint URL that will be used for SQS operations with the
+// supplied credentials files.  An endpoint_url entry within the files is used in
+// preference to the sqs-endpoint option.  An empty string indicates that the AWS
+// endpoint for the region is to be used.
+//
+func SQSEndpoint(credFiles []string) (endpoint string) {
+	for _, aFile := range credFiles {
+		f, errGo := os.Open(filepath.Clean(aFile))
+		if errGo != nil {
+			continue
+		}
+		scan := bufio.NewScanner(f)
+		for scan.Scan() {
+			line := strings.Replace(scan.Text(), " ", "", -1)
+			if strings.HasPrefix(strings.ToLower(line), "endpoint_url=") {
+				endpoint = strings.SplitN(line, "=", 2)[1]
+				break
+			}
+		}
+		f.Close()
+		if len(endpoint) != 0 {
+			return endpoint
+		}
+	}
+	return *sqsEndpointOpt
+}
+
+// client creates an SQS service client using the queues credentials and endpoint
+//
+func (sq *SQS) client() (svc *sqs.SQS, err kv.Error) {
+	cfg := aws.Config{
+		Region:                        aws.String(sq.creds.Region),
+		Credentials:                   sq.creds.Creds,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+	if len(sq.endpoint) != 0 {
+		cfg.Endpoint = aws.String(sq.endpoint)
+	}
+
+	sess, errGo := session.NewSessionWithOptions(session.Options{
+		Config:  cfg,
+		Profile: "default",
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds, "endpoint", sq.endpoint)
+	}
+	return sqs.New(sess), nil
 }
 
 // NewSQS creates an SQS data structure using set set of credentials (creds) for
 // an sqs queue (sqs)
 //
 func NewSQS(project string, creds string, w wrapper.Wrapper, l *log.Logger) (queue *SQS, err kv.Error) {
-	// Use the creds directory to locate all of the credentials for AWS within
-	// a hierarchy of directories
-
-	awsCreds, err := aws_gsc.AWSExtractCreds(strings.Split(creds, ","), "default")
-	if err != nil {
-		return nil, err
+	awsCreds := &aws_gsc.AWSCred{}
+	endpoint := ""
+
+	if IsIdentityCreds(creds) {
+		// Identities use credentials obtained from the environment that are
+		// refreshed by the AWS SDK
+		if awsCreds, endpoint, err = lookupIdentityCred(creds); err != nil {
+			return nil, err
+		}
+	} else {
+		// Use the creds directory to locate all of the credentials for AWS within
+		// a hierarchy of directories
+		files := strings.Split(creds, ",")
+		if awsCreds, err = aws_gsc.AWSExtractCreds(files, "default"); err != nil {
+			return nil, err
+		}
+		endpoint = SQSEndpoint(files)
 	}
 
-	return &SQS{
-		project: project,
-		creds:   awsCreds,
-		wrapper: w,
-		logger:  l,
-	}, nil
+	return newSQS(project, awsCreds, endpoint, w, l), nil
 }
 
 // GetSQSProjects can be used to get a list of the SQS servers and the main URLs that are accessible to them
@@ -77,6 +166,12 @@ func GetSQSProjects(credFiles []string) (urls map[string]struct{}, err kv.Error)
 		return urls, kv.Wrap(err, "failed to refresh sqs").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	return projectURLs(found), nil
+}
+
+// projectURLs extracts the main URLs of the SQS servers from a list of queue URLs
+//
+func projectURLs(found []string) (urls map[string]struct{}) {
 	urls = make(map[string]struct{}, len(found))
 	for _, urlStr := range found {
 		qURL, err := url.Parse(urlStr)
@@ -87,27 +182,16 @@ func GetSQSProjects(credFiles []string) (urls map[string]struct{}, err kv.Error)
 		qURL.Path = strings.Join(segments[:len(segments)-1], "/")
 		urls[qURL.String()] = struct{}{}
 	}
-
-	return urls, nil
+	return urls
 }
 
 func (sq *SQS) listQueues(qNameMatch *regexp.Regexp, qNameMismatch *regexp.Regexp) (queues *sqs.ListQueuesOutput, err kv.Error) {
 
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
-
-	if errGo != nil {
-		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
-	}
-
 	// Create a SQS service client.
-	svc := sqs.New(sess)
+	svc, err := sq.client()
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *sqsTimeoutOpt)
 	defer cancel()
@@ -243,21 +327,11 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 	qt.ShortQName = items[len(items)-1]
 	hostName, _ := os.Hostname()
 
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
-
-	if errGo != nil {
-		return false, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
-	}
-
 	// Create a SQS service client.
-	svc := sqs.New(sess)
+	svc, err := sq.client()
+	if err != nil {
+		return false, nil, err
+	}
 
 	defer func() {
 		defer func() {
@@ -267,14 +341,20 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 		}()
 	}()
 
-	visTimeout := int64(30)
+	visTimeout := sq.visibility
 	waitTimeout := int64(5)
-	msgs, errGo := svc.ReceiveMessageWithContext(ctx,
-		&sqs.ReceiveMessageInput{
-			QueueUrl:          &urlString,
-			VisibilityTimeout: &visTimeout,
-			WaitTimeSeconds:   &waitTimeout,
-		})
+	receive := &sqs.ReceiveMessageInput{
+		QueueUrl:              &urlString,
+		VisibilityTimeout:     &visTimeout,
+		WaitTimeSeconds:       &waitTimeout,
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String("All")},
+	}
+	if isFIFO(urlString) {
+		// Allows SQS to return the same messages should the SDK retry the receive
+		receive.ReceiveRequestAttemptId = aws.String(xid.New().String())
+	}
+	msgs, errGo := svc.ReceiveMessageWithContext(ctx, receive)
 	if errGo != nil {
 		return false, nil, kv.Wrap(errGo).With("credentials", sq.creds, "url", urlString).With("stack", stack.Trace().TrimRuntime())
 	}
@@ -289,16 +369,23 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 	default:
 	}
 
-	var taskMessage *sqs.Message = nil
+	// taskMessage is owned by the visibility extender until it is done, as it
+	// will be replaced should the message need to be continued
+	taskMessage := msgs.Messages[0]
+	qt.MsgGroup = aws.StringValue(taskMessage.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+
 	msgForceDeleted := false
-	hardVisibilityTimeout := 12*time.Hour - 10*time.Minute
-	visExtensionLimit := time.Now().Add(hardVisibilityTimeout)
+	msgContinued := false
+	visExtensionLimit := time.Now().Add(sq.hardVisibility)
 	// Start a visbility timeout extender that runs until the work is done
 	// Changing the timeout restarts the timer on the SQS side, for more information
 	// see http://docs.aws.amazon.com/AWSSimpleQueueService/latest/SQSDeveloperGuide/sqs-visibility-timeout.html
 	//
 	quitC := make(chan struct{})
+	extenderDoneC := make(chan struct{})
 	go func() {
+		defer close(extenderDoneC)
+
 		timeout := time.Duration(int(visTimeout / 2))
 		for {
 			select {
@@ -306,22 +393,31 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 				if visExtensionLimit.Before(time.Now()) {
 					// Message has reached hard SQS visibility timeout,
 					// and processing still not finished.
-					// Our approach here is to delete the message to avoid task resubmit
-					// and continue processing.
-					_, errGo := svc.DeleteMessage(&sqs.DeleteMessageInput{
-						QueueUrl:      &urlString,
-						ReceiptHandle: taskMessage.ReceiptHandle,
-					})
+					// Our approach here is to publish a continuation of the message,
+					// within the same message group for FIFO queues, delete the original,
+					// and take ownership of the continuation.  Should the continuation
+					// not be received we continue processing and leave the continuation
+					// for another runner.
+					next, published, errCont := sq.continueMsg(svc, urlString, taskMessage, visTimeout)
+					if next != nil {
+						taskMessage = next
+						visExtensionLimit = time.Now().Add(sq.hardVisibility)
+						if qt.QueueLogger != nil {
+							qt.QueueLogger.Warn("SQS-QUEUE: Hard SQS visibility limit reached. CONTINUED msg on queue: ", qt.ShortQName, "message_id", aws.StringValue(next.MessageId), "group", qt.MsgGroup, "error", visError(errCont), "host: ", hostName)
+						}
+						continue
+					}
 					msgForceDeleted = true
+					msgContinued = published
 					if qt.QueueLogger != nil {
-						qt.QueueLogger.Debug("SQS-QUEUE: Hard SQS visibility limit reached. DELETE msg from queue: ", qt.ShortQName, "error", visError(errGo), "host: ", hostName)
+						qt.QueueLogger.Warn("SQS-QUEUE: Hard SQS visibility limit reached. DELETE msg from queue: ", qt.ShortQName, "continued", published, "error", visError(errCont), "host: ", hostName)
 					}
 					return
 				}
 
 				if _, errGo := svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
 					QueueUrl:          &urlString,
-					ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
+					ReceiptHandle:     taskMessage.ReceiptHandle,
 					VisibilityTimeout: &visTimeout,
 				}); errGo != nil {
 					// Once the 1/2 way mark is reached continue to try to change the
@@ -340,17 +436,28 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 		}
 	}()
 
-	taskMessage = msgs.Messages[0]
+	// Messages with large payloads hold a pointer to the payload in S3, messages that
+	// cannot be retrieved are returned to the queue without being handled
+	payload, pointer, err := sq.fetchPayload(ctx, taskMessage)
+	payloadFailed := err != nil
+
 	qt.Msg = nil
-	qt.Msg = []byte(*taskMessage.Body)
+	qt.Msg = payload
 
-	rsc, ack, err := qt.Handler(ctx, qt)
+	rsc := (*server.Resource)(nil)
+	ack := false
+	if err == nil {
+		rsc, ack, err = qt.Handler(ctx, qt)
+	}
 	errMsg := "no error"
 	if err != nil {
 		errMsg = err.Error()
 	}
 	close(quitC)
 
+	// Wait for the extender to stop so that its view of the message is settled
+	<-extenderDoneC
+
 	if !msgForceDeleted {
 		if ack {
 			// Delete the message
@@ -363,11 +470,15 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 			}
 			resource = rsc
 		} else {
-			// Set visibility timeout to 0, in other words Nack the message
+			// Set visibility timeout to 0, in other words Nack the message, unless
+			// the payload could not be retrieved in which case redelivery is delayed
 			visTimeout = 0
+			if payloadFailed {
+				visTimeout = payloadRetryVisibility(taskMessage)
+			}
 			svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
 				QueueUrl:          &urlString,
-				ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
+				ReceiptHandle:     taskMessage.ReceiptHandle,
 				VisibilityTimeout: &visTimeout,
 			})
 			if qt.QueueLogger != nil {
@@ -380,6 +491,14 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 		}
 	}
 
+	// Once the message is gone from the queue its payload is no longer needed, unless
+	// a continuation that refers to it was left for another runner
+	if pointer != nil && ((ack && !msgForceDeleted) || (msgForceDeleted && !msgContinued)) {
+		if errRemove := sq.removePayload(ctx, pointer); errRemove != nil && qt.QueueLogger != nil {
+			qt.QueueLogger.Warn("SQS-QUEUE: payload not removed for queue: ", qt.ShortQName, "bucket", pointer.Bucket, "key", pointer.Key, "error", errRemove.Error(), "host: ", hostName)
+		}
+	}
+
 	return true, resource, err
 }
 
@@ -401,21 +520,125 @@ func (sq *SQS) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error
 
 // Responder is used to open a connection to an existing response queue if
 // one was made available and also to provision a channel into which the
-// runner can place report messages
-func (sq *SQS) Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error) {
+// runner can place report messages.  Messages that are too large to be sent
+// using SQS are stored in S3 and sent as extended client pointers.  Responses
+// sent to FIFO queues use the message group of the request the task is working on.
+func (sq *SQS) Responder(ctx context.Context, qt *task.QueueTask, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error) {
+	if encryptKey == nil {
+		return nil, kv.NewError("response queue encryption key missing").With("subscription", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	svc, err := sq.client()
+	if err != nil {
+		return nil, err
+	}
+
+	urlString := sq.project + "/" + subscription
+
+	// Responses sent to FIFO queues share the message group of the request so that they
+	// are ordered alongside the requests of the group, each response from this responder
+	// has its own deduplication ID
+	responderID := xid.New().String()
+	sequence := 0
+
 	sender = make(chan string, 1)
 	// Open the queue and if this cannot be done exit with the error
 	go func() {
 		for {
 			select {
-			case <-sender:
-				continue
+			case msg, isOpen := <-sender:
+				if !isOpen {
+					return
+				}
+				if len(msg) == 0 {
+					continue
+				}
+				sequence++
+				group, dedup := "", ""
+				if isFIFO(subscription) {
+					// The group is read as each response is sent as the request, and its
+					// group, will not have been received when the responder was started
+					if group = qt.MsgGroup; len(group) == 0 {
+						group = responderID
+					}
+					dedup = responderID + "-" + strconv.Itoa(sequence)
+				}
+				if err := sq.respond(ctx, svc, urlString, subscription, msg, encryptKey, group, dedup); err != nil && sq.logger != nil {
+					sq.logger.Warn("response not sent", "subscription", subscription, "error", err.Error())
+				}
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	return sender, err
+	return sender, nil
+}
+
+// respond encrypts and sends a single message to a response queue, FIFO queues
+// also require the message group and a deduplication ID
+//
+func (sq *SQS) respond(ctx context.Context, svc *sqs.SQS, urlString string, subscription string, msg string, encryptKey *rsa.PublicKey,
+	group string, dedup string) (err kv.Error) {
+	body, err := defense.HybridSeal([]byte(msg), encryptKey)
+	if err != nil {
+		return err
+	}
+	return sq.send(ctx, svc, urlString, subscription, []byte(body), group, dedup)
+}
+
+// Publish sends a message to the named queue within the project, for example a
+// request for work from a client.  FIFO queues require a message group, if one is
+// not supplied a new group is used for the message.
+//
+func (sq *SQS) Publish(ctx context.Context, subscription string, msg []byte, group string) (err kv.Error) {
+	svc, err := sq.client()
+	if err != nil {
+		return err
+	}
+
+	dedup := ""
+	if isFIFO(subscription) {
+		if len(group) == 0 {
+			group = xid.New().String()
+		}
+		dedup = xid.New().String()
+	} else {
+		group = ""
+	}
+	return sq.send(ctx, svc, sq.project+"/"+subscription, subscription, msg, group, dedup)
+}
+
+// send places a single message onto a queue, storing the message in S3 should it be
+// too large to be sent using SQS
+//
+func (sq *SQS) send(ctx context.Context, svc *sqs.SQS, urlString string, subscription string, msg []byte,
+	group string, dedup string) (err kv.Error) {
+
+	body := string(msg)
+	attrs := map[string]*sqs.MessageAttributeValue(nil)
+	if len(body) > sqsMessageLimit {
+		if body, attrs, err = sq.storePayload(ctx, subscription, msg); err != nil {
+			return err
+		}
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, *sqsTimeoutOpt)
+	defer cancel()
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(urlString),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attrs,
+	}
+	if len(group) != 0 {
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = aws.String(dedup)
+	}
+
+	if _, errGo := svc.SendMessageWithContext(sendCtx, input); errGo != nil {
+		return kv.Wrap(errGo).With("url", urlString).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
 }
 
 func (sq *SQS) GetQueuesRefreshInterval() time.Duration {
@@ -0,0 +1,260 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+// This file contains a minimal in-process stand-in for an SQS server, in the style of
+// ElasticMQ, that implements the query protocol actions used by the runner
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeSQSMsg struct {
+	id        string
+	body      string
+	attrs     map[string]string
+	group     string
+	dedup     string
+	receipt   string
+	visibleAt time.Time
+	received  int
+}
+
+type fakeSQS struct {
+	server   *httptest.Server
+	queues   map[string][]*fakeSQSMsg
+	actions  map[string]int
+	sequence int
+	rejects  bool // Causes messages sent to the fake to be rejected
+	sync.Mutex
+}
+
+func newFakeSQS(queues ...string) (fake *fakeSQS) {
+	fake = &fakeSQS{
+		queues:  map[string][]*fakeSQSMsg{},
+		actions: map[string]int{},
+	}
+	for _, q := range queues {
+		fake.queues[q] = []*fakeSQSMsg{}
+	}
+	fake.server = httptest.NewServer(fake)
+	return fake
+}
+
+func (fake *fakeSQS) Close() {
+	fake.server.Close()
+}
+
+// project returns the base URL for queues hosted by the fake
+func (fake *fakeSQS) project() string {
+	return fake.server.URL + "/000000000000"
+}
+
+func (fake *fakeSQS) send(q string, body string) {
+	fake.sendAttrs(q, body, nil)
+}
+
+// sendAttrs queues a message with Number message attributes
+func (fake *fakeSQS) sendAttrs(q string, body string, attrs map[string]string) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.enqueue(q, body, attrs)
+}
+
+// sendGroup queues a message within a message group of a FIFO queue
+func (fake *fakeSQS) sendGroup(q string, body string, group string) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.enqueue(q, body, nil).group = group
+}
+
+func (fake *fakeSQS) addQueue(q string) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.queues[q] = []*fakeSQSMsg{}
+}
+
+func (fake *fakeSQS) rejectSends(reject bool) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.rejects = reject
+}
+
+func (fake *fakeSQS) enqueue(q string, body string, attrs map[string]string) (msg *fakeSQSMsg) {
+	fake.sequence++
+	msg = &fakeSQSMsg{
+		id:    fmt.Sprintf("msg-%d", fake.sequence),
+		body:  body,
+		attrs: attrs,
+	}
+	fake.queues[q] = append(fake.queues[q], msg)
+	return msg
+}
+
+func (fake *fakeSQS) messages(q string) (msgs []fakeSQSMsg) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	msgs = []fakeSQSMsg{}
+	for _, msg := range fake.queues[q] {
+		msgs = append(msgs, *msg)
+	}
+	return msgs
+}
+
+func (fake *fakeSQS) count(action string) int {
+	fake.Lock()
+	defer fake.Unlock()
+	return fake.actions[action]
+}
+
+func (fake *fakeSQS) queueName(r *http.Request) string {
+	segments := strings.Split(r.Form.Get("QueueUrl"), "/")
+	return segments[len(segments)-1]
+}
+
+func (fake *fakeSQS) find(q string, receipt string) (msg *fakeSQSMsg, idx int) {
+	for i, msg := range fake.queues[q] {
+		if msg.receipt == receipt {
+			return msg, i
+		}
+	}
+	return nil, -1
+}
+
+func (fake *fakeSQS) fail(w http.ResponseWriter, code string, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>fake</RequestId></ErrorResponse>`, code, msg)
+}
+
+func (fake *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if errGo := r.ParseForm(); errGo != nil {
+		fake.fail(w, "InvalidParameterValue", errGo.Error())
+		return
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	action := r.Form.Get("Action")
+	fake.actions[action]++
+
+	q := fake.queueName(r)
+
+	switch action {
+	case "ListQueues":
+		fmt.Fprint(w, `<ListQueuesResponse><ListQueuesResult>`)
+		for name := range fake.queues {
+			fmt.Fprintf(w, `<QueueUrl>%s/%s</QueueUrl>`, fake.project(), name)
+		}
+		fmt.Fprint(w, `</ListQueuesResult><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></ListQueuesResponse>`)
+
+	case "ReceiveMessage":
+		visibility, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		max, _ := strconv.Atoi(r.Form.Get("MaxNumberOfMessages"))
+		if max == 0 {
+			max = 1
+		}
+		// FIFO queues do not deliver messages from a group that has a message in flight
+		blocked := map[string]struct{}{}
+		fmt.Fprint(w, `<ReceiveMessageResponse><ReceiveMessageResult>`)
+		for _, msg := range fake.queues[q] {
+			if _, isBlocked := blocked[msg.group]; isBlocked && len(msg.group) != 0 {
+				continue
+			}
+			if msg.visibleAt.After(time.Now()) {
+				blocked[msg.group] = struct{}{}
+				continue
+			}
+			if max == 0 {
+				break
+			}
+			max--
+			blocked[msg.group] = struct{}{}
+
+			fake.sequence++
+			msg.received++
+			msg.receipt = fmt.Sprintf("receipt-%d", fake.sequence)
+			msg.visibleAt = time.Now().Add(time.Duration(visibility) * time.Second)
+
+			digest := md5.Sum([]byte(msg.body))
+			body := &strings.Builder{}
+			_ = xml.EscapeText(body, []byte(msg.body))
+			fmt.Fprintf(w, `<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle><MD5OfBody>%s</MD5OfBody><Body>%s</Body>`,
+				msg.id, msg.receipt, hex.EncodeToString(digest[:]), body.String())
+			fmt.Fprintf(w, `<Attribute><Name>ApproximateReceiveCount</Name><Value>%d</Value></Attribute>`, msg.received)
+			if len(msg.group) != 0 {
+				fmt.Fprintf(w, `<Attribute><Name>MessageGroupId</Name><Value>%s</Value></Attribute>`, msg.group)
+			}
+			for name, value := range msg.attrs {
+				fmt.Fprintf(w, `<MessageAttribute><Name>%s</Name><Value><StringValue>%s</StringValue><DataType>Number</DataType></Value></MessageAttribute>`, name, value)
+			}
+			fmt.Fprint(w, `</Message>`)
+		}
+		fmt.Fprint(w, `</ReceiveMessageResult><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></ReceiveMessageResponse>`)
+
+	case "SendMessage":
+		if _, isPresent := fake.queues[q]; !isPresent {
+			fake.fail(w, "AWS.SimpleQueueService.NonExistentQueue", "queue not found")
+			return
+		}
+		if fake.rejects {
+			fake.fail(w, "InvalidParameterValue", "sends rejected")
+			return
+		}
+		group, dedup := r.Form.Get("MessageGroupId"), r.Form.Get("MessageDeduplicationId")
+		if strings.HasSuffix(q, ".fifo") && (len(group) == 0 || len(dedup) == 0) {
+			fake.fail(w, "MissingParameter", "FIFO queues require a message group and deduplication ID")
+			return
+		}
+		attrs := map[string]string{}
+		for i := 1; len(r.Form.Get(fmt.Sprintf("MessageAttribute.%d.Name", i))) != 0; i++ {
+			attrs[r.Form.Get(fmt.Sprintf("MessageAttribute.%d.Name", i))] = r.Form.Get(fmt.Sprintf("MessageAttribute.%d.Value.StringValue", i))
+		}
+		body := r.Form.Get("MessageBody")
+		msg := fake.enqueue(q, body, attrs)
+		msg.group, msg.dedup = group, dedup
+		digest := md5.Sum([]byte(body))
+		fmt.Fprintf(w, `<SendMessageResponse><SendMessageResult><MD5OfMessageBody>%s</MD5OfMessageBody><MessageId>%s</MessageId></SendMessageResult><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></SendMessageResponse>`,
+			hex.EncodeToString(digest[:]), msg.id)
+
+	case "ChangeMessageVisibility":
+		msg, _ := fake.find(q, r.Form.Get("ReceiptHandle"))
+		if msg == nil {
+			fake.fail(w, "ReceiptHandleIsInvalid", "receipt handle not found")
+			return
+		}
+		visibility, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		if visibility == 0 {
+			// Track visibility changes that return the message to the queue
+			fake.actions["Nack"]++
+		}
+		msg.visibleAt = time.Now().Add(time.Duration(visibility) * time.Second)
+		fmt.Fprint(w, `<ChangeMessageVisibilityResponse><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></ChangeMessageVisibilityResponse>`)
+
+	case "DeleteMessage":
+		msg, idx := fake.find(q, r.Form.Get("ReceiptHandle"))
+		if msg == nil {
+			fake.fail(w, "ReceiptHandleIsInvalid", "receipt handle not found")
+			return
+		}
+		fake.queues[q] = append(fake.queues[q][:idx], fake.queues[q][idx+1:]...)
+		fmt.Fprint(w, `<DeleteMessageResponse><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></DeleteMessageResponse>`)
+
+	default:
+		fake.fail(w, "InvalidAction", action)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package aws_ext
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+// This file contains integration tests for the SQS queue implementation that are
+// run against a local stand-in for the SQS server
+
+const (
+	fakeQueue  = "studioml-test"
+	fakeRegion = "us-west-2"
+)
+
+// setupFakeSQS starts a fake SQS server and writes a credentials directory that
+// uses an endpoint override to reach it
+func setupFakeSQS(t *testing.T) (fake *fakeSQS, credFiles []string) {
+	fake = newFakeSQS(fakeQueue)
+	t.Cleanup(fake.Close)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"credentials": "[default]\naws_access_key_id = fake\naws_secret_access_key = fake\n",
+		"config":      "[default]\nregion = " + fakeRegion + "\nendpoint_url = " + fake.server.URL + "\n",
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if errGo := os.WriteFile(fn, []byte(content), 0600); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		credFiles = append(credFiles, fn)
+	}
+	return fake, credFiles
+}
+
+func newFakeSQSQueue(t *testing.T, fake *fakeSQS, credFiles []string) (sq *SQS, qt *task.QueueTask) {
+	urls, err := GetSQSProjects(credFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := urls[fake.project()]; len(urls) != 1 || !isPresent {
+		t.Fatal(kv.NewError("fake project not found").With("urls", urls).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	sq, err = NewSQS(fake.project(), strings.Join(credFiles, ","), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := sq.Refresh(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription := fakeRegion + ":" + fakeQueue
+	if _, isPresent := known[subscription]; !isPresent {
+		t.Fatal(kv.NewError("fake queue not found").With("known", known).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	return sq, &task.QueueTask{
+		Project:      fake.project(),
+		Subscription: subscription,
+	}
+}
+
+// TestSQSWork checks that a message is received, handled and deleted from the queue
+func TestSQSWork(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, qt := newFakeSQSQueue(t, fake, credFiles)
+
+	// An empty queue should not result in the handler being run
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		t.Fatal(kv.NewError("handler called for empty queue").With("stack", stack.Trace().TrimRuntime()))
+		return nil, false, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || processed {
+		t.Fatal(kv.NewError("empty queue processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	body := `{"experiment": {"key": "<test & check>"}}`
+	fake.send(fakeQueue, body)
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		if string(qt.Msg) != body {
+			t.Fatal(kv.NewError("message body mismatch").With("body", string(qt.Msg)).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return &server.Resource{}, true, nil
+	}
+	processed, _, err := sq.Work(context.Background(), qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processed {
+		t.Fatal(kv.NewError("message not processed").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if qt.ShortQName != fakeQueue {
+		t.Fatal(kv.NewError("unexpected queue name").With("name", qt.ShortQName).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs := fake.messages(fakeQueue); len(msgs) != 0 {
+		t.Fatal(kv.NewError("message not deleted").With("remaining", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSNack checks that a message that is not acknowledged is returned to the
+// queue for another attempt and that the visibility is extended while the message
+// is being handled
+func TestSQSNack(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, qt := newFakeSQSQueue(t, fake, credFiles)
+
+	// Extend the visibility every second
+	sq.visibility = 2
+
+	fake.send(fakeQueue, "nack")
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		time.Sleep(2500 * time.Millisecond)
+		return nil, false, kv.NewError("resources not available")
+	}
+	if processed, _, _ := sq.Work(context.Background(), qt); !processed {
+		t.Fatal(kv.NewError("message not processed").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	msgs := fake.messages(fakeQueue)
+	if len(msgs) != 1 || msgs[0].received != 1 || msgs[0].visibleAt.After(time.Now()) {
+		t.Fatal(kv.NewError("message not returned to the queue").With("messages", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if nacks := fake.count("Nack"); nacks != 1 {
+		t.Fatal(kv.NewError("message not released").With("nacks", nacks).With("stack", stack.Trace().TrimRuntime()))
+	}
+	// The final visibility change is the NACK, the others are the extensions
+	if extensions := fake.count("ChangeMessageVisibility") - 1; extensions < 2 {
+		t.Fatal(kv.NewError("visibility not extended").With("extensions", extensions).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// A retry that succeeds should remove the message
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		return nil, true, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || !processed {
+		t.Fatal(kv.NewError("retry not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs := fake.messages(fakeQueue); len(msgs) != 0 {
+		t.Fatal(kv.NewError("message not deleted").With("remaining", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSContinuation checks that work which outlives the SQS visibility limit has
+// its message continued so that it is not handed to another runner, and that the
+// continuation is deleted once the work is done
+func TestSQSContinuation(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, qt := newFakeSQSQueue(t, fake, credFiles)
+
+	// Shrink the 12 hour limit so that the first visibility extension finds
+	// it has been reached
+	sq.visibility = 2
+	sq.hardVisibility = 500 * time.Millisecond
+
+	fake.send(fakeQueue, "long running")
+
+	handled := 0
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		handled++
+		time.Sleep(1500 * time.Millisecond)
+
+		// The continuation should be held by the runner while the work is being done
+		msgs := fake.messages(fakeQueue)
+		if len(msgs) != 1 || msgs[0].attrs[continuationAttribute] != "1" || msgs[0].attrs[continuationOfAttribute] != "msg-1" {
+			t.Fatal(kv.NewError("message not continued").With("messages", msgs).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !msgs[0].visibleAt.After(time.Now()) {
+			t.Fatal(kv.NewError("continuation not held").With("stack", stack.Trace().TrimRuntime()))
+		}
+		return nil, true, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if handled != 1 {
+		t.Fatal(kv.NewError("unexpected handling").With("handled", handled).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs := fake.messages(fakeQueue); len(msgs) != 0 {
+		t.Fatal(kv.NewError("continuation not deleted").With("remaining", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if fake.count("Nack") != 0 {
+		t.Fatal(kv.NewError("continued message was released").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSForcedDelete checks that work which outlives the SQS visibility limit, and
+// cannot be continued, has its message deleted so that it is not handed to another
+// runner, and that the result of the work does not then return the message to the queue
+func TestSQSForcedDelete(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, qt := newFakeSQSQueue(t, fake, credFiles)
+
+	sq.visibility = 2
+	sq.hardVisibility = 500 * time.Millisecond
+
+	fake.send(fakeQueue, "long running")
+	fake.rejectSends(true)
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		time.Sleep(2 * time.Second)
+		return nil, false, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if msgs := fake.messages(fakeQueue); len(msgs) != 0 {
+		t.Fatal(kv.NewError("message not force deleted").With("remaining", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if fake.count("Nack") != 0 {
+		t.Fatal(kv.NewError("force deleted message was released").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if deletes := fake.count("DeleteMessage"); deletes != 1 {
+		t.Fatal(kv.NewError("unexpected deletes").With("deletes", deletes).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSFIFOContinuation checks that work on a FIFO queue which outlives the SQS
+// visibility limit has its message continued within the same message group, using a
+// new deduplication ID, and that the continuation is held until the work is done
+func TestSQSFIFOContinuation(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, _ := newFakeSQSQueue(t, fake, credFiles)
+
+	fifoQueue := fakeQueue + ".fifo"
+	fake.addQueue(fifoQueue)
+
+	sq.visibility = 2
+	sq.hardVisibility = 500 * time.Millisecond
+
+	fake.sendGroup(fifoQueue, "user-a 1", "user-a")
+	fake.sendGroup(fifoQueue, "user-b 1", "user-b")
+
+	qt := &task.QueueTask{
+		Project:      fake.project(),
+		Subscription: fakeRegion + ":" + fifoQueue,
+	}
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		time.Sleep(1500 * time.Millisecond)
+
+		msgs := fake.messages(fifoQueue)
+		if len(msgs) != 2 || msgs[0].body != "user-b 1" {
+			t.Fatal(kv.NewError("original message not replaced").With("messages", msgs).With("stack", stack.Trace().TrimRuntime()))
+		}
+		// Messages received while looking for the continuation are returned to the queue
+		if msgs[0].visibleAt.After(time.Now()) {
+			t.Fatal(kv.NewError("message from another group held").With("stack", stack.Trace().TrimRuntime()))
+		}
+		cont := msgs[1]
+		if cont.body != "user-a 1" || cont.group != "user-a" || cont.dedup != "msg-1-1" || cont.attrs[continuationOfAttribute] != "msg-1" {
+			t.Fatal(kv.NewError("message not continued within its group").With("continuation", cont).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !cont.visibleAt.After(time.Now()) {
+			t.Fatal(kv.NewError("continuation not held").With("stack", stack.Trace().TrimRuntime()))
+		}
+		return nil, true, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), qt); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if msgs := fake.messages(fifoQueue); len(msgs) != 1 || msgs[0].body != "user-b 1" {
+		t.Fatal(kv.NewError("continuation not deleted once done").With("messages", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if deletes := fake.count("DeleteMessage"); deletes != 2 {
+		t.Fatal(kv.NewError("unexpected deletes").With("deletes", deletes).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSQSFIFO checks that messages within a FIFO message group are handled in order
+// and one at a time while other groups continue to be serviced
+func TestSQSFIFO(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, _ := newFakeSQSQueue(t, fake, credFiles)
+
+	fifoQueue := fakeQueue + ".fifo"
+	fake.addQueue(fifoQueue)
+
+	fake.sendGroup(fifoQueue, "user-a 1", "user-a")
+	fake.sendGroup(fifoQueue, "user-a 2", "user-a")
+	fake.sendGroup(fifoQueue, "user-b 1", "user-b")
+
+	newTask := func(handler task.MsgHandler) (qt *task.QueueTask) {
+		return &task.QueueTask{
+			Project:      fake.project(),
+			Subscription: fakeRegion + ":" + fifoQueue,
+			Handler:      handler,
+		}
+	}
+
+	handled := []string{}
+	record := func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		handled = append(handled, qt.MsgGroup+"/"+string(qt.Msg))
+		return nil, true, nil
+	}
+
+	// While the first message for user-a is being handled the next message for
+	// user-a should be held back and the message for user-b be delivered
+	first := func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		handled = append(handled, qt.MsgGroup+"/"+string(qt.Msg))
+		if processed, _, err := sq.Work(ctx, newTask(record)); err != nil || !processed {
+			t.Fatal(kv.NewError("concurrent message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return nil, true, nil
+	}
+	if processed, _, err := sq.Work(context.Background(), newTask(first)); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if processed, _, err := sq.Work(context.Background(), newTask(record)); err != nil || !processed {
+		t.Fatal(kv.NewError("message not processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	expected := []string{"user-a/user-a 1", "user-b/user-b 1", "user-a/user-a 2"}
+	if strings.Join(handled, ",") != strings.Join(expected, ",") {
+		t.Fatal(kv.NewError("unexpected order").With("handled", handled, "expected", expected).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Responses sent to a FIFO response queue use the message group of the request
+	// and need a deduplication ID
+	responseQ := fakeQueue + "_response.fifo"
+	fake.addQueue(responseQ)
+
+	key, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	qt := newTask(nil)
+	qt.MsgGroup = "user-a"
+	sender, err := sq.Responder(ctx, qt, responseQ, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender <- "first"
+	sender <- "second"
+
+	msgs := []fakeSQSMsg{}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if msgs = fake.messages(responseQ); len(msgs) == 2 {
+			break
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatal(kv.NewError("responses not sent").With("sent", len(msgs)).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if msgs[0].group != "user-a" || msgs[1].group != "user-a" || len(msgs[0].dedup) == 0 || msgs[0].dedup == msgs[1].dedup {
+		t.Fatal(kv.NewError("response ordering identifiers invalid").With("messages", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	close(sender)
+}
+
+// TestSQSPublish checks that requests published by clients are sent to standard
+// queues, and to FIFO queues using a message group
+func TestSQSPublish(t *testing.T) {
+	fake, credFiles := setupFakeSQS(t)
+	sq, _ := newFakeSQSQueue(t, fake, credFiles)
+
+	fifoQueue := fakeQueue + ".fifo"
+	fake.addQueue(fifoQueue)
+
+	ctx := context.Background()
+	if err := sq.Publish(ctx, fakeQueue, []byte("standard"), "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Publish(ctx, fifoQueue, []byte("grouped"), "user-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Publish(ctx, fifoQueue, []byte("ungrouped"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := fake.messages(fakeQueue); len(msgs) != 1 || msgs[0].body != "standard" || len(msgs[0].group) != 0 {
+		t.Fatal(kv.NewError("standard queue message mismatch").With("msgs", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	msgs := fake.messages(fifoQueue)
+	if len(msgs) != 2 || msgs[0].body != "grouped" || msgs[0].group != "user-a" {
+		t.Fatal(kv.NewError("FIFO queue message mismatch").With("msgs", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(msgs[1].group) == 0 || msgs[0].dedup == msgs[1].dedup {
+		t.Fatal(kv.NewError("FIFO message group or deduplication ID missing").With("msgs", msgs).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
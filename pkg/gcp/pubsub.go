@@ -0,0 +1,429 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package gcp_ext
+
+// This file contains the implementation of Google Cloud Pub/Sub subscriptions
+// as they are used by studioML.  Work is pulled from subscriptions one message at
+// a time with the acknowledgement deadline being extended while the work is done,
+// and responses are published to a topic named after the response queue.
+//
+// When the PUBSUB_EMULATOR_HOST environment variable is set the runner will use
+// the Pub/Sub emulator at that address.
+
+import (
+	"context"
+	"crypto/rsa"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	pubsub "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/andreidenissov-cog/go-service/pkg/log"
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// ProjectPrefix is used to identify runner projects that are hosted using Pub/Sub
+	ProjectPrefix = "pubsub://"
+
+	// defaultAckDeadline is the acknowledgement deadline, in seconds, used for messages
+	// being processed, it is extended at the half way mark until the work is done
+	defaultAckDeadline = int32(30)
+
+	// pullTimeout is the longest period that will be waited on for a message to arrive
+	pullTimeout = 5 * time.Second
+
+	// publishLimit is the largest message that Pub/Sub will accept
+	publishLimit = 10 * 1024 * 1024
+)
+
+// PubSub encapsulates a Google Cloud Pub/Sub project containing the subscriptions
+// that work will be retrieved from
+//
+type PubSub struct {
+	project     string                   // The runner project reference, pubsub:// followed by the GCP project ID
+	gcpProject  string                   // The GCP project ID
+	creds       string                   // Optional service account credentials file, application default credentials are used when empty
+	ackDeadline int32                    // Acknowledgement deadline in seconds for messages being processed
+	sub         *pubsub.SubscriberClient // Client used for subscriptions
+	pub         *pubsub.PublisherClient  // Client used for response topics
+	conn        *grpc.ClientConn         // Connection to the emulator, when used, which the clients do not own
+	wrapper     wrapper.Wrapper          // Decryption information for messages with encrypted payloads
+	logger      *log.Logger
+}
+
+// clientOptions returns the options for connecting to Pub/Sub, or to the emulator
+// when one has been configured.  The emulator connection is returned so that the
+// caller can close it, the Pub/Sub clients leave connections they are given open.
+//
+func clientOptions(creds string) (opts []option.ClientOption, conn *grpc.ClientConn, err kv.Error) {
+	if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); len(addr) != 0 {
+		conn, errGo := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if errGo != nil {
+			return nil, nil, kv.Wrap(errGo).With("emulator", addr).With("stack", stack.Trace().TrimRuntime())
+		}
+		return []option.ClientOption{option.WithGRPCConn(conn)}, conn, nil
+	}
+	if len(creds) != 0 {
+		return []option.ClientOption{option.WithCredentialsFile(creds)}, nil, nil
+	}
+	return []option.ClientOption{}, nil, nil
+}
+
+// NewPubSub creates a task queue for the subscriptions within a Pub/Sub project.  The project
+// is specified using the pubsub://project-id form, and creds is an optional service account file.
+//
+func NewPubSub(ctx context.Context, project string, creds string, w wrapper.Wrapper, l *log.Logger) (queue *PubSub, err kv.Error) {
+	gcpProject := strings.TrimPrefix(project, ProjectPrefix)
+	if len(gcpProject) == 0 || strings.Contains(gcpProject, "/") {
+		return nil, kv.NewError("invalid Pub/Sub project").With("project", project).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	queue = &PubSub{
+		project:     project,
+		gcpProject:  gcpProject,
+		creds:       creds,
+		ackDeadline: defaultAckDeadline,
+		wrapper:     w,
+		logger:      l,
+	}
+
+	opts, conn, err := clientOptions(creds)
+	if err != nil {
+		return nil, err
+	}
+	queue.conn = conn
+
+	errGo := error(nil)
+	if queue.sub, errGo = pubsub.NewSubscriberClient(ctx, opts...); errGo != nil {
+		queue.Close()
+		return nil, kv.Wrap(errGo).With("project", project).With("stack", stack.Trace().TrimRuntime())
+	}
+	if queue.pub, errGo = pubsub.NewPublisherClient(ctx, opts...); errGo != nil {
+		queue.Close()
+		return nil, kv.Wrap(errGo).With("project", project).With("stack", stack.Trace().TrimRuntime())
+	}
+	return queue, nil
+}
+
+// Close releases the clients and any emulator connection used to reach Pub/Sub, it
+// should be called once the queue is no longer being used
+//
+func (ps *PubSub) Close() {
+	if ps.sub != nil {
+		ps.sub.Close()
+	}
+	if ps.pub != nil {
+		ps.pub.Close()
+	}
+	if ps.conn != nil {
+		ps.conn.Close()
+	}
+}
+
+// GetPubSubProject validates that the GCP project is accessible using the credentials and
+// returns the runner project reference for it
+//
+func GetPubSubProject(ctx context.Context, gcpProject string, creds string) (project string, err kv.Error) {
+	ps, err := NewPubSub(ctx, ProjectPrefix+gcpProject, creds, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer ps.Close()
+
+	if _, err = ps.subscriptions(ctx, nil, nil); err != nil {
+		return "", err
+	}
+	return ps.project, nil
+}
+
+func (ps *PubSub) subscriptionPath(subscription string) string {
+	return "projects/" + ps.gcpProject + "/subscriptions/" + subscription
+}
+
+func (ps *PubSub) topicPath(topic string) string {
+	return "projects/" + ps.gcpProject + "/topics/" + topic
+}
+
+// subscriptions lists the short names of the subscriptions within the project
+//
+func (ps *PubSub) subscriptions(ctx context.Context, qNameMatch *regexp.Regexp, qNameMismatch *regexp.Regexp) (names []string, err kv.Error) {
+	names = []string{}
+
+	subs := ps.sub.ListSubscriptions(ctx, &pubsubpb.ListSubscriptionsRequest{
+		Project: "projects/" + ps.gcpProject,
+	})
+	for {
+		sub, errGo := subs.Next()
+		if errGo == iterator.Done {
+			break
+		}
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("project", ps.project).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		name := sub.Name[strings.LastIndex(sub.Name, "/")+1:]
+		if qNameMismatch != nil && qNameMismatch.MatchString(name) {
+			continue
+		}
+		if qNameMatch != nil && !qNameMatch.MatchString(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Refresh uses a regular expression to obtain matching subscriptions from
+// the Pub/Sub project.
+//
+func (ps *PubSub) Refresh(ctx context.Context, qNameMatch *regexp.Regexp, qNameMismatch *regexp.Regexp) (known map[string]interface{}, err kv.Error) {
+	names, err := ps.subscriptions(ctx, qNameMatch, qNameMismatch)
+	if err != nil {
+		return known, err
+	}
+
+	known = make(map[string]interface{}, len(names))
+	for _, name := range names {
+		known[name] = ps.creds
+	}
+	return known, nil
+}
+
+// Exists tests for the presence of a subscription, or a topic, on the Pub/Sub project.
+// Topics are included as response queues are topics that the runner publishes to.
+//
+func (ps *PubSub) Exists(ctx context.Context, subscription string) (exists bool, err kv.Error) {
+	name := subscription[strings.LastIndex(subscription, ":")+1:]
+
+	_, errGo := ps.sub.GetSubscription(ctx, &pubsubpb.GetSubscriptionRequest{
+		Subscription: ps.subscriptionPath(name),
+	})
+	if errGo == nil {
+		return true, nil
+	}
+	if status.Code(errGo) != codes.NotFound {
+		return true, kv.Wrap(errGo).With("project", ps.project, "subscription", name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if _, errGo = ps.pub.GetTopic(ctx, &pubsubpb.GetTopicRequest{Topic: ps.topicPath(name)}); errGo == nil {
+		return true, nil
+	}
+	if status.Code(errGo) != codes.NotFound {
+		return true, kv.Wrap(errGo).With("project", ps.project, "topic", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	return false, nil
+}
+
+// Work is invoked by the queue handling software within the runner to get the
+// specific queue implementation to process potential work that could be
+// waiting inside the subscription.
+//
+func (ps *PubSub) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool, resource *server.Resource, err kv.Error) {
+	qt.ShortQName = qt.Subscription
+	subPath := ps.subscriptionPath(qt.Subscription)
+	hostName, _ := os.Hostname()
+
+	pullCtx, cancel := context.WithTimeout(ctx, pullTimeout)
+	pulled, errGo := ps.sub.Pull(pullCtx, &pubsubpb.PullRequest{
+		Subscription: subPath,
+		MaxMessages:  1,
+	})
+	cancel()
+	if errGo != nil {
+		if status.Code(errGo) == codes.DeadlineExceeded && ctx.Err() == nil {
+			return false, nil, nil
+		}
+		return false, nil, kv.Wrap(errGo).With("project", ps.project, "subscription", qt.Subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(pulled.ReceivedMessages) == 0 {
+		return false, nil, nil
+	}
+
+	msg := pulled.ReceivedMessages[0]
+	ackIDs := []string{msg.AckId}
+
+	// Make sure that the main ctx has not been Done with before continuing
+	select {
+	case <-ctx.Done():
+		ps.modifyDeadline(subPath, ackIDs, 0)
+		return false, nil, kv.NewError("queue worker cancel received").With("project", ps.project).With("stack", stack.Trace().TrimRuntime())
+	default:
+	}
+
+	// Start an acknowledgement deadline extender that runs until the work is done
+	//
+	quitC := make(chan struct{})
+	extenderDoneC := make(chan struct{})
+	go func() {
+		defer close(extenderDoneC)
+
+		timeout := time.Duration(ps.ackDeadline/2) * time.Second
+		for {
+			select {
+			case <-time.After(timeout):
+				errGo := ps.modifyDeadline(subPath, ackIDs, ps.ackDeadline)
+				if errGo != nil {
+					// Once the 1/2 way mark is reached continue to try to extend the
+					// deadline at decreasing intervals until we finish the job
+					if timeout > 5*time.Second {
+						timeout = timeout / 2
+					}
+				}
+				if qt.QueueLogger != nil {
+					qt.QueueLogger.Debug("PUBSUB-QUEUE: Ack deadline extended for subscription: ", qt.ShortQName, "error", errorText(errGo), "host: ", hostName)
+				}
+
+			case <-quitC:
+				return
+			}
+		}
+	}()
+
+	qt.Msg = nil
+	qt.Msg = msg.Message.GetData()
+	qt.MsgGroup = msg.Message.GetOrderingKey()
+
+	rsc, ack, err := qt.Handler(ctx, qt)
+	errMsg := "no error"
+	if err != nil {
+		errMsg = err.Error()
+	}
+	close(quitC)
+	<-extenderDoneC
+
+	if ack {
+		ackCtx, cancel := context.WithTimeout(context.Background(), pullTimeout)
+		errGo = ps.sub.Acknowledge(ackCtx, &pubsubpb.AcknowledgeRequest{
+			Subscription: subPath,
+			AckIds:       ackIDs,
+		})
+		cancel()
+		if qt.QueueLogger != nil {
+			qt.QueueLogger.Debug("PUBSUB-QUEUE: ACK msg from subscription: ", qt.ShortQName, "err: ", errMsg, "ack_error", errorText(errGo), "host: ", hostName)
+		}
+		resource = rsc
+	} else {
+		// Setting the deadline to 0 returns the message for redelivery, in other words Nack the message
+		errGo = ps.modifyDeadline(subPath, ackIDs, 0)
+		if qt.QueueLogger != nil {
+			qt.QueueLogger.Debug("PUBSUB-QUEUE: RETURN msg to subscription: ", qt.ShortQName, "err: ", errMsg, "nack_error", errorText(errGo), "host: ", hostName)
+		}
+	}
+
+	return true, resource, err
+}
+
+func (ps *PubSub) modifyDeadline(subPath string, ackIDs []string, deadline int32) (errGo error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pullTimeout)
+	defer cancel()
+
+	return ps.sub.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       subPath,
+		AckIds:             ackIDs,
+		AckDeadlineSeconds: deadline,
+	})
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return "none"
+	}
+	return err.Error()
+}
+
+// HasWork will look at the subscription to see if there is any pending work.  Pub/Sub
+// does not offer a way of doing this cheaply so we always assume there is work.
+//
+func (ps *PubSub) HasWork(ctx context.Context, subscription string) (hasWork bool, err kv.Error) {
+	return true, nil
+}
+
+// GetShortQName returns the name of the subscription for the task
+//
+func (ps *PubSub) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error) {
+	return qt.Subscription, nil
+}
+
+// Responder is used to open a connection to an existing response topic if
+// one was made available and also to provision a channel into which the
+// runner can place report messages.  Reports are published using the ordering
+// key of the request the task is working on.
+//
+func (ps *PubSub) Responder(ctx context.Context, qt *task.QueueTask, subscription string, encryptKey *rsa.PublicKey) (sender chan string, err kv.Error) {
+	if encryptKey == nil {
+		return nil, kv.NewError("response queue encryption key missing").With("subscription", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	topic := ps.topicPath(subscription)
+
+	sender = make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case msg, isOpen := <-sender:
+				if !isOpen {
+					return
+				}
+				if len(msg) == 0 {
+					continue
+				}
+				// The ordering key is read as each report is sent as the request will
+				// not have been received when the responder was started
+				if err := ps.respond(ctx, topic, msg, encryptKey, qt.MsgGroup); err != nil && ps.logger != nil {
+					ps.logger.Warn("response not sent", "topic", topic, "error", err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sender, nil
+}
+
+// respond encrypts and publishes a single message to a response topic
+//
+func (ps *PubSub) respond(ctx context.Context, topic string, msg string, encryptKey *rsa.PublicKey, orderingKey string) (err kv.Error) {
+	body, err := defense.HybridSeal([]byte(msg), encryptKey)
+	if err != nil {
+		return err
+	}
+	if len(body) > publishLimit {
+		return kv.NewError("response too large").With("size", len(body), "topic", topic).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	pubCtx, cancel := context.WithTimeout(ctx, pullTimeout)
+	defer cancel()
+
+	if _, errGo := ps.pub.Publish(pubCtx, &pubsubpb.PublishRequest{
+		Topic:    topic,
+		Messages: []*pubsubpb.PubsubMessage{{Data: []byte(body), OrderingKey: orderingKey}},
+	}); errGo != nil {
+		return kv.Wrap(errGo).With("topic", topic).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+func (ps *PubSub) GetQueuesRefreshInterval() time.Duration {
+	return 5 * time.Minute
+}
+
+func (ps *PubSub) GetWorkCheckInterval() time.Duration {
+	return 5 * time.Second
+}
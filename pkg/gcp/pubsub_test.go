@@ -0,0 +1,230 @@
+// Copyright 2018-2022 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package gcp_ext
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+
+	"github.com/andreidenissov-cog/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+// This file contains integration tests for the Pub/Sub queue implementation that are
+// run against the Pub/Sub emulator.  When PUBSUB_EMULATOR_HOST is not set an in-process
+// emulator is started.
+
+const (
+	testProject = "studioml-test"
+	testQueue   = "studioml-test"
+)
+
+func setupEmulator(t *testing.T) (ps *PubSub) {
+	if len(os.Getenv("PUBSUB_EMULATOR_HOST")) == 0 {
+		srv := pstest.NewServer()
+		t.Cleanup(func() { _ = srv.Close() })
+		t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	}
+
+	ctx := context.Background()
+
+	ps, err := NewPubSub(ctx, ProjectPrefix+testProject, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ps.Close)
+
+	// Start each test with fresh topics and subscriptions
+	for _, name := range []string{testQueue, testQueue + "_response"} {
+		_ = ps.sub.DeleteSubscription(ctx, &pubsubpb.DeleteSubscriptionRequest{Subscription: ps.subscriptionPath(name)})
+		_ = ps.pub.DeleteTopic(ctx, &pubsubpb.DeleteTopicRequest{Topic: ps.topicPath(name)})
+
+		if _, errGo := ps.pub.CreateTopic(ctx, &pubsubpb.Topic{Name: ps.topicPath(name)}); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if _, errGo := ps.sub.CreateSubscription(ctx, &pubsubpb.Subscription{
+			Name:               ps.subscriptionPath(name),
+			Topic:              ps.topicPath(name),
+			AckDeadlineSeconds: 10,
+		}); errGo != nil {
+			t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	return ps
+}
+
+func publish(t *testing.T, ps *PubSub, topic string, data string) {
+	if _, errGo := ps.pub.Publish(context.Background(), &pubsubpb.PublishRequest{
+		Topic:    ps.topicPath(topic),
+		Messages: []*pubsubpb.PubsubMessage{{Data: []byte(data), OrderingKey: "user-a"}},
+	}); errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestPubSubWork checks that subscriptions are discovered and that a message is received,
+// handled and acknowledged
+func TestPubSubWork(t *testing.T) {
+	ps := setupEmulator(t)
+	ctx := context.Background()
+
+	known, err := ps.Refresh(ctx, regexp.MustCompile("^studioml-"), regexp.MustCompile("_response$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known[testQueue]; len(known) != 1 || !isPresent {
+		t.Fatal(kv.NewError("subscription not found").With("known", known).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if exists, err := ps.Exists(ctx, testQueue+"_response"); err != nil || !exists {
+		t.Fatal(kv.NewError("response queue not found").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if exists, err := ps.Exists(ctx, "missing"); err != nil || exists {
+		t.Fatal(kv.NewError("missing queue found").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	qt := &task.QueueTask{
+		Project:      ps.project,
+		Subscription: testQueue,
+	}
+
+	// An empty subscription should not result in the handler being run
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		t.Fatal(kv.NewError("handler called for empty subscription").With("stack", stack.Trace().TrimRuntime()))
+		return nil, false, nil
+	}
+	if processed, _, err := ps.Work(ctx, qt); err != nil || processed {
+		t.Fatal(kv.NewError("empty subscription processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	body := `{"experiment": {"key": "pubsub"}}`
+	publish(t, ps, testQueue, body)
+
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		if string(qt.Msg) != body || qt.MsgGroup != "user-a" {
+			t.Fatal(kv.NewError("message mismatch").With("body", string(qt.Msg), "group", qt.MsgGroup).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return &server.Resource{}, true, nil
+	}
+	processed, rsc, err := ps.Work(ctx, qt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processed || rsc == nil {
+		t.Fatal(kv.NewError("message not processed").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// The acknowledged message should not be delivered again
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		t.Fatal(kv.NewError("acknowledged message redelivered").With("stack", stack.Trace().TrimRuntime()))
+		return nil, false, nil
+	}
+	if processed, _, err := ps.Work(ctx, qt); err != nil || processed {
+		t.Fatal(kv.NewError("acknowledged message processed").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestPubSubNack checks that the ack deadline is extended while a message is being
+// handled, and that a message that is not acknowledged is redelivered
+func TestPubSubNack(t *testing.T) {
+	ps := setupEmulator(t)
+	ctx := context.Background()
+
+	// Extend the deadline every second
+	ps.ackDeadline = 2
+
+	publish(t, ps, testQueue, "nack")
+
+	qt := &task.QueueTask{
+		Project:      ps.project,
+		Subscription: testQueue,
+	}
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		time.Sleep(3 * time.Second)
+
+		// While being handled the message should not be available to others
+		other := &task.QueueTask{
+			Project:      ps.project,
+			Subscription: testQueue,
+			Handler: func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+				t.Fatal(kv.NewError("message delivered while being handled").With("stack", stack.Trace().TrimRuntime()))
+				return nil, false, nil
+			},
+		}
+		if processed, _, err := ps.Work(ctx, other); err != nil || processed {
+			t.Fatal(kv.NewError("message processed concurrently").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return nil, false, kv.NewError("resources not available")
+	}
+	if processed, _, _ := ps.Work(ctx, qt); !processed {
+		t.Fatal(kv.NewError("message not processed").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// The returned message should be redelivered immediately
+	handled := false
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		handled = string(qt.Msg) == "nack"
+		return nil, true, nil
+	}
+	if processed, _, err := ps.Work(ctx, qt); err != nil || !processed || !handled {
+		t.Fatal(kv.NewError("message not redelivered").With("error", err).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestPubSubResponder checks that responses are encrypted and published to the response topic
+func TestPubSubResponder(t *testing.T) {
+	ps := setupEmulator(t)
+
+	key, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	responseQ := testQueue + "_response"
+	sender, err := ps.Responder(ctx, &task.QueueTask{}, responseQ, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := `{"experiment_id": "pubsub"}`
+	sender <- ""
+	sender <- response
+
+	qt := &task.QueueTask{
+		Project:      ps.project,
+		Subscription: responseQ,
+	}
+	received := ""
+	qt.Handler = func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		decrypted, err := defense.Unseal(string(qt.Msg), key)
+		if err != nil {
+			return nil, true, err
+		}
+		received = string(decrypted)
+		return nil, true, nil
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && len(received) == 0; {
+		if _, _, err := ps.Work(ctx, qt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received != response {
+		t.Fatal(kv.NewError("response mismatch").With("received", received).With("stack", stack.Trace().TrimRuntime()))
+	}
+	close(sender)
+}